@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long keys fetched from a JWKS URL are cached, and the minimum time between
+// two fetches triggered by an unknown key ID
+const (
+	jwksRefreshInterval = time.Hour
+	jwksMinRefresh      = time.Minute
+)
+
+// ErrUnknownKey is returned when a token is signed by a key that is not in the key set
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// KeySet holds the public keys used to verify tokens, loaded from a JWKS file or URL
+type KeySet struct {
+	source string
+
+	mu          sync.RWMutex
+	keys        map[string]crypto.PublicKey
+	fetchedAt   time.Time
+	lastAttempt time.Time
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// NewKeySet loads a key set from source, a path to a JWKS file or an http(s) URL
+func NewKeySet(source string) (*KeySet, error) {
+	ks := &KeySet{source: source}
+	if err := ks.refresh(context.Background()); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+func (ks *KeySet) isURL() bool {
+	return strings.HasPrefix(ks.source, "http://") || strings.HasPrefix(ks.source, "https://")
+}
+
+// Key returns the public key with the given key ID, refreshing keys from a URL
+// when they are stale or the key ID is unknown
+func (ks *KeySet) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	ks.mu.RLock()
+	key, ok := ks.keys[kid]
+	stale := ks.isURL() && time.Since(ks.fetchedAt) > jwksRefreshInterval
+	canRetry := ks.isURL() && time.Since(ks.lastAttempt) > jwksMinRefresh
+	ks.mu.RUnlock()
+
+	if ok && !stale {
+		return key, nil
+	}
+
+	if stale || canRetry {
+		if err := ks.refresh(ctx); err != nil {
+			log.Println("Error refreshing JWKS", err)
+		}
+		ks.mu.RLock()
+		key, ok = ks.keys[kid]
+		ks.mu.RUnlock()
+	}
+
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+func (ks *KeySet) refresh(ctx context.Context) error {
+	ks.mu.Lock()
+	ks.lastAttempt = time.Now()
+	ks.mu.Unlock()
+
+	data, err := ks.read(ctx)
+	if err != nil {
+		return err
+	}
+
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.fetchedAt = time.Now()
+	ks.mu.Unlock()
+	return nil
+}
+
+func (ks *KeySet) read(ctx context.Context) ([]byte, error) {
+	if !ks.isURL() {
+		return os.ReadFile(ks.source)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ks.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching JWKS: status %d", response.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(response.Body, 1<<20))
+}
+
+// parseJWKS parses the RSA and EC signing keys of a JWKS document
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("error parsing JWKS: %v", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		switch k.Kty {
+		case "RSA":
+			n, err := decodeBigInt(k.N)
+			if err != nil {
+				return nil, err
+			}
+			e, err := decodeBigInt(k.E)
+			if err != nil {
+				return nil, err
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+			}
+			x, err := decodeBigInt(k.X)
+			if err != nil {
+				return nil, err
+			}
+			y, err := decodeBigInt(k.Y)
+			if err != nil {
+				return nil, err
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no signing keys")
+	}
+	return keys, nil
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding JWK value: %v", err)
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// RoleAdmin is the role allowed to manage credits and access codes and to
+// access every user's content
+const RoleAdmin = "admin"
+
+// Keys used to store the caller in the gin context
+const (
+	contextKeyUserID = "auth_user_id"
+	contextKeyRoles  = "auth_roles"
+)
+
+// Config configures how tokens are verified
+type Config struct {
+	// JWKS is a path to a JWKS file or an http(s) URL
+	JWKS string
+	// Issuer and Audience are checked when set
+	Issuer   string
+	Audience string
+	// RoleClaim is the claim holding the caller's role(s), dotted for nested
+	// claims, e.g. "metadata.role"
+	RoleClaim string
+}
+
+// Authenticator verifies the tokens of requests with a key set
+type Authenticator struct {
+	keys   *KeySet
+	config Config
+}
+
+// New loads the key set of cfg
+func New(cfg Config) (*Authenticator, error) {
+	ks, err := NewKeySet(cfg.JWKS)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RoleClaim == "" {
+		cfg.RoleClaim = "role"
+	}
+	return &Authenticator{keys: ks, config: cfg}, nil
+}
+
+// RequireUser is a gin middleware that verifies the bearer token of the request
+// and stores the caller's user ID and roles in the context
+func (a *Authenticator) RequireUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		tokenString, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok || tokenString == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing bearer token"})
+			return
+		}
+
+		claims, err := a.verify(c, tokenString)
+		if err != nil {
+			log.Println("Invalid token", err)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+
+		userID, _ := claims.GetSubject()
+		if userID == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Token has no subject"})
+			return
+		}
+
+		c.Set(contextKeyUserID, userID)
+		c.Set(contextKeyRoles, rolesFromClaims(claims, a.config.RoleClaim))
+		c.Next()
+	}
+}
+
+// RequireAdmin is a gin middleware that only lets admins through, it must run after RequireUser
+func RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !IsAdmin(c) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin role required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// UserID returns the ID of the authenticated caller
+func UserID(c *gin.Context) string {
+	return c.GetString(contextKeyUserID)
+}
+
+// IsAdmin reports whether the authenticated caller has the admin role
+func IsAdmin(c *gin.Context) bool {
+	roles, _ := c.Get(contextKeyRoles)
+	list, _ := roles.([]string)
+	for _, role := range list {
+		if role == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Authenticator) verify(c *gin.Context, tokenString string) (jwt.MapClaims, error) {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}),
+		jwt.WithExpirationRequired(),
+	}
+	if a.config.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(a.config.Issuer))
+	}
+	if a.config.Audience != "" {
+		opts = append(opts, jwt.WithAudience(a.config.Audience))
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return a.keys.Key(c.Request.Context(), kid)
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// rolesFromClaims reads a string or list of strings claim at a dotted path
+func rolesFromClaims(claims jwt.MapClaims, path string) []string {
+	var value interface{} = map[string]interface{}(claims)
+	for _, part := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[part]
+	}
+
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var roles []string
+		for _, item := range v {
+			if role, ok := item.(string); ok {
+				roles = append(roles, role)
+			}
+		}
+		return roles
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// localKey reads the private key of the local test key set
+func localKey(t *testing.T) crypto.Signer {
+	t.Helper()
+	data, err := os.ReadFile("testdata/private.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatal("invalid private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.(crypto.Signer)
+}
+
+func sign(t *testing.T, key crypto.Signer, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	method := jwt.SigningMethod(jwt.SigningMethodRS256)
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		method = jwt.SigningMethodES256
+	}
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// claimsFor returns valid claims for userID
+func claimsFor(userID string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"sub": userID,
+		"iss": "https://issuer.test",
+		"aud": "slides-api",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func newAuthenticator(t *testing.T, cfg Config) *Authenticator {
+	t.Helper()
+	a, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// router answers /me with the caller and /admin to admins only
+func router(a *Authenticator) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(a.RequireUser())
+	r.GET("/me", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"user_id": UserID(c), "admin": IsAdmin(c)})
+	})
+	r.GET("/admin", RequireAdmin(), func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+	return r
+}
+
+func request(r *gin.Engine, path string, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestRequireUser(t *testing.T) {
+	a := newAuthenticator(t, Config{JWKS: "testdata/jwks.json", Issuer: "https://issuer.test", Audience: "slides-api"})
+	key := localKey(t)
+	r := router(a)
+
+	w := request(r, "/me", sign(t, key, localKeyID, claimsFor("alice")))
+	if w.Code != http.StatusOK {
+		t.Fatalf("valid token: status %d, %s", w.Code, w.Body)
+	}
+	var me struct {
+		UserID string `json:"user_id"`
+		Admin  bool   `json:"admin"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &me); err != nil {
+		t.Fatal(err)
+	}
+	if me.UserID != "alice" || me.Admin {
+		t.Errorf("caller = %+v, want alice without the admin role", me)
+	}
+
+	expired := claimsFor("alice")
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+	wrongAudience := claimsFor("alice")
+	wrongAudience["aud"] = "other-api"
+	wrongIssuer := claimsFor("alice")
+	wrongIssuer["iss"] = "https://other.test"
+	noExpiry := claimsFor("alice")
+	delete(noExpiry, "exp")
+	noSubject := claimsFor("")
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"missing token", ""},
+		{"malformed token", "not.a.token"},
+		{"expired token", sign(t, key, localKeyID, expired)},
+		{"wrong audience", sign(t, key, localKeyID, wrongAudience)},
+		{"wrong issuer", sign(t, key, localKeyID, wrongIssuer)},
+		{"no expiry", sign(t, key, localKeyID, noExpiry)},
+		{"no subject", sign(t, key, localKeyID, noSubject)},
+		{"unknown key", sign(t, key, "other", claimsFor("alice"))},
+	}
+	for _, test := range tests {
+		if w := request(r, "/me", test.token); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status %d, want 401", test.name, w.Code)
+		}
+	}
+}
+
+func TestRequireUserRejectsOtherKeys(t *testing.T) {
+	a := newAuthenticator(t, Config{JWKS: "testdata/jwks.json"})
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Signed by a key that is not in the set, under the ID of one that is
+	if w := request(router(a), "/me", sign(t, other, localKeyID, claimsFor("alice"))); w.Code != http.StatusUnauthorized {
+		t.Errorf("status %d, want 401", w.Code)
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	key := localKey(t)
+
+	t.Run("top level claim", func(t *testing.T) {
+		a := newAuthenticator(t, Config{JWKS: "testdata/jwks.json"})
+		r := router(a)
+
+		admin := claimsFor("alice")
+		admin["role"] = RoleAdmin
+		if w := request(r, "/admin", sign(t, key, localKeyID, admin)); w.Code != http.StatusNoContent {
+			t.Errorf("admin: status %d, want 204", w.Code)
+		}
+		if w := request(r, "/admin", sign(t, key, localKeyID, claimsFor("bob"))); w.Code != http.StatusForbidden {
+			t.Errorf("user: status %d, want 403", w.Code)
+		}
+	})
+
+	t.Run("nested list claim", func(t *testing.T) {
+		a := newAuthenticator(t, Config{JWKS: "testdata/jwks.json", RoleClaim: "metadata.roles"})
+		r := router(a)
+
+		admin := claimsFor("alice")
+		admin["metadata"] = map[string]interface{}{"roles": []string{"editor", RoleAdmin}}
+		if w := request(r, "/admin", sign(t, key, localKeyID, admin)); w.Code != http.StatusNoContent {
+			t.Errorf("admin: status %d, want 204", w.Code)
+		}
+
+		// The top level claim is not the configured one
+		topLevel := claimsFor("bob")
+		topLevel["role"] = RoleAdmin
+		if w := request(r, "/admin", sign(t, key, localKeyID, topLevel)); w.Code != http.StatusForbidden {
+			t.Errorf("role outside of the claim: status %d, want 403", w.Code)
+		}
+	})
+}
+
+// jwksServer serves a key set that can be replaced, counting the requests
+type jwksServer struct {
+	mu       sync.Mutex
+	keys     map[string]*ecdsa.PrivateKey
+	requests int
+}
+
+func (s *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+
+	encode := func(n []byte) string { return base64.RawURLEncoding.EncodeToString(n) }
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	for kid, key := range s.keys {
+		set.Keys = append(set.Keys, jwk{
+			Kty: "EC",
+			Kid: kid,
+			Use: "sig",
+			Crv: "P-256",
+			X:   encode(key.X.FillBytes(make([]byte, 32))),
+			Y:   encode(key.Y.FillBytes(make([]byte, 32))),
+		})
+	}
+	json.NewEncoder(w).Encode(set)
+}
+
+func (s *jwksServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func (s *jwksServer) rotate(keys map[string]*ecdsa.PrivateKey) {
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+}
+
+func TestJWKSRotation(t *testing.T) {
+	first, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	second, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	jwks := &jwksServer{keys: map[string]*ecdsa.PrivateKey{"first": first}}
+	server := httptest.NewServer(jwks)
+	defer server.Close()
+
+	a := newAuthenticator(t, Config{JWKS: server.URL})
+	r := router(a)
+	oldToken := sign(t, first, "first", claimsFor("alice"))
+	newToken := sign(t, second, "second", claimsFor("alice"))
+
+	if w := request(r, "/me", oldToken); w.Code != http.StatusOK {
+		t.Fatalf("token of the first key: status %d", w.Code)
+	}
+
+	jwks.rotate(map[string]*ecdsa.PrivateKey{"second": second})
+
+	// Unknown key IDs refetch the set at most once a minute
+	if w := request(r, "/me", newToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("token of the new key right after the last fetch: status %d, want 401", w.Code)
+	}
+	if n := jwks.count(); n != 1 {
+		t.Errorf("%d requests for the key set, want 1", n)
+	}
+
+	a.keys.mu.Lock()
+	a.keys.lastAttempt = time.Now().Add(-2 * jwksMinRefresh)
+	a.keys.mu.Unlock()
+
+	if w := request(r, "/me", newToken); w.Code != http.StatusOK {
+		t.Errorf("token of the new key: status %d, want 200", w.Code)
+	}
+	if n := jwks.count(); n != 2 {
+		t.Errorf("%d requests for the key set, want 2", n)
+	}
+
+	// Keys removed from the set are no longer trusted once it is refetched
+	if w := request(r, "/me", oldToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("token of the removed key: status %d, want 401", w.Code)
+	}
+
+	// The set is refetched once stale, even for known keys
+	jwks.rotate(map[string]*ecdsa.PrivateKey{"first": first, "second": second})
+	a.keys.mu.Lock()
+	a.keys.fetchedAt = time.Now().Add(-2 * jwksRefreshInterval)
+	a.keys.mu.Unlock()
+
+	if w := request(r, "/me", newToken); w.Code != http.StatusOK {
+		t.Errorf("token of the new key with a stale set: status %d, want 200", w.Code)
+	}
+	if n := jwks.count(); n != 3 {
+		t.Errorf("%d requests for the key set, want 3", n)
+	}
+}
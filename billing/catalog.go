@@ -0,0 +1,67 @@
+package billing
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Checkout modes of a product
+const (
+	ModePayment      = "payment"
+	ModeSubscription = "subscription"
+)
+
+// PlanFree is the plan of users without an active subscription
+const PlanFree = "free"
+
+// Product is something users can buy: a credit pack paid once, or a plan billed
+// every period that grants Credits on each paid invoice
+type Product struct {
+	ID      string `json:"id"`
+	Mode    string `json:"mode"`
+	PriceID string `json:"-"`
+	Credits int    `json:"credits"`
+}
+
+// ParseProducts parses products of one mode from a list like
+// "small:price_123:100,large:price_456:500" (id:stripe price ID:credits)
+func ParseProducts(mode string, value string) ([]Product, error) {
+	var products []Product
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid product %q", entry)
+		}
+		credits, err := strconv.Atoi(parts[2])
+		if err != nil || credits < 0 {
+			return nil, fmt.Errorf("invalid credits in product %q", entry)
+		}
+		products = append(products, Product{ID: parts[0], Mode: mode, PriceID: parts[1], Credits: credits})
+	}
+	return products, nil
+}
+
+// productByID returns the product with an ID
+func productByID(id string) (Product, bool) {
+	for _, product := range config.Products {
+		if product.ID == id {
+			return product, true
+		}
+	}
+	return Product{}, false
+}
+
+// productByPrice returns the product sold at a Stripe price
+func productByPrice(priceID string) (Product, bool) {
+	for _, product := range config.Products {
+		if product.PriceID == priceID {
+			return product, true
+		}
+	}
+	return Product{}, false
+}
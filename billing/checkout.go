@@ -0,0 +1,89 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"main/db"
+	"main/models"
+
+	"github.com/stripe/stripe-go/v78"
+	"github.com/stripe/stripe-go/v78/checkout/session"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const collectionNameUsers = "users"
+
+// ErrUnknownProduct is returned for product IDs that are not in the catalog
+var ErrUnknownProduct = errors.New("unknown product")
+
+// Config configures billing, it is disabled when SecretKey is empty
+type Config struct {
+	SecretKey     string
+	WebhookSecret string
+	// Where Checkout sends the user back to
+	SuccessURL string
+	CancelURL  string
+	Products   []Product
+}
+
+var config Config
+
+// Configure sets up the Stripe client
+func Configure(cfg Config) {
+	config = cfg
+	stripe.Key = cfg.SecretKey
+}
+
+// Enabled reports whether billing is configured
+func Enabled() bool {
+	return config.SecretKey != ""
+}
+
+// Products returns the catalog
+func Products() []Product {
+	return append([]Product{}, config.Products...)
+}
+
+// newCheckoutSession creates a Checkout Session through the Stripe API
+var newCheckoutSession = session.New
+
+// CreateCheckout creates a Checkout Session for a user to buy a product. The
+// user's ID is stored on the session, and on the subscription for plans, so
+// the webhook knows who to credit
+func CreateCheckout(ctx context.Context, userID string, productID string) (*stripe.CheckoutSession, error) {
+	product, ok := productByID(productID)
+	if !ok {
+		return nil, ErrUnknownProduct
+	}
+
+	var user models.User
+	err := db.DB.Collection(collectionNameUsers).FindOne(ctx, bson.M{"user_id": userID}).Decode(&user)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	metadata := map[string]string{"user_id": userID, "product_id": product.ID}
+	params := &stripe.CheckoutSessionParams{
+		Mode:              stripe.String(product.Mode),
+		ClientReferenceID: stripe.String(userID),
+		SuccessURL:        stripe.String(config.SuccessURL),
+		CancelURL:         stripe.String(config.CancelURL),
+		LineItems: []*stripe.CheckoutSessionLineItemParams{
+			{Price: stripe.String(product.PriceID), Quantity: stripe.Int64(1)},
+		},
+		Metadata: metadata,
+	}
+	params.Context = ctx
+
+	if user.StripeCustomerID != "" {
+		params.Customer = stripe.String(user.StripeCustomerID)
+	} else if user.Email != "" {
+		params.CustomerEmail = stripe.String(user.Email)
+	}
+	if product.Mode == ModeSubscription {
+		params.SubscriptionData = &stripe.CheckoutSessionSubscriptionDataParams{Metadata: metadata}
+	}
+
+	return newCheckoutSession(params)
+}
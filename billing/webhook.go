@@ -0,0 +1,300 @@
+package billing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"main/credits"
+	"main/db"
+	"main/models"
+	"time"
+
+	"github.com/stripe/stripe-go/v78"
+	"github.com/stripe/stripe-go/v78/webhook"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const CollectionNameStripeEvents = "stripe_events"
+
+// Statuses of a received event
+const (
+	eventProcessing = "processing"
+	eventProcessed  = "processed"
+)
+
+// An event still marked as processing after this long is assumed to have been
+// abandoned by a crashed server and is processed again
+const eventProcessingTimeout = 10 * time.Minute
+
+// ErrEventInProgress is returned when another delivery of the same event is
+// being processed
+var ErrEventInProgress = errors.New("event is already being processed")
+
+// ConstructEvent verifies the Stripe-Signature header of a webhook payload
+func ConstructEvent(payload []byte, signature string) (stripe.Event, error) {
+	return webhook.ConstructEvent(payload, signature, config.WebhookSecret)
+}
+
+// SignPayload returns a Stripe-Signature header for payload, to replay recorded
+// webhook fixtures against a server without calling Stripe
+func SignPayload(payload []byte, secret string) string {
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: secret})
+	return signed.Header
+}
+
+// HandleEvent applies a webhook event once. Redeliveries of an event that was
+// already processed are ignored, and an event that fails is forgotten so Stripe
+// delivers it again
+func HandleEvent(ctx context.Context, event stripe.Event) error {
+	processed, err := claimEvent(ctx, event)
+	if err != nil || processed {
+		return err
+	}
+
+	events := db.DB.Collection(CollectionNameStripeEvents)
+	if err := processEvent(ctx, event); err != nil {
+		events.DeleteOne(ctx, bson.M{"_id": event.ID})
+		return err
+	}
+
+	_, err = events.UpdateOne(ctx, bson.M{"_id": event.ID}, bson.M{"$set": bson.M{"status": eventProcessed, "updated_at": time.Now()}})
+	return err
+}
+
+// claimEvent records that an event is being processed, it reports true if the
+// event was already processed
+func claimEvent(ctx context.Context, event stripe.Event) (bool, error) {
+	now := time.Now()
+	events := db.DB.Collection(CollectionNameStripeEvents)
+	_, err := events.InsertOne(ctx, bson.M{
+		"_id":        event.ID,
+		"type":       event.Type,
+		"status":     eventProcessing,
+		"created_at": now,
+		"updated_at": now,
+	})
+	if err == nil {
+		return false, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return false, err
+	}
+
+	var existing struct {
+		Status string `bson:"status"`
+	}
+	if err := events.FindOne(ctx, bson.M{"_id": event.ID}).Decode(&existing); err != nil {
+		return false, err
+	}
+	if existing.Status == eventProcessed {
+		return true, nil
+	}
+
+	// Take over an abandoned event
+	result, err := events.UpdateOne(ctx,
+		bson.M{"_id": event.ID, "status": eventProcessing, "updated_at": bson.M{"$lt": now.Add(-eventProcessingTimeout)}},
+		bson.M{"$set": bson.M{"updated_at": now}},
+	)
+	if err != nil {
+		return false, err
+	}
+	if result.MatchedCount == 0 {
+		return false, ErrEventInProgress
+	}
+	return false, nil
+}
+
+func processEvent(ctx context.Context, event stripe.Event) error {
+	occurredAt := time.Unix(event.Created, 0)
+
+	switch event.Type {
+	case "checkout.session.completed", "checkout.session.async_payment_succeeded":
+		var s stripe.CheckoutSession
+		if err := json.Unmarshal(event.Data.Raw, &s); err != nil {
+			return err
+		}
+		return checkoutCompleted(ctx, &s, occurredAt)
+
+	case "invoice.paid":
+		var invoice stripe.Invoice
+		if err := json.Unmarshal(event.Data.Raw, &invoice); err != nil {
+			return err
+		}
+		return invoicePaid(ctx, &invoice)
+
+	case "customer.subscription.created", "customer.subscription.updated", "customer.subscription.deleted":
+		var subscription stripe.Subscription
+		if err := json.Unmarshal(event.Data.Raw, &subscription); err != nil {
+			return err
+		}
+		return subscriptionChanged(ctx, &subscription, occurredAt)
+	}
+
+	log.Println("Ignoring Stripe event", event.Type)
+	return nil
+}
+
+// checkoutCompleted credits a paid credit pack, plans are credited by invoicePaid
+func checkoutCompleted(ctx context.Context, s *stripe.CheckoutSession, occurredAt time.Time) error {
+	userID := s.ClientReferenceID
+	if userID == "" {
+		userID = s.Metadata["user_id"]
+	}
+	if userID == "" {
+		return fmt.Errorf("checkout session %s has no user", s.ID)
+	}
+
+	var customerID string
+	if s.Customer != nil {
+		customerID = s.Customer.ID
+	}
+
+	product, ok := productByID(s.Metadata["product_id"])
+	if !ok {
+		return fmt.Errorf("checkout session %s: %w: %s", s.ID, ErrUnknownProduct, s.Metadata["product_id"])
+	}
+
+	switch s.Mode {
+	case stripe.CheckoutSessionModeSubscription:
+		var subscriptionID string
+		if s.Subscription != nil {
+			subscriptionID = s.Subscription.ID
+		}
+		return setPlan(ctx, userID, product.ID, customerID, subscriptionID, occurredAt)
+
+	case stripe.CheckoutSessionModePayment:
+		// Delayed payment methods complete later with async_payment_succeeded
+		if s.PaymentStatus != stripe.CheckoutSessionPaymentStatusPaid {
+			return nil
+		}
+		if customerID != "" {
+			setCustomer(ctx, userID, customerID)
+		}
+		_, err := credits.Purchase(ctx, userID, product.Credits, s.ID, "stripe:"+s.ID)
+		return err
+	}
+	return nil
+}
+
+// invoicePaid grants the credits of a plan for each paid billing period
+func invoicePaid(ctx context.Context, invoice *stripe.Invoice) error {
+	if invoice.Subscription == nil || invoice.Lines == nil {
+		return nil
+	}
+
+	userID, err := subscriptionUser(ctx, invoice.SubscriptionDetails, invoice.Customer)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range invoice.Lines.Data {
+		if line.Price == nil {
+			continue
+		}
+		product, ok := productByPrice(line.Price.ID)
+		if !ok || product.Mode != ModeSubscription {
+			continue
+		}
+		_, err := credits.Purchase(ctx, userID, product.Credits, invoice.ID, "stripe:"+invoice.ID+":"+line.ID)
+		if err != nil && !errors.Is(err, credits.ErrInvalidAmount) {
+			return err
+		}
+	}
+	return nil
+}
+
+// subscriptionChanged keeps the user's plan in sync with their subscription
+func subscriptionChanged(ctx context.Context, subscription *stripe.Subscription, occurredAt time.Time) error {
+	userID := subscription.Metadata["user_id"]
+	if userID == "" {
+		var err error
+		userID, err = userByCustomer(ctx, subscription.Customer)
+		if err != nil {
+			return err
+		}
+	}
+
+	var customerID string
+	if subscription.Customer != nil {
+		customerID = subscription.Customer.ID
+	}
+
+	plan := PlanFree
+	switch subscription.Status {
+	case stripe.SubscriptionStatusActive, stripe.SubscriptionStatusTrialing, stripe.SubscriptionStatusPastDue:
+		if subscription.Items != nil {
+			for _, item := range subscription.Items.Data {
+				if item.Price == nil {
+					continue
+				}
+				if product, ok := productByPrice(item.Price.ID); ok && product.Mode == ModeSubscription {
+					plan = product.ID
+				}
+			}
+		}
+	}
+
+	return setPlan(ctx, userID, plan, customerID, subscription.ID, occurredAt)
+}
+
+// subscriptionUser finds the user of an invoice from the subscription metadata,
+// falling back to the Stripe customer
+func subscriptionUser(ctx context.Context, details *stripe.InvoiceSubscriptionDetails, customer *stripe.Customer) (string, error) {
+	if details != nil && details.Metadata["user_id"] != "" {
+		return details.Metadata["user_id"], nil
+	}
+	return userByCustomer(ctx, customer)
+}
+
+func userByCustomer(ctx context.Context, customer *stripe.Customer) (string, error) {
+	if customer == nil || customer.ID == "" {
+		return "", errors.New("event has no customer")
+	}
+	var user models.User
+	err := db.DB.Collection(collectionNameUsers).FindOne(ctx, bson.M{"stripe_customer_id": customer.ID}).Decode(&user)
+	if err != nil {
+		return "", fmt.Errorf("no user for customer %s: %w", customer.ID, err)
+	}
+	return user.UserID, nil
+}
+
+// setPlan changes a user's plan unless a more recent event already did
+func setPlan(ctx context.Context, userID string, plan string, customerID string, subscriptionID string, occurredAt time.Time) error {
+	set := bson.M{"plan": plan, "plan_updated_at": occurredAt, "updated_at": time.Now()}
+	if customerID != "" {
+		set["stripe_customer_id"] = customerID
+	}
+	if subscriptionID != "" {
+		set["stripe_subscription_id"] = subscriptionID
+	}
+
+	filter := bson.M{
+		"user_id": userID,
+		"$or": bson.A{
+			bson.M{"plan_updated_at": bson.M{"$exists": false}},
+			bson.M{"plan_updated_at": bson.M{"$lte": occurredAt}},
+		},
+	}
+	result, err := db.DB.Collection(collectionNameUsers).UpdateOne(ctx, filter, bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		log.Println("Skipping outdated plan change for user", userID)
+	}
+	return nil
+}
+
+// setCustomer remembers the Stripe customer of a user so later checkouts reuse it
+func setCustomer(ctx context.Context, userID string, customerID string) {
+	_, err := db.DB.Collection(collectionNameUsers).UpdateOne(ctx,
+		bson.M{"user_id": userID, "stripe_customer_id": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"stripe_customer_id": customerID}},
+	)
+	if err != nil {
+		log.Println("Error saving Stripe customer", err)
+	}
+}
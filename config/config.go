@@ -0,0 +1,352 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"main/auth"
+	"time"
+)
+
+// Config is the configuration of the server. Each field can be set in the YAML
+// file under its yaml key, or with the environment variable of its env tag
+type Config struct {
+	// "production", "development", or "local" if unset
+	Env string `yaml:"env" env:"SERVER_ENV"`
+
+	Server     Server     `yaml:"server"`
+	Mongo      Mongo      `yaml:"mongo"`
+	Storage    Storage    `yaml:"storage"`
+	Auth       Auth       `yaml:"auth"`
+	Billing    Billing    `yaml:"billing"`
+	LLM        LLM        `yaml:"llm"`
+	TTS        TTS        `yaml:"tts"`
+	Slides     Slides     `yaml:"slides"`
+	Fetch      Fetch      `yaml:"fetch"`
+	Background Background `yaml:"background"`
+}
+
+type Server struct {
+	Port int `yaml:"port" env:"PORT"`
+	// READ_TIMEOUT and WRITE_TIMEOUT also bound uploads and event streams, so
+	// they are disabled unless set
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"READ_HEADER_TIMEOUT"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" env:"READ_TIMEOUT"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" env:"WRITE_TIMEOUT"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" env:"IDLE_TIMEOUT"`
+	// How long a shutdown waits for requests, operations and jobs to finish
+	// before interrupting them
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+}
+
+type Mongo struct {
+	URI      string `yaml:"uri" env:"MONGO_URI"`
+	Database string `yaml:"database" env:"DB_NAME"`
+	// Where slides, spaces, users, quizzes and flashcards are stored, "mongo"
+	// or "memory"
+	Repository string `yaml:"repository" env:"REPOSITORY"`
+	// Where progress events are stored, "mongo" or "memory"
+	EventLog string `yaml:"event_log" env:"EVENT_LOG"`
+	// Skips migrations at startup, when they are run with "go run . migrate"
+	// before deploying instead
+	SkipMigrations bool `yaml:"skip_migrations" env:"SKIP_MIGRATIONS"`
+}
+
+type Storage struct {
+	// "s3" or "local"
+	Driver      string `yaml:"driver" env:"STORAGE_DRIVER"`
+	AWSRegion   string `yaml:"aws_region" env:"AWS_REGION"`
+	AWSBucket   string `yaml:"aws_bucket_name" env:"AWS_BUCKET_NAME"`
+	LocalDir    string `yaml:"local_dir" env:"LOCAL_STORAGE_DIR"`
+	LocalURL    string `yaml:"local_url" env:"LOCAL_STORAGE_URL"`
+	LocalSecret string `yaml:"local_secret" env:"LOCAL_STORAGE_SECRET"`
+	// How long presigned file URLs stay valid
+	PresignURLTTL time.Duration `yaml:"presign_url_ttl" env:"PRESIGN_URL_TTL"`
+}
+
+type Auth struct {
+	// JWKS file or URL used to verify bearer tokens, e.g. auth/testdata/jwks.json
+	// locally or https://<tenant>/.well-known/jwks.json
+	JWKS      string `yaml:"jwks" env:"AUTH_JWKS"`
+	Issuer    string `yaml:"issuer" env:"AUTH_ISSUER"`
+	Audience  string `yaml:"audience" env:"AUTH_AUDIENCE"`
+	RoleClaim string `yaml:"role_claim" env:"AUTH_ROLE_CLAIM"`
+}
+
+// Billing is disabled without StripeSecret. Packs and plans are lists of
+// id:stripe_price_id:credits, e.g. "small:price_123:100,large:price_456:500"
+type Billing struct {
+	StripeSecret        string `yaml:"stripe_secret" env:"STRIPE_SECRET"`
+	StripeWebhookSecret string `yaml:"stripe_webhook_secret" env:"STRIPE_WEBHOOK_SECRET"`
+	CreditPacks         string `yaml:"credit_packs" env:"BILLING_CREDIT_PACKS"`
+	Plans               string `yaml:"plans" env:"BILLING_PLANS"`
+	SuccessURL          string `yaml:"success_url" env:"BILLING_SUCCESS_URL"`
+	CancelURL           string `yaml:"cancel_url" env:"BILLING_CANCEL_URL"`
+	// Overrides of the credit price of each operation, e.g. "generate_audio=3,generate_notes=0"
+	CreditPrices string `yaml:"credit_prices" env:"CREDIT_PRICES"`
+}
+
+type LLM struct {
+	// "openai" or "fake" for offline development
+	Provider     string        `yaml:"provider" env:"LLM_PROVIDER"`
+	OpenAIAPIKey string        `yaml:"openai_api_key" env:"OPENAI_API_KEY"`
+	TextModel    string        `yaml:"text_model" env:"LLM_TEXT_MODEL"`
+	VisionModel  string        `yaml:"vision_model" env:"LLM_VISION_MODEL"`
+	JSONModel    string        `yaml:"json_model" env:"LLM_JSON_MODEL"`
+	Timeout      time.Duration `yaml:"timeout" env:"LLM_TIMEOUT"`
+	MaxRetries   int           `yaml:"max_retries" env:"LLM_MAX_RETRIES"`
+}
+
+// TTS configures narration, audio is disabled when the default provider has
+// no API key
+type TTS struct {
+	// Default provider, "openai", "deepgram" or "stub" for offline development
+	Provider       string  `yaml:"provider" env:"TTS_PROVIDER"`
+	Voice          string  `yaml:"voice" env:"TTS_VOICE"`
+	Speed          float64 `yaml:"speed" env:"TTS_SPEED"`
+	Format         string  `yaml:"format" env:"TTS_FORMAT"`
+	OpenAIAPIKey   string  `yaml:"openai_api_key" env:"OPENAI_API_KEY"`
+	OpenAIModel    string  `yaml:"openai_model" env:"OPENAI_TTS_MODEL"`
+	DeepgramAPIKey string  `yaml:"deepgram_api_key" env:"DEEPGRAM_API_KEY"`
+	// Encodes M4A lecture exports, ffmpeg in the PATH if unset. Only MP3
+	// exports are available without it
+	FFmpegPath string `yaml:"ffmpeg_path" env:"FFMPEG_PATH"`
+}
+
+// Enabled reports whether the default provider can be used
+func (t TTS) Enabled() bool {
+	switch t.Provider {
+	case "openai":
+		return t.OpenAIAPIKey != ""
+	case "deepgram":
+		return t.DeepgramAPIKey != ""
+	}
+	return t.Provider == "stub"
+}
+
+// Slides configures uploads and the conversion of PDFs and presentations
+type Slides struct {
+	PDFMaxPages int   `yaml:"pdf_max_pages" env:"PDF_MAX_PAGES"`
+	PDFMaxBytes int64 `yaml:"pdf_max_bytes" env:"PDF_MAX_BYTES"`
+	// Number of pages rendered at once
+	PDFWorkers int `yaml:"pdf_workers" env:"PDF_WORKERS"`
+	// Slide images, format is "webp", "jpeg" or "png"
+	RenderDPI      float64 `yaml:"render_dpi" env:"RENDER_DPI"`
+	RenderFormat   string  `yaml:"render_format" env:"RENDER_FORMAT"`
+	RenderQuality  int     `yaml:"render_quality" env:"RENDER_QUALITY"`
+	ThumbnailWidth int     `yaml:"thumbnail_width" env:"THUMBNAIL_WIDTH"`
+	// Converts presentations to PDF, "libreoffice", "stub" for offline
+	// development or "none" to only accept PDFs and images
+	PresentationConverter string `yaml:"presentation_converter" env:"PRESENTATION_CONVERTER"`
+	LibreOfficePath       string `yaml:"libreoffice_path" env:"LIBREOFFICE_PATH"`
+}
+
+// Fetch configures remote downloads of user provided URLs. Hosts starting with
+// a dot allow their subdomains, any public host is allowed if Hosts is empty.
+// Lists are comma separated in environment variables
+type Fetch struct {
+	Schemes []string      `yaml:"allowed_schemes" env:"FETCH_ALLOWED_SCHEMES"`
+	Hosts   []string      `yaml:"allowed_hosts" env:"FETCH_ALLOWED_HOSTS"`
+	Timeout time.Duration `yaml:"timeout" env:"FETCH_TIMEOUT"`
+	// Only for development against local servers
+	AllowPrivate bool `yaml:"allow_private" env:"FETCH_ALLOW_PRIVATE"`
+}
+
+type Background struct {
+	// Number of background job workers
+	JobWorkers int `yaml:"job_workers" env:"JOB_WORKERS"`
+	// How often orphaned documents and files are removed, never if zero
+	GCInterval time.Duration `yaml:"gc_interval" env:"GC_INTERVAL"`
+	// How long deleted slides and spaces stay in the trash, and how often
+	// those that expired are purged
+	TrashRetention     time.Duration `yaml:"trash_retention" env:"TRASH_RETENTION"`
+	TrashPurgeInterval time.Duration `yaml:"trash_purge_interval" env:"TRASH_PURGE_INTERVAL"`
+}
+
+// Local reports whether the server runs on a developer's machine, the only
+// place where the local test keys may be used
+func (c *Config) Local() bool {
+	return c.Env == "" || c.Env == "local"
+}
+
+// Default returns the configuration used for everything that is not set
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Port:              8080,
+			ReadHeaderTimeout: 10 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownTimeout:   time.Minute,
+		},
+		Mongo: Mongo{
+			Database:   "donotfail",
+			Repository: "mongo",
+			EventLog:   "mongo",
+		},
+		Storage: Storage{
+			Driver:        "s3",
+			LocalDir:      "storage",
+			LocalSecret:   "local",
+			PresignURLTTL: 15 * time.Minute,
+		},
+		LLM: LLM{
+			Provider:   "openai",
+			Timeout:    2 * time.Minute,
+			MaxRetries: 4,
+		},
+		TTS: TTS{
+			Provider: "openai",
+			Speed:    1.0,
+			Format:   "mp3",
+		},
+		Slides: Slides{
+			PDFMaxPages:    500,
+			PDFMaxBytes:    100 << 20,
+			PDFWorkers:     4,
+			RenderDPI:      150,
+			RenderFormat:   "webp",
+			RenderQuality:  80,
+			ThumbnailWidth: 320,
+		},
+		Fetch: Fetch{
+			Schemes: []string{"https"},
+			Timeout: 2 * time.Minute,
+		},
+		Background: Background{
+			JobWorkers:         2,
+			TrashRetention:     30 * 24 * time.Hour,
+			TrashPurgeInterval: time.Hour,
+		},
+	}
+}
+
+// Validate returns every invalid or missing setting joined in one error
+func (c *Config) Validate() error {
+	var errs []error
+	invalid := func(name string, value any) {
+		errs = append(errs, fmt.Errorf("invalid %s: %v", name, value))
+	}
+	required := func(name string, value string) {
+		if value == "" {
+			errs = append(errs, fmt.Errorf("%s is required", name))
+		}
+	}
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		invalid("PORT", c.Server.Port)
+	}
+	for name, timeout := range map[string]time.Duration{
+		"READ_HEADER_TIMEOUT": c.Server.ReadHeaderTimeout,
+		"READ_TIMEOUT":        c.Server.ReadTimeout,
+		"WRITE_TIMEOUT":       c.Server.WriteTimeout,
+		"IDLE_TIMEOUT":        c.Server.IdleTimeout,
+	} {
+		if timeout < 0 {
+			invalid(name, timeout)
+		}
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		invalid("SHUTDOWN_TIMEOUT", c.Server.ShutdownTimeout)
+	}
+
+	required("MONGO_URI", c.Mongo.URI)
+	required("DB_NAME", c.Mongo.Database)
+	if c.Mongo.Repository != "mongo" && c.Mongo.Repository != "memory" {
+		invalid("REPOSITORY", c.Mongo.Repository)
+	}
+	if c.Mongo.EventLog != "mongo" && c.Mongo.EventLog != "memory" {
+		invalid("EVENT_LOG", c.Mongo.EventLog)
+	}
+
+	switch c.Storage.Driver {
+	case "s3":
+		required("AWS_REGION", c.Storage.AWSRegion)
+		required("AWS_BUCKET_NAME", c.Storage.AWSBucket)
+	case "local":
+		if c.Env == "production" && c.Storage.LocalSecret == Default().Storage.LocalSecret {
+			errs = append(errs, errors.New("LOCAL_STORAGE_SECRET must be set in production"))
+		}
+	default:
+		invalid("STORAGE_DRIVER", c.Storage.Driver)
+	}
+	if c.Storage.PresignURLTTL <= 0 {
+		invalid("PRESIGN_URL_TTL", c.Storage.PresignURLTTL)
+	}
+
+	required("AUTH_JWKS", c.Auth.JWKS)
+	if !c.Local() && c.Auth.JWKS != "" && auth.IsLocalJWKS(c.Auth.JWKS) {
+		errs = append(errs, errors.New("AUTH_JWKS may only be the local test key set when SERVER_ENV is local"))
+	}
+
+	if c.Billing.StripeSecret != "" {
+		required("STRIPE_WEBHOOK_SECRET", c.Billing.StripeWebhookSecret)
+		required("BILLING_SUCCESS_URL", c.Billing.SuccessURL)
+		required("BILLING_CANCEL_URL", c.Billing.CancelURL)
+	}
+
+	switch c.LLM.Provider {
+	case "openai":
+		required("OPENAI_API_KEY", c.LLM.OpenAIAPIKey)
+	case "fake":
+	default:
+		invalid("LLM_PROVIDER", c.LLM.Provider)
+	}
+	if c.LLM.Timeout <= 0 {
+		invalid("LLM_TIMEOUT", c.LLM.Timeout)
+	}
+	if c.LLM.MaxRetries < 0 {
+		invalid("LLM_MAX_RETRIES", c.LLM.MaxRetries)
+	}
+
+	if c.TTS.Provider != "openai" && c.TTS.Provider != "deepgram" && c.TTS.Provider != "stub" {
+		invalid("TTS_PROVIDER", c.TTS.Provider)
+	}
+	if c.TTS.Speed < 0.25 || c.TTS.Speed > 4 {
+		invalid("TTS_SPEED", c.TTS.Speed)
+	}
+
+	if c.Slides.PDFMaxPages < 1 {
+		invalid("PDF_MAX_PAGES", c.Slides.PDFMaxPages)
+	}
+	if c.Slides.PDFMaxBytes < 1 {
+		invalid("PDF_MAX_BYTES", c.Slides.PDFMaxBytes)
+	}
+	if c.Slides.PDFWorkers < 1 {
+		invalid("PDF_WORKERS", c.Slides.PDFWorkers)
+	}
+	if c.Slides.RenderDPI < 36 || c.Slides.RenderDPI > 600 {
+		invalid("RENDER_DPI", c.Slides.RenderDPI)
+	}
+	if c.Slides.RenderFormat != "webp" && c.Slides.RenderFormat != "jpeg" && c.Slides.RenderFormat != "png" {
+		invalid("RENDER_FORMAT", c.Slides.RenderFormat)
+	}
+	if c.Slides.RenderQuality < 1 || c.Slides.RenderQuality > 100 {
+		invalid("RENDER_QUALITY", c.Slides.RenderQuality)
+	}
+	if c.Slides.ThumbnailWidth < 16 {
+		invalid("THUMBNAIL_WIDTH", c.Slides.ThumbnailWidth)
+	}
+
+	for _, scheme := range c.Fetch.Schemes {
+		if scheme != "https" && scheme != "http" {
+			invalid("FETCH_ALLOWED_SCHEMES", scheme)
+		}
+	}
+	if c.Fetch.Timeout <= 0 {
+		invalid("FETCH_TIMEOUT", c.Fetch.Timeout)
+	}
+
+	if c.Background.JobWorkers < 1 {
+		invalid("JOB_WORKERS", c.Background.JobWorkers)
+	}
+	if c.Background.GCInterval < 0 {
+		invalid("GC_INTERVAL", c.Background.GCInterval)
+	}
+	if c.Background.TrashRetention <= 0 {
+		invalid("TRASH_RETENTION", c.Background.TrashRetention)
+	}
+	if c.Background.TrashPurgeInterval <= 0 {
+		invalid("TRASH_PURGE_INTERVAL", c.Background.TrashPurgeInterval)
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"main/auth"
+	"testing"
+)
+
+// valid returns a configuration that passes Validate in env
+func valid(env string) *Config {
+	c := Default()
+	c.Env = env
+	c.Mongo.URI = "mongodb://localhost:27017"
+	c.Storage.Driver = "s3"
+	c.Storage.AWSRegion = "eu-west-1"
+	c.Storage.AWSBucket = "slides"
+	c.Auth.JWKS = "https://issuer.test/.well-known/jwks.json"
+	c.LLM.Provider = "fake"
+	return c
+}
+
+func TestLocalJWKSOnlyLocally(t *testing.T) {
+	for _, env := range []string{"", "local"} {
+		c := valid(env)
+		c.Auth.JWKS = auth.LocalJWKS
+		if !c.Local() {
+			t.Errorf("Local() = false for env %q", env)
+		}
+		if err := c.Validate(); err != nil {
+			t.Errorf("env %q with the local key set: %v", env, err)
+		}
+	}
+
+	for _, env := range []string{"development", "staging", "production"} {
+		c := valid(env)
+		if err := c.Validate(); err != nil {
+			t.Fatalf("env %q: %v", env, err)
+		}
+		c.Auth.JWKS = auth.LocalJWKS
+		if c.Local() {
+			t.Errorf("Local() = true for env %q", env)
+		}
+		if err := c.Validate(); err == nil {
+			t.Errorf("env %q accepted the local key set", env)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultFile is read when CONFIG_FILE is not set, if it exists
+const DefaultFile = "config.yaml"
+
+// Load reads the configuration, later sources overriding earlier ones: the
+// defaults, the YAML file at CONFIG_FILE, then the environment. Outside of
+// production and development the environment is first filled from .env
+func Load() (*Config, error) {
+	env := os.Getenv("SERVER_ENV")
+	if env != "production" && env != "development" {
+		// Variables already set in the environment win over .env
+		if err := godotenv.Load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("error loading .env file: %w", err)
+		}
+	}
+
+	cfg := Default()
+
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		if _, err := os.Stat(DefaultFile); err == nil {
+			path = DefaultFile
+		}
+	}
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := loadEnv(reflect.ValueOf(cfg).Elem()); err != nil {
+		return nil, err
+	}
+
+	// The OpenAI key is shared unless narration has its own
+	if cfg.TTS.OpenAIAPIKey == "" {
+		cfg.TTS.OpenAIAPIKey = cfg.LLM.OpenAIAPIKey
+	}
+	if cfg.Storage.LocalURL == "" {
+		cfg.Storage.LocalURL = fmt.Sprintf("http://localhost:%d/files", cfg.Server.Port)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile overrides the configuration with the keys set in a YAML file,
+// unknown keys are rejected to catch typos
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// loadEnv overrides the fields of v that have an env tag with the environment
+// variables that are set
+func loadEnv(v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		name := v.Type().Field(i).Tag.Get("env")
+
+		if field.Kind() == reflect.Struct {
+			if err := loadEnv(field); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := os.LookupEnv(name)
+		if name == "" || !ok || value == "" {
+			continue
+		}
+		if err := setField(field, value); err != nil {
+			return fmt.Errorf("invalid %s: %s", name, value)
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, value string) error {
+	if field.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Slice:
+		field.Set(reflect.ValueOf(splitList(value)))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// splitList splits a comma separated list, dropping empty values
+func splitList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,104 @@
+package convert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// Kinds of documents slides can be made from
+const (
+	KindPDF          = "pdf"
+	KindPresentation = "presentation"
+	KindImage        = "image"
+)
+
+var (
+	ErrUnsupportedType = errors.New("unsupported file type")
+	ErrNoConverter     = errors.New("no presentation converter configured")
+)
+
+// Presentation formats converted to PDF, Keynote decks must be exported to one
+// of them first
+var presentationTypes = []string{
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	"application/vnd.ms-powerpoint",
+	"application/vnd.oasis.opendocument.presentation",
+}
+
+// Image formats accepted as slides
+var imageTypes = []string{"image/png", "image/jpeg", "image/webp", "image/gif", "image/bmp", "image/tiff"}
+
+// Type is the detected type of a file
+type Type struct {
+	Kind string
+	MIME string
+	// Extension is the usual extension of the type, with the dot
+	Extension string
+}
+
+// Detect returns the type of a file from its contents
+func Detect(path string) (Type, error) {
+	mtype, err := mimetype.DetectFile(path)
+	if err != nil {
+		return Type{}, err
+	}
+	return typeOf(mtype)
+}
+
+// Lookup returns the type of a MIME type announced by a client, before its
+// contents can be detected
+func Lookup(mimeType string) (Type, error) {
+	mtype := mimetype.Lookup(mimeType)
+	if mtype == nil {
+		return Type{MIME: mimeType}, fmt.Errorf("%w: %s", ErrUnsupportedType, mimeType)
+	}
+	return typeOf(mtype)
+}
+
+func typeOf(mtype *mimetype.MIME) (Type, error) {
+	t := Type{MIME: mtype.String(), Extension: mtype.Extension()}
+	switch {
+	case mtype.Is("application/pdf"):
+		t.Kind = KindPDF
+	case isAny(mtype, presentationTypes):
+		t.Kind = KindPresentation
+	case isAny(mtype, imageTypes):
+		t.Kind = KindImage
+	default:
+		return t, fmt.Errorf("%w: %s", ErrUnsupportedType, t.MIME)
+	}
+	return t, nil
+}
+
+func isAny(mtype *mimetype.MIME, types []string) bool {
+	for _, t := range types {
+		if mtype.Is(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Converter converts presentations to PDF
+type Converter interface {
+	// ToPDF converts the file at input and returns the path of the PDF, which is
+	// written to outputDir
+	ToPDF(ctx context.Context, input string, outputDir string) (string, error)
+}
+
+// New returns the converter selected by driver, "libreoffice" (default), "stub"
+// for offline development or "none", for which it returns nil
+func New(driver string, binary string) (Converter, error) {
+	switch driver {
+	case "", "libreoffice":
+		return NewLibreOffice(binary), nil
+	case "stub":
+		return NewStub(), nil
+	case "none":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown presentation converter: %s", driver)
+}
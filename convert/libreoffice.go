@@ -0,0 +1,50 @@
+package convert
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// LibreOffice converts presentations with a local headless LibreOffice
+type LibreOffice struct {
+	binary string
+}
+
+// NewLibreOffice creates a LibreOffice converter, binary defaults to soffice
+func NewLibreOffice(binary string) *LibreOffice {
+	if binary == "" {
+		binary = "soffice"
+	}
+	return &LibreOffice{binary: binary}
+}
+
+func (l *LibreOffice) ToPDF(ctx context.Context, input string, outputDir string) (string, error) {
+	// A profile per conversion lets conversions run at the same time
+	profile, err := os.MkdirTemp("", "soffice")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(profile)
+
+	cmd := exec.CommandContext(ctx, l.binary,
+		"-env:UserInstallation=file://"+filepath.ToSlash(profile),
+		"--headless", "--norestore",
+		"--convert-to", "pdf",
+		"--outdir", outputDir,
+		input,
+	)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("libreoffice failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	pdfPath := filepath.Join(outputDir, strings.TrimSuffix(filepath.Base(input), filepath.Ext(input))+".pdf")
+	if _, err := os.Stat(pdfPath); err != nil {
+		return "", fmt.Errorf("libreoffice wrote no PDF: %s", strings.TrimSpace(string(output)))
+	}
+	return pdfPath, nil
+}
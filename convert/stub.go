@@ -0,0 +1,56 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Stub is a Converter for offline use that turns any presentation into a
+// one-page PDF naming the file
+type Stub struct{}
+
+// NewStub creates a Stub
+func NewStub() *Stub {
+	return &Stub{}
+}
+
+func (s *Stub) ToPDF(ctx context.Context, input string, outputDir string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	name := filepath.Base(input)
+	pdfPath := filepath.Join(outputDir, strings.TrimSuffix(name, filepath.Ext(name))+".pdf")
+	return pdfPath, os.WriteFile(pdfPath, onePagePDF("Converted from "+name), 0644)
+}
+
+// onePagePDF returns a minimal PDF with a line of text
+func onePagePDF(text string) []byte {
+	text = strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`).Replace(text)
+	content := fmt.Sprintf("BT /F1 24 Tf 72 720 Td (%s) Tj ET", text)
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 960 540] /Contents 4 0 R /Resources << /Font << /F1 5 0 R >> >> >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+	}
+
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return b.Bytes()
+}
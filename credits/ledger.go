@@ -0,0 +1,371 @@
+package credits
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"main/db"
+	"main/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	CollectionNameTransactions = "credit_transactions"
+	collectionNameUsers        = "users"
+)
+
+// Transaction types
+const (
+	TypeGrant    = "grant"
+	TypeDeduct   = "deduct"
+	TypeCharge   = "charge"
+	TypeRefund   = "refund"
+	TypePurchase = "purchase"
+)
+
+// Transaction statuses. A transaction is pending between being recorded and the
+// balance being updated, and rejected when the balance could not be updated
+const (
+	StatusPending  = "pending"
+	StatusApplied  = "applied"
+	StatusRejected = "rejected"
+)
+
+var (
+	ErrInsufficientCredits = errors.New("insufficient credits")
+	ErrUserNotFound        = errors.New("user not found")
+	ErrTransactionNotFound = errors.New("credit transaction not found")
+	ErrTransactionPending  = errors.New("credit transaction is still pending")
+	ErrInvalidAmount       = errors.New("amount must be positive")
+	ErrDuplicateCharge     = errors.New("idempotency key was already used for this charge")
+	ErrTransactionExpired  = errors.New("transaction expired before it was applied")
+)
+
+// recentTransactions is how many applied transaction IDs are kept on a user, so
+// that transactions left pending by a crash can be reconciled
+const recentTransactions = 100
+
+// Grant adds credits to a user
+func Grant(ctx context.Context, userID string, amount int, idempotencyKey string) (*models.CreditTransaction, error) {
+	if amount <= 0 {
+		return nil, ErrInvalidAmount
+	}
+	return applyOnce(ctx, models.CreditTransaction{
+		UserID:         userID,
+		Type:           TypeGrant,
+		Amount:         amount,
+		IdempotencyKey: idempotencyKey,
+	})
+}
+
+// Deduct removes credits from a user, it fails with ErrInsufficientCredits
+// instead of taking the balance below zero
+func Deduct(ctx context.Context, userID string, amount int, idempotencyKey string) (*models.CreditTransaction, error) {
+	if amount <= 0 {
+		return nil, ErrInvalidAmount
+	}
+	return applyOnce(ctx, models.CreditTransaction{
+		UserID:         userID,
+		Type:           TypeDeduct,
+		Amount:         -amount,
+		IdempotencyKey: idempotencyKey,
+	})
+}
+
+// Purchase adds credits paid for through a payment provider, reference is the
+// provider's ID of the payment
+func Purchase(ctx context.Context, userID string, amount int, reference string, idempotencyKey string) (*models.CreditTransaction, error) {
+	if amount <= 0 {
+		return nil, ErrInvalidAmount
+	}
+	return applyOnce(ctx, models.CreditTransaction{
+		UserID:         userID,
+		Type:           TypePurchase,
+		Amount:         amount,
+		Reference:      reference,
+		IdempotencyKey: idempotencyKey,
+	})
+}
+
+// Charge debits a user for units of an operation at the price in Prices, free
+// operations return a nil transaction. A charge whose idempotency key was
+// already used fails with ErrDuplicateCharge, so that the caller never starts
+// the work it pays for twice
+func Charge(ctx context.Context, userID string, operation string, units int, reference string, idempotencyKey string) (*models.CreditTransaction, error) {
+	amount := Price(operation) * units
+	if amount <= 0 {
+		return nil, nil
+	}
+	tx, replayed, err := apply(ctx, models.CreditTransaction{
+		UserID:         userID,
+		Type:           TypeCharge,
+		Amount:         -amount,
+		Operation:      operation,
+		Units:          units,
+		Reference:      reference,
+		IdempotencyKey: idempotencyKey,
+	})
+	if replayed && err == nil {
+		return tx, ErrDuplicateCharge
+	}
+	return tx, err
+}
+
+// Refund gives back the credits of an applied charge, refunding the same charge
+// twice is a no-op
+func Refund(ctx context.Context, chargeID primitive.ObjectID) (*models.CreditTransaction, error) {
+	return RefundUnused(ctx, chargeID, 0)
+}
+
+// RefundUnused gives back the credits of the units of an applied charge past
+// the first used ones, e.g. the images a failed job did not process. A charge
+// is refunded at most once, later calls return the first refund
+func RefundUnused(ctx context.Context, chargeID primitive.ObjectID, used int) (*models.CreditTransaction, error) {
+	var charge models.CreditTransaction
+	err := db.DB.Collection(CollectionNameTransactions).FindOne(ctx, bson.M{"_id": chargeID}).Decode(&charge)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrTransactionNotFound
+		}
+		return nil, err
+	}
+	if charge.Type != TypeCharge {
+		return nil, fmt.Errorf("transaction %s is not a charge", chargeID.Hex())
+	}
+	if charge.Status != StatusApplied {
+		// Nothing was taken
+		return nil, nil
+	}
+
+	amount, units := unusedAmount(charge, used)
+	if amount <= 0 {
+		return nil, nil
+	}
+	return applyOnce(ctx, models.CreditTransaction{
+		UserID:         charge.UserID,
+		Type:           TypeRefund,
+		Amount:         amount,
+		Operation:      charge.Operation,
+		Units:          units,
+		Reference:      charge.Reference,
+		RefundOf:       charge.ID,
+		IdempotencyKey: "refund:" + charge.ID.Hex(),
+	})
+}
+
+// unusedAmount returns the credits and units of a charge left once used units
+// are taken out, at the price the charge was made at. Charges recorded without
+// units are all or nothing
+func unusedAmount(charge models.CreditTransaction, used int) (int, int) {
+	units := charge.Units
+	if units <= 0 {
+		units = 1
+	}
+	if used < 0 {
+		used = 0
+	}
+	if used >= units {
+		return 0, 0
+	}
+	unused := units - used
+	return -charge.Amount * unused / units, unused
+}
+
+// History returns the transactions of a user, newest first, starting before the
+// transaction ID before when it is set
+func History(ctx context.Context, userID string, limit int64, before primitive.ObjectID) ([]models.CreditTransaction, error) {
+	filter := bson.M{"user_id": userID}
+	if !before.IsZero() {
+		filter["_id"] = bson.M{"$lt": before}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(limit)
+
+	cursor, err := db.DB.Collection(CollectionNameTransactions).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	transactions := []models.CreditTransaction{}
+	if err = cursor.All(ctx, &transactions); err != nil {
+		return nil, err
+	}
+	return transactions, nil
+}
+
+// applyOnce applies a transaction, a transaction whose idempotency key was
+// already used returns the outcome of the first one
+func applyOnce(ctx context.Context, tx models.CreditTransaction) (*models.CreditTransaction, error) {
+	result, _, err := apply(ctx, tx)
+	return result, err
+}
+
+// apply records a transaction and updates the user's balance with a single
+// conditional $inc, so concurrent debits can never overdraw. A transaction whose
+// idempotency key was already used returns the first transaction instead, and
+// reports that it was replayed
+func apply(ctx context.Context, tx models.CreditTransaction) (*models.CreditTransaction, bool, error) {
+	now := time.Now()
+	tx.ID = primitive.NewObjectID()
+	tx.Status = StatusPending
+	tx.CreatedAt = now
+	tx.UpdatedAt = now
+
+	transactions := db.DB.Collection(CollectionNameTransactions)
+	if _, err := transactions.InsertOne(ctx, tx); err != nil {
+		if tx.IdempotencyKey != "" && mongo.IsDuplicateKeyError(err) {
+			first, err := replay(ctx, tx.UserID, tx.IdempotencyKey)
+			return first, true, err
+		}
+		return nil, false, err
+	}
+
+	filter := bson.M{"user_id": tx.UserID}
+	if tx.Amount < 0 {
+		filter["credits"] = bson.M{"$gte": -tx.Amount}
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var user models.User
+	err := db.DB.Collection(collectionNameUsers).FindOneAndUpdate(ctx, filter,
+		bson.M{
+			"$inc": bson.M{"credits": tx.Amount},
+			"$set": bson.M{"updated_at": now},
+			// Tells ReconcilePending whether the balance was updated
+			"$push": bson.M{"recent_transactions": bson.M{"$each": bson.A{tx.ID}, "$slice": -recentTransactions}},
+		},
+		opts,
+	).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		err = rejectionReason(ctx, tx.UserID)
+		reject(ctx, &tx, err)
+		return &tx, false, err
+	}
+	if err != nil {
+		// The balance may or may not have changed, the transaction stays pending
+		// until ReconcilePending settles it
+		return &tx, false, err
+	}
+
+	tx.Status = StatusApplied
+	tx.BalanceAfter = user.Credits
+	tx.UpdatedAt = time.Now()
+	_, err = transactions.UpdateOne(ctx, bson.M{"_id": tx.ID}, bson.M{"$set": bson.M{
+		"status":        tx.Status,
+		"balance_after": tx.BalanceAfter,
+		"updated_at":    tx.UpdatedAt,
+	}})
+	if err != nil {
+		return &tx, false, err
+	}
+	return &tx, false, nil
+}
+
+// replay returns the outcome of the transaction first recorded with an idempotency key
+func replay(ctx context.Context, userID string, idempotencyKey string) (*models.CreditTransaction, error) {
+	var tx models.CreditTransaction
+	err := db.DB.Collection(CollectionNameTransactions).FindOne(ctx, bson.M{"user_id": userID, "idempotency_key": idempotencyKey}).Decode(&tx)
+	if err != nil {
+		return nil, err
+	}
+
+	switch tx.Status {
+	case StatusPending:
+		return &tx, ErrTransactionPending
+	case StatusRejected:
+		for _, reason := range []error{ErrInsufficientCredits, ErrUserNotFound, ErrTransactionExpired} {
+			if tx.Error == reason.Error() {
+				return &tx, reason
+			}
+		}
+		return &tx, errors.New(tx.Error)
+	}
+	return &tx, nil
+}
+
+// rejectionReason tells apart a missing user from a balance that is too low
+func rejectionReason(ctx context.Context, userID string) error {
+	count, err := db.DB.Collection(collectionNameUsers).CountDocuments(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrUserNotFound
+	}
+	return ErrInsufficientCredits
+}
+
+func reject(ctx context.Context, tx *models.CreditTransaction, reason error) {
+	tx.Status = StatusRejected
+	tx.Error = reason.Error()
+	tx.UpdatedAt = time.Now()
+	db.DB.Collection(CollectionNameTransactions).UpdateOne(ctx, bson.M{"_id": tx.ID}, bson.M{"$set": bson.M{
+		"status":     tx.Status,
+		"error":      tx.Error,
+		"updated_at": tx.UpdatedAt,
+	}})
+}
+
+// ReconcilePending settles transactions left pending for longer than olderThan,
+// e.g. by a crash between recording them and updating the balance. Those whose
+// ID was recorded on the user are applied, the others are rejected as expired
+func ReconcilePending(ctx context.Context, olderThan time.Duration) (int, error) {
+	transactions := db.DB.Collection(CollectionNameTransactions)
+	cursor, err := transactions.Find(ctx, bson.M{
+		"status":     StatusPending,
+		"created_at": bson.M{"$lt": time.Now().Add(-olderThan)},
+	})
+	if err != nil {
+		return 0, err
+	}
+	var pending []models.CreditTransaction
+	if err := cursor.All(ctx, &pending); err != nil {
+		return 0, err
+	}
+
+	for i := range pending {
+		tx := &pending[i]
+		var user models.User
+		err := db.DB.Collection(collectionNameUsers).FindOne(ctx, bson.M{"user_id": tx.UserID, "recent_transactions": tx.ID}).Decode(&user)
+		if err == mongo.ErrNoDocuments {
+			reject(ctx, tx, ErrTransactionExpired)
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		_, err = transactions.UpdateOne(ctx, bson.M{"_id": tx.ID, "status": StatusPending}, bson.M{"$set": bson.M{
+			"status":     StatusApplied,
+			"updated_at": time.Now(),
+		}})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(pending), nil
+}
+
+// RunReconciler reconciles pending transactions every interval until ctx is cancelled
+func RunReconciler(ctx context.Context, interval time.Duration, olderThan time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := ReconcilePending(ctx, olderThan)
+			if err != nil {
+				log.Println("Error reconciling credit transactions", err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("Reconciled %d pending credit transactions", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package credits_test
+
+import (
+	"context"
+	"errors"
+	"main/credits"
+	"main/db"
+	"main/migrations"
+	"main/models"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The ledger relies on MongoDB for its atomic balance updates and the unique
+// index on idempotency keys, so these tests run against a throwaway database
+// on the server at MONGO_TEST_URI and are skipped without one
+func connect(t *testing.T) context.Context {
+	t.Helper()
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI is not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	t.Cleanup(cancel)
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("connecting to MongoDB: %v", err)
+	}
+	database := client.Database("test_credits_" + primitive.NewObjectID().Hex())
+	t.Cleanup(func() {
+		database.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+
+	previous := db.DB
+	db.DB = database
+	t.Cleanup(func() { db.DB = previous })
+
+	// Creates the unique index on idempotency keys
+	if _, err := migrations.Run(ctx, nil, false); err != nil {
+		t.Fatalf("migrations: %v", err)
+	}
+	return ctx
+}
+
+func createUser(t *testing.T, ctx context.Context, userID string, balance int) {
+	t.Helper()
+	_, err := db.DB.Collection("users").InsertOne(ctx, models.User{
+		ID:      primitive.NewObjectID(),
+		UserID:  userID,
+		Credits: balance,
+	})
+	if err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+}
+
+func balance(t *testing.T, ctx context.Context, userID string) int {
+	t.Helper()
+	var user models.User
+	if err := db.DB.Collection("users").FindOne(ctx, bson.M{"user_id": userID}).Decode(&user); err != nil {
+		t.Fatalf("finding user: %v", err)
+	}
+	return user.Credits
+}
+
+func TestCharge(t *testing.T) {
+	ctx := connect(t)
+	createUser(t, ctx, "alice", 10)
+
+	tx, err := credits.Charge(ctx, "alice", credits.OpGenerateAudio, 3, "slide", "audio:slide:1")
+	if err != nil {
+		t.Fatalf("Charge: %v", err)
+	}
+	if tx.Status != credits.StatusApplied || tx.Amount != -6 || tx.BalanceAfter != 4 {
+		t.Errorf("charge = %s %d, balance after %d, want applied -6 and 4", tx.Status, tx.Amount, tx.BalanceAfter)
+	}
+	if got := balance(t, ctx, "alice"); got != 4 {
+		t.Errorf("balance = %d, want 4", got)
+	}
+}
+
+func TestChargeInsufficientCredits(t *testing.T) {
+	ctx := connect(t)
+	createUser(t, ctx, "alice", 1)
+
+	tx, err := credits.Charge(ctx, "alice", credits.OpGenerateAudio, 1, "slide", "audio:slide:1")
+	if !errors.Is(err, credits.ErrInsufficientCredits) {
+		t.Fatalf("Charge = %v, want ErrInsufficientCredits", err)
+	}
+	if tx.Status != credits.StatusRejected {
+		t.Errorf("status = %s, want rejected", tx.Status)
+	}
+	if got := balance(t, ctx, "alice"); got != 1 {
+		t.Errorf("balance = %d, want 1", got)
+	}
+
+	// The outcome of a key is kept, even once the user could afford it
+	if _, err := credits.Grant(ctx, "alice", 10, ""); err != nil {
+		t.Fatalf("Grant: %v", err)
+	}
+	if _, err := credits.Charge(ctx, "alice", credits.OpGenerateAudio, 1, "slide", "audio:slide:1"); !errors.Is(err, credits.ErrInsufficientCredits) {
+		t.Errorf("replayed Charge = %v, want ErrInsufficientCredits", err)
+	}
+}
+
+func TestChargeUnknownUser(t *testing.T) {
+	ctx := connect(t)
+
+	_, err := credits.Charge(ctx, "nobody", credits.OpGenerateQuiz, 1, "slide", "")
+	if !errors.Is(err, credits.ErrUserNotFound) {
+		t.Errorf("Charge = %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestChargeReplay(t *testing.T) {
+	ctx := connect(t)
+	createUser(t, ctx, "alice", 10)
+
+	first, err := credits.Charge(ctx, "alice", credits.OpGenerateQuiz, 2, "slide", "quiz:slide:request")
+	if err != nil {
+		t.Fatalf("Charge: %v", err)
+	}
+	replayed, err := credits.Charge(ctx, "alice", credits.OpGenerateQuiz, 2, "slide", "quiz:slide:request")
+	if !errors.Is(err, credits.ErrDuplicateCharge) {
+		t.Fatalf("replayed Charge = %v, want ErrDuplicateCharge", err)
+	}
+	if replayed.ID != first.ID {
+		t.Errorf("replay returned transaction %s, want %s", replayed.ID.Hex(), first.ID.Hex())
+	}
+	if got := balance(t, ctx, "alice"); got != 8 {
+		t.Errorf("balance = %d, want 8 after a single charge", got)
+	}
+
+	// Keys are per user
+	createUser(t, ctx, "bob", 10)
+	if _, err := credits.Charge(ctx, "bob", credits.OpGenerateQuiz, 2, "slide", "quiz:slide:request"); err != nil {
+		t.Errorf("Charge of another user with the same key = %v", err)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	ctx := connect(t)
+	createUser(t, ctx, "alice", 10)
+
+	charge, err := credits.Charge(ctx, "alice", credits.OpGenerateQuiz, 4, "slide", "quiz:slide:1")
+	if err != nil {
+		t.Fatalf("Charge: %v", err)
+	}
+	refund, err := credits.Refund(ctx, charge.ID)
+	if err != nil {
+		t.Fatalf("Refund: %v", err)
+	}
+	if refund.Amount != 4 || refund.RefundOf != charge.ID {
+		t.Errorf("refund = %d of %s, want 4 of %s", refund.Amount, refund.RefundOf.Hex(), charge.ID.Hex())
+	}
+
+	again, err := credits.Refund(ctx, charge.ID)
+	if err != nil {
+		t.Fatalf("second Refund: %v", err)
+	}
+	if again.ID != refund.ID {
+		t.Errorf("second refund created transaction %s, want %s", again.ID.Hex(), refund.ID.Hex())
+	}
+	if got := balance(t, ctx, "alice"); got != 10 {
+		t.Errorf("balance = %d, want 10", got)
+	}
+}
+
+func TestRefundUnused(t *testing.T) {
+	ctx := connect(t)
+	createUser(t, ctx, "alice", 10)
+
+	// 4 images at 2 credits, a job that failed after processing 1 of them
+	charge, err := credits.Charge(ctx, "alice", credits.OpGenerateAudio, 4, "slide", "audio:slide:1")
+	if err != nil {
+		t.Fatalf("Charge: %v", err)
+	}
+	refund, err := credits.RefundUnused(ctx, charge.ID, 1)
+	if err != nil {
+		t.Fatalf("RefundUnused: %v", err)
+	}
+	if refund.Amount != 6 || refund.Units != 3 {
+		t.Errorf("refund = %d for %d units, want 6 for 3", refund.Amount, refund.Units)
+	}
+
+	// A charge is refunded once, whatever the units
+	again, err := credits.RefundUnused(ctx, charge.ID, 0)
+	if err != nil {
+		t.Fatalf("second RefundUnused: %v", err)
+	}
+	if again.ID != refund.ID {
+		t.Errorf("second refund created transaction %s, want %s", again.ID.Hex(), refund.ID.Hex())
+	}
+	if got := balance(t, ctx, "alice"); got != 8 {
+		t.Errorf("balance = %d, want 8", got)
+	}
+
+	// Nothing is refunded once every unit was used
+	used, err := credits.Charge(ctx, "alice", credits.OpGenerateAudio, 2, "slide", "audio:slide:2")
+	if err != nil {
+		t.Fatalf("Charge: %v", err)
+	}
+	if refund, err := credits.RefundUnused(ctx, used.ID, 2); err != nil || refund != nil {
+		t.Errorf("RefundUnused of a used charge = %v, %v, want nothing to refund", refund, err)
+	}
+	if got := balance(t, ctx, "alice"); got != 4 {
+		t.Errorf("balance = %d, want 4", got)
+	}
+}
+
+func TestRefundOfRejectedCharge(t *testing.T) {
+	ctx := connect(t)
+	createUser(t, ctx, "alice", 0)
+
+	charge, _ := credits.Charge(ctx, "alice", credits.OpGenerateQuiz, 1, "slide", "quiz:slide:1")
+	refund, err := credits.Refund(ctx, charge.ID)
+	if err != nil || refund != nil {
+		t.Errorf("Refund = %v, %v, want nothing to refund", refund, err)
+	}
+	if got := balance(t, ctx, "alice"); got != 0 {
+		t.Errorf("balance = %d, want 0", got)
+	}
+}
+
+func TestGrantReplay(t *testing.T) {
+	ctx := connect(t)
+	createUser(t, ctx, "alice", 0)
+
+	// Webhooks are delivered again, granting twice returns the first grant
+	first, err := credits.Grant(ctx, "alice", 5, "stripe:evt_1")
+	if err != nil {
+		t.Fatalf("Grant: %v", err)
+	}
+	second, err := credits.Grant(ctx, "alice", 5, "stripe:evt_1")
+	if err != nil {
+		t.Fatalf("replayed Grant: %v", err)
+	}
+	if second.ID != first.ID {
+		t.Errorf("replay returned transaction %s, want %s", second.ID.Hex(), first.ID.Hex())
+	}
+	if got := balance(t, ctx, "alice"); got != 5 {
+		t.Errorf("balance = %d, want 5", got)
+	}
+}
+
+func TestReconcilePending(t *testing.T) {
+	ctx := connect(t)
+	createUser(t, ctx, "alice", 10)
+
+	// Two charges left pending by a crash, only the first updated the balance
+	old := time.Now().Add(-time.Hour)
+	applied := models.CreditTransaction{ID: primitive.NewObjectID(), UserID: "alice", Type: credits.TypeCharge, Amount: -1, Status: credits.StatusPending, IdempotencyKey: "applied", CreatedAt: old}
+	lost := models.CreditTransaction{ID: primitive.NewObjectID(), UserID: "alice", Type: credits.TypeCharge, Amount: -1, Status: credits.StatusPending, IdempotencyKey: "lost", CreatedAt: old}
+	transactions := db.DB.Collection(credits.CollectionNameTransactions)
+	if _, err := transactions.InsertMany(ctx, []interface{}{applied, lost}); err != nil {
+		t.Fatalf("inserting transactions: %v", err)
+	}
+	if _, err := db.DB.Collection("users").UpdateOne(ctx, bson.M{"user_id": "alice"}, bson.M{
+		"$inc":  bson.M{"credits": -1},
+		"$push": bson.M{"recent_transactions": applied.ID},
+	}); err != nil {
+		t.Fatalf("updating user: %v", err)
+	}
+
+	// A retry while pending must not start the work again
+	if _, err := credits.Charge(ctx, "alice", credits.OpGenerateQuiz, 1, "slide", "lost"); !errors.Is(err, credits.ErrTransactionPending) {
+		t.Errorf("Charge while pending = %v, want ErrTransactionPending", err)
+	}
+
+	n, err := credits.ReconcilePending(ctx, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("ReconcilePending: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("reconciled %d transactions, want 2", n)
+	}
+
+	if _, err := credits.Charge(ctx, "alice", credits.OpGenerateQuiz, 1, "slide", "applied"); !errors.Is(err, credits.ErrDuplicateCharge) {
+		t.Errorf("Charge of an applied key = %v, want ErrDuplicateCharge", err)
+	}
+	if _, err := credits.Charge(ctx, "alice", credits.OpGenerateQuiz, 1, "slide", "lost"); !errors.Is(err, credits.ErrTransactionExpired) {
+		t.Errorf("Charge of an expired key = %v, want ErrTransactionExpired", err)
+	}
+	if got := balance(t, ctx, "alice"); got != 9 {
+		t.Errorf("balance = %d, want 9", got)
+	}
+}
+
+func TestFreeOperation(t *testing.T) {
+	credits.SetPrices(map[string]int{credits.OpGenerateQuiz: 0})
+	defer credits.SetPrices(nil)
+
+	// Free operations never reach the database
+	tx, err := credits.Charge(context.Background(), "alice", credits.OpGenerateQuiz, 3, "slide", "quiz:slide:1")
+	if tx != nil || err != nil {
+		t.Errorf("Charge = %v, %v, want no transaction", tx, err)
+	}
+}
+
+func TestInvalidAmount(t *testing.T) {
+	for _, amount := range []int{0, -5} {
+		if _, err := credits.Grant(context.Background(), "alice", amount, ""); !errors.Is(err, credits.ErrInvalidAmount) {
+			t.Errorf("Grant(%d) = %v, want ErrInvalidAmount", amount, err)
+		}
+		if _, err := credits.Deduct(context.Background(), "alice", amount, ""); !errors.Is(err, credits.ErrInvalidAmount) {
+			t.Errorf("Deduct(%d) = %v, want ErrInvalidAmount", amount, err)
+		}
+	}
+}
+
+func TestParsePrices(t *testing.T) {
+	table, err := credits.ParsePrices(" generate_audio=3, generate_quiz = 0,")
+	if err != nil {
+		t.Fatalf("ParsePrices: %v", err)
+	}
+	if len(table) != 2 || table[credits.OpGenerateAudio] != 3 || table[credits.OpGenerateQuiz] != 0 {
+		t.Errorf("table = %v", table)
+	}
+
+	for _, value := range []string{"generate_audio", "generate_audio=-1", "generate_audio=two"} {
+		if _, err := credits.ParsePrices(value); err == nil {
+			t.Errorf("ParsePrices(%q) succeeded, want an error", value)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package credits
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Operations that cost credits, whole-slide operations are charged once per
+// slide image
+const (
+	OpGenerateQuiz       = "generate_quiz"
+	OpGenerateFlashcards = "generate_flashcards"
+	OpGenerateAudio      = "generate_audio"
+	OpGenerateImageText  = "generate_image_text"
+)
+
+// DefaultPrices is the price of each operation unless configured otherwise
+var DefaultPrices = map[string]int{
+	OpGenerateQuiz:       1,
+	OpGenerateFlashcards: 1,
+	OpGenerateAudio:      2,
+	OpGenerateImageText:  1,
+}
+
+var (
+	pricesMu sync.RWMutex
+	prices   = copyPrices(DefaultPrices)
+)
+
+// SetPrices overrides the price of the given operations, a price of 0 makes an
+// operation free
+func SetPrices(overrides map[string]int) {
+	pricesMu.Lock()
+	defer pricesMu.Unlock()
+	prices = copyPrices(DefaultPrices)
+	for operation, price := range overrides {
+		prices[operation] = price
+	}
+}
+
+// Price returns the price of one unit of an operation
+func Price(operation string) int {
+	pricesMu.RLock()
+	defer pricesMu.RUnlock()
+	return prices[operation]
+}
+
+// Prices returns the current price table
+func Prices() map[string]int {
+	pricesMu.RLock()
+	defer pricesMu.RUnlock()
+	return copyPrices(prices)
+}
+
+// ParsePrices parses a price table like "generate_audio=2,generate_quiz=1"
+func ParsePrices(value string) (map[string]int, error) {
+	table := map[string]int{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		operation, price, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid price %q", entry)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(price))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid price %q", entry)
+		}
+		table[strings.TrimSpace(operation)] = n
+	}
+	return table, nil
+}
+
+func copyPrices(table map[string]int) map[string]int {
+	result := make(map[string]int, len(table))
+	for operation, price := range table {
+		result[operation] = price
+	}
+	return result
+}
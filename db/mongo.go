@@ -2,6 +2,7 @@ package db
 
 import (
 	"context"
+	"errors"
 	"log"
 
 	"go.mongodb.org/mongo-driver/mongo"
@@ -9,14 +10,17 @@ import (
 )
 
 var DB *mongo.Database
-var DB_NAME = "donotfail"
 
-func ConnectMongo(uri string) {
+var client *mongo.Client
+
+// ConnectMongo connects to MongoDB and sets DB to database
+func ConnectMongo(uri string, database string) {
 	// Set client options
 	clientOptions := options.Client().ApplyURI(uri)
 
 	// Connect to MongoDB
-	client, err := mongo.Connect(context.TODO(), clientOptions)
+	var err error
+	client, err = mongo.Connect(context.TODO(), clientOptions)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -28,7 +32,23 @@ func ConnectMongo(uri string) {
 	}
 
 	// Assign client database to DB
-	DB = client.Database(DB_NAME)
+	DB = client.Database(database)
 
 	log.Println("Connected to MongoDB!")
 }
+
+// PingMongo checks that MongoDB can be reached
+func PingMongo(ctx context.Context) error {
+	if client == nil {
+		return errors.New("not connected to MongoDB")
+	}
+	return client.Ping(ctx, nil)
+}
+
+// DisconnectMongo closes the connections to MongoDB
+func DisconnectMongo(ctx context.Context) error {
+	if client == nil {
+		return nil
+	}
+	return client.Disconnect(ctx)
+}
@@ -1 +1,151 @@
 package db
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3Store is a BlobStore backed by an AWS S3 bucket
+type S3Store struct {
+	bucket   string
+	client   *s3.S3
+	uploader *s3manager.Uploader
+}
+
+// NewS3Store creates a BlobStore for the given region and bucket
+func NewS3Store(region string, bucket string) (*S3Store, error) {
+	s3session, err := session.NewSession(&aws.Config{
+		Region: aws.String(region),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3Store{
+		bucket:   bucket,
+		client:   s3.New(s3session),
+		uploader: s3manager.NewUploader(s3session),
+	}, nil
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, body io.Reader, contentType string) error {
+	_, err := s.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        body,
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	output, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+	return output.Body, nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (s *S3Store) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := s.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			keys = append(keys, aws.StringValue(object.Key))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *S3Store) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	req, _ := s.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	req.SetContext(ctx)
+	return req.Presign(ttl)
+}
+
+func (s *S3Store) PresignPut(ctx context.Context, key string, contentType string, ttl time.Duration) (string, error) {
+	req, _ := s.client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	})
+	req.SetContext(ctx)
+	return req.Presign(ttl)
+}
+
+func (s *S3Store) URL(key string) string {
+	return fmt.Sprintf("https://%s.s3.amazonaws.com/%s", s.bucket, key)
+}
+
+// keyFromURL accepts the global and regional endpoints of the bucket, in
+// virtual hosted and path style, as presigned URLs use the regional ones
+func (s *S3Store) keyFromURL(u *url.URL) (string, bool) {
+	if !strings.EqualFold(u.Scheme, "https") {
+		return "", false
+	}
+	host := strings.ToLower(u.Hostname())
+	if !strings.HasSuffix(host, ".amazonaws.com") {
+		return "", false
+	}
+	endpoint := strings.TrimSuffix(host, ".amazonaws.com")
+
+	prefix := "/"
+	if bucket := s.bucket + "."; strings.HasPrefix(endpoint, bucket) {
+		endpoint = strings.TrimPrefix(endpoint, bucket)
+	} else {
+		prefix = "/" + s.bucket + "/"
+	}
+	if !isS3Endpoint(endpoint) {
+		return "", false
+	}
+	return trimKeyPrefix(u.Path, prefix)
+}
+
+// isS3Endpoint reports whether endpoint, without its amazonaws.com suffix, is
+// one of S3: s3, s3.<region>, s3-<region> or s3.dualstack.<region>
+func isS3Endpoint(endpoint string) bool {
+	if endpoint == "s3" {
+		return true
+	}
+	region := strings.TrimPrefix(endpoint, "s3.dualstack.")
+	if region == endpoint {
+		region = strings.TrimPrefix(endpoint, "s3.")
+	}
+	if region == endpoint {
+		region = strings.TrimPrefix(endpoint, "s3-")
+	}
+	return region != endpoint && region != "" && !strings.Contains(region, ".")
+}
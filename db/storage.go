@@ -0,0 +1,106 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrObjectNotFound is returned by a BlobStore when the requested key does not exist
+var ErrObjectNotFound = errors.New("object not found")
+
+// BlobStore is the object storage used for PDFs, slide images and audio files
+type BlobStore interface {
+	// Put stores the contents of body under key
+	Put(ctx context.Context, key string, body io.Reader, contentType string) error
+	// Get opens the object stored under key, the caller must close it
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the object stored under key
+	Delete(ctx context.Context, key string) error
+	// List returns the keys of every object starting with prefix
+	List(ctx context.Context, prefix string) ([]string, error)
+	// PresignGet returns a URL that can be used to download key until ttl expires
+	PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error)
+	// PresignPut returns a URL that can be used to upload key with a PUT request
+	// of contentType until ttl expires
+	PresignPut(ctx context.Context, key string, contentType string, ttl time.Duration) (string, error)
+	// URL returns the permanent URL of key
+	URL(key string) string
+}
+
+// NewStorage returns the store selected by driver ("s3" or "local")
+func NewStorage(driver string, s3Region string, s3Bucket string, localDir string, localURL string, localSecret string) (BlobStore, error) {
+	switch driver {
+	case "", "s3":
+		store, err := NewS3Store(s3Region, s3Bucket)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case "local":
+		store, err := NewLocalStore(localDir, localURL, localSecret)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+	return nil, errors.New("unknown storage driver: " + driver)
+}
+
+// urlParser is implemented by stores whose objects can be reached at more
+// than one URL
+type urlParser interface {
+	keyFromURL(u *url.URL) (string, bool)
+}
+
+// KeyFromURL returns the key of an object from its permanent or presigned URL,
+// the query string of presigned URLs is ignored
+func KeyFromURL(store BlobStore, rawURL string) (string, bool) {
+	if rawURL == "" {
+		return "", false
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" || u.User != nil {
+		return "", false
+	}
+	if parser, ok := store.(urlParser); ok {
+		return parser.keyFromURL(u)
+	}
+
+	base, err := url.Parse(store.URL(""))
+	if err != nil {
+		return "", false
+	}
+	if !strings.EqualFold(u.Scheme, base.Scheme) || !strings.EqualFold(u.Host, base.Host) {
+		return "", false
+	}
+	return trimKeyPrefix(u.Path, base.Path)
+}
+
+// trimKeyPrefix returns the key in path after prefix
+func trimKeyPrefix(path string, prefix string) (string, bool) {
+	if !strings.HasPrefix(path, prefix) {
+		return "", false
+	}
+	key := strings.TrimPrefix(path, prefix)
+	return key, key != ""
+}
+
+// PingStorage checks that store can be reached by reading an object that
+// doesn't need to exist
+func PingStorage(ctx context.Context, store BlobStore) error {
+	if store == nil {
+		return errors.New("storage is not connected")
+	}
+	body, err := store.Get(ctx, "readyz")
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return body.Close()
+}
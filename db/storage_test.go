@@ -0,0 +1,44 @@
+package db
+
+import "testing"
+
+func TestKeyFromURL(t *testing.T) {
+	local, err := NewLocalStore(t.TempDir(), "http://localhost:8080/files", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3 := &S3Store{bucket: "decks"}
+
+	tests := []struct {
+		store BlobStore
+		url   string
+		key   string
+		ok    bool
+	}{
+		{local, "http://localhost:8080/files/slides/1/a.pdf", "slides/1/a.pdf", true},
+		{local, "http://localhost:8080/files/slides/1/a.pdf?expires=1700000000&signature=abc", "slides/1/a.pdf", true},
+		{local, "http://localhost:8080/files/", "", false},
+		{local, "http://localhost:8080/other/slides/1/a.pdf", "", false},
+		{local, "http://localhost:9090/files/slides/1/a.pdf", "", false},
+		{local, "http://user@localhost:8080/files/slides/1/a.pdf", "", false},
+		{local, "", "", false},
+
+		{s3, "https://decks.s3.amazonaws.com/slides/1/a.pdf", "slides/1/a.pdf", true},
+		{s3, "https://decks.s3.eu-west-1.amazonaws.com/slides/1/a.pdf?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Signature=abc", "slides/1/a.pdf", true},
+		{s3, "https://decks.s3-eu-west-1.amazonaws.com/slides/1/a.pdf", "slides/1/a.pdf", true},
+		{s3, "https://decks.s3.dualstack.eu-west-1.amazonaws.com/slides/1/a.pdf", "slides/1/a.pdf", true},
+		{s3, "https://s3.eu-west-1.amazonaws.com/decks/slides/1/a.pdf?X-Amz-Signature=abc", "slides/1/a.pdf", true},
+		{s3, "https://s3.amazonaws.com/decks/slides/1/a.pdf", "slides/1/a.pdf", true},
+		{s3, "http://decks.s3.amazonaws.com/slides/1/a.pdf", "", false},
+		{s3, "https://other.s3.amazonaws.com/slides/1/a.pdf", "", false},
+		{s3, "https://s3.amazonaws.com/other/slides/1/a.pdf", "", false},
+		{s3, "https://decks.s3.evil.com.amazonaws.com/slides/1/a.pdf", "", false},
+		{s3, "https://decks.s3.amazonaws.com.evil.com/slides/1/a.pdf", "", false},
+	}
+	for _, test := range tests {
+		key, ok := KeyFromURL(test.store, test.url)
+		if key != test.key || ok != test.ok {
+			t.Errorf("KeyFromURL(%s) = %q, %v, want %q, %v", test.url, key, ok, test.key, test.ok)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"log"
+	"main/models"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Event types sent to clients
+const (
+	TypeProgress = "progress"
+	TypeLog      = "log"
+	TypeError    = "error"
+	TypeDone     = "done"
+)
+
+// EventLog stores the events of every stream so clients can replay the ones they missed
+type EventLog interface {
+	// Append stores an event at the end of a stream, assigning it the next ID of the stream
+	Append(ctx context.Context, streamID string, eventType string, data bson.M) (models.Event, error)
+	// Since returns the events of a stream with an ID greater than afterID, in order
+	Since(ctx context.Context, streamID string, afterID int64) ([]models.Event, error)
+	// Start starts a run of the work whose events go to a stream, unless one is
+	// in progress. A run lasts until its done or error event, or until expires
+	// in case its server stopped before writing it
+	Start(ctx context.Context, streamID string, expires time.Time) (Run, error)
+}
+
+// Run is a run of the work of a stream, streams used by operations that can be
+// done again hold one run after the other
+type Run struct {
+	// Started is set when the caller started the run, another one was in
+	// progress otherwise
+	Started bool
+	// After is the ID of the last event before the run
+	After int64
+}
+
+// isLast reports whether an event of eventType ends the run of its stream
+func isLast(eventType string) bool {
+	return eventType == TypeDone || eventType == TypeError
+}
+
+// New returns the event log selected by driver ("mongo" or "memory")
+func New(driver string) (EventLog, error) {
+	switch driver {
+	case "", "mongo":
+		return NewMongoLog(), nil
+	case "memory":
+		return NewMemoryLog(), nil
+	}
+	return nil, errors.New("unknown event log driver: " + driver)
+}
+
+var (
+	subscribersMu sync.Mutex
+	subscribers   = map[string]map[chan struct{}]struct{}{}
+)
+
+// Subscribe returns a channel that receives a value whenever an event is
+// published to streamID by this process, call unsubscribe when done
+func Subscribe(streamID string) (notify <-chan struct{}, unsubscribe func()) {
+	ch := make(chan struct{}, 1)
+
+	subscribersMu.Lock()
+	if subscribers[streamID] == nil {
+		subscribers[streamID] = map[chan struct{}]struct{}{}
+	}
+	subscribers[streamID][ch] = struct{}{}
+	subscribersMu.Unlock()
+
+	return ch, func() {
+		subscribersMu.Lock()
+		delete(subscribers[streamID], ch)
+		if len(subscribers[streamID]) == 0 {
+			delete(subscribers, streamID)
+		}
+		subscribersMu.Unlock()
+	}
+}
+
+func notify(streamID string) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	for ch := range subscribers[streamID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Publish appends an event to a stream of l and wakes up its subscribers
+func Publish(l EventLog, streamID string, eventType string, data bson.M) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := l.Append(ctx, streamID, eventType, data); err != nil {
+		log.Println("Error publishing event", err)
+		return
+	}
+	notify(streamID)
+}
+
+// Emitter publishes the typed events of one stream
+type Emitter struct {
+	Events   EventLog
+	StreamID string
+}
+
+// Progress publishes a progress event
+func (e Emitter) Progress(current int, total int, message string) {
+	Publish(e.Events, e.StreamID, TypeProgress, bson.M{"current": current, "total": total, "message": message})
+}
+
+// Log publishes a log event
+func (e Emitter) Log(message string) {
+	Publish(e.Events, e.StreamID, TypeLog, bson.M{"message": message})
+}
+
+// Error publishes an error event, it is the last event of the stream
+func (e Emitter) Error(message string) {
+	Publish(e.Events, e.StreamID, TypeError, bson.M{"error": message})
+}
+
+// Done publishes a done event, it is the last event of the stream
+func (e Emitter) Done(data bson.M) {
+	if data == nil {
+		data = bson.M{}
+	}
+	Publish(e.Events, e.StreamID, TypeDone, data)
+}
@@ -0,0 +1,125 @@
+package events
+
+import (
+	"context"
+	"main/models"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// memoryRetention is how long MemoryLog keeps a stream once its done or error
+// event is written, the time clients have to replay it
+const memoryRetention = time.Hour
+
+// MemoryLog is an EventLog kept in memory, events are lost on restart
+type MemoryLog struct {
+	mu      sync.Mutex
+	streams map[string]*memoryStream
+	// Finished streams are evicted after ttl, and the others after Retention
+	// without events
+	ttl       time.Duration
+	lastSweep time.Time
+}
+
+type memoryStream struct {
+	events       []models.Event
+	runAfter     int64
+	runningUntil time.Time
+	finishedAt   time.Time
+}
+
+// NewMemoryLog creates an empty in-memory event log
+func NewMemoryLog() *MemoryLog {
+	return &MemoryLog{streams: map[string]*memoryStream{}, ttl: memoryRetention}
+}
+
+func (l *MemoryLog) Append(ctx context.Context, streamID string, eventType string, data bson.M) (models.Event, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep()
+
+	stream := l.stream(streamID)
+	event := models.Event{
+		ID:        int64(len(stream.events) + 1),
+		StreamID:  streamID,
+		Type:      eventType,
+		Data:      data,
+		CreatedAt: time.Now(),
+	}
+	stream.events = append(stream.events, event)
+	if isLast(eventType) {
+		stream.finishedAt = event.CreatedAt
+		stream.runningUntil = time.Time{}
+	} else {
+		stream.finishedAt = time.Time{}
+	}
+	return event, nil
+}
+
+func (l *MemoryLog) Since(ctx context.Context, streamID string, afterID int64) ([]models.Event, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stream, ok := l.streams[streamID]
+	if !ok {
+		return nil, nil
+	}
+	if afterID < 0 {
+		afterID = 0
+	}
+	if afterID >= int64(len(stream.events)) {
+		return nil, nil
+	}
+
+	// IDs start at 1 and have no gaps, so the event with ID afterID+1 is at index afterID
+	events := make([]models.Event, len(stream.events)-int(afterID))
+	copy(events, stream.events[afterID:])
+	return events, nil
+}
+
+func (l *MemoryLog) Start(ctx context.Context, streamID string, expires time.Time) (Run, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep()
+
+	stream := l.stream(streamID)
+	if time.Now().Before(stream.runningUntil) {
+		return Run{After: stream.runAfter}, nil
+	}
+	stream.runAfter = int64(len(stream.events))
+	stream.runningUntil = expires
+	stream.finishedAt = time.Time{}
+	return Run{Started: true, After: stream.runAfter}, nil
+}
+
+// stream returns the stream with streamID, creating it if needed
+func (l *MemoryLog) stream(streamID string) *memoryStream {
+	stream, ok := l.streams[streamID]
+	if !ok {
+		stream = &memoryStream{}
+		l.streams[streamID] = stream
+	}
+	return stream
+}
+
+// sweep evicts the expired streams, at most once a minute
+func (l *MemoryLog) sweep() {
+	now := time.Now()
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for id, stream := range l.streams {
+		if now.Before(stream.runningUntil) {
+			continue
+		}
+		finished := !stream.finishedAt.IsZero() && now.Sub(stream.finishedAt) > l.ttl
+		idle := len(stream.events) == 0 || now.Sub(stream.events[len(stream.events)-1].CreatedAt) > Retention
+		if finished || idle {
+			delete(l.streams, id)
+		}
+	}
+}
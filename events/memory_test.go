@@ -0,0 +1,66 @@
+package events
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryLogRuns(t *testing.T) {
+	ctx := context.Background()
+	l := NewMemoryLog()
+	expires := time.Now().Add(time.Minute)
+
+	run, err := l.Start(ctx, "op", expires)
+	if err != nil || !run.Started || run.After != 0 {
+		t.Fatalf("Start = %+v, %v, want a started run after 0", run, err)
+	}
+	l.Append(ctx, "op", TypeProgress, nil)
+
+	// Another request attaches to the run in progress
+	if run, _ := l.Start(ctx, "op", expires); run.Started || run.After != 0 {
+		t.Errorf("Start while running = %+v, want the run after 0", run)
+	}
+
+	l.Append(ctx, "op", TypeDone, nil)
+	run, _ = l.Start(ctx, "op", expires)
+	if !run.Started || run.After != 2 {
+		t.Errorf("Start once done = %+v, want a started run after 2", run)
+	}
+
+	// A run whose server stopped before its last event expires
+	l.Append(ctx, "stale", TypeProgress, nil)
+	l.Start(ctx, "stale", time.Now().Add(-time.Second))
+	if run, _ := l.Start(ctx, "stale", expires); !run.Started || run.After != 1 {
+		t.Errorf("Start of an expired run = %+v, want a started run after 1", run)
+	}
+}
+
+func TestMemoryLogEvictsFinishedStreams(t *testing.T) {
+	ctx := context.Background()
+	l := NewMemoryLog()
+
+	l.Append(ctx, "done", TypeDone, nil)
+	l.Append(ctx, "running", TypeProgress, nil)
+	l.Start(ctx, "started", time.Now().Add(time.Hour))
+
+	// Finished more than ttl ago
+	l.mu.Lock()
+	l.streams["done"].finishedAt = time.Now().Add(-2 * l.ttl)
+	l.lastSweep = time.Time{}
+	l.mu.Unlock()
+
+	l.Append(ctx, "other", TypeLog, nil)
+
+	if events, _ := l.Since(ctx, "done", 0); len(events) != 0 {
+		t.Errorf("finished stream still has %d events", len(events))
+	}
+	for _, id := range []string{"running", "started", "other"} {
+		l.mu.Lock()
+		_, ok := l.streams[id]
+		l.mu.Unlock()
+		if !ok {
+			t.Errorf("stream %s was evicted", id)
+		}
+	}
+}
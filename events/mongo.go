@@ -0,0 +1,125 @@
+package events
+
+import (
+	"context"
+	"main/db"
+	"main/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	CollectionNameEvents       = "events"
+	CollectionNameEventStreams = "event_streams"
+)
+
+// How long Since waits for a missing event before skipping it. IDs are taken
+// before the event is inserted, so concurrent publishers can insert out of
+// order, and an insert that failed leaves a gap for good
+const gapTimeout = 10 * time.Second
+
+// Retention is how long events and streams are kept, see the TTL indexes in
+// the migrations package
+const Retention = 7 * 24 * time.Hour
+
+// MongoLog is an EventLog stored in MongoDB, so streams survive restarts and
+// can be replayed by any server instance
+type MongoLog struct{}
+
+// NewMongoLog creates an event log stored in db.DB
+func NewMongoLog() *MongoLog {
+	return &MongoLog{}
+}
+
+func (l *MongoLog) Append(ctx context.Context, streamID string, eventType string, data bson.M) (models.Event, error) {
+	// Take the next ID of the stream
+	var stream struct {
+		Seq int64 `bson:"seq"`
+	}
+	update := bson.M{"$inc": bson.M{"seq": 1}, "$set": bson.M{"updated_at": time.Now()}}
+	if isLast(eventType) {
+		update["$unset"] = bson.M{"running_until": ""}
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := db.DB.Collection(CollectionNameEventStreams).FindOneAndUpdate(ctx,
+		bson.M{"_id": streamID},
+		update,
+		opts,
+	).Decode(&stream)
+	if err != nil {
+		return models.Event{}, err
+	}
+
+	event := models.Event{
+		ID:        stream.Seq,
+		StreamID:  streamID,
+		Type:      eventType,
+		Data:      data,
+		CreatedAt: time.Now(),
+	}
+	_, err = db.DB.Collection(CollectionNameEvents).InsertOne(ctx, event)
+	if err != nil {
+		return models.Event{}, err
+	}
+	return event, nil
+}
+
+func (l *MongoLog) Since(ctx context.Context, streamID string, afterID int64) ([]models.Event, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "seq", Value: 1}})
+	cursor, err := db.DB.Collection(CollectionNameEvents).Find(ctx, bson.M{"stream_id": streamID, "seq": bson.M{"$gt": afterID}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var events []models.Event
+	if err = cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+
+	// Hold back the events after a gap until the missing one is inserted, so a
+	// reader never skips it
+	next := afterID + 1
+	for i, event := range events {
+		if event.ID != next && time.Since(event.CreatedAt) < gapTimeout {
+			return events[:i], nil
+		}
+		next = event.ID + 1
+	}
+	return events, nil
+}
+
+func (l *MongoLog) Start(ctx context.Context, streamID string, expires time.Time) (Run, error) {
+	now := time.Now()
+	streams := db.DB.Collection(CollectionNameEventStreams)
+
+	var stream struct {
+		RunAfter int64 `bson:"run_after"`
+	}
+	// Matches streams without a run in progress, the upsert of a stream that
+	// has one fails on its _id
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := streams.FindOneAndUpdate(ctx,
+		bson.M{"_id": streamID, "running_until": bson.M{"$not": bson.M{"$gt": now}}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"run_after":     bson.M{"$ifNull": bson.A{"$seq", 0}},
+			"running_until": expires,
+			"updated_at":    now,
+		}}}},
+		opts,
+	).Decode(&stream)
+	if err == nil {
+		return Run{Started: true, After: stream.RunAfter}, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return Run{}, err
+	}
+
+	if err := streams.FindOne(ctx, bson.M{"_id": streamID}).Decode(&stream); err != nil {
+		return Run{}, err
+	}
+	return Run{After: stream.RunAfter}, nil
+}
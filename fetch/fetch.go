@@ -0,0 +1,243 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrSchemeNotAllowed  = errors.New("URL scheme is not allowed")
+	ErrHostNotAllowed    = errors.New("URL host is not allowed")
+	ErrAddressNotAllowed = errors.New("URL resolves to a private address")
+	ErrTooLarge          = errors.New("file is too large")
+	ErrTooManyRedirects  = errors.New("too many redirects")
+)
+
+const maxRedirects = 5
+
+// Ranges that are not globally reachable besides those netip already knows
+// about, see the IANA special-purpose address registries
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001::/23"),
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+// Config restricts what a Fetcher downloads
+type Config struct {
+	// Schemes allowed in URLs, https only if empty
+	Schemes []string
+	// Hosts allowed in URLs, any host if empty. A host starting with a dot
+	// allows its subdomains
+	Hosts []string
+	// MaxBytes is the size limit of a download, none if 0
+	MaxBytes int64
+	// Timeout of a download including reading the body, none if 0
+	Timeout time.Duration
+	// AllowPrivate allows private and loopback addresses, for development only
+	AllowPrivate bool
+}
+
+// ProgressFunc is called as a download is read with the bytes read so far and
+// the size of the file, or -1 if it is unknown
+type ProgressFunc func(read int64, total int64)
+
+// Fetcher downloads user provided URLs. Every address it connects to is
+// checked after DNS resolution, so hosts resolving or redirecting to private
+// addresses are rejected
+type Fetcher struct {
+	cfg    Config
+	client *http.Client
+}
+
+// New creates a Fetcher with the restrictions of cfg
+func New(cfg Config) *Fetcher {
+	if len(cfg.Schemes) == 0 {
+		cfg.Schemes = []string{"https"}
+	}
+	f := &Fetcher{cfg: cfg}
+
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: f.control,
+	}
+	f.client = &http.Client{
+		Transport: &http.Transport{
+			// A proxy would be the only address checked
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return ErrTooManyRedirects
+			}
+			return f.Check(req.URL.String())
+		},
+	}
+	return f
+}
+
+// Check returns an error if rawURL does not have an allowed scheme and host.
+// Addresses are checked when connecting
+func (f *Fetcher) Check(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if !contains(f.cfg.Schemes, strings.ToLower(u.Scheme)) {
+		return fmt.Errorf("%w: %s", ErrSchemeNotAllowed, u.Scheme)
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return fmt.Errorf("%w: no host", ErrHostNotAllowed)
+	}
+	if u.User != nil {
+		return fmt.Errorf("%w: credentials in URL", ErrHostNotAllowed)
+	}
+	if len(f.cfg.Hosts) > 0 && !hostAllowed(f.cfg.Hosts, host) {
+		return fmt.Errorf("%w: %s", ErrHostNotAllowed, host)
+	}
+	// Refuse literal addresses early rather than at connection
+	if ip, err := netip.ParseAddr(host); err == nil && !f.addressAllowed(ip) {
+		return fmt.Errorf("%w: %s", ErrAddressNotAllowed, ip)
+	}
+	return nil
+}
+
+// Download writes the file at rawURL to w and returns its size, failing once it
+// exceeds MaxBytes. progress may be nil
+func (f *Fetcher) Download(ctx context.Context, rawURL string, w io.Writer, progress ProgressFunc) (int64, error) {
+	if err := f.Check(rawURL); err != nil {
+		return 0, err
+	}
+	if f.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.cfg.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	response, err := f.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+	if f.cfg.MaxBytes > 0 && response.ContentLength > f.cfg.MaxBytes {
+		return 0, ErrTooLarge
+	}
+
+	var body io.Reader = response.Body
+	if f.cfg.MaxBytes > 0 {
+		body = io.LimitReader(body, f.cfg.MaxBytes+1)
+	}
+	if progress != nil {
+		body = &progressReader{r: body, total: response.ContentLength, progress: progress}
+	}
+
+	n, err := io.Copy(w, body)
+	if err != nil {
+		return n, err
+	}
+	if f.cfg.MaxBytes > 0 && n > f.cfg.MaxBytes {
+		return n, ErrTooLarge
+	}
+	return n, nil
+}
+
+// control rejects connections to addresses that are not allowed, it runs after
+// DNS resolution for every address tried
+func (f *Fetcher) control(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !f.addressAllowed(ip) {
+		return fmt.Errorf("%w: %s", ErrAddressNotAllowed, ip)
+	}
+	return nil
+}
+
+func (f *Fetcher) addressAllowed(ip netip.Addr) bool {
+	return f.cfg.AllowPrivate || IsPublic(ip)
+}
+
+// IsPublic reports whether ip is a globally reachable unicast address
+func IsPublic(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func hostAllowed(hosts []string, host string) bool {
+	for _, allowed := range hosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// progressReader calls progress as its reader is read
+type progressReader struct {
+	r        io.Reader
+	read     int64
+	total    int64
+	progress ProgressFunc
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	r.progress(r.read, r.total)
+	return n, err
+}
@@ -25,6 +25,10 @@ func CreateAccessCode(c *gin.Context) {
 
 	// Insert the access code into MongoDB
 	_, err := db.DB.Collection(CollectionNameAccessCodes).InsertOne(c.Request.Context(), accessCode)
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Access code already exists"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
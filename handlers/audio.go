@@ -5,30 +5,28 @@ package handlers
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
-	"main/db"
+	"main/auth"
+	"main/credits"
+	"main/events"
+	"main/jobs"
 	"main/models"
-	"main/utils"
+	"main/repo"
+	"main/tts"
 	"net/http"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
-var collectionNameSlideImages = "slide_images"
+var errGeneratedTextNotFound = errors.New("generated text not found")
 
-func GenerateAudio(c *gin.Context) {
+func (d *Deps) GenerateAudio(c *gin.Context) {
 	// Get request body
 	var request models.AudioRequest
 	if err := c.ShouldBindJSON(&request); err != nil {
@@ -55,10 +53,9 @@ func GenerateAudio(c *gin.Context) {
 	}
 
 	// Find slide image
-	var slideImage bson.M
-	slideImageResult := db.DB.Collection(collectionNameSlideImages).FindOne(ctx, bson.M{"_id": objID})
-	if err := slideImageResult.Decode(&slideImage); err != nil {
-		if err == mongo.ErrNoDocuments {
+	slideImage, err := d.SlideImages.Get(ctx, objID)
+	if err != nil {
+		if err == repo.ErrNotFound {
 			log.Println("Slide Image not found")
 			c.JSON(http.StatusNotFound, gin.H{"error": "Slide Image not found"})
 		} else {
@@ -68,121 +65,100 @@ func GenerateAudio(c *gin.Context) {
 		return
 	}
 
-	// Get generated text
-	generatedText, ok := slideImage["generated_text"].(string)
-	if !ok {
+	if slideImage.GeneratedText == "" {
 		log.Println("Generated text not found")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Generated text not found"})
 		return
 	}
+	slideID := slideImage.SlideID
 
 	// Check if audio URL already exists
-	audioURL, ok := slideImage["audio_url"].(string)
-	if ok && audioURL != "" && !request.Update {
+	if hasAudio(slideImage) && !request.Update {
 		log.Println("Audio URL already exists")
+		audioURL, err := d.fileURL(ctx, slideImage.AudioKey, slideImage.AudioURL)
+		if err != nil {
+			log.Println("Error presigning audio URL")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error presigning audio URL"})
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{"status": "success", "data": audioURL, "status_code": http.StatusOK})
 		return
 	}
 
-	// Generate audio file
-	log.Println("Generating audio file")
-	voice := "aura-athena-en"
-	url := fmt.Sprintf("https://api.deepgram.com/v1/speak?model=%s", voice)
-	headers := map[string]string{
-		"Content-Type":  "application/json",
-		"Authorization": fmt.Sprintf("Token %s", utils.DEEPGRAM_API_KEY),
-	}
-	data := map[string]string{
-		"text": generatedText,
-	}
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		log.Println("Error preparing request data")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error preparing request data"})
-		return
-	}
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		log.Println("Error creating request")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating request"})
-		return
-	}
-	for k, v := range headers {
-		req.Header.Set(k, v)
-	}
-
-	client := &http.Client{}
-	response, err := client.Do(req)
+	// This endpoint has always spoken with Deepgram
+	opts := d.resolveVoice(ctx, auth.UserID(c), slideID, tts.Options{Provider: tts.ProviderDeepgram})
+	audioKey, err := d.synthesizeSlideImageAudio(ctx, slideImage, opts)
 	if err != nil {
-		log.Println("Error sending request")
+		log.Println(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	defer response.Body.Close()
 
-	if response.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(response.Body)
-		log.Println("Error generating audio file")
-		c.JSON(response.StatusCode, gin.H{"error": string(body)})
-		return
-	}
+	log.Println("Slide image updated with audio key", audioKey)
 
-	log.Println("Audio file generated")
-
-	// Read audio content
-	audioBlob, err := io.ReadAll(response.Body)
-	if err != nil {
-		log.Println("Error reading audio response")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading audio response"})
-		return
-	}
-	log.Println("Audio generated")
-
-	// Upload audio to S3
-	fileName := generateFileName()
-	awsPath := fmt.Sprintf("slides/%s/audio/%s.mp3", slideImage["slide_id"].(string), fileName)
-	s3session := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(utils.AWS_REGION),
-	}))
-
-	uploader := s3.New(s3session)
-	_, err = uploader.PutObject(&s3.PutObjectInput{
-		Bucket:      aws.String(utils.AWS_BUCKET_NAME),
-		Key:         aws.String(awsPath),
-		Body:        bytes.NewReader(audioBlob),
-		ContentType: aws.String("audio/mpeg"),
-	})
+	audioURL, err := d.presignKey(ctx, audioKey)
 	if err != nil {
-		log.Println("Error uploading audio to S3")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error uploading audio to S3"})
+		log.Println("Error presigning audio URL")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error presigning audio URL"})
 		return
 	}
 
-	log.Println("Audio uploaded to S3")
+	c.JSON(http.StatusOK, gin.H{"status": "success", "data": audioURL, "status_code": http.StatusOK})
+}
+
+// hasAudio reports whether a slide image has been narrated
+func hasAudio(slideImage *models.SlideImage) bool {
+	return slideImage.AudioKey != "" || slideImage.AudioURL != ""
+}
 
-	// Generate audio URL
-	audioURL = fmt.Sprintf("https://%s.s3.amazonaws.com/%s", utils.AWS_BUCKET_NAME, awsPath)
+func generateFileName() string {
+	return uuid.New().String()
+}
 
-	// Update slide image with audio URL
-	_, err = db.DB.Collection(collectionNameSlideImages).UpdateOne(ctx, bson.M{"_id": objID}, bson.M{"$set": bson.M{"audio_url": audioURL}})
+// uploadAudio uploads the audio of a slide to storage and returns its key
+func (d *Deps) uploadAudio(ctx context.Context, slideID string, audio *tts.Audio) (string, error) {
+	key := fmt.Sprintf("slides/%s/audio/%s.%s", slideID, generateFileName(), audio.Format)
+	err := d.Storage.Put(ctx, key, bytes.NewReader(audio.Data), audio.ContentType())
 	if err != nil {
-		log.Println("Error updating slide image")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating slide image"})
-		return
+		return "", err
 	}
+	return key, nil
+}
 
-	log.Println("Slide image updated with audio URL", audioURL)
+// setSlideImageAudio stores the audio key, chunk and caption timings on a slide image,
+// replacing any legacy audio URL
+func (d *Deps) setSlideImageAudio(ctx context.Context, slideImageID primitive.ObjectID, audioKey string, narration *tts.Narration) error {
+	chunks := make([]models.AudioChunk, len(narration.Chunks))
+	for i, chunk := range narration.Chunks {
+		chunks[i] = models.AudioChunk{
+			Text:       chunk.Text,
+			StartMS:    chunk.Start.Milliseconds(),
+			DurationMS: chunk.Duration.Milliseconds(),
+		}
+	}
 
-	c.JSON(http.StatusOK, gin.H{"status": "success", "data": audioURL, "status_code": http.StatusOK})
-}
+	set := bson.M{
+		"audio_key":         audioKey,
+		"audio_chunks":      chunks,
+		"audio_duration_ms": narration.Duration.Milliseconds(),
+	}
+	unset := bson.M{"audio_url": ""}
+	// Timings can only be estimated when the duration of the audio is known
+	if narration.Duration > 0 {
+		set["captions"] = captions(narration.Sentences)
+	} else {
+		unset["captions"] = ""
+	}
 
-func generateFileName() string {
-	return uuid.New().String()
+	_, err := d.SlideImages.UpdateOne(ctx, repo.ByID(slideImageID), bson.M{
+		"$set":   set,
+		"$unset": unset,
+	})
+	return err
 }
 
 // GenerateAudio2 is the updated version of GenerateAudio
-func GenerateAudio2(c *gin.Context) {
+func (d *Deps) GenerateAudio2(c *gin.Context) {
 	slideImageID := c.Param("slide_image_id")
 	if slideImageID == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Slide image ID is required"})
@@ -208,10 +184,9 @@ func GenerateAudio2(c *gin.Context) {
 		return
 	}
 
-	var slideImage bson.M
-	slideImageResult := db.DB.Collection(collectionNameSlideImages).FindOne(ctx, bson.M{"_id": objID})
-	if err := slideImageResult.Decode(&slideImage); err != nil {
-		if err == mongo.ErrNoDocuments {
+	slideImage, err := d.SlideImages.Get(ctx, objID)
+	if err != nil {
+		if err == repo.ErrNotFound {
 			log.Println("Slide Image not found")
 			c.JSON(http.StatusNotFound, gin.H{"error": "Slide Image not found"})
 		} else {
@@ -221,129 +196,58 @@ func GenerateAudio2(c *gin.Context) {
 		return
 	}
 
-	generatedText, ok := slideImage["generated_text"].(string)
-	if !ok {
+	if slideImage.GeneratedText == "" {
 		log.Println("Generated text not found")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Generated text not found"})
 		return
 	}
 
-	c.Writer.Header().Set("Content-Type", "text/event-stream")
-	c.Writer.Header().Set("Cache-Control", "no-cache")
-	c.Writer.Header().Set("Connection", "keep-alive")
-	c.Writer.Flush()
-
-	audioURL, ok := slideImage["audio_url"].(string)
-	if ok && audioURL != "" && update == "false" {
-		log.Println("Audio URL already exists")
-		responseMap := map[string]interface{}{
-			"status":      "success",
-			"data":        audioURL,
-			"status_code": http.StatusOK,
-		}
-		finalResponse, _ := json.Marshal(responseMap)
-		fmt.Fprintf(c.Writer, "data: %s\n\n", string(finalResponse))
-		c.Writer.Flush()
-	}
-
-	sendSSE := func(message string) {
-		fmt.Fprintf(c.Writer, "data: %s\n\n", message)
-		c.Writer.Flush()
-	}
-
-	sendSSE("Generating audio file")
-
-	voice := "alloy"
-	url := "https://api.openai.com/v1/audio/speech"
-	headers := map[string]string{
-		"Content-Type":  "application/json",
-		"Authorization": fmt.Sprintf("Bearer %s", utils.OPENAI_API_KEY),
-	}
-	data := map[string]interface{}{
-		"model": "tts-1",
-		"input": generatedText,
-		"voice": voice,
-		"speed": 1,
-	}
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		sendSSE("Error preparing request data")
-		return
-	}
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		sendSSE("Error creating request")
-		return
-	}
-	for k, v := range headers {
-		req.Header.Set(k, v)
-	}
-	client := &http.Client{}
-	response, err := client.Do(req)
+	override, err := d.voiceQuery(c)
 	if err != nil {
-		sendSSE("Error sending request")
-		return
-	}
-	defer response.Body.Close()
-	if response.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(response.Body)
-		sendSSE(fmt.Sprintf("Error generating audio file: %s", string(body)))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	sendSSE("Audio file generated")
+	slideID := slideImage.SlideID
+	opts := d.resolveVoice(ctx, auth.UserID(c), slideID, override)
 
-	audioBlob, err := io.ReadAll(response.Body)
-	if err != nil {
-		sendSSE("Error reading audio response")
-		return
+	// Returning the existing audio is free
+	cost := operationCost{operation: credits.OpGenerateAudio, units: 1, reference: slideImageID}
+	if hasAudio(slideImage) && update == "false" {
+		cost = operationCost{}
 	}
-	sendSSE("Audio generated")
-
-	fileName := generateFileName()
-	awsPath := fmt.Sprintf("slides/%s/audio/%s.mp3", slideImage["slide_id"].(string), fileName)
-	s3session := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(utils.AWS_REGION),
-	}))
-	uploader := s3.New(s3session)
-	_, err = uploader.PutObject(&s3.PutObjectInput{
-		Bucket:      aws.String(utils.AWS_BUCKET_NAME),
-		Key:         aws.String(awsPath),
-		Body:        bytes.NewReader(audioBlob),
-		ContentType: aws.String("audio/mpeg"),
-	})
-	if err != nil {
-		sendSSE("Error uploading audio to S3")
-		return
-	}
-	sendSSE("Audio uploaded to S3")
 
-	audioURL = fmt.Sprintf("https://%s.s3.amazonaws.com/%s", utils.AWS_BUCKET_NAME, awsPath)
-	_, err = db.DB.Collection(collectionNameSlideImages).UpdateOne(ctx, bson.M{"_id": objID}, bson.M{"$set": bson.M{"audio_url": audioURL}})
-	if err != nil {
-		sendSSE("Error updating slide image")
-		return
-	}
-	sendSSE("Slide image updated with audio URL")
+	d.runOperation(c, "generate-audio:"+slideImageID, 4*time.Minute, cost, func(ctx context.Context, emitter events.Emitter) (bson.M, error) {
+		if hasAudio(slideImage) && update == "false" {
+			log.Println("Audio URL already exists")
+			audioURL, err := d.fileURL(ctx, slideImage.AudioKey, slideImage.AudioURL)
+			if err != nil {
+				return nil, fmt.Errorf("error presigning audio URL")
+			}
+			return bson.M{"status": "success", "data": audioURL, "status_code": http.StatusOK}, nil
+		}
 
-	responseMap := map[string]interface{}{
-		"status":      "success",
-		"data":        audioURL,
-		"status_code": http.StatusOK,
-	}
-	finalResponse, _ := json.Marshal(responseMap)
-	fmt.Fprintf(c.Writer, "data: %s\n\n", string(finalResponse))
-	c.Writer.Flush()
+		emitter.Progress(0, 2, "Generating audio file")
+		audioKey, err := d.synthesizeSlideImageAudio(ctx, slideImage, opts)
+		if err != nil {
+			return nil, err
+		}
+		emitter.Progress(1, 2, "Slide image updated with audio URL")
+
+		audioURL, err := d.presignKey(ctx, audioKey)
+		if err != nil {
+			return nil, fmt.Errorf("error presigning audio URL")
+		}
+		emitter.Progress(2, 2, "Audio ready")
+
+		return bson.M{"status": "success", "data": audioURL, "status_code": http.StatusOK}, nil
+	})
 }
 
-// GenerateAllAudioForSlide generates audio files for a given slide ID
-func GenerateAllAudioForSlide(c *gin.Context) {
+// GenerateAllAudioForSlide enqueues a job generating audio files for a given slide ID
+func (d *Deps) GenerateAllAudioForSlide(c *gin.Context) {
 	// Get slide ID from request parameters
 	slideID := c.Param("slide_id")
 
-	// Find slide images by slide ID
-	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
-	defer cancel()
-
 	_, err := primitive.ObjectIDFromHex(slideID)
 	if err != nil {
 		log.Println("Invalid slide ID")
@@ -351,130 +255,51 @@ func GenerateAllAudioForSlide(c *gin.Context) {
 		return
 	}
 
-	slideImagesCursor, err := db.DB.Collection(collectionNameSlideImages).Find(ctx, bson.M{"slide_id": slideID})
+	override, err := d.voiceQuery(c)
 	if err != nil {
-		log.Println("Error finding slide images")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error finding slide images"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	defer slideImagesCursor.Close(ctx)
+	d.enqueueJob(c, JobTypeGenerateAllAudio, voiceParams(map[string]string{"slide_id": slideID}, override))
+}
 
-	for slideImagesCursor.Next(ctx) {
-		var slideImage bson.M
-		err := slideImagesCursor.Decode(&slideImage)
-		if err != nil {
-			log.Println("Error decoding slide image")
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error decoding slide image"})
-			return
+// generateAllAudioJob generates audio files for every slide image of a slide that does not have one yet
+func (d *Deps) generateAllAudioJob(ctx context.Context, job *models.Job, report jobs.ReportFunc) (bson.M, error) {
+	slideID := job.Params["slide_id"]
+	opts := d.resolveVoice(ctx, job.UserID, slideID, voiceFromParams(job.Params))
+
+	// Find slide images by slide ID
+	slideImages, err := d.findSlideImagesBySlideID(slideID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, slideImage := range slideImages {
+		if err := ctx.Err(); err != nil {
+			return nil, err
 		}
 
-		order := slideImage["order"].(int32)
+		order := slideImage.Order
 		log.Printf("Generating audio for slide image with order %d", order)
 
 		// Check if audio URL already exists
-		audioURL, ok := slideImage["audio_url"].(string)
-		if ok && audioURL != "" {
+		if hasAudio(&slideImage) {
 			log.Println("Audio URL already exists")
+			report(i+1, len(slideImages), fmt.Sprintf("Audio already exists for slide order %d", order))
 			continue
 		}
 
 		// Generate audio for slide image
-		err = generateAudioForSlideImage(ctx, slideImage)
+		report(i, len(slideImages), fmt.Sprintf("Generating audio for slide order %d", order))
+		_, err = d.synthesizeSlideImageAudio(ctx, &slideImage, opts)
 		if err != nil {
 			log.Println("Error generating audio for slide image")
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating audio for slide image"})
-			return
+			return nil, fmt.Errorf("error generating audio for slide order %d: %v", order, err)
 		}
+		d.completeUnit(job)
+		report(i+1, len(slideImages), fmt.Sprintf("Generated audio for slide order %d", order))
 	}
 
 	log.Println("Audio generated for all slide images")
-	c.JSON(http.StatusOK, gin.H{"status": "success", "message": "Audio generated for all slide images"})
-}
-
-// GenerateAudioForSlideImage generates audio file for a given slide image
-func generateAudioForSlideImage(ctx context.Context, slideImage bson.M) error {
-	// Get generated text
-	generatedText, ok := slideImage["generated_text"].(string)
-	if !ok {
-		log.Println("Generated text not found")
-		return errors.New("generated text not found")
-	}
-
-	// Generate audio file
-	log.Println("Generating audio file")
-	voice := "alloy"
-	url := "https://api.openai.com/v1/audio/speech"
-	headers := map[string]string{
-		"Content-Type":  "application/json",
-		"Authorization": fmt.Sprintf("Bearer %s", utils.OPENAI_API_KEY),
-	}
-	data := map[string]interface{}{
-		"model": "tts-1",
-		"input": generatedText,
-		"voice": voice,
-		"speed": 1,
-	}
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		log.Println("Error preparing request data")
-		return errors.New("error preparing request data")
-	}
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		log.Println("Error creating request")
-		return errors.New("error creating request")
-	}
-	for k, v := range headers {
-		req.Header.Set(k, v)
-	}
-	client := &http.Client{}
-	response, err := client.Do(req)
-	if err != nil {
-		log.Println("Error sending request")
-		return errors.New("error sending request")
-	}
-	defer response.Body.Close()
-	if response.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(response.Body)
-		log.Println("Error generating audio file")
-		return fmt.Errorf("error generating audio file: %s", string(body))
-	}
-	log.Println("Audio file generated")
-	// Read audio content
-	audioBlob, err := io.ReadAll(response.Body)
-	if err != nil {
-		log.Println("Error reading audio response")
-		return errors.New("error reading audio response")
-	}
-	log.Println("Audio generated")
-	// Upload audio to S3
-	fileName := generateFileName()
-	awsPath := fmt.Sprintf("slides/%s/audio/%s.mp3", slideImage["slide_id"].(string), fileName)
-	s3session := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(utils.AWS_REGION),
-	}))
-	uploader := s3.New(s3session)
-	_, err = uploader.PutObject(&s3.PutObjectInput{
-		Bucket:      aws.String(utils.AWS_BUCKET_NAME),
-		Key:         aws.String(awsPath),
-		Body:        bytes.NewReader(audioBlob),
-		ContentType: aws.String("audio/mpeg"),
-	})
-	if err != nil {
-		log.Println("Error uploading audio to S3")
-		return errors.New("error uploading audio to S3")
-	}
-	log.Println("Audio uploaded to S3")
-	// Generate audio URL
-	audioURL := fmt.Sprintf("https://%s.s3.amazonaws.com/%s", utils.AWS_BUCKET_NAME, awsPath)
-	log.Println("Audio URL:", audioURL)
-	// Update slide image with audio URL
-	_, err = db.DB.Collection(collectionNameSlideImages).UpdateOne(ctx, bson.M{"_id": slideImage["_id"]}, bson.M{"$set": bson.M{"audio_url": audioURL}})
-	if err != nil {
-		log.Println("Error updating slide image", err)
-		return errors.New("error updating slide image")
-	}
-
-	log.Println("Slide image updated with audio URL")
-	return nil
+	return bson.M{"total_images": len(slideImages)}, nil
 }
@@ -0,0 +1,284 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"main/auth"
+	"main/db"
+	"main/repo"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var errInvalidID = errors.New("invalid ID")
+var errNotFound = errors.New("not found")
+
+// spaceResolver returns the ID of the space a resource belongs to
+type spaceResolver func(ctx context.Context, id string) (string, error)
+
+// findField returns a string field of a document by its hex ID, documents in the
+// trash are not found
+func findField(ctx context.Context, collection string, id string, field string) (string, error) {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return "", errInvalidID
+	}
+
+	var doc bson.M
+	err = db.DB.Collection(collection).FindOne(ctx, notTrashed(bson.M{"_id": objID})).Decode(&doc)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return "", errNotFound
+		}
+		return "", err
+	}
+
+	value, _ := doc[field].(string)
+	return value, nil
+}
+
+// findLive returns a document of r by its hex ID, documents in the trash are
+// not found
+func findLive[T any](ctx context.Context, r repo.Repository[T], id string) (*T, error) {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, errInvalidID
+	}
+	doc, err := r.FindOne(ctx, notTrashed(repo.ByID(objID)))
+	if err == repo.ErrNotFound {
+		return nil, errNotFound
+	}
+	return doc, err
+}
+
+// spaceOfSpace resolves a space to itself after checking it exists
+func (d *Deps) spaceOfSpace(ctx context.Context, id string) (string, error) {
+	if _, err := findLive(ctx, d.Spaces, id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (d *Deps) spaceOfSlide(ctx context.Context, id string) (string, error) {
+	slide, err := findLive(ctx, d.Slides, id)
+	if err != nil {
+		return "", err
+	}
+	return slide.SpaceID, nil
+}
+
+func (d *Deps) spaceOfSlideImage(ctx context.Context, id string) (string, error) {
+	slideImage, err := findLive(ctx, d.SlideImages, id)
+	if err != nil {
+		return "", err
+	}
+	return d.spaceOfSlide(ctx, slideImage.SlideID)
+}
+
+func (d *Deps) spaceOfQuizQuestion(ctx context.Context, id string) (string, error) {
+	question, err := findLive(ctx, d.QuizQuestions, id)
+	if err != nil {
+		return "", err
+	}
+	return d.spaceOfSlide(ctx, question.SlideID)
+}
+
+func (d *Deps) spaceOfFlashcard(ctx context.Context, id string) (string, error) {
+	flashcard, err := findLive(ctx, d.Flashcards, id)
+	if err != nil {
+		return "", err
+	}
+	return d.spaceOfSlide(ctx, flashcard.SlideID)
+}
+
+// userSpaceIDs returns the IDs of the spaces owned by a user
+func (d *Deps) userSpaceIDs(ctx context.Context, userID string) ([]string, error) {
+	spaceIDs := []string{}
+	user, err := d.Users.FindOne(ctx, bson.M{"user_id": userID})
+	if err != nil && err != repo.ErrNotFound {
+		return nil, err
+	}
+	if user != nil {
+		spaceIDs = append(spaceIDs, user.SpaceIDs...)
+	}
+
+	created, err := d.Spaces.IDs(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range created {
+		spaceIDs = append(spaceIDs, id.Hex())
+	}
+	return spaceIDs, nil
+}
+
+// userOwnsSpace reports whether a user owns a space, either because they created
+// it or because it is in their list of spaces
+func (d *Deps) userOwnsSpace(ctx context.Context, userID string, spaceID string) (bool, error) {
+	if spaceID == "" {
+		return false, nil
+	}
+	spaceIDs, err := d.userSpaceIDs(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	for _, id := range spaceIDs {
+		if id == spaceID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// canAccessSpace reports whether the caller is an admin or owns spaceID, spaces
+// in the trash are not found
+func (d *Deps) canAccessSpace(c *gin.Context, spaceID string) (bool, error) {
+	if trashed, err := d.spaceTrashed(c.Request.Context(), spaceID); err != nil || trashed {
+		if err == nil {
+			err = errNotFound
+		}
+		return false, err
+	}
+	if auth.IsAdmin(c) {
+		return true, nil
+	}
+	return d.userOwnsSpace(c.Request.Context(), auth.UserID(c), spaceID)
+}
+
+// respondAuthzError responds to an error of a spaceResolver
+func respondAuthzError(c *gin.Context, err error) {
+	switch err {
+	case errInvalidID:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+	case errNotFound:
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Not found"})
+	default:
+		log.Println("Error checking ownership", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Error checking ownership"})
+	}
+}
+
+// requireOwner is a gin middleware that only lets through admins and owners of the
+// space the resource identified by param belongs to
+func (d *Deps) requireOwner(param string, spaceOf spaceResolver) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		spaceID, err := spaceOf(c.Request.Context(), c.Param(param))
+		if err != nil {
+			respondAuthzError(c, err)
+			return
+		}
+
+		ok, err := d.canAccessSpace(c, spaceID)
+		if err != nil {
+			respondAuthzError(c, err)
+			return
+		}
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// requireSelf is a gin middleware that only lets through admins and the user
+// whose ID is in param
+func requireSelf(param string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !auth.IsAdmin(c) && c.Param(param) != auth.UserID(c) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// requireJobOwner is a gin middleware that only lets through admins and the user
+// who created the job identified by param
+func requireJobOwner(param string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := findField(c.Request.Context(), "jobs", c.Param(param), "user_id")
+		if err != nil {
+			respondAuthzError(c, err)
+			return
+		}
+		if !auth.IsAdmin(c) && userID != auth.UserID(c) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// accessibleSpaceIDs returns the IDs of the spaces the caller can access, or nil
+// for admins who can access every space
+func (d *Deps) accessibleSpaceIDs(c *gin.Context) ([]string, error) {
+	if auth.IsAdmin(c) {
+		return nil, nil
+	}
+	spaceIDs, err := d.userSpaceIDs(c.Request.Context(), auth.UserID(c))
+	if err != nil {
+		return nil, err
+	}
+	if spaceIDs == nil {
+		spaceIDs = []string{}
+	}
+	return spaceIDs, nil
+}
+
+// slideFilter restricts a slides query to the spaces the caller can access,
+// leaving out the trash
+func (d *Deps) slideFilter(c *gin.Context) (bson.M, error) {
+	spaceIDs, err := d.accessibleSpaceIDs(c)
+	if err != nil {
+		return nil, err
+	}
+	trashed, err := d.trashedSpaceIDs(c.Request.Context())
+	if err != nil {
+		return nil, err
+	}
+	spaceCondition := bson.M{"$nin": trashed}
+	if spaceIDs != nil {
+		spaceCondition["$in"] = spaceIDs
+	}
+	return notTrashed(bson.M{"space_id": spaceCondition}), nil
+}
+
+// spaceFilter restricts a spaces query to the spaces the caller can access,
+// leaving out the trash
+func (d *Deps) spaceFilter(c *gin.Context) (bson.M, error) {
+	spaceIDs, err := d.accessibleSpaceIDs(c)
+	if err != nil {
+		return nil, err
+	}
+	if spaceIDs == nil {
+		return notTrashed(bson.M{}), nil
+	}
+	objIDs := []primitive.ObjectID{}
+	for _, id := range spaceIDs {
+		if objID, err := primitive.ObjectIDFromHex(id); err == nil {
+			objIDs = append(objIDs, objID)
+		}
+	}
+	return notTrashed(bson.M{"_id": bson.M{"$in": objIDs}}), nil
+}
+
+// requireSpaceAccess responds with 403 and returns false when the caller cannot
+// access spaceID
+func (d *Deps) requireSpaceAccess(c *gin.Context, spaceID string) bool {
+	ok, err := d.canAccessSpace(c, spaceID)
+	if err != nil {
+		respondAuthzError(c, err)
+		return false
+	}
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+		return false
+	}
+	return true
+}
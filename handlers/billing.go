@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"log"
+	"main/auth"
+	"main/billing"
+	"main/models"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Stripe recommends accepting webhook payloads up to 64KB, larger ones are
+// refused rather than cut short
+const maxWebhookBytes = 65536
+
+// GetBillingProducts lists the credit packs and plans that can be bought
+func GetBillingProducts(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "success", "data": billing.Products()})
+}
+
+// CreateCheckout creates a Stripe Checkout Session for the caller to buy a
+// credit pack or subscribe to a plan, the client redirects to the returned URL
+func CreateCheckout(c *gin.Context) {
+	log.Println("*** /billing/checkout ***")
+
+	var request models.CheckoutRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	session, err := billing.CreateCheckout(c.Request.Context(), auth.UserID(c), request.ProductID)
+	if err != nil {
+		if errors.Is(err, billing.ErrUnknownProduct) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown product"})
+			return
+		}
+		log.Println("Error creating checkout session", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Error creating checkout session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "success", "data": gin.H{"id": session.ID, "url": session.URL}})
+}
+
+// StripeWebhook receives Stripe events, it answers 2xx once an event is applied
+// so Stripe retries the ones that failed
+func StripeWebhook(c *gin.Context) {
+	payload, err := io.ReadAll(io.LimitReader(c.Request.Body, maxWebhookBytes+1))
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Error reading body"})
+		return
+	}
+	if len(payload) > maxWebhookBytes {
+		log.Println("Stripe webhook payload is too large")
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Payload too large"})
+		return
+	}
+
+	event, err := billing.ConstructEvent(payload, c.GetHeader("Stripe-Signature"))
+	if err != nil {
+		log.Println("Invalid Stripe webhook", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid signature"})
+		return
+	}
+
+	if err := billing.HandleEvent(c.Request.Context(), event); err != nil {
+		if errors.Is(err, billing.ErrEventInProgress) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		log.Println("Error handling Stripe event", event.ID, event.Type, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error handling event"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"received": true})
+}
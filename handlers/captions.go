@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"main/models"
+	"main/repo"
+	"main/tts"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// captions converts the sentence timings of a narration to captions
+func captions(sentences []tts.Sentence) []models.Caption {
+	result := make([]models.Caption, len(sentences))
+	for i, sentence := range sentences {
+		caption := models.Caption{
+			Text:    sentence.Text,
+			StartMS: sentence.Start.Milliseconds(),
+			EndMS:   sentence.End.Milliseconds(),
+		}
+		for _, word := range sentence.Words {
+			caption.Words = append(caption.Words, models.WordTiming{
+				Text:    word.Text,
+				StartMS: word.Start.Milliseconds(),
+				EndMS:   word.End.Milliseconds(),
+			})
+		}
+		result[i] = caption
+	}
+	return result
+}
+
+// GetSlideImageCaptions returns the sentence and word timings of the narration
+// of a slide image as JSON, or as WebVTT with ?format=vtt
+func (d *Deps) GetSlideImageCaptions(c *gin.Context) {
+	log.Println("GetSlideImageCaptions")
+
+	objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid slide image ID"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	slideImage, err := d.SlideImages.Get(ctx, objID)
+	if err != nil {
+		if err == repo.ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Slide Image not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	if len(slideImage.Captions) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No captions, regenerate the audio of this slide image"})
+		return
+	}
+
+	switch c.Query("format") {
+	case "vtt":
+		c.Data(http.StatusOK, "text/vtt; charset=utf-8", []byte(webVTT(slideImage.Captions, c.Query("words") == "true")))
+	case "", "json":
+		c.JSON(http.StatusOK, gin.H{
+			"slide_image_id": slideImage.ID,
+			"duration_ms":    slideImage.AudioDurationMS,
+			"captions":       slideImage.Captions,
+		})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or vtt"})
+	}
+}
+
+// webVTT writes one cue per sentence, with a timestamp tag before every word
+// if words is set
+func webVTT(captions []models.Caption, words bool) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for i, caption := range captions {
+		fmt.Fprintf(&b, "\n%d\n%s --> %s\n", i+1, vttTimestamp(caption.StartMS), vttTimestamp(caption.EndMS))
+		if !words || len(caption.Words) == 0 {
+			b.WriteString(vttEscape(caption.Text))
+		} else {
+			for j, word := range caption.Words {
+				if j > 0 {
+					fmt.Fprintf(&b, " <%s>", vttTimestamp(word.StartMS))
+				}
+				b.WriteString(vttEscape(word.Text))
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func vttTimestamp(ms int64) string {
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+var vttEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func vttEscape(text string) string {
+	return vttEscaper.Replace(text)
+}
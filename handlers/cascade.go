@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"main/models"
+	"main/repo"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// byIDMatching filters a document by ID that also matches the conditions in match
+func byIDMatching(id primitive.ObjectID, match bson.M) bson.M {
+	filter := repo.ByID(id)
+	for key, value := range match {
+		filter[key] = value
+	}
+	return filter
+}
+
+// deleteSlideCascade deletes a slide document along with its slide images,
+// quiz questions and flashcards, then the files of all of them. Documents go
+// first, so a failure leaves at most orphaned files for the garbage collector.
+// Nothing is deleted unless the slide still matches the conditions in match, if
+// any
+func (d *Deps) deleteSlideCascade(ctx context.Context, slide *models.Slide, match bson.M) error {
+	slideID := slide.ID.Hex()
+
+	slideImages, err := d.findSlideImagesBySlideID(slideID)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := d.Slides.DeleteOne(ctx, byIDMatching(slide.ID, match))
+	if err != nil {
+		return fmt.Errorf("error deleting slide: %v", err)
+	}
+	if deleted == 0 {
+		return errSlideNotFound
+	}
+
+	bySlide := bson.M{"slide_id": slideID}
+	if _, err := d.SlideImages.DeleteMany(ctx, bySlide); err != nil {
+		return fmt.Errorf("error deleting slide images of slide: %v", err)
+	}
+	if _, err := d.QuizQuestions.DeleteMany(ctx, bySlide); err != nil {
+		return fmt.Errorf("error deleting quiz questions of slide: %v", err)
+	}
+	if _, err := d.Flashcards.DeleteMany(ctx, bySlide); err != nil {
+		return fmt.Errorf("error deleting flashcards of slide: %v", err)
+	}
+
+	d.deleteFile(slide.PDFKey, slide.PDFURL)
+	d.deleteFile(slide.AudioExportKey, "")
+	for _, key := range slide.ImageSourceKeys {
+		d.deleteStorageKey(key)
+	}
+	d.deleteSlideImageFiles(slideImages)
+
+	log.Printf("Deleted slide %s with %d slide images", slideID, len(slideImages))
+	return nil
+}
+
+// deleteSpaceCascade deletes a space along with its slides, and removes it from
+// the spaces of every user. It returns repo.ErrNotFound if there is no such space
+// or it no longer matches the conditions in match
+func (d *Deps) deleteSpaceCascade(ctx context.Context, spaceID string, match bson.M) error {
+	objID, err := primitive.ObjectIDFromHex(spaceID)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := d.Spaces.DeleteOne(ctx, byIDMatching(objID, match))
+	if err != nil {
+		return fmt.Errorf("error deleting space: %v", err)
+	}
+	if deleted == 0 {
+		return repo.ErrNotFound
+	}
+
+	if _, err := d.Users.UpdateMany(ctx, bson.M{"space_ids": spaceID}, bson.M{
+		"$pull": bson.M{"space_ids": spaceID},
+	}); err != nil {
+		return fmt.Errorf("error removing space from users: %v", err)
+	}
+
+	slides, err := d.Slides.Find(ctx, bson.M{"space_id": spaceID}, nil)
+	if err != nil {
+		return fmt.Errorf("error finding slides of space: %v", err)
+	}
+	for i := range slides {
+		if err := d.deleteSlideCascade(ctx, &slides[i], nil); err != nil && err != errSlideNotFound {
+			return err
+		}
+	}
+
+	log.Printf("Deleted space %s with %d slides", spaceID, len(slides))
+	return nil
+}
+
+// deleteUserCascade deletes a user along with the spaces they own: those they
+// created, and those in their list of spaces that have no creator and are not
+// listed by anyone else. The credit ledger is kept for accounting
+func (d *Deps) deleteUserCascade(ctx context.Context, userID string) error {
+	user, err := d.Users.FindOne(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		return err
+	}
+
+	spaceIDs, err := d.Spaces.IDs(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		return fmt.Errorf("error finding spaces of user: %v", err)
+	}
+	var owned []string
+	for _, id := range spaceIDs {
+		owned = append(owned, id.Hex())
+	}
+	for _, spaceID := range user.SpaceIDs {
+		space, err := findLive(ctx, d.Spaces, spaceID)
+		if err != nil || space.UserID != "" {
+			continue
+		}
+		shared, err := d.Users.Count(ctx, bson.M{"space_ids": spaceID, "user_id": bson.M{"$ne": userID}})
+		if err != nil {
+			return fmt.Errorf("error finding users of space: %v", err)
+		}
+		if shared == 0 {
+			owned = append(owned, spaceID)
+		}
+	}
+
+	if _, err := d.Users.DeleteOne(ctx, bson.M{"user_id": userID}); err != nil {
+		return fmt.Errorf("error deleting user: %v", err)
+	}
+	for _, spaceID := range owned {
+		if err := d.deleteSpaceCascade(ctx, spaceID, nil); err != nil && err != repo.ErrNotFound {
+			return err
+		}
+	}
+
+	log.Printf("Deleted user %s with %d spaces", userID, len(owned))
+	return nil
+}
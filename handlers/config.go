@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"main/auth"
+	"main/convert"
+	"main/db"
+	"main/events"
+	"main/fetch"
+	"main/jobs"
+	"main/llm"
+	"main/repo"
+	"main/tts"
+	"time"
+)
+
+// Config is what the handlers need from the server configuration
+type Config struct {
+	// "s3" or "local", the local driver serves files itself
+	StorageDriver string
+	PresignURLTTL time.Duration
+
+	PDFMaxPages int
+	PDFMaxBytes int64
+	PDFWorkers  int
+
+	RenderDPI      float64
+	RenderFormat   string
+	RenderQuality  int
+	ThumbnailWidth int
+
+	// How long deleted documents stay in the trash
+	TrashRetention time.Duration
+
+	// Audio routes are only set up when a text-to-speech provider is configured
+	Audio bool
+}
+
+// Deps holds the configuration and the services used by the handlers, which
+// are its methods. It is built at startup and passed to SetUpRoutes
+type Deps struct {
+	Config  Config
+	Storage db.BlobStore
+	*repo.Repositories
+	LLM       llm.Completer
+	TTS       *tts.Speaker
+	Events    events.EventLog
+	Jobs      *jobs.Queue
+	Fetcher   *fetch.Fetcher
+	Converter convert.Converter
+	Auth      *auth.Authenticator
+}
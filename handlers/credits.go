@@ -2,8 +2,10 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"log"
-	"main/db"
+	"main/auth"
+	"main/credits"
 	"main/models"
 	"net/http"
 	"strconv"
@@ -11,106 +13,205 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-// const credit values
+// Page size of the credit history
 const (
-	GENERATENOTESFORSLIDE = 1
-	GENERATEQUIZQUESTION  = 1
-	GENERATEAUDIO         = 2
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
 )
 
-func AddCredits(c *gin.Context) {
+func (d *Deps) AddCredits(c *gin.Context) {
 	log.Println("AddCredits")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	userID := c.Param("user_id")
-	amount := c.Param("amount")
 
 	// Parse amount as an integer
-	credits, err := strconv.Atoi(amount)
+	amount, err := strconv.Atoi(c.Param("amount"))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid amount"})
 		return
 	}
 
-	var user models.User
-
-	if err := db.DB.Collection(CollectionNameUsers).FindOne(ctx, bson.M{"user_id": userID}).Decode(&user); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	// Add credits to the user
-	user.Credits += credits
-
-	// Update the user in MongoDB
-	_, err = db.DB.Collection(CollectionNameUsers).UpdateOne(ctx, bson.M{"user_id": userID}, bson.M{"$set": bson.M{"credits": user.Credits}})
-
+	tx, err := credits.Grant(ctx, userID, amount, c.GetHeader("Idempotency-Key"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		d.respondCreditsError(c, tx, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Credits added successfully", "credits": user.Credits, "status_code": http.StatusOK})
+	c.JSON(http.StatusOK, gin.H{"message": "Credits added successfully", "credits": tx.BalanceAfter, "transaction": tx, "status_code": http.StatusOK})
 }
 
-func RemoveCredits(c *gin.Context) {
+func (d *Deps) RemoveCredits(c *gin.Context) {
 	log.Println("RemoveCredits")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	userID := c.Param("user_id")
-	amount := c.Param("amount")
 
 	// Parse amount as an integer
-	credits, err := strconv.Atoi(amount)
+	amount, err := strconv.Atoi(c.Param("amount"))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid amount"})
 		return
 	}
 
-	var user models.User
-
-	if err := db.DB.Collection(CollectionNameUsers).FindOne(ctx, bson.M{"user_id": userID}).Decode(&user); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	tx, err := credits.Deduct(ctx, userID, amount, c.GetHeader("Idempotency-Key"))
+	if err != nil {
+		d.respondCreditsError(c, tx, err)
 		return
 	}
 
-	log.Println("User credits:", user.Credits)
-	// Check if user has enough credits
-	if user.Credits < credits {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient credits", "status_code": http.StatusBadRequest, "credits": user.Credits})
-		return
-	}
+	c.JSON(http.StatusOK, gin.H{"message": "Credits removed successfully", "credits": tx.BalanceAfter, "transaction": tx, "status_code": http.StatusOK})
+}
 
-	// Remove credits from the user
-	user.Credits -= credits
+func (d *Deps) GetUserCredits(c *gin.Context) {
+	log.Println("GetCredits")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	// Update the user in MongoDB
-	_, err = db.DB.Collection(CollectionNameUsers).UpdateOne(ctx, bson.M{"user_id": userID}, bson.M{"$set": bson.M{"credits": user.Credits}})
+	userID := c.Param("user_id")
+
+	user, err := d.Users.FindOne(ctx, bson.M{"user_id": userID})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Credits removed successfully", "credits": user.Credits, "status_code": http.StatusOK})
+	c.JSON(http.StatusOK, gin.H{"credits": user.Credits, "status_code": http.StatusOK})
 }
 
-func GetUserCredits(c *gin.Context) {
-	log.Println("GetCredits")
+// GetCreditHistory returns the credit transactions of a user, newest first. Older
+// pages are fetched by passing the ID of the last transaction as ?before=
+func GetCreditHistory(c *gin.Context) {
+	log.Println("GetCreditHistory")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	userID := c.Param("user_id")
 
-	var user models.User
+	limit := defaultHistoryLimit
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		limit = n
+		if limit > maxHistoryLimit {
+			limit = maxHistoryLimit
+		}
+	}
+
+	var before primitive.ObjectID
+	if value := c.Query("before"); value != "" {
+		objID, err := primitive.ObjectIDFromHex(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid before"})
+			return
+		}
+		before = objID
+	}
 
-	if err := db.DB.Collection(CollectionNameUsers).FindOne(ctx, bson.M{"user_id": userID}).Decode(&user); err != nil {
+	transactions, err := credits.History(ctx, userID, int64(limit), before)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"credits": user.Credits, "status_code": http.StatusOK})
+	c.JSON(http.StatusOK, gin.H{"status": "success", "data": transactions})
+}
+
+// respondCreditsError responds to an error of the credits ledger
+func (d *Deps) respondCreditsError(c *gin.Context, tx *models.CreditTransaction, err error) {
+	switch {
+	case errors.Is(err, credits.ErrInvalidAmount):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid amount"})
+	case errors.Is(err, credits.ErrUserNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	case errors.Is(err, credits.ErrInsufficientCredits):
+		balance := 0
+		if tx != nil {
+			if user, err := d.Users.FindOne(c.Request.Context(), bson.M{"user_id": tx.UserID}); err == nil {
+				balance = user.Credits
+			}
+		}
+		c.JSON(http.StatusPaymentRequired, gin.H{"error": "Insufficient credits", "status_code": http.StatusPaymentRequired, "credits": balance})
+	case errors.Is(err, credits.ErrDuplicateCharge):
+		c.JSON(http.StatusConflict, gin.H{"error": "This idempotency key was already used for this operation"})
+	case errors.Is(err, credits.ErrTransactionPending):
+		c.JSON(http.StatusConflict, gin.H{"error": "A request with this idempotency key is still in progress"})
+	default:
+		log.Println("Error updating credits", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// chargeCredits charges the caller for units of an operation on reference, e.g.
+// a slide ID. It responds with 402 and returns false when the caller cannot pay,
+// and with 409 when the Idempotency-Key was already used for the same operation
+// and reference. The transaction is nil for free operations
+func (d *Deps) chargeCredits(c *gin.Context, operation string, units int, reference string) (*models.CreditTransaction, bool) {
+	key := ""
+	if header := c.GetHeader("Idempotency-Key"); header != "" {
+		key = operation + ":" + reference + ":" + header
+	}
+
+	tx, err := credits.Charge(c.Request.Context(), auth.UserID(c), operation, units, reference, key)
+	if err != nil {
+		d.respondCreditsError(c, tx, err)
+		return nil, false
+	}
+	return tx, true
+}
+
+// refundCredits refunds a charge made by chargeCredits, if any
+func refundCredits(tx *models.CreditTransaction) {
+	if tx == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := credits.Refund(ctx, tx.ID); err != nil {
+		log.Println("Error refunding credits", tx.ID.Hex(), err)
+	}
+}
+
+// refundOnError refunds a charge if the handler responded with an error, it is
+// meant to be deferred right after chargeCredits
+func refundOnError(c *gin.Context, tx *models.CreditTransaction) {
+	if c.Writer.Status() >= http.StatusBadRequest {
+		refundCredits(tx)
+	}
+}
+
+// countSlideImages returns the number of images of a slide, the units charged
+// for whole-slide operations
+func (d *Deps) countSlideImages(ctx context.Context, slideID string) (int, error) {
+	count, err := d.SlideImages.Count(ctx, bson.M{"slide_id": slideID})
+	return int(count), err
+}
+
+// countSlideImagesWithoutText returns the number of images of a slide that have
+// no generated text
+func (d *Deps) countSlideImagesWithoutText(ctx context.Context, slideID string) (int, error) {
+	count, err := d.SlideImages.Count(ctx, bson.M{
+		"slide_id":       slideID,
+		"generated_text": bson.M{"$in": bson.A{nil, ""}},
+	})
+	return int(count), err
+}
+
+// countSlideImagesWithoutAudio returns the number of images of a slide that have
+// no audio file
+func (d *Deps) countSlideImagesWithoutAudio(ctx context.Context, slideID string) (int, error) {
+	count, err := d.SlideImages.Count(ctx, bson.M{
+		"slide_id":  slideID,
+		"audio_key": bson.M{"$in": bson.A{nil, ""}},
+		"audio_url": bson.M{"$in": bson.A{nil, ""}},
+	})
+	return int(count), err
 }
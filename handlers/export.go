@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"main/jobs"
+	"main/models"
+	"main/repo"
+	"main/tts"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ExportSlideAudio enqueues a job joining the narration of every slide image of a
+// slide into one MP3, or M4A with ?format=m4a, with a chapter per slide image
+func (d *Deps) ExportSlideAudio(c *gin.Context) {
+	slideID := c.Param("id")
+
+	_, err := primitive.ObjectIDFromHex(slideID)
+	if err != nil {
+		log.Println("Invalid slide ID")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid slide ID"})
+		return
+	}
+
+	format := c.DefaultQuery("format", tts.FormatMP3)
+	switch {
+	case format != tts.FormatMP3 && format != tts.FormatM4A:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Lecture audio can only be exported as mp3 or m4a"})
+		return
+	case format == tts.FormatM4A && !d.TTS.CanEncodeM4A():
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Lecture audio can only be exported as mp3 on this server"})
+		return
+	}
+
+	// The options only apply to slide images that have no audio yet, which
+	// are joined as MP3 whatever the format of the export
+	override, err := d.voiceQueryWithFormat(c, "")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	params := voiceParams(map[string]string{"slide_id": slideID}, override)
+	params["export_format"] = format
+	d.enqueueJob(c, JobTypeExportAudio, params)
+}
+
+// exportAudioJob generates the missing audio of a slide, then joins the audio of
+// its slide images in order, in the export_format param, and stores the result
+// on the slide
+func (d *Deps) exportAudioJob(ctx context.Context, job *models.Job, report jobs.ReportFunc) (bson.M, error) {
+	slideID := job.Params["slide_id"]
+	objID, err := primitive.ObjectIDFromHex(slideID)
+	if err != nil {
+		return nil, errors.New("invalid slide ID")
+	}
+
+	slide, err := d.Slides.Get(ctx, objID)
+	if err != nil {
+		return nil, fmt.Errorf("error finding slide: %v", err)
+	}
+
+	slideImages, err := d.findSlideImagesBySlideID(slideID)
+	if err != nil {
+		return nil, err
+	}
+	if len(slideImages) == 0 {
+		return nil, errors.New("slide has no images")
+	}
+
+	opts := d.resolveVoice(ctx, job.UserID, slideID, voiceFromParams(job.Params))
+	opts.Format = tts.FormatMP3
+
+	total := len(slideImages) + 1
+	parts := make([][]byte, len(slideImages))
+	for i := range slideImages {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		order := slideImages[i].Order
+
+		audioKey := slideImages[i].AudioKey
+		if audioKey == "" {
+			report(i, total, fmt.Sprintf("Generating audio for slide order %d", order))
+			audioKey, err = d.synthesizeSlideImageAudio(ctx, &slideImages[i], opts)
+			if err != nil {
+				return nil, fmt.Errorf("error generating audio for slide order %d: %v", order, err)
+			}
+			d.completeUnit(job)
+		}
+		if !strings.HasSuffix(audioKey, "."+tts.FormatMP3) {
+			return nil, fmt.Errorf("audio of slide order %d is not mp3, regenerate it with format=mp3", order)
+		}
+
+		parts[i], err = d.readStorageKey(ctx, audioKey)
+		if err != nil {
+			return nil, fmt.Errorf("error reading audio of slide order %d: %v", order, err)
+		}
+		report(i+1, total, fmt.Sprintf("Added audio of slide order %d", order))
+	}
+
+	audio, durations, err := tts.JoinMP3(parts...)
+	if err != nil {
+		return nil, fmt.Errorf("error joining audio: %v", err)
+	}
+
+	var chapters []tts.Chapter
+	var duration time.Duration
+	for i, part := range durations {
+		chapters = append(chapters, tts.Chapter{Title: fmt.Sprintf("Slide %d", i+1), Start: duration, End: duration + part})
+		duration += part
+	}
+
+	format := job.Params["export_format"]
+	if format == tts.FormatM4A {
+		report(len(slideImages), total, "Encoding lecture audio")
+		audio, err = d.TTS.EncodeM4A(ctx, audio, slide.Name, chapters)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding lecture audio: %v", err)
+		}
+	} else {
+		format = tts.FormatMP3
+		audio = tts.TagMP3(audio, slide.Name, chapters)
+	}
+
+	key := fmt.Sprintf("slides/%s/audio/lecture-%s.%s", slideID, generateFileName(), format)
+	if err := d.Storage.Put(ctx, key, bytes.NewReader(audio), tts.ContentType(format)); err != nil {
+		log.Println("Error uploading lecture audio", err)
+		return nil, errors.New("error uploading lecture audio to storage")
+	}
+
+	now := time.Now()
+	_, err = d.Slides.UpdateOne(ctx, repo.ByID(objID), bson.M{"$set": bson.M{
+		"audio_export_key":         key,
+		"audio_export_duration_ms": duration.Milliseconds(),
+		"audio_exported_at":        now,
+		"updated_at":               now,
+	}})
+	if err != nil {
+		d.deleteStorageKey(key)
+		return nil, fmt.Errorf("error updating slide: %v", err)
+	}
+	if slide.AudioExportKey != "" {
+		d.deleteStorageKey(slide.AudioExportKey)
+	}
+	report(total, total, "Lecture audio exported")
+
+	url, err := d.presignKey(ctx, key)
+	if err != nil {
+		return nil, errors.New("error presigning lecture audio URL")
+	}
+	return bson.M{"audio_export_url": url, "duration_ms": duration.Milliseconds(), "chapters": len(chapters)}, nil
+}
+
+// readStorageKey reads a whole object from storage
+func (d *Deps) readStorageKey(ctx context.Context, key string) ([]byte, error) {
+	file, err := d.Storage.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
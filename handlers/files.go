@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"main/db"
+	"main/models"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ServeFile serves an object from storage, used when running with the local storage driver
+func (d *Deps) ServeFile(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+
+	// Only presigned URLs can be used to download files
+	if store, ok := d.Storage.(*db.LocalStore); ok {
+		if !store.Verify(http.MethodGet, key, c.Query("expires"), c.Query("signature")) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or expired signature"})
+			return
+		}
+	}
+
+	file, err := d.Storage.Get(c.Request.Context(), key)
+	if err != nil {
+		if errors.Is(err, db.ErrObjectNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		} else {
+			log.Println("Error reading file", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading file"})
+		}
+		return
+	}
+	defer file.Close()
+
+	// Keys of slide images have no extension, so fall back to sniffing the content
+	reader := bufio.NewReader(file)
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		head, _ := reader.Peek(512)
+		contentType = http.DetectContentType(head)
+	}
+	c.Header("Content-Type", contentType)
+	c.Status(http.StatusOK)
+	io.Copy(c.Writer, reader)
+}
+
+// ReceiveFile stores the body of a request signed by PresignPut, used for direct
+// uploads when running with the local storage driver
+func (d *Deps) ReceiveFile(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+
+	store, ok := d.Storage.(*db.LocalStore)
+	if !ok || !store.Verify(http.MethodPut, key, c.Query("expires"), c.Query("signature")) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or expired signature"})
+		return
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, d.Config.PDFMaxBytes)
+	if err := store.Put(c.Request.Context(), key, body, c.ContentType()); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": errFileTooLarge.Error()})
+		} else {
+			log.Println("Error storing file", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error storing file"})
+		}
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// presignKey returns a short lived URL to download key from storage
+func (d *Deps) presignKey(ctx context.Context, key string) (string, error) {
+	return d.Storage.PresignGet(ctx, key, d.Config.PresignURLTTL)
+}
+
+// presignSlide fills in the PDF, source image and audio export URLs of a slide stored in storage
+func (d *Deps) presignSlide(ctx context.Context, slide *models.Slide) error {
+	slide.ImageSourceURLs = nil
+	for _, key := range slide.ImageSourceKeys {
+		url, err := d.presignKey(ctx, key)
+		if err != nil {
+			return err
+		}
+		slide.ImageSourceURLs = append(slide.ImageSourceURLs, url)
+	}
+	if slide.AudioExportKey != "" {
+		url, err := d.presignKey(ctx, slide.AudioExportKey)
+		if err != nil {
+			return err
+		}
+		slide.AudioExportURL = url
+	}
+	if slide.PDFKey == "" {
+		return nil
+	}
+	url, err := d.presignKey(ctx, slide.PDFKey)
+	if err != nil {
+		return err
+	}
+	slide.PDFURL = url
+	return nil
+}
+
+// presignSlides fills in the PDF URLs of a list of slides
+func (d *Deps) presignSlides(ctx context.Context, slides []models.Slide) error {
+	for i := range slides {
+		if err := d.presignSlide(ctx, &slides[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// presignSlideImage fills in the image and audio URLs of a slide image
+func (d *Deps) presignSlideImage(ctx context.Context, slideImage *models.SlideImage) error {
+	if slideImage.ImageKey != "" {
+		url, err := d.presignKey(ctx, slideImage.ImageKey)
+		if err != nil {
+			return err
+		}
+		slideImage.ImageURL = url
+	}
+	if slideImage.ThumbnailKey != "" {
+		url, err := d.presignKey(ctx, slideImage.ThumbnailKey)
+		if err != nil {
+			return err
+		}
+		slideImage.ThumbnailURL = url
+	}
+	if slideImage.AudioKey != "" {
+		url, err := d.presignKey(ctx, slideImage.AudioKey)
+		if err != nil {
+			return err
+		}
+		slideImage.AudioURL = url
+	}
+	return nil
+}
+
+// fileURL returns a downloadable URL for a file stored as key, or at the
+// permanent url of legacy documents
+func (d *Deps) fileURL(ctx context.Context, key string, url string) (string, error) {
+	if key != "" {
+		return d.presignKey(ctx, key)
+	}
+	return url, nil
+}
+
+// deleteFile deletes a file stored as key, or at the permanent url of legacy
+// documents, from storage
+func (d *Deps) deleteFile(key string, url string) {
+	if key != "" {
+		d.deleteStorageKey(key)
+	} else if url != "" {
+		d.deleteStorageFile(url)
+	}
+}
+
+// deleteSlideImageFiles deletes the image, thumbnail and audio of slide images
+// from storage
+func (d *Deps) deleteSlideImageFiles(slideImages []models.SlideImage) {
+	for _, slideImage := range slideImages {
+		d.deleteFile(slideImage.ImageKey, slideImage.ImageURL)
+		d.deleteFile(slideImage.ThumbnailKey, slideImage.ThumbnailURL)
+		d.deleteFile(slideImage.AudioKey, slideImage.AudioURL)
+	}
+}
@@ -5,87 +5,100 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"main/db"
+	"main/credits"
+	"main/jobs"
+	"main/llm"
 	"main/models"
-	"main/utils"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/sashabaranov/go-openai"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-// GenerateFlashCards is a gin handler to generate flashcards from slide images
-func GenerateFlashCards(c *gin.Context) {
+const collectionNameFlashcards = "flashcards"
+
+// GenerateFlashCards is a gin handler that enqueues a job generating flashcards from slide images
+func (d *Deps) GenerateFlashCards(c *gin.Context) {
 	slideID := c.Param("slide_id")
 	log.Println("*** /generate-flashcards ***")
 
+	if _, err := primitive.ObjectIDFromHex(slideID); err != nil {
+		log.Println("Invalid slide ID", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid slide ID"})
+		return
+	}
+
+	d.enqueueJob(c, JobTypeGenerateFlashcards, map[string]string{"slide_id": slideID})
+}
+
+// generateFlashcardsJob generates flashcards for every slide image of a slide
+func (d *Deps) generateFlashcardsJob(ctx context.Context, job *models.Job, report jobs.ReportFunc) (bson.M, error) {
+	slideID := job.Params["slide_id"]
+
 	// Retrieve all slide images for the specified slide ID
-	slideImages, err := findSlideImagesBySlideID(slideID)
+	slideImages, err := d.findSlideImagesBySlideID(slideID)
 	if err != nil {
-		log.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return nil, err
 	}
 
 	log.Println("Found slide images:", len(slideImages))
 
-	var allFlashcards []models.Flashcard
+	totalFlashcards := 0
 	var contextStr string
 
 	// Process in chunks of 10 slide images
 	for i, slideImage := range slideImages {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		log.Println("Processing slide image", i+1)
-		generatedText, ok := slideImage["generated_text"].(string)
-		if !ok || generatedText == "" {
-			log.Println("Generated text not found")
-			c.JSON(http.StatusNotFound, gin.H{"error": "Generated text not found"})
-			return
+		generatedText := slideImage.GeneratedText
+		if generatedText == "" {
+			return nil, fmt.Errorf("generated text not found")
 		}
-		contextStr += fmt.Sprintf("Slide ID: %s, Slide Image ID: %s\n%s\n\n", slideID, slideImage["_id"].(primitive.ObjectID).Hex(), generatedText)
+		slideImageID := slideImage.ID.Hex()
+		contextStr += fmt.Sprintf("Slide ID: %s, Slide Image ID: %s\n%s\n\n", slideID, slideImageID, generatedText)
 
 		log.Println("Context length:", len(contextStr))
 		// Every 10 slide images, generate flashcards
 		if (i+1)%10 == 0 || i+1 == len(slideImages) {
-			slideImageID := slideImage["_id"].(primitive.ObjectID).Hex()
-			flashcards, err := generateFlashcards(contextStr, slideID, slideImageID)
+			report(i, len(slideImages), fmt.Sprintf("Generating flashcards up to slide image %d", i+1))
+
+			flashcards, err := d.generateFlashcards(ctx, contextStr, slideID, slideImageID)
 			if err != nil {
-				log.Println("Error generating flashcards", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
+				return nil, fmt.Errorf("error generating flashcards: %v", err)
 			}
 
 			log.Println("Generated flashcards:", len(flashcards))
 
 			// Store generated flashcards in the database
-			if err := storeFlashcards(flashcards); err != nil {
-				log.Println("Error storing flashcards", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
+			if err := d.storeFlashcards(flashcards); err != nil {
+				return nil, fmt.Errorf("error storing flashcards: %v", err)
 			}
 
 			log.Println("Stored flashcards in the database")
 
-			allFlashcards = append(allFlashcards, flashcards...)
+			totalFlashcards += len(flashcards)
 			contextStr = "" // Reset context for next chunk
 
+			report(i+1, len(slideImages), fmt.Sprintf("Generated %d flashcards", totalFlashcards))
 		}
-
 	}
 
-	c.JSON(http.StatusOK, gin.H{"status": "success", "data": allFlashcards})
+	return bson.M{"total_flashcards": totalFlashcards}, nil
 }
 
 // Route to return list of slides based on if they have flashcards
-func GetSlidesWithFlashcards(c *gin.Context) {
+func (d *Deps) GetSlidesWithFlashcards(c *gin.Context) {
 	log.Println("*** /slides-with-flashcards ***")
 	ctx, cancel := context.WithTimeout(context.Background(), 360*time.Second)
 	defer cancel()
 
 	// Find all slide IDs with flashcards
-	slideIDs, err := db.DB.Collection("flashcards").Distinct(ctx, "slide_id", bson.M{})
+	slideIDs, err := d.Flashcards.Distinct(ctx, "slide_id", notTrashed(bson.M{}))
 	if err != nil {
 		log.Println("Error finding slides with flashcards", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -94,30 +107,43 @@ func GetSlidesWithFlashcards(c *gin.Context) {
 
 	log.Println("Found slides with flashcards")
 
-	var slideIDStrings []string
+	var slideObjIDs []primitive.ObjectID
 	for _, id := range slideIDs {
-		slideIDStrings = append(slideIDStrings, id.(string))
+		if objID, err := primitive.ObjectIDFromHex(id); err == nil {
+			slideObjIDs = append(slideObjIDs, objID)
+		}
 	}
 
-	log.Println("Slide IDs with flashcards:", slideIDStrings)
+	log.Println("Slide IDs with flashcards:", slideObjIDs)
 
-	// Get slide details
-	var slides []models.Slide
-	for _, slideID := range slideIDStrings {
-		slide, err := findSlideByID(slideID)
-		if err != nil {
-			log.Println("Error finding slide by ID", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-		slides = append(slides, slide)
+	// Get the slide details of the slides the caller can access, leaving out
+	// the trash
+	filter, err := d.slideFilter(c)
+	if err != nil {
+		log.Println("Error finding user spaces", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	filter["_id"] = bson.M{"$in": slideObjIDs}
+
+	slides, err := d.Slides.Find(ctx, filter, nil)
+	if err != nil {
+		log.Println("Error finding slides", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err = d.presignSlides(ctx, slides); err != nil {
+		log.Println("Error presigning slides", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"status": "success", "data": slides})
 }
 
 // Delete Flashcard by Flashcard ID
-func DeleteFlashcard(c *gin.Context) {
+func (d *Deps) DeleteFlashcard(c *gin.Context) {
 	flashcardID := c.Param("flashcard_id")
 	log.Println("*** /flashcards ***")
 
@@ -131,7 +157,8 @@ func DeleteFlashcard(c *gin.Context) {
 		return
 	}
 
-	_, err = db.DB.Collection("flashcards").DeleteOne(ctx, bson.M{"_id": flashcardObjID})
+	// Deleted flashcards go to the trash
+	_, err = moveToTrash(ctx, d.Flashcards, flashcardObjID.Hex())
 	if err != nil {
 		log.Println("Error deleting flashcard", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -142,33 +169,25 @@ func DeleteFlashcard(c *gin.Context) {
 }
 
 // Get all flashcards for a slide
-func GetFlashcards(c *gin.Context) {
+func (d *Deps) GetFlashcards(c *gin.Context) {
 	slideID := c.Param("slide_id")
 	log.Println("*** /flashcards ***")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 360*time.Second)
 	defer cancel()
 
-	cursor, err := db.DB.Collection("flashcards").Find(ctx, bson.M{"slide_id": slideID})
+	flashcards, err := d.Flashcards.Find(ctx, notTrashed(bson.M{"slide_id": slideID}), nil)
 	if err != nil {
 		log.Println("Error finding flashcards", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	defer cursor.Close(ctx)
-
-	var flashcards []models.Flashcard
-	if err = cursor.All(ctx, &flashcards); err != nil {
-		log.Println("Error decoding flashcards", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
 
 	c.JSON(http.StatusOK, gin.H{"status": "success", "data": flashcards})
 }
 
 // Get all flashcards for a slide image
-func GetFlashcardsForSlideImage(c *gin.Context) {
+func (d *Deps) GetFlashcardsForSlideImage(c *gin.Context) {
 	slideID := c.Param("slide_id")
 	slideImageID := c.Param("slide_image_id")
 	log.Println("*** /flashcards ***")
@@ -176,25 +195,17 @@ func GetFlashcardsForSlideImage(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 360*time.Second)
 	defer cancel()
 
-	cursor, err := db.DB.Collection("flashcards").Find(ctx, bson.M{"slide_id": slideID, "slide_image_id": slideImageID})
+	flashcards, err := d.Flashcards.Find(ctx, notTrashed(bson.M{"slide_id": slideID, "slide_image_id": slideImageID}), nil)
 	if err != nil {
 		log.Println("Error finding flashcards", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	defer cursor.Close(ctx)
-
-	var flashcards []models.Flashcard
-	if err = cursor.All(ctx, &flashcards); err != nil {
-		log.Println("Error decoding flashcards", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
 
 	c.JSON(http.StatusOK, gin.H{"status": "success", "data": flashcards})
 }
 
-func generateFlashcards(contextStr string, slideID string, slideImageID string) ([]models.Flashcard, error) {
+func (d *Deps) generateFlashcards(ctx context.Context, contextStr string, slideID string, slideImageID string) ([]models.Flashcard, error) {
 	PROMPT := fmt.Sprintf(`
 	You are a professor. Generate flashcards for university students to review the main concepts from the following content. Ensure the flashcards are relevant and based on the important topics of the slides, excluding any course administration or professor-related details. Assume the student does not have access to the slides when reviewing the flashcards. Each flashcard should have a question on one side and the corresponding answer on the other. Provide a rationale for the answer. Return the response in JUST JSON format array, nothing else.
 	example: 
@@ -211,34 +222,14 @@ func generateFlashcards(contextStr string, slideID string, slideImageID string)
 
 	log.Println("Prompt:", PROMPT)
 
-	client := openai.NewClient(utils.OPENAI_API_KEY)
-	result, err := client.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{
-		Model: openai.GPT4o,
-		Messages: []openai.ChatCompletionMessage{
-			{
-				Role:    openai.ChatMessageRoleUser,
-				Content: PROMPT,
-			},
-		},
-		MaxTokens: 4000,
-	})
-
+	content, err := d.LLM.CompleteJSON(ctx, llm.Prompt{User: PROMPT, MaxTokens: 4000})
 	if err != nil {
 		return nil, err
 	}
 
-	log.Println("Response:", result.Choices[0].Message.Content)
+	log.Println("Response:", content)
 
-	var flashcards []models.Flashcard
-	for _, choice := range result.Choices {
-		fcs, err := parseFlashcards(choice.Message.Content, slideID, slideImageID)
-		if err != nil {
-			return nil, err
-		}
-		flashcards = append(flashcards, fcs...)
-	}
-
-	return flashcards, nil
+	return parseFlashcards(content, slideID, slideImageID)
 }
 
 func parseFlashcards(content, slideID, slideImageID string) ([]models.Flashcard, error) {
@@ -265,38 +256,26 @@ func parseFlashcards(content, slideID, slideImageID string) ([]models.Flashcard,
 	return fc.Flashcards, nil
 }
 
-func storeFlashcards(flashcards []models.Flashcard) error {
+func (d *Deps) storeFlashcards(flashcards []models.Flashcard) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 360*time.Second)
 	defer cancel()
 
-	var docs []interface{}
-	for _, flashcard := range flashcards {
-		docs = append(docs, flashcard)
-	}
-
-	_, err := db.DB.Collection("flashcards").InsertMany(ctx, docs)
-	return err
+	return d.Flashcards.InsertMany(ctx, flashcards)
 }
 
-func getFlashcardsForSlideImage(slideID string, slideImageID string) ([]models.Flashcard, error) {
+func (d *Deps) getFlashcardsForSlideImage(slideID string, slideImageID string) ([]models.Flashcard, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	cursor, err := db.DB.Collection("flashcards").Find(ctx, bson.M{"slide_id": slideID, "slide_image_id": slideImageID})
+	flashcards, err := d.Flashcards.Find(ctx, notTrashed(bson.M{"slide_id": slideID, "slide_image_id": slideImageID}), nil)
 	if err != nil {
 		return nil, fmt.Errorf("error finding flashcards: %v", err)
 	}
-	defer cursor.Close(ctx)
-
-	var flashcards []models.Flashcard
-	if err = cursor.All(ctx, &flashcards); err != nil {
-		return nil, fmt.Errorf("error decoding flashcards: %v", err)
-	}
 	return flashcards, nil
 }
 
 // Generate flashcards for a specific slide image
-func GenerateFlashcardsForSlideImage(c *gin.Context) {
+func (d *Deps) GenerateFlashcardsForSlideImage(c *gin.Context) {
 	slideID := c.Param("slide_id")
 	slideImageID := c.Param("slide_image_id")
 	log.Println("*** /generate-flashcards ***")
@@ -309,7 +288,7 @@ func GenerateFlashcardsForSlideImage(c *gin.Context) {
 	}
 
 	// Retrieve slide image
-	slideImage, err := findSlideImageByID(objID)
+	slideImage, err := d.findSlideImageByID(objID)
 	if err != nil {
 		log.Println(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -318,8 +297,8 @@ func GenerateFlashcardsForSlideImage(c *gin.Context) {
 
 	log.Println("Found slide image")
 
-	generatedText, ok := slideImage["generated_text"].(string)
-	if !ok || generatedText == "" {
+	generatedText := slideImage.GeneratedText
+	if generatedText == "" {
 		log.Println("Generated text not found")
 		c.JSON(http.StatusNotFound, gin.H{"error": "Generated text not found"})
 		return
@@ -327,8 +306,14 @@ func GenerateFlashcardsForSlideImage(c *gin.Context) {
 
 	log.Println("Generated text:", generatedText)
 
+	charge, ok := d.chargeCredits(c, credits.OpGenerateFlashcards, 1, slideImageID)
+	if !ok {
+		return
+	}
+	defer refundOnError(c, charge)
+
 	// Retrieve existing flashcards for the slide image
-	existingFlashcards, err := getFlashcardsForSlideImage(slideID, slideImageID)
+	existingFlashcards, err := d.getFlashcardsForSlideImage(slideID, slideImageID)
 	if err != nil {
 		log.Println("Error retrieving existing flashcards", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -345,7 +330,7 @@ func GenerateFlashcardsForSlideImage(c *gin.Context) {
 	}
 
 	// Generate flashcards
-	flashcards, err := generateFlashcards(contextStr, slideID, slideImageID)
+	flashcards, err := d.generateFlashcards(c.Request.Context(), contextStr, slideID, slideImageID)
 	if err != nil {
 		log.Println("Error generating flashcards", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -355,7 +340,7 @@ func GenerateFlashcardsForSlideImage(c *gin.Context) {
 	log.Println("Generated flashcards:", len(flashcards))
 
 	// Store generated flashcards in the database
-	if err := storeFlashcards(flashcards); err != nil {
+	if err := d.storeFlashcards(flashcards); err != nil {
 		log.Println("Error storing flashcards", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"main/models"
+	"main/repo"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Slides younger than this are left alone, their files are uploaded before
+// their documents are saved
+const gcGracePeriod = time.Hour
+
+// Presigned uploads that were not completed after this are abandoned
+const uploadAbandonAfter = 24 * time.Hour
+
+// GCReport lists what CollectGarbage found, by ID or storage key
+type GCReport struct {
+	Slides           []string `json:"slides"`
+	AbandonedUploads []string `json:"abandoned_uploads"`
+	SlideImages      []string `json:"slide_images"`
+	QuizQuestions    []string `json:"quiz_questions"`
+	Flashcards       []string `json:"flashcards"`
+	UserSpaceIDs     []string `json:"user_space_ids"`
+	Files            []string `json:"files"`
+	Removed          bool     `json:"removed"`
+}
+
+// CollectGarbage finds documents whose parent no longer exists and files in
+// storage that belong to deleted slides, and removes them if remove is set
+func (d *Deps) CollectGarbage(ctx context.Context, remove bool) (*GCReport, error) {
+	report := &GCReport{Removed: remove}
+
+	spaceIDs, err := hexIDs(ctx, d.Spaces, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	// Slides of deleted spaces, and presigned uploads never completed
+	slides, err := d.Slides.Find(ctx, bson.M{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	slideIDs := map[string]bool{}
+	for i, slide := range slides {
+		var list *[]string
+		switch {
+		case slide.SpaceID != "" && !spaceIDs[slide.SpaceID]:
+			list = &report.Slides
+		case slide.UploadStartedAt != nil && time.Since(*slide.UploadStartedAt) > uploadAbandonAfter:
+			list = &report.AbandonedUploads
+		default:
+			slideIDs[slide.ID.Hex()] = true
+			continue
+		}
+		*list = append(*list, slide.ID.Hex())
+		if remove {
+			if err := d.deleteSlideCascade(ctx, &slides[i], nil); err != nil && err != errSlideNotFound {
+				return nil, err
+			}
+		}
+	}
+
+	// Slide images of deleted slides
+	slideImages, err := d.SlideImages.Find(ctx, bson.M{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	slideImageIDs := map[string]bool{}
+	for _, slideImage := range slideImages {
+		if slideIDs[slideImage.SlideID] || !orphanable(slideImage.SlideID) {
+			slideImageIDs[slideImage.ID.Hex()] = true
+			continue
+		}
+		report.SlideImages = append(report.SlideImages, slideImage.ID.Hex())
+		if remove {
+			if _, err := d.SlideImages.DeleteOne(ctx, repo.ByID(slideImage.ID)); err != nil {
+				return nil, err
+			}
+			d.deleteSlideImageFiles([]models.SlideImage{slideImage})
+		}
+	}
+
+	// Quiz questions and flashcards of deleted slides or slide images
+	orphaned := func(slideID string, slideImageID string) bool {
+		return orphanable(slideID) && (!slideIDs[slideID] || slideImageID != "" && !slideImageIDs[slideImageID])
+	}
+	questions, err := d.QuizQuestions.Find(ctx, bson.M{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	var orphans bson.A
+	for _, question := range questions {
+		if orphaned(question.SlideID, question.SlideImageID) {
+			report.QuizQuestions = append(report.QuizQuestions, question.ID.Hex())
+			orphans = append(orphans, question.ID)
+		}
+	}
+	if remove && len(orphans) > 0 {
+		if _, err := d.QuizQuestions.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": orphans}}); err != nil {
+			return nil, err
+		}
+	}
+	flashcards, err := d.Flashcards.Find(ctx, bson.M{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	orphans = bson.A{}
+	for _, flashcard := range flashcards {
+		if orphaned(flashcard.SlideID, flashcard.SlideImageID) {
+			report.Flashcards = append(report.Flashcards, flashcard.ID.Hex())
+			orphans = append(orphans, flashcard.ID)
+		}
+	}
+	if remove && len(orphans) > 0 {
+		if _, err := d.Flashcards.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": orphans}}); err != nil {
+			return nil, err
+		}
+	}
+
+	// Spaces of users that no longer exist
+	users, err := d.Users.Find(ctx, bson.M{"space_ids.0": bson.M{"$exists": true}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		var missing []string
+		for _, spaceID := range user.SpaceIDs {
+			if !spaceIDs[spaceID] {
+				missing = append(missing, spaceID)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		for _, spaceID := range missing {
+			report.UserSpaceIDs = append(report.UserSpaceIDs, user.UserID+"/"+spaceID)
+		}
+		if remove {
+			_, err := d.Users.UpdateOne(ctx, bson.M{"user_id": user.UserID}, bson.M{
+				"$pull": bson.M{"space_ids": bson.M{"$in": missing}},
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Files of deleted slides, slides keep their files under slides/<slide ID>/
+	keys, err := d.Storage.List(ctx, "slides/")
+	if err != nil {
+		return nil, fmt.Errorf("error listing files: %v", err)
+	}
+	for _, key := range keys {
+		slideID := strings.SplitN(strings.TrimPrefix(key, "slides/"), "/", 2)[0]
+		if slideIDs[slideID] || !orphanable(slideID) {
+			continue
+		}
+		report.Files = append(report.Files, key)
+		if remove {
+			d.deleteStorageKey(key)
+		}
+	}
+
+	return report, nil
+}
+
+// orphanable reports whether a slide ID is old enough for its slide to be
+// considered deleted rather than not saved yet
+func orphanable(slideID string) bool {
+	objID, err := primitive.ObjectIDFromHex(slideID)
+	return err != nil || time.Since(objID.Timestamp()) > gcGracePeriod
+}
+
+// hexIDs returns the IDs of the documents of r matching filter
+func hexIDs[T any](ctx context.Context, r repo.Repository[T], filter bson.M) (map[string]bool, error) {
+	values, err := r.IDs(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	ids := map[string]bool{}
+	for _, value := range values {
+		ids[value.Hex()] = true
+	}
+	return ids, nil
+}
+
+// RunGarbageCollector removes garbage every interval until ctx is done
+func (d *Deps) RunGarbageCollector(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := d.CollectGarbage(ctx, true)
+			if err != nil {
+				log.Println("Error collecting garbage", err)
+				continue
+			}
+			log.Printf("Collected garbage: %d slides, %d abandoned uploads, %d slide images, %d quiz questions, %d flashcards, %d user spaces, %d files",
+				len(report.Slides), len(report.AbandonedUploads), len(report.SlideImages), len(report.QuizQuestions),
+				len(report.Flashcards), len(report.UserSpaceIDs), len(report.Files))
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"main/db"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errNotReady = errors.New("server is starting or shutting down")
+
+// ready is set once the server is set up and cleared when it starts shutting
+// down, so that load balancers stop sending it requests
+var ready atomic.Bool
+
+// SetReady sets whether the server accepts new requests
+func SetReady(value bool) {
+	ready.Store(value)
+}
+
+// Healthz reports that the server is running
+func Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readyz reports whether the server can serve requests, i.e. MongoDB and the
+// storage can be reached and every dependency is configured
+func (d *Deps) Readyz(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
+	defer cancel()
+
+	checks := gin.H{}
+	ok := true
+	check := func(name string, err error) {
+		if err != nil {
+			checks[name] = err.Error()
+			ok = false
+			return
+		}
+		checks[name] = "ok"
+	}
+
+	if !ready.Load() {
+		check("server", errNotReady)
+	}
+	check("mongo", db.PingMongo(ctx))
+	check("storage", db.PingStorage(ctx, d.Storage))
+	check("config", d.configured())
+
+	if !ok {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "checks": checks})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "checks": checks})
+}
+
+// configured returns an error if a dependency was not set up at startup
+func (d *Deps) configured() error {
+	switch {
+	case d.Repositories == nil:
+		return errors.New("repositories are not configured")
+	case d.Events == nil:
+		return errors.New("event log is not configured")
+	case d.LLM == nil:
+		return errors.New("LLM client is not configured")
+	case d.Converter == nil:
+		return errors.New("presentation converter is not configured")
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"main/auth"
+	"main/credits"
+	"main/jobs"
+	"main/models"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Job types run by the background workers
+const (
+	JobTypeConvertPDF           = "convert_pdf"
+	JobTypeGenerateAllImageText = "generate_all_image_text"
+	JobTypeGenerateAllAudio     = "generate_all_audio"
+	JobTypeGenerateQuiz         = "generate_quiz"
+	JobTypeGenerateFlashcards   = "generate_flashcards"
+	JobTypeExportAudio          = "export_audio"
+)
+
+// jobOperations maps the job types that cost credits to the operation they are
+// charged as, once per image of the slide in the slide_id param that the job
+// processes
+var jobOperations = map[string]string{
+	JobTypeGenerateAllImageText: credits.OpGenerateImageText,
+	JobTypeGenerateAllAudio:     credits.OpGenerateAudio,
+	JobTypeGenerateQuiz:         credits.OpGenerateQuiz,
+	JobTypeGenerateFlashcards:   credits.OpGenerateFlashcards,
+	JobTypeExportAudio:          credits.OpGenerateAudio,
+}
+
+// RegisterJobs registers the handlers of every job type with the job queue
+func (d *Deps) RegisterJobs() {
+	d.Jobs.Register(JobTypeConvertPDF, 30*time.Minute, 1, d.convertPDFToImagesJob)
+	d.Jobs.Register(JobTypeGenerateAllImageText, 60*time.Minute, 3, d.generateAllImageTextJob)
+	d.Jobs.Register(JobTypeGenerateAllAudio, 60*time.Minute, 3, d.generateAllAudioJob)
+	d.Jobs.Register(JobTypeGenerateQuiz, 30*time.Minute, 1, d.generateQuizQuestionsJob)
+	d.Jobs.Register(JobTypeGenerateFlashcards, 30*time.Minute, 1, d.generateFlashcardsJob)
+	d.Jobs.Register(JobTypeExportAudio, 60*time.Minute, 3, d.exportAudioJob)
+
+	// Jobs that did not complete give back the credits of the units they did
+	// not process
+	d.Jobs.OnFailure(func(ctx context.Context, job *models.Job) {
+		if job.ChargeID.IsZero() {
+			return
+		}
+		if _, err := credits.RefundUnused(ctx, job.ChargeID, job.CompletedUnits); err != nil {
+			log.Println("Error refunding job", job.ID.Hex(), err)
+		}
+	})
+}
+
+// completeUnit records that a unit the job was charged for is done, so that it
+// stays paid for if the job fails later
+func (d *Deps) completeUnit(job *models.Job) {
+	if err := d.Jobs.CompleteUnits(context.Background(), job, 1); err != nil {
+		log.Println("Error recording completed unit of job", job.ID.Hex(), err)
+	}
+}
+
+// chargeJob charges the caller for a new job, see jobOperations
+func (d *Deps) chargeJob(c *gin.Context, jobType string, params map[string]string) (*models.CreditTransaction, bool) {
+	operation, ok := jobOperations[jobType]
+	if !ok {
+		return nil, true
+	}
+
+	// Jobs that skip images with text or audio only pay for the others
+	count := d.countSlideImages
+	switch jobType {
+	case JobTypeGenerateAllImageText:
+		count = d.countSlideImagesWithoutText
+	case JobTypeGenerateAllAudio, JobTypeExportAudio:
+		count = d.countSlideImagesWithoutAudio
+	}
+	units, err := count(c.Request.Context(), params["slide_id"])
+	if err != nil {
+		log.Println("Error counting slide images", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return d.chargeCredits(c, operation, units, params["slide_id"])
+}
+
+// enqueueJob enqueues a job and responds with its ID, or streams its events if the
+// client asked for an event stream. A job of the same type and params that the
+// caller enqueued and is still queued or running is reused, and a client
+// reconnecting with Last-Event-ID is attached to the job it was following
+func (d *Deps) enqueueJob(c *gin.Context, jobType string, params map[string]string) {
+	lastID, resuming := lastEventID(c)
+
+	job, err := d.Jobs.FindLatest(c.Request.Context(), jobType, params, auth.UserID(c), !resuming)
+	if errors.Is(err, jobs.ErrJobNotFound) {
+		lastID = 0
+
+		charge, ok := d.chargeJob(c, jobType, params)
+		if !ok {
+			return
+		}
+		var chargeID primitive.ObjectID
+		if charge != nil {
+			chargeID = charge.ID
+		}
+
+		job, err = d.Jobs.Enqueue(c.Request.Context(), jobType, params, auth.UserID(c), chargeID)
+		if err != nil {
+			refundCredits(charge)
+		}
+	}
+	if err != nil {
+		log.Println("Error enqueuing job", err)
+		if errors.Is(err, jobs.ErrUnknownJobType) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error enqueuing job"})
+		}
+		return
+	}
+
+	if wantsEventStream(c) {
+		d.streamEvents(c, jobs.StreamID(job.ID), lastID)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"status": "success", "job_id": job.ID.Hex(), "data": job})
+}
+
+// CreateJob enqueues a job of any registered type
+func (d *Deps) CreateJob(c *gin.Context) {
+	log.Println("*** /jobs ***")
+
+	var request models.JobRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Jobs can only target slides and slide images the caller owns
+	resolvers := map[string]spaceResolver{"slide_id": d.spaceOfSlide, "slide_image_id": d.spaceOfSlideImage}
+	for param, spaceOf := range resolvers {
+		id, ok := request.Params[param]
+		if !ok {
+			continue
+		}
+		spaceID, err := spaceOf(c.Request.Context(), id)
+		if err != nil {
+			respondAuthzError(c, err)
+			return
+		}
+		if !d.requireSpaceAccess(c, spaceID) {
+			return
+		}
+	}
+
+	d.enqueueJob(c, request.Type, request.Params)
+}
+
+// GetJob returns the status, progress and result of a job
+func (d *Deps) GetJob(c *gin.Context) {
+	objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid job ID"})
+		return
+	}
+
+	job, err := d.Jobs.Get(c.Request.Context(), objID)
+	if err != nil {
+		if errors.Is(err, jobs.ErrJobNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "success", "data": job})
+}
+
+// GetJobEvents streams the events of a job, replaying the ones after Last-Event-ID
+func (d *Deps) GetJobEvents(c *gin.Context) {
+	objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid job ID"})
+		return
+	}
+
+	if _, err := d.Jobs.Get(c.Request.Context(), objID); err != nil {
+		if errors.Is(err, jobs.ErrJobNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	lastID, _ := lastEventID(c)
+	d.streamEvents(c, jobs.StreamID(objID), lastID)
+}
+
+// CancelJob cancels a queued or running job
+func (d *Deps) CancelJob(c *gin.Context) {
+	objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid job ID"})
+		return
+	}
+
+	job, err := d.Jobs.Cancel(c.Request.Context(), objID)
+	if err != nil {
+		if errors.Is(err, jobs.ErrJobNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "success", "data": job})
+}
@@ -2,221 +2,640 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"image"
-	"image/png"
-	"io/ioutil"
+	"io"
 	"log"
-	"main/db"
+	"main/convert"
+	"main/fetch"
+	"main/jobs"
 	"main/models"
-	"main/utils"
+	"main/repo"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/disintegration/imaging"
 	"github.com/gen2brain/go-fitz"
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func ConvertPDFToImages(c *gin.Context) {
+// ConvertPDFToImages enqueues a job converting the document of a slide, a PDF,
+// a presentation or a set of images, to slide images
+func (d *Deps) ConvertPDFToImages(c *gin.Context) {
 	slideID := c.Param("slide_id")
 	fmt.Println("*** /convert-pdf-to-images ***")
-	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
-	defer cancel()
 
-	objID, err := primitive.ObjectIDFromHex(slideID)
+	slide, err := d.findSlide(c.Request.Context(), slideID)
 	if err != nil {
-		log.Println("Invalid slide ID", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid slide ID"})
+		respondSlideError(c, err)
 		return
 	}
 
-	// Find slide
-	var slide bson.M
-	slideResult := db.DB.Collection("slides").FindOne(ctx, bson.M{"_id": objID})
-	if err := slideResult.Decode(&slide); err != nil {
-		if err == mongo.ErrNoDocuments {
-			log.Println("Slide not found", err)
-			c.JSON(http.StatusNotFound, gin.H{"error": "Slide not found"})
-		} else {
-			log.Println("Error finding slide", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error finding slide"})
-		}
+	if slide.UploadStartedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "The upload of this slide has not been completed"})
 		return
 	}
 
-	pdfURL, ok := slide["pdf_url"].(string)
-	if !ok || pdfURL == "" {
+	if slide.PDFKey == "" && slide.PDFURL == "" && len(slide.ImageSourceKeys) == 0 {
 		log.Println("PDF URL not found")
 		c.JSON(http.StatusNotFound, gin.H{"error": "PDF URL not found"})
 		return
 	}
 
-	log.Println("pdfURL", pdfURL)
+	mode := c.DefaultQuery("mode", ConvertModeSkip)
+	if mode != ConvertModeSkip && mode != ConvertModeReplace && mode != ConvertModeAppend {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mode must be skip, replace or append"})
+		return
+	}
 
-	c.Writer.Header().Set("Content-Type", "text/event-stream")
-	c.Writer.Header().Set("Cache-Control", "no-cache")
-	c.Writer.Header().Set("Connection", "keep-alive")
-	c.Writer.Flush()
+	// Converting again is a no-op unless asked to replace or append
+	if mode == ConvertModeSkip {
+		count, err := d.countSlideImages(c.Request.Context(), slideID)
+		if err != nil {
+			log.Println("Error counting slide images", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if count > 0 {
+			c.JSON(http.StatusOK, gin.H{"status": "skipped", "total_images": count})
+			return
+		}
+	}
 
-	sendSSE := func(message string) {
-		fmt.Fprintf(c.Writer, "data: %s\n\n", message)
-		c.Writer.Flush()
+	params := map[string]string{"slide_id": slideID, "mode": mode}
+	if err := d.renderQuery(c, params); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	sendSSE("Downloading PDF")
+	d.enqueueJob(c, JobTypeConvertPDF, params)
+}
 
-	// Download the PDF
-	response, err := http.Get(pdfURL)
+// Conversion modes, for slides that already have slide images
+const (
+	ConvertModeSkip    = "skip"
+	ConvertModeReplace = "replace"
+	ConvertModeAppend  = "append"
+)
+
+var (
+	errFileTooLarge    = errors.New("file is too large")
+	errPDFTooManyPages = errors.New("PDF has too many pages")
+)
+
+// convertPDFToImagesJob downloads the document of a slide to a temp dir,
+// converting presentations to PDF, then renders, uploads and saves its pages
+// with a pool of workers so that only a page per worker is held in memory
+func (d *Deps) convertPDFToImagesJob(ctx context.Context, job *models.Job, report jobs.ReportFunc) (bson.M, error) {
+	slideID := job.Params["slide_id"]
+
+	slide, err := d.findSlide(ctx, slideID)
 	if err != nil {
-		log.Println("Error downloading PDF", err)
-		sendSSE("Error downloading PDF")
-		return
+		return nil, err
 	}
-	defer response.Body.Close()
 
-	pdfBytes, err := ioutil.ReadAll(response.Body)
+	mode := job.Params["mode"]
+	switch mode {
+	case "":
+		mode = ConvertModeSkip
+	case ConvertModeSkip, ConvertModeReplace, ConvertModeAppend:
+	default:
+		return nil, fmt.Errorf("unknown conversion mode: %s", mode)
+	}
+	existing, err := d.findSlideImagesBySlideID(slideID)
 	if err != nil {
-		log.Println("Error reading PDF response", err)
-		sendSSE("Error reading PDF response")
-		return
+		return nil, err
+	}
+	if len(existing) > 0 && mode == ConvertModeSkip {
+		return bson.M{"total_images": len(existing), "skipped": true}, nil
+	}
+	firstOrder := 0
+	if mode == ConvertModeAppend {
+		for _, slideImage := range existing {
+			if slideImage.Order >= firstOrder {
+				firstOrder = slideImage.Order + 1
+			}
+		}
 	}
 
-	// Create a temporary directory for the PDF and images
-	tmpDir, err := os.MkdirTemp(".", "fitz")
+	// Create a temporary directory for the document and images
+	tmpDir, err := os.MkdirTemp("", "fitz")
 	if err != nil {
-		log.Println("Error creating temp directory", err)
-		sendSSE("Error creating temp directory")
-		return
+		return nil, fmt.Errorf("error creating temp directory: %v", err)
 	}
 	defer os.RemoveAll(tmpDir)
 
-	// Save the PDF to the temporary directory
-	tempPDFPath := filepath.Join(tmpDir, "document.pdf")
-	if err := ioutil.WriteFile(tempPDFPath, pdfBytes, 0644); err != nil {
-		log.Println("Error writing PDF to file", err)
-		sendSSE("Error writing PDF to file")
-		return
+	report(0, 0, "Downloading document")
+
+	var open func() (pageRenderer, error)
+	var numPages int
+	if keys := slide.ImageSourceKeys; len(keys) > 0 {
+		paths, err := d.downloadImages(ctx, keys, tmpDir)
+		if err != nil {
+			return nil, err
+		}
+		open = openImages(paths)
+		numPages = len(paths)
+	} else {
+		sourcePath := filepath.Join(tmpDir, "source")
+		if err := d.downloadFile(ctx, slide.PDFKey, slide.PDFURL, sourcePath, downloadProgress(report)); err != nil {
+			return nil, err
+		}
+
+		open, numPages, err = d.openDocument(ctx, sourcePath, tmpDir, report)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if numPages > d.Config.PDFMaxPages {
+		return nil, fmt.Errorf("%w: %d, the limit is %d", errPDFTooManyPages, numPages, d.Config.PDFMaxPages)
 	}
 
-	sendSSE("Converting PDF to images")
+	report(0, numPages, "Converting PDF to images")
 
-	// Convert PDF to images
-	images, err := pdfToImages(tempPDFPath)
+	opts := d.renderFromParams(job.Params)
+	created, err := d.convertPages(ctx, slideID, tmpDir, numPages, firstOrder, opts, open, report)
 	if err != nil {
-		log.Println("Error converting PDF to images", err)
-		sendSSE("Error converting PDF to images")
-		return
+		return nil, fmt.Errorf("error converting PDF to images: %v", err)
 	}
 
-	sendSSE(fmt.Sprintf(`{"totalImages": %d}`, len(images)))
-	index := 0
-	for _, img := range images {
-		fileName := generateFileName()
-		imagePath := filepath.Join(tmpDir, fileName)
-		err = saveImageToFile(img, imagePath)
-		if err != nil {
-			log.Println("Error saving image to file", err)
-			sendSSE("Error saving image to file")
-			return
+	if mode == ConvertModeReplace && len(existing) > 0 {
+		report(numPages, numPages, fmt.Sprintf("Replacing %d slide images", len(existing)))
+		err = d.replaceSlideImages(ctx, slideID, existing, created)
+	} else {
+		err = d.insertSlideImages(ctx, created)
+	}
+	if err != nil {
+		d.deleteSlideImageDocs(created)
+		d.deleteSlideImageFiles(created)
+		return nil, fmt.Errorf("error saving slide images: %v", err)
+	}
+
+	return bson.M{"total_images": numPages, "mode": mode, "replaced": len(existing)}, nil
+}
+
+// replaceSlideImages swaps the slide images of a slide for new ones. Orders are
+// unique per slide, so the new ones are saved after the orders of the old ones
+// and take their own orders once the old ones are gone, a failure before that
+// leaves the old ones untouched. The files, quiz questions and flashcards of
+// the old ones are then deleted along with the exported audio of the slide,
+// which no longer matches
+func (d *Deps) replaceSlideImages(ctx context.Context, slideID string, old []models.SlideImage, slideImages []models.SlideImage) error {
+	ids := make(bson.A, len(old))
+	hexIDs := make(bson.A, len(old))
+	offset := 0
+	for i, slideImage := range old {
+		ids[i] = slideImage.ID
+		hexIDs[i] = slideImage.ID.Hex()
+		if slideImage.Order >= offset {
+			offset = slideImage.Order + 1
 		}
-		sendSSE(fmt.Sprintf("Uploading image %d to S3", index+1))
-		err = uploadFileToS3(c, slideID, imagePath, fileName, "image/png", index)
+	}
+
+	for i := range slideImages {
+		slideImages[i].Order += offset
+	}
+	if err := d.insertSlideImages(ctx, slideImages); err != nil {
+		return err
+	}
+	if _, err := d.SlideImages.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+		return err
+	}
+
+	// In order, each order is free once the slide image holding it has moved
+	for i := range slideImages {
+		slideImages[i].Order -= offset
+		_, err := d.SlideImages.UpdateOne(ctx, repo.ByID(slideImages[i].ID), bson.M{"$set": bson.M{"order": slideImages[i].Order}})
 		if err != nil {
-			log.Println("Error uploading image to S3", err)
-			sendSSE("Error uploading image to S3")
-			return
+			// The slide images are still in order, only further apart
+			log.Println("Error moving slide image of slide", slideID, err)
+			break
 		}
-		sendSSE(fmt.Sprintf(`{"processedImage": %d}`, index+1))
-		index++
 	}
 
-	sendSSE("PDF converted to images successfully")
-	sendSSE("[DONE]") // Indicate the process is done
+	d.deleteSlideImageFiles(old)
+	byImage := bson.M{"slide_image_id": bson.M{"$in": hexIDs}}
+	if _, err := d.QuizQuestions.DeleteMany(ctx, byImage); err != nil {
+		log.Println("Error deleting quiz questions of replaced slide images", err)
+	}
+	if _, err := d.Flashcards.DeleteMany(ctx, byImage); err != nil {
+		log.Println("Error deleting flashcards of replaced slide images", err)
+	}
+
+	slide, err := d.findSlide(ctx, slideID)
+	if err == nil && slide.AudioExportKey != "" {
+		_, err = d.Slides.UpdateOne(ctx, repo.ByID(slide.ID), bson.M{
+			"$unset": bson.M{"audio_export_key": "", "audio_export_duration_ms": "", "audio_exported_at": ""},
+		})
+		if err == nil {
+			d.deleteStorageKey(slide.AudioExportKey)
+		}
+	}
+	if err != nil {
+		log.Println("Error removing exported audio of slide", slideID, err)
+	}
+	return nil
 }
 
-func pdfToImages(pdfPath string) ([]image.Image, error) {
-	doc, err := fitz.New(pdfPath)
+// openDocument detects the type of a downloaded document, converting
+// presentations to PDF, and returns how to open it and its number of pages
+func (d *Deps) openDocument(ctx context.Context, sourcePath string, tmpDir string, report jobs.ReportFunc) (func() (pageRenderer, error), int, error) {
+	fileType, err := convert.Detect(sourcePath)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	defer doc.Close()
+	log.Println("Document type:", fileType.MIME)
+
+	switch fileType.Kind {
+	case convert.KindImage:
+		return openImages([]string{sourcePath}), 1, nil
 
-	var images []image.Image
-	for n := 0; n < doc.NumPage(); n++ {
-		img, err := doc.Image(n)
+	case convert.KindPresentation:
+		if d.Converter == nil {
+			return nil, 0, convert.ErrNoConverter
+		}
+		report(0, 0, "Converting presentation to PDF")
+		// Converters go by the extension
+		presentationPath := sourcePath + fileType.Extension
+		if err := os.Rename(sourcePath, presentationPath); err != nil {
+			return nil, 0, err
+		}
+		outputDir := filepath.Join(tmpDir, "pdf")
+		if err := os.Mkdir(outputDir, 0755); err != nil {
+			return nil, 0, err
+		}
+		pdfPath, err := d.Converter.ToPDF(ctx, presentationPath, outputDir)
 		if err != nil {
-			return nil, err
+			return nil, 0, fmt.Errorf("error converting presentation to PDF: %v", err)
 		}
-		images = append(images, img)
+		sourcePath = pdfPath
+	}
+
+	doc, err := fitz.New(sourcePath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error opening PDF: %v", err)
+	}
+	numPages := doc.NumPage()
+	doc.Close()
+	return openPDF(sourcePath), numPages, nil
+}
+
+// downloadImages downloads the source images of a slide, they must all be images
+func (d *Deps) downloadImages(ctx context.Context, keys []string, tmpDir string) ([]string, error) {
+	if len(keys) > d.Config.PDFMaxPages {
+		return nil, fmt.Errorf("%w: %d, the limit is %d", errPDFTooManyPages, len(keys), d.Config.PDFMaxPages)
 	}
 
-	return images, nil
+	paths := make([]string, len(keys))
+	for i, key := range keys {
+		paths[i] = filepath.Join(tmpDir, fmt.Sprintf("source-%d", i))
+		if err := d.downloadFile(ctx, key, "", paths[i], nil); err != nil {
+			return nil, err
+		}
+		fileType, err := convert.Detect(paths[i])
+		if err != nil {
+			return nil, fmt.Errorf("image %d: %v", i+1, err)
+		}
+		if fileType.Kind != convert.KindImage {
+			return nil, fmt.Errorf("image %d: %w: %s", i+1, convert.ErrUnsupportedType, fileType.MIME)
+		}
+	}
+	return paths, nil
 }
 
-func saveImageToFile(img image.Image, path string) error {
+// downloadFile streams a file from storage, or from url for slides created
+// before storage keys, to path, failing once it exceeds PDF_MAX_BYTES. Remote
+// downloads go through the fetcher and report their progress if progress is set
+func (d *Deps) downloadFile(ctx context.Context, key string, url string, path string, progress fetch.ProgressFunc) error {
+	if key == "" && url == "" {
+		return fmt.Errorf("PDF URL not found")
+	}
+
 	file, err := os.Create(path)
 	if err != nil {
-		return err
+		return fmt.Errorf("error creating file: %v", err)
 	}
 	defer file.Close()
 
-	err = png.Encode(file, img)
+	if key == "" {
+		_, err := d.Fetcher.Download(ctx, url, file, progress)
+		if errors.Is(err, fetch.ErrTooLarge) {
+			return errFileTooLarge
+		}
+		if err != nil {
+			return fmt.Errorf("error downloading file: %w", err)
+		}
+		return file.Close()
+	}
+
+	body, err := d.Storage.Get(ctx, key)
 	if err != nil {
-		return err
+		return fmt.Errorf("error reading file: %w", err)
+	}
+	defer body.Close()
+
+	n, err := io.Copy(file, io.LimitReader(body, d.Config.PDFMaxBytes+1))
+	if err != nil {
+		return fmt.Errorf("error writing file: %v", err)
+	}
+	if n > d.Config.PDFMaxBytes {
+		return errFileTooLarge
+	}
+	return file.Close()
+}
+
+// downloadProgress reports the progress of a download once per megabyte
+func downloadProgress(report jobs.ReportFunc) fetch.ProgressFunc {
+	const step = 1 << 20
+	var reported int64
+	return func(read int64, total int64) {
+		if read-reported < step && read != total {
+			return
+		}
+		reported = read
+		if total > 0 {
+			report(0, 0, fmt.Sprintf("Downloading document, %.1f of %.1f MB", float64(read)/step, float64(total)/step))
+		} else {
+			report(0, 0, fmt.Sprintf("Downloading document, %.1f MB", float64(read)/step))
+		}
 	}
+}
 
+// pageRenderer renders the pages of a document, a renderer is used by one
+// worker at a time
+type pageRenderer interface {
+	// Render returns the image of page n and its text and links, if any
+	Render(n int, opts renderOptions) (image.Image, string, []string, error)
+	Close() error
+}
+
+// pdfRenderer renders the pages of a PDF with its own fitz document
+type pdfRenderer struct {
+	doc *fitz.Document
+}
+
+func openPDF(path string) func() (pageRenderer, error) {
+	return func() (pageRenderer, error) {
+		doc, err := fitz.New(path)
+		if err != nil {
+			return nil, fmt.Errorf("error opening PDF: %v", err)
+		}
+		return &pdfRenderer{doc: doc}, nil
+	}
+}
+
+func (r *pdfRenderer) Render(n int, opts renderOptions) (image.Image, string, []string, error) {
+	img, err := r.doc.ImageDPI(n, opts.DPI)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("error rendering page: %v", err)
+	}
+	text, links := pageText(r.doc, n)
+	return img, text, links, nil
+}
+
+func (r *pdfRenderer) Close() error {
+	return r.doc.Close()
+}
+
+// imageRenderer decodes image files as pages, rotated upright and scaled down
+// to the width of a 13.33 inch slide at the render DPI
+type imageRenderer struct {
+	paths []string
+}
+
+func openImages(paths []string) func() (pageRenderer, error) {
+	return func() (pageRenderer, error) {
+		return &imageRenderer{paths: paths}, nil
+	}
+}
+
+func (r *imageRenderer) Render(n int, opts renderOptions) (image.Image, string, []string, error) {
+	img, err := imaging.Open(r.paths[n], imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("error decoding image: %v", err)
+	}
+	maxSize := int(opts.DPI * 40 / 3)
+	if img.Bounds().Dx() > maxSize || img.Bounds().Dy() > maxSize {
+		img = imaging.Fit(img, maxSize, maxSize, imaging.Lanczos)
+	}
+	return img, "", nil, nil
+}
+
+func (r *imageRenderer) Close() error {
 	return nil
 }
 
-func uploadFileToS3(c *gin.Context, slideID string, filePath string, fileName string, contentType string, index int) error {
-	file, err := os.Open(filePath)
+// convertPages renders and uploads the pages of a document with PDF_WORKERS
+// workers, each with its own renderer, and returns them as slide images
+// starting at firstOrder, for the caller to save. If a page fails, the files
+// already uploaded are removed again
+func (d *Deps) convertPages(ctx context.Context, slideID string, tmpDir string, numPages int, firstOrder int, opts renderOptions, open func() (pageRenderer, error), report jobs.ReportFunc) ([]models.SlideImage, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		done     int
+		created  = make([]models.SlideImage, numPages)
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+		cancel()
+	}
+
+	pageNumbers := make(chan int)
+	workers := d.Config.PDFWorkers
+	if workers > numPages {
+		workers = numPages
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			renderer, err := open()
+			if err != nil {
+				fail(err)
+				return
+			}
+			defer renderer.Close()
+
+			for n := range pageNumbers {
+				slideImage, err := d.convertPage(ctx, renderer, slideID, tmpDir, n, opts)
+				if err != nil {
+					fail(fmt.Errorf("page %d: %v", n+1, err))
+					return
+				}
+				slideImage.Order = firstOrder + n
+
+				// Reported under the lock so progress never goes backwards
+				mu.Lock()
+				created[n] = slideImage
+				done++
+				report(done, numPages, fmt.Sprintf("Processed image %d", n+1))
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for n := 0; n < numPages; n++ {
+		select {
+		case pageNumbers <- n:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(pageNumbers)
+	wg.Wait()
+
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	if firstErr != nil {
+		d.deleteSlideImageFiles(created)
+		return nil, firstErr
+	}
+	return created, nil
+}
+
+// convertPage renders and uploads a single page and its thumbnail
+func (d *Deps) convertPage(ctx context.Context, renderer pageRenderer, slideID string, tmpDir string, n int, opts renderOptions) (models.SlideImage, error) {
+	if err := ctx.Err(); err != nil {
+		return models.SlideImage{}, err
+	}
+
+	img, text, links, err := renderer.Render(n, opts)
 	if err != nil {
-		return err
+		return models.SlideImage{}, err
+	}
+
+	fileName := generateFileName() + "." + opts.Format
+	key, err := d.uploadImage(ctx, slideID, tmpDir, fileName, img, opts)
+	if err != nil {
+		return models.SlideImage{}, err
+	}
+	thumbnailKey, err := d.uploadImage(ctx, slideID, tmpDir, "thumbnails/"+fileName, d.thumbnail(img), opts)
+	if err != nil {
+		d.deleteStorageKey(key)
+		return models.SlideImage{}, err
 	}
-	defer file.Close()
 
-	awsPath := fmt.Sprintf("slides/%s/%s", slideID, fileName)
+	slideImage := models.SlideImage{
+		SlideID:       slideID,
+		ImageKey:      key,
+		ThumbnailKey:  thumbnailKey,
+		Order:         n,
+		ExtractedText: text,
+		Links:         links,
+	}
+	return slideImage, nil
+}
 
-	s3session := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(utils.AWS_REGION),
-	}))
-	uploader := s3.New(s3session)
-	_, err = uploader.PutObject(&s3.PutObjectInput{
-		Bucket:      aws.String(utils.AWS_BUCKET_NAME),
-		Key:         aws.String(awsPath),
-		Body:        file,
-		ContentType: aws.String(contentType),
-	})
+// uploadImage encodes an image to a temp file and uploads it under the slide
+func (d *Deps) uploadImage(ctx context.Context, slideID string, tmpDir string, fileName string, img image.Image, opts renderOptions) (string, error) {
+	imagePath := filepath.Join(tmpDir, generateFileName())
+	err := saveImageToFile(img, imagePath, opts)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("error saving image to file: %v", err)
 	}
+	defer os.Remove(imagePath)
 
-	url := fmt.Sprintf("https://%s.s3.amazonaws.com/%s", utils.AWS_BUCKET_NAME, awsPath)
-	log.Println("Uploaded file URL:", url)
+	key, err := d.uploadFileToStorage(ctx, slideID, imagePath, fileName, imageContentType(opts.Format))
+	if err != nil {
+		return "", fmt.Errorf("error uploading image to storage: %v", err)
+	}
+	return key, nil
+}
 
-	if contentType == "image/png" {
-		slideImage := models.SlideImage{
-			ID:        primitive.NewObjectID(),
-			SlideID:   slideID,
-			ImageURL:  url,
-			Order:     index,
-			CreatedAt: time.Now(),
-			UpdatedAt: time.Now(),
+// deleteSlideImageDocs removes saved slide images, which may have been saved
+// only in part
+func (d *Deps) deleteSlideImageDocs(slideImages []models.SlideImage) {
+	ids := bson.A{}
+	for _, slideImage := range slideImages {
+		if !slideImage.ID.IsZero() {
+			ids = append(ids, slideImage.ID)
 		}
-		result, err := db.DB.Collection(collectionNameSlideImages).InsertOne(context.TODO(), slideImage)
-		if err != nil {
-			return err
+	}
+	_, err := d.SlideImages.DeleteMany(context.Background(), bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		log.Println("Error deleting slide images", err)
+	}
+}
+
+// pageText returns the embedded text and link targets of a page. Scanned pages
+// have none, and a page whose text cannot be read is still converted
+func pageText(doc *fitz.Document, n int) (string, []string) {
+	text, err := doc.Text(n)
+	if err != nil {
+		log.Printf("Error extracting text of page %d: %v", n+1, err)
+	}
+
+	links, err := doc.Links(n)
+	if err != nil {
+		log.Printf("Error extracting links of page %d: %v", n+1, err)
+	}
+	var uris []string
+	seen := map[string]bool{}
+	for _, link := range links {
+		if link.URI != "" && !seen[link.URI] {
+			seen[link.URI] = true
+			uris = append(uris, link.URI)
 		}
-		log.Println("Inserted slide image with ID:", result.InsertedID)
 	}
 
+	return strings.TrimSpace(text), uris
+}
+
+// uploadFileToStorage uploads a file of a slide to storage and returns its key
+func (d *Deps) uploadFileToStorage(ctx context.Context, slideID string, filePath string, fileName string, contentType string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	key := fmt.Sprintf("slides/%s/%s", slideID, fileName)
+
+	err = d.Storage.Put(ctx, key, file, contentType)
+	if err != nil {
+		return "", err
+	}
+
+	log.Println("Uploaded file key:", key)
+	return key, nil
+}
+
+// insertSlideImages saves new slide images in order
+func (d *Deps) insertSlideImages(ctx context.Context, slideImages []models.SlideImage) error {
+	if len(slideImages) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	for i := range slideImages {
+		slideImages[i].ID = primitive.NewObjectID()
+		slideImages[i].CreatedAt = now
+		slideImages[i].UpdatedAt = now
+	}
+
+	if err := d.SlideImages.InsertMany(ctx, slideImages); err != nil {
+		return err
+	}
+	log.Println("Inserted slide images:", len(slideImages))
 	return nil
 }
@@ -5,93 +5,100 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"main/db"
+	"main/credits"
+	"main/jobs"
+	"main/llm"
 	"main/models"
-	"main/utils"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/sashabaranov/go-openai"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-// GenerateQuizQuestions is a gin handler to generate quiz questions from slide images
-func GenerateQuizQuestions(c *gin.Context) {
+const collectionNameQuizQuestions = "quiz_questions"
+
+// GenerateQuizQuestions is a gin handler that enqueues a job generating quiz questions from slide images
+func (d *Deps) GenerateQuizQuestions(c *gin.Context) {
 	slideID := c.Param("slide_id")
 	log.Println("*** /generate-quiz-questions ***")
 
+	if _, err := primitive.ObjectIDFromHex(slideID); err != nil {
+		log.Println("Invalid slide ID", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid slide ID"})
+		return
+	}
+
+	d.enqueueJob(c, JobTypeGenerateQuiz, map[string]string{"slide_id": slideID})
+}
+
+// generateQuizQuestionsJob generates quiz questions for every slide image of a slide
+func (d *Deps) generateQuizQuestionsJob(ctx context.Context, job *models.Job, report jobs.ReportFunc) (bson.M, error) {
+	slideID := job.Params["slide_id"]
+
 	// Retrieve all slide images for the specified slide ID
-	slideImages, err := findSlideImagesBySlideIDQuiz(slideID)
+	slideImages, err := d.findSlideImagesBySlideID(slideID)
 	if err != nil {
-		log.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return nil, err
 	}
 
 	log.Println("Found slide images:", len(slideImages))
 
-	var allQuestions []models.QuizQA
+	totalQuestions := 0
 	var contextStr string
 
-	// Process in chunks of 10 slide images
+	// Process in chunks of 5 slide images
 	for i, slideImage := range slideImages {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		log.Println("Processing slide image", i+1)
-		generatedText, ok := slideImage["generated_text"].(string)
-		if !ok || generatedText == "" {
-			log.Println("Generated text not found")
-			c.JSON(http.StatusNotFound, gin.H{"error": "Generated text not found"})
-			return
+		generatedText := slideImage.GeneratedText
+		if generatedText == "" {
+			return nil, fmt.Errorf("generated text not found")
 		}
-		contextStr += fmt.Sprintf("Slide ID: %s, Slide Image ID: %s\n%s\n\n", slideID, slideImage["_id"].(primitive.ObjectID).Hex(), generatedText)
+		slideImageID := slideImage.ID.Hex()
+		contextStr += fmt.Sprintf("Slide ID: %s, Slide Image ID: %s\n%s\n\n", slideID, slideImageID, generatedText)
 
 		log.Println("Context length:", len(contextStr))
-		// Every 10 slide images, generate 20 quiz questions
+		// Every 5 slide images, generate 10 quiz questions
 		if (i+1)%5 == 0 || i+1 == len(slideImages) {
-			slideImageID := slideImage["_id"].(primitive.ObjectID).Hex()
-			questions, err := generateQuizQuestions(contextStr, slideID, slideImageID, 10)
+			report(i, len(slideImages), fmt.Sprintf("Generating quiz questions up to slide image %d", i+1))
+
+			questions, err := d.generateQuizQuestions(ctx, contextStr, slideID, slideImageID, 10)
 			if err != nil {
-				log.Println("Error generating quiz questions", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
+				return nil, fmt.Errorf("error generating quiz questions: %v", err)
 			}
 
 			log.Println("Generated questions:", len(questions))
 
 			// Store generated questions in the database
-			if err := storeQuizQuestions(questions); err != nil {
-				log.Println("Error storing quiz questions", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
+			if err := d.storeQuizQuestions(questions); err != nil {
+				return nil, fmt.Errorf("error storing quiz questions: %v", err)
 			}
 
 			log.Println("Stored questions in the database")
 
-			allQuestions = append(allQuestions, questions...)
+			totalQuestions += len(questions)
 			contextStr = "" // Reset context for next chunk
 
+			report(i+1, len(slideImages), fmt.Sprintf("Generated %d quiz questions", totalQuestions))
 		}
-
-		// if (i+1)%5 == 0 || i+1 == len(slideImages) {
-		// 	break // For testing purposes, only process the first slide image
-		// }
-
 	}
 
-	c.JSON(http.StatusOK, gin.H{"status": "success", "data": allQuestions})
+	return bson.M{"total_questions": totalQuestions}, nil
 }
 
 // Route to return list of slides based on if they have quiz questions
-func GetSlidesWithQuizQuestions(c *gin.Context) {
+func (d *Deps) GetSlidesWithQuizQuestions(c *gin.Context) {
 	log.Println("*** /slides-with-quiz-questions ***")
 	ctx, cancel := context.WithTimeout(context.Background(), 360*time.Second)
 	defer cancel()
 
 	// Find all slide IDs with quiz questions
-	slideIDs, err := db.DB.Collection("quiz_questions").Distinct(ctx, "slide_id", bson.M{})
+	slideIDs, err := d.QuizQuestions.Distinct(ctx, "slide_id", notTrashed(bson.M{}))
 	if err != nil {
 		log.Println("Error finding slides with quiz questions", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -100,30 +107,43 @@ func GetSlidesWithQuizQuestions(c *gin.Context) {
 
 	log.Println("Found slides with quiz questions")
 
-	var slideIDStrings []string
+	var slideObjIDs []primitive.ObjectID
 	for _, id := range slideIDs {
-		slideIDStrings = append(slideIDStrings, id.(string))
+		if objID, err := primitive.ObjectIDFromHex(id); err == nil {
+			slideObjIDs = append(slideObjIDs, objID)
+		}
 	}
 
-	log.Println("Slide IDs with quiz questions:", slideIDStrings)
+	log.Println("Slide IDs with quiz questions:", slideObjIDs)
 
-	// Get slide details
-	var slides []models.Slide
-	for _, slideID := range slideIDStrings {
-		slide, err := findSlideByID(slideID)
-		if err != nil {
-			log.Println("Error finding slide by ID", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-		slides = append(slides, slide)
+	// Get the slide details of the slides the caller can access, leaving out
+	// the trash
+	filter, err := d.slideFilter(c)
+	if err != nil {
+		log.Println("Error finding user spaces", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	filter["_id"] = bson.M{"$in": slideObjIDs}
+
+	slides, err := d.Slides.Find(ctx, filter, nil)
+	if err != nil {
+		log.Println("Error finding slides", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err = d.presignSlides(ctx, slides); err != nil {
+		log.Println("Error presigning slides", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"status": "success", "data": slides})
 }
 
 // Delete Quiz Question by Quiz ID
-func DeleteQuizQuestion(c *gin.Context) {
+func (d *Deps) DeleteQuizQuestion(c *gin.Context) {
 	quizID := c.Param("quiz_id")
 	log.Println("*** /quiz-questions ***")
 
@@ -137,7 +157,8 @@ func DeleteQuizQuestion(c *gin.Context) {
 		return
 	}
 
-	_, err = db.DB.Collection("quiz_questions").DeleteOne(ctx, bson.M{"_id": quizObjID})
+	// Deleted quiz questions go to the trash
+	_, err = moveToTrash(ctx, d.QuizQuestions, quizObjID.Hex())
 	if err != nil {
 		log.Println("Error deleting quiz questions", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -148,33 +169,25 @@ func DeleteQuizQuestion(c *gin.Context) {
 }
 
 // Get all quiz questions for a slide
-func GetQuizQuestions(c *gin.Context) {
+func (d *Deps) GetQuizQuestions(c *gin.Context) {
 	slideID := c.Param("slide_id")
 	log.Println("*** /quiz-questions ***")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 360*time.Second)
 	defer cancel()
 
-	cursor, err := db.DB.Collection("quiz_questions").Find(ctx, bson.M{"slide_id": slideID})
+	questions, err := d.QuizQuestions.Find(ctx, notTrashed(bson.M{"slide_id": slideID}), nil)
 	if err != nil {
 		log.Println("Error finding quiz questions", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	defer cursor.Close(ctx)
-
-	var questions []models.QuizQA
-	if err = cursor.All(ctx, &questions); err != nil {
-		log.Println("Error decoding quiz questions", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
 
 	c.JSON(http.StatusOK, gin.H{"status": "success", "data": questions})
 }
 
 // Get all quiz questions for a slide image
-func GetQuizQuestionsForSlideImage(c *gin.Context) {
+func (d *Deps) GetQuizQuestionsForSlideImage(c *gin.Context) {
 	slideID := c.Param("slide_id")
 	slideImageID := c.Param("slide_image_id")
 	log.Println("*** /quiz-questions ***")
@@ -182,65 +195,17 @@ func GetQuizQuestionsForSlideImage(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 360*time.Second)
 	defer cancel()
 
-	cursor, err := db.DB.Collection("quiz_questions").Find(ctx, bson.M{"slide_id": slideID, "slide_image_id": slideImageID})
+	questions, err := d.QuizQuestions.Find(ctx, notTrashed(bson.M{"slide_id": slideID, "slide_image_id": slideImageID}), nil)
 	if err != nil {
 		log.Println("Error finding quiz questions", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	defer cursor.Close(ctx)
-
-	var questions []models.QuizQA
-	if err = cursor.All(ctx, &questions); err != nil {
-		log.Println("Error decoding quiz questions", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
 
 	c.JSON(http.StatusOK, gin.H{"status": "success", "data": questions})
 }
 
-func findSlideByID(slideID string) (models.Slide, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	objID, err := primitive.ObjectIDFromHex(slideID)
-	if err != nil {
-		return models.Slide{}, err
-	}
-
-	var slide models.Slide
-	err = db.DB.Collection("slides").FindOne(ctx, bson.M{"_id": objID}).Decode(&slide)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return models.Slide{}, fmt.Errorf("slide not found")
-		}
-		return models.Slide{}, fmt.Errorf("error finding slide: %v", err)
-	}
-	return slide, nil
-}
-
-func findSlideImagesBySlideIDQuiz(slideID string) ([]bson.M, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 360*time.Second)
-	defer cancel()
-
-	opts := options.Find()
-	cursor, err := db.DB.Collection("slide_images").Find(ctx, bson.M{"slide_id": slideID}, opts)
-	if err != nil {
-		log.Println("Error finding slide images", err)
-		return nil, fmt.Errorf("error finding slide images: %v", err)
-	}
-	defer cursor.Close(ctx)
-
-	var slideImages []bson.M
-	if err = cursor.All(ctx, &slideImages); err != nil {
-		log.Println("Error decoding slide images", err)
-		return nil, fmt.Errorf("error decoding slide images: %v", err)
-	}
-	return slideImages, nil
-}
-
-func generateQuizQuestions(contextStr string, slideID string, slideImageID string, numOfQ int) ([]models.QuizQA, error) {
+func (d *Deps) generateQuizQuestions(ctx context.Context, contextStr string, slideID string, slideImageID string, numOfQ int) ([]models.QuizQA, error) {
 	strNumQ := fmt.Sprintf("%d", numOfQ)
 	PROMPT := fmt.Sprintf(`
 	You are a professor. Generate %s quiz questions for a student who wants to review the main concepts of the learning objectives from the following content, make the questions relevant, just based on the important topics of the slides, no course admin type questions, and no questions about professor, assume the student does not have access to the slides when completing quiz. Each question should have 4 answer choices and specify the correct answer. Return the response in JUST JSON format array, nothing else. If there are existing questions, generate questions for other parts of the content.
@@ -266,37 +231,14 @@ func generateQuizQuestions(contextStr string, slideID string, slideImageID strin
 
 	log.Println("Prompt:", PROMPT)
 
-	client := openai.NewClient(utils.OPENAI_API_KEY)
-	result, err := client.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{
-		Model: openai.GPT4o,
-		Messages: []openai.ChatCompletionMessage{
-			{
-				Role:    openai.ChatMessageRoleUser,
-				Content: PROMPT,
-			},
-		},
-		MaxTokens: 4000,
-		ResponseFormat: &openai.ChatCompletionResponseFormat{
-			Type: openai.ChatCompletionResponseFormatTypeJSONObject,
-		},
-	})
-
+	content, err := d.LLM.CompleteJSON(ctx, llm.Prompt{User: PROMPT, MaxTokens: 4000})
 	if err != nil {
 		return nil, err
 	}
 
-	log.Println("Response:", result.Choices[0].Message.Content)
-
-	var questions []models.QuizQA
-	for _, choice := range result.Choices {
-		qas, err := parseQuizQuestions(choice.Message.Content, slideID, slideImageID)
-		if err != nil {
-			return nil, err
-		}
-		questions = append(questions, qas...)
-	}
+	log.Println("Response:", content)
 
-	return questions, nil
+	return parseQuizQuestions(content, slideID, slideImageID)
 }
 
 func parseQuizQuestions(content, slideID, slideImageID string) ([]models.QuizQA, error) {
@@ -326,38 +268,26 @@ func parseQuizQuestions(content, slideID, slideImageID string) ([]models.QuizQA,
 	return qq.QuizQuestions, nil
 }
 
-func storeQuizQuestions(questions []models.QuizQA) error {
+func (d *Deps) storeQuizQuestions(questions []models.QuizQA) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 360*time.Second)
 	defer cancel()
 
-	var docs []interface{}
-	for _, question := range questions {
-		docs = append(docs, question)
-	}
-
-	_, err := db.DB.Collection("quiz_questions").InsertMany(ctx, docs)
-	return err
+	return d.QuizQuestions.InsertMany(ctx, questions)
 }
 
-func getQuizQuestionsForSlideImage(slideID string, slideImageID string) ([]models.QuizQA, error) {
+func (d *Deps) getQuizQuestionsForSlideImage(slideID string, slideImageID string) ([]models.QuizQA, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	cursor, err := db.DB.Collection("quiz_questions").Find(ctx, bson.M{"slide_id": slideID, "slide_image_id": slideImageID})
+	questions, err := d.QuizQuestions.Find(ctx, notTrashed(bson.M{"slide_id": slideID, "slide_image_id": slideImageID}), nil)
 	if err != nil {
 		return nil, fmt.Errorf("error finding quiz questions: %v", err)
 	}
-	defer cursor.Close(ctx)
-
-	var questions []models.QuizQA
-	if err = cursor.All(ctx, &questions); err != nil {
-		return nil, fmt.Errorf("error decoding quiz questions: %v", err)
-	}
 	return questions, nil
 }
 
 // Generate quiz questions for a specific slide image
-func GenerateQuizQuestionsForSlideImage(c *gin.Context) {
+func (d *Deps) GenerateQuizQuestionsForSlideImage(c *gin.Context) {
 	slideID := c.Param("slide_id")
 	slideImageID := c.Param("slide_image_id")
 	log.Println("*** /generate-quiz-questions ***")
@@ -370,7 +300,7 @@ func GenerateQuizQuestionsForSlideImage(c *gin.Context) {
 	}
 
 	// Retrieve slide image
-	slideImage, err := findSlideImageByID(objID)
+	slideImage, err := d.findSlideImageByID(objID)
 	if err != nil {
 		log.Println(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -379,8 +309,8 @@ func GenerateQuizQuestionsForSlideImage(c *gin.Context) {
 
 	log.Println("Found slide image")
 
-	generatedText, ok := slideImage["generated_text"].(string)
-	if !ok || generatedText == "" {
+	generatedText := slideImage.GeneratedText
+	if generatedText == "" {
 		log.Println("Generated text not found")
 		c.JSON(http.StatusNotFound, gin.H{"error": "Generated text not found"})
 		return
@@ -388,8 +318,14 @@ func GenerateQuizQuestionsForSlideImage(c *gin.Context) {
 
 	log.Println("Generated text:", generatedText)
 
+	charge, ok := d.chargeCredits(c, credits.OpGenerateQuiz, 1, slideImageID)
+	if !ok {
+		return
+	}
+	defer refundOnError(c, charge)
+
 	// Retrieve existing questions for the slide image
-	existingQuestions, err := getQuizQuestionsForSlideImage(slideID, slideImageID)
+	existingQuestions, err := d.getQuizQuestionsForSlideImage(slideID, slideImageID)
 	if err != nil {
 		log.Println("Error retrieving existing quiz questions", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -406,7 +342,7 @@ func GenerateQuizQuestionsForSlideImage(c *gin.Context) {
 	}
 
 	// Generate quiz questions
-	questions, err := generateQuizQuestions(contextStr, slideID, slideImageID, 3)
+	questions, err := d.generateQuizQuestions(c.Request.Context(), contextStr, slideID, slideImageID, 3)
 	if err != nil {
 		log.Println("Error generating quiz questions", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -416,7 +352,7 @@ func GenerateQuizQuestionsForSlideImage(c *gin.Context) {
 	log.Println("Generated questions:", len(questions))
 
 	// Store generated questions in the database
-	if err := storeQuizQuestions(questions); err != nil {
+	if err := d.storeQuizQuestions(questions); err != nil {
 		log.Println("Error storing quiz questions", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
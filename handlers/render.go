@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/chai2010/webp"
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+)
+
+// Formats slide images are rendered as
+const (
+	ImageFormatWebP = "webp"
+	ImageFormatJPEG = "jpeg"
+	ImageFormatPNG  = "png"
+)
+
+var errInvalidRenderOptions = errors.New("dpi must be 36-600, quality 1-100 and format webp, jpeg or png")
+
+// renderOptions choose how PDF pages are rendered to slide images
+type renderOptions struct {
+	DPI     float64
+	Format  string
+	Quality int
+}
+
+// defaultRenderOptions returns the render options configured for the server
+func (d *Deps) defaultRenderOptions() renderOptions {
+	return renderOptions{DPI: d.Config.RenderDPI, Format: d.Config.RenderFormat, Quality: d.Config.RenderQuality}
+}
+
+func (o renderOptions) valid() bool {
+	return o.DPI >= 36 && o.DPI <= 600 && o.Quality >= 1 && o.Quality <= 100 && imageContentType(o.Format) != ""
+}
+
+// renderQuery reads the dpi, format and quality query parameters on top of the
+// defaults, as job params
+func (d *Deps) renderQuery(c *gin.Context, params map[string]string) error {
+	opts := d.defaultRenderOptions()
+	if dpi := c.Query("dpi"); dpi != "" {
+		v, err := strconv.ParseFloat(dpi, 64)
+		if err != nil {
+			return errInvalidRenderOptions
+		}
+		opts.DPI = v
+		params["dpi"] = dpi
+	}
+	if format := c.Query("format"); format != "" {
+		opts.Format = format
+		params["format"] = format
+	}
+	if quality := c.Query("quality"); quality != "" {
+		v, err := strconv.Atoi(quality)
+		if err != nil {
+			return errInvalidRenderOptions
+		}
+		opts.Quality = v
+		params["quality"] = quality
+	}
+	if !opts.valid() {
+		return errInvalidRenderOptions
+	}
+	return nil
+}
+
+// renderFromParams reads the options added by renderQuery
+func (d *Deps) renderFromParams(params map[string]string) renderOptions {
+	opts := d.defaultRenderOptions()
+	if dpi, err := strconv.ParseFloat(params["dpi"], 64); err == nil {
+		opts.DPI = dpi
+	}
+	if params["format"] != "" {
+		opts.Format = params["format"]
+	}
+	if quality, err := strconv.Atoi(params["quality"]); err == nil {
+		opts.Quality = quality
+	}
+	return opts
+}
+
+// imageContentType returns the MIME type of an image format, or "" if it is unknown
+func imageContentType(format string) string {
+	switch format {
+	case ImageFormatWebP:
+		return "image/webp"
+	case ImageFormatJPEG:
+		return "image/jpeg"
+	case ImageFormatPNG:
+		return "image/png"
+	}
+	return ""
+}
+
+// encodeImage writes img in the format and quality of opts, quality is ignored
+// for PNG which is always lossless
+func encodeImage(w io.Writer, img image.Image, opts renderOptions) error {
+	switch opts.Format {
+	case ImageFormatWebP:
+		return webp.Encode(w, img, &webp.Options{Quality: float32(opts.Quality)})
+	case ImageFormatJPEG:
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: opts.Quality})
+	case ImageFormatPNG:
+		return png.Encode(w, img)
+	}
+	return fmt.Errorf("unknown image format: %s", opts.Format)
+}
+
+// saveImageToFile encodes img to a new file at path
+func saveImageToFile(img image.Image, path string, opts renderOptions) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := encodeImage(file, img, opts); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// thumbnail scales img down to THUMBNAIL_WIDTH pixels wide
+func (d *Deps) thumbnail(img image.Image) image.Image {
+	return imaging.Resize(img, d.Config.ThumbnailWidth, 0, imaging.Lanczos)
+}
@@ -1,127 +1,161 @@
 package handlers
 
-import "github.com/gin-gonic/gin"
+import (
+	"main/auth"
+	"main/billing"
 
-func SetUpRoutes(r *gin.Engine) {
+	"github.com/gin-gonic/gin"
+)
+
+// SetUpRoutes registers the routes of the handlers of d
+func SetUpRoutes(r *gin.Engine, d *Deps) {
+
+	// Liveness and readiness probes
+	r.GET("/healthz", Healthz)
+	r.GET("/readyz", d.Readyz)
+
+	// Every route except presigned files requires an authenticated user
+	api := r.Group("", d.Auth.RequireUser())
+	admin := auth.RequireAdmin()
+
+	slideOwner := d.requireOwner("slide_id", d.spaceOfSlide)
+	slideImageOwner := d.requireOwner("slide_image_id", d.spaceOfSlideImage)
 
 	// Spaces routes
-	spaceRoutes := r.Group("/space")
+	spaceRoutes := api.Group("/space")
 	{
-		spaceRoutes.GET("/:id", GetSpace)
-		spaceRoutes.POST("/", CreateSpace)
+		spaceRoutes.GET("/:id", d.requireOwner("id", d.spaceOfSpace), d.GetSpace)
+		spaceRoutes.POST("/", d.CreateSpace)
 		// spaceRoutes.PUT("/:id", updateSpace)
-		spaceRoutes.DELETE("/:id", DeleteSpace)
+		spaceRoutes.DELETE("/:id", d.requireOwner("id", d.spaceOfSpace), d.DeleteSpace)
 	}
 
 	// Get a space by ID
-	r.GET("/spaces", GetSpaces)
+	api.GET("/spaces", d.GetSpaces)
 
 	// Get all space slides
-	r.GET("/space-slides/:space_id", GetSpaceSlides)
+	api.GET("/space-slides/:space_id", d.requireOwner("space_id", d.spaceOfSpace), d.GetSpaceSlides)
 
 	// Slides
-	slideRoutes := r.Group("/slide")
+	slideRoutes := api.Group("/slide")
 	{
-		slideRoutes.GET("/:id", GetSlide)
-		slideRoutes.POST("/", CreateSlide)
-		slideRoutes.PUT("/:id", UpdateSlide)
-		slideRoutes.DELETE("/:id", DeleteSlide)
+		slideRoutes.GET("/:id", d.requireOwner("id", d.spaceOfSlide), d.GetSlide)
+		slideRoutes.POST("/", d.CreateSlide)
+		slideRoutes.POST("/upload", d.UploadSlide)
+		slideRoutes.POST("/upload-url", d.CreateSlideUpload)
+		slideRoutes.POST("/:id/upload/complete", d.requireOwner("id", d.spaceOfSlide), d.CompleteSlideUpload)
+		slideRoutes.PUT("/:id", d.requireOwner("id", d.spaceOfSlide), d.UpdateSlide)
+		slideRoutes.DELETE("/:id", d.requireOwner("id", d.spaceOfSlide), d.DeleteSlide)
+		if d.Config.Audio {
+			slideRoutes.POST("/:id/export-audio", d.requireOwner("id", d.spaceOfSlide), d.ExportSlideAudio)
+		}
 
 		// 	// Slide Images
-		slideImageRoutes := slideRoutes.Group("/images/:slide_id")
+		slideImageRoutes := slideRoutes.Group("/images/:slide_id", slideOwner)
 		{
-			slideImageRoutes.GET("/", GetSlideImages)
+			slideImageRoutes.GET("/", d.GetSlideImages)
 		}
 	}
 
 	// Get all slides
-	r.GET("/slides", GetSlides)
+	api.GET("/slides", d.GetSlides)
 
-	// generate audio routes
+	// generate audio routes, only with a text-to-speech provider
 	// Generate audio for a slide
-	r.GET("/generate-audio/:slide_image_id", GenerateAudio2)
+	if d.Config.Audio {
+		api.GET("/generate-audio/:slide_image_id", slideImageOwner, d.GenerateAudio2)
+	}
+
+	// Sentence and word timings of a slide image narration
+	api.GET("/slide-image/:id/captions", d.requireOwner("id", d.spaceOfSlideImage), d.GetSlideImageCaptions)
 
 	// generate text routes
 	// Generate text for a slide image
-	r.GET("/generate-image-text/:slide_image_id", GenerateText)
+	api.GET("/generate-image-text/:slide_image_id", slideImageOwner, d.GenerateText)
 
 	// convert pdf to image routes
 	// Convert PDF to images for a slide
-	r.GET("/convert-pdf-to-images/:slide_id", ConvertPDFToImages)
+	api.GET("/convert-pdf-to-images/:slide_id", slideOwner, d.ConvertPDFToImages)
 
 	// generate all image text
-	r.GET("/generate-all-image-text/:slide_id", GenerateAllImageText)
+	api.GET("/generate-all-image-text/:slide_id", slideOwner, d.GenerateAllImageText)
 
 	// search
-	r.POST("/search", SearchQuestion)
+	api.POST("/search", d.SearchQuestion)
 
 	// generate notes
-	r.POST("/generate-notes/:slide_id", GenerateNotes)
+	api.POST("/generate-notes/:slide_id", slideOwner, d.GenerateNotes)
 
 	// generate all audio
-	r.POST("/generate-all-audio/:slide_id", GenerateAllAudioForSlide)
+	if d.Config.Audio {
+		api.POST("/generate-all-audio/:slide_id", slideOwner, d.GenerateAllAudioForSlide)
+	}
 
 	// generate quiz
-	r.POST("/generate-quiz/:slide_id", GenerateQuizQuestions)
+	api.POST("/generate-quiz/:slide_id", slideOwner, d.GenerateQuizQuestions)
 
-	r.POST("/generate-quiz/:slide_id/:slide_image_id", GenerateQuizQuestionsForSlideImage)
+	api.POST("/generate-quiz/:slide_id/:slide_image_id", slideOwner, slideImageOwner, d.GenerateQuizQuestionsForSlideImage)
 
-	r.GET("/quiz-questions/:slide_id/:slide_image_id", GetQuizQuestionsForSlideImage)
+	api.GET("/quiz-questions/:slide_id/:slide_image_id", slideOwner, d.GetQuizQuestionsForSlideImage)
 
 	// GetSlidesWithQuizQuestions
-	r.GET("/slides-with-quiz-questions", GetSlidesWithQuizQuestions)
+	api.GET("/slides-with-quiz-questions", d.GetSlidesWithQuizQuestions)
 
 	// Get all quiz questions for a slide
-	r.GET("/quiz-questions/:slide_id", GetQuizQuestions)
+	api.GET("/quiz-questions/:slide_id", slideOwner, d.GetQuizQuestions)
 
 	// Delete quiz question by quiz id
-	r.DELETE("/quiz-question/:quiz_id", DeleteQuizQuestion)
+	api.DELETE("/quiz-question/:quiz_id", d.requireOwner("quiz_id", d.spaceOfQuizQuestion), d.DeleteQuizQuestion)
 
 	// Get all flashcards for a slide
-	r.GET("/generate-flashcards/:slide_id", GenerateFlashCards)
+	api.GET("/generate-flashcards/:slide_id", slideOwner, d.GenerateFlashCards)
 
 	// Generate flashcards for a slide image
-	r.GET("/generate-flashcards/:slide_id/:slide_image_id", GenerateFlashcardsForSlideImage)
+	api.GET("/generate-flashcards/:slide_id/:slide_image_id", slideOwner, slideImageOwner, d.GenerateFlashcardsForSlideImage)
 
 	// Get all flashcards for a slide image
-	r.GET("/flashcards/:slide_id/:slide_image_id", GetFlashcardsForSlideImage)
+	api.GET("/flashcards/:slide_id/:slide_image_id", slideOwner, d.GetFlashcardsForSlideImage)
 
 	// Get all slides with flashcards
-	r.GET("/slides-with-flashcards", GetSlidesWithFlashcards)
+	api.GET("/slides-with-flashcards", d.GetSlidesWithFlashcards)
 
 	// Get all flashcards for a slide
-	r.GET("/flashcards/:slide_id", GetFlashcards)
+	api.GET("/flashcards/:slide_id", slideOwner, d.GetFlashcards)
 
 	// Delete flashcard by flashcard id
-	r.DELETE("/flashcard/:flashcard_id", DeleteFlashcard)
+	api.DELETE("/flashcard/:flashcard_id", d.requireOwner("flashcard_id", d.spaceOfFlashcard), d.DeleteFlashcard)
 
 	// Users
-	userRoutes := r.Group("/user")
+	userRoutes := api.Group("/user")
 	{
-		userRoutes.GET("/:user_id", GetUser)
-		userRoutes.POST("/", CreateUser)
+		userRoutes.GET("/:user_id", requireSelf("user_id"), d.GetUser)
+		userRoutes.POST("/", d.CreateUser)
+		if d.Config.Audio {
+			userRoutes.PUT("/:user_id/voice", requireSelf("user_id"), d.SetUserVoice)
+		}
 		// userRoutes.PUT("/:id", updateUser)
-		// userRoutes.DELETE("/:id", deleteUser)
+		userRoutes.DELETE("/:user_id", requireSelf("user_id"), d.DeleteUser)
 
 		// User spaces
-		userSpaceRoutes := userRoutes.Group("/:user_id/space")
+		userSpaceRoutes := userRoutes.Group("/:user_id/space", requireSelf("user_id"))
 		{
-			userSpaceRoutes.GET("/", GetUserSpaces)
-			userSpaceRoutes.PUT("/:space_id", AddSpaceToUser)
-			userSpaceRoutes.DELETE("/:space_id", RemoveSpaceFromUser)
+			userSpaceRoutes.GET("/", d.GetUserSpaces)
+			userSpaceRoutes.PUT("/:space_id", d.AddSpaceToUser)
+			userSpaceRoutes.DELETE("/:space_id", d.RemoveSpaceFromUser)
 		}
 	}
 
 	// Credits
-	creditRoutes := r.Group("/credits")
+	creditRoutes := api.Group("/credits")
 	{
-		creditRoutes.GET("/:user_id", GetUserCredits)
-		creditRoutes.POST("/:user_id/add/:amount", AddCredits)
-		creditRoutes.POST("/:user_id/remove/:amount", RemoveCredits)
+		creditRoutes.GET("/:user_id", requireSelf("user_id"), d.GetUserCredits)
+		creditRoutes.GET("/:user_id/history", requireSelf("user_id"), GetCreditHistory)
+		creditRoutes.POST("/:user_id/add/:amount", admin, d.AddCredits)
+		creditRoutes.POST("/:user_id/remove/:amount", admin, d.RemoveCredits)
 	}
 
 	// Access codes
-	accessCodeRoutes := r.Group("/access-code")
+	accessCodeRoutes := api.Group("/access-code", admin)
 	{
 		accessCodeRoutes.POST("/", CreateAccessCode)
 		accessCodeRoutes.GET("/:id", GetAccessCode)
@@ -130,6 +164,32 @@ func SetUpRoutes(r *gin.Engine) {
 	}
 
 	// Verify access code
-	r.POST("/verify-access-code", VerifyAccessCode)
+	api.POST("/verify-access-code", VerifyAccessCode)
+
+	// Trash, deleted slides, spaces, quiz questions and flashcards
+	api.GET("/trash", d.GetTrash)
+	api.POST("/trash/:id/restore", d.RestoreFromTrash)
+
+	// Background jobs
+	jobRoutes := api.Group("/jobs")
+	{
+		jobRoutes.POST("", d.CreateJob)
+		jobRoutes.GET("/:id", requireJobOwner("id"), d.GetJob)
+		jobRoutes.GET("/:id/events", requireJobOwner("id"), d.GetJobEvents)
+		jobRoutes.DELETE("/:id", requireJobOwner("id"), d.CancelJob)
+	}
+
+	// Billing, the webhook is authenticated by its Stripe signature
+	if billing.Enabled() {
+		api.GET("/billing/products", GetBillingProducts)
+		api.POST("/billing/checkout", CreateCheckout)
+		r.POST("/billing/webhook", StripeWebhook)
+	}
+
+	// Files from the local storage driver
+	if d.Config.StorageDriver == "local" {
+		r.GET("/files/*key", d.ServeFile)
+		r.PUT("/files/*key", d.ReceiveFile)
+	}
 
 }
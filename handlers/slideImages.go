@@ -3,8 +3,6 @@ package handlers
 import (
 	"context"
 	"log"
-	"main/db"
-	"main/models"
 	"net/http"
 	"time"
 
@@ -15,23 +13,24 @@ import (
 const CollectionNameSlideImages = "slide_images"
 
 // get all slide images
-func GetSlideImages(c *gin.Context) {
+func (d *Deps) GetSlideImages(c *gin.Context) {
 	log.Println("getSlideImages")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	slideID := c.Param("slide_id")
-	cursor, err := db.DB.Collection(CollectionNameSlideImages).Find(ctx, bson.M{"slide_id": slideID})
+	slideImages, err := d.SlideImages.Find(ctx, bson.M{"slide_id": slideID}, nil)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	var slideImages []models.SlideImage
-	if err = cursor.All(ctx, &slideImages); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	for i := range slideImages {
+		if err = d.presignSlideImage(ctx, &slideImages[i]); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
 	}
 
 	c.JSON(http.StatusOK, slideImages)
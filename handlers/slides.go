@@ -2,42 +2,44 @@ package handlers
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"main/db"
 	"main/models"
-	"main/utils"
+	"main/repo"
 	"net/http"
-	"os"
 	"reflect"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 const CollectionNameSlides = "slides"
 
 // Get all slides
-func GetSlides(c *gin.Context) {
+func (d *Deps) GetSlides(c *gin.Context) {
 	log.Println("getSlides")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	cursor, err := db.DB.Collection(CollectionNameSlides).Find(ctx, bson.M{})
+	filter, err := d.slideFilter(c)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	var slides []models.Slide
-	if err = cursor.All(ctx, &slides); err != nil {
+	slides, err := d.Slides.Find(ctx, filter, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err = d.presignSlides(ctx, slides); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -46,7 +48,7 @@ func GetSlides(c *gin.Context) {
 }
 
 // GetSlide
-func GetSlide(c *gin.Context) {
+func (d *Deps) GetSlide(c *gin.Context) {
 	log.Println("GetSlide")
 
 	slideID := c.Param("id")
@@ -60,10 +62,9 @@ func GetSlide(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	var slide models.Slide
-	err = db.DB.Collection(CollectionNameSlides).FindOne(ctx, bson.M{"_id": objID}).Decode(&slide)
+	slide, err := d.Slides.Get(ctx, objID)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
+		if err == repo.ErrNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Slide not found"})
 		} else {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -71,11 +72,16 @@ func GetSlide(c *gin.Context) {
 		return
 	}
 
+	if err = d.presignSlide(ctx, slide); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
 	c.JSON(http.StatusOK, slide)
 }
 
 // CreateSlide
-func CreateSlide(c *gin.Context) {
+func (d *Deps) CreateSlide(c *gin.Context) {
 	log.Println("CreateSlide")
 
 	var slide models.Slide
@@ -85,26 +91,41 @@ func CreateSlide(c *gin.Context) {
 		return
 	}
 
+	if !d.requireSpaceAccess(c, slide.SpaceID) {
+		return
+	}
+
 	slide.ID = primitive.NewObjectID()
 	slide.CreatedAt = time.Now()
 	slide.UpdatedAt = time.Now()
 
+	// The slide is new, so no file in storage can belong to it yet
+	if _, ok := db.KeyFromURL(d.Storage, slide.PDFURL); ok || len(slide.ImageSourceURLs) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errUseUpload.Error()})
+		return
+	}
+	if slide.PDFURL != "" {
+		if err := d.Fetcher.Check(slide.PDFURL); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "pdf_url: " + err.Error()})
+			return
+		}
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	result, err := db.DB.Collection(CollectionNameSlides).InsertOne(ctx, slide)
-	if err != nil {
+	if err := d.Slides.Insert(ctx, &slide); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	log.Println("Create created:", result.InsertedID)
+	log.Println("Create created:", slide.ID)
 
-	c.JSON(http.StatusOK, gin.H{"message": "Slide created successfully", "status_code": 200, "result": result})
+	c.JSON(http.StatusOK, gin.H{"message": "Slide created successfully", "status_code": 200, "result": gin.H{"InsertedID": slide.ID}})
 }
 
 // UpdateSlide
-func UpdateSlide(c *gin.Context) {
+func (d *Deps) UpdateSlide(c *gin.Context) {
 	log.Println("UpdateSlide")
 
 	// Get slide id
@@ -124,6 +145,21 @@ func UpdateSlide(c *gin.Context) {
 		return
 	}
 
+	// Moving a slide requires owning the destination space
+	if slide.SpaceID != "" && !d.requireSpaceAccess(c, slide.SpaceID) {
+		return
+	}
+
+	if err := d.TTS.Validate(voiceOptions(slide.Voice)); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := d.setPDFSource(objID, &slide); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "pdf_url: " + err.Error()})
+		return
+	}
+
 	slide.UpdatedAt = time.Now()
 
 	log.Println("Slide:", slide)
@@ -140,142 +176,166 @@ func UpdateSlide(c *gin.Context) {
 		fieldType := field.Type.Kind()
 
 		if fieldType == reflect.Bool || !reflect.DeepEqual(fieldValue, reflect.Zero(field.Type).Interface()) {
-			bsonTag := field.Tag.Get("bson")
-			// Skip if bson tag is not set or is "-"
-			if bsonTag == "" || bsonTag == "-" {
+			bsonTag := strings.Split(field.Tag.Get("bson"), ",")[0]
+			if !editableSlideFields[bsonTag] {
 				continue
 			}
 
-			update[field.Tag.Get("bson")] = fieldValue
+			update[bsonTag] = fieldValue
 		}
 	}
 
-	result, err := db.DB.Collection(CollectionNameSlides).UpdateOne(ctx, bson.M{"_id": objID}, bson.M{"$set": update})
+	changes := bson.M{"$set": update}
+	// A PDF in our storage replaces the URL it was given by
+	if slide.PDFKey != "" {
+		changes["$unset"] = bson.M{"pdf_url": ""}
+	}
+
+	matched, err := d.Slides.UpdateOne(ctx, repo.ByID(objID), changes)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	log.Println("Update result:", result)
+	log.Println("Update matched:", matched)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Slide updated successfully", "status_code": 200, "result": gin.H{"MatchedCount": matched}})
+}
+
+var (
+	errForeignFile = errors.New("files in storage must have been uploaded for this slide")
+	errUseUpload   = errors.New("files are added to a new slide with POST /slide/upload or /slide/upload-url")
+)
+
+// editableSlideFields are the fields UpdateSlide sets, the others are owned by
+// the server or have their own routes
+var editableSlideFields = map[string]bool{
+	"name":            true,
+	"pdf_url":         true,
+	"pdf_key":         true,
+	"space_id":        true,
+	"generated_notes": true,
+	"voice":           true,
+	"updated_at":      true,
+}
+
+// slideKeyFromURL returns the key of a URL in our storage, ok is false for other
+// URLs. Files of a slide are under slides/<slide ID>/ and are deleted with it,
+// so files of other slides are rejected
+func (d *Deps) slideKeyFromURL(slideID primitive.ObjectID, url string) (key string, ok bool, err error) {
+	key, ok = db.KeyFromURL(d.Storage, url)
+	if !ok {
+		return "", false, nil
+	}
+	if !strings.HasPrefix(key, "slides/"+slideID.Hex()+"/") {
+		return "", true, errForeignFile
+	}
+	return key, true, nil
+}
+
+// setPDFSource stores the PDF URL of a slide by key when it is in our storage,
+// other PDFs are downloaded when converting
+func (d *Deps) setPDFSource(slideID primitive.ObjectID, slide *models.Slide) error {
+	if slide.PDFURL == "" {
+		return nil
+	}
+	key, ok, err := d.slideKeyFromURL(slideID, slide.PDFURL)
+	if !ok {
+		return d.Fetcher.Check(slide.PDFURL)
+	}
+	if err != nil {
+		return err
+	}
+	slide.PDFKey = key
+	slide.PDFURL = ""
+	return nil
+}
+
+// deleteStorageFile deletes a file from storage given its URL
+func (d *Deps) deleteStorageFile(url string) bool {
+	key, ok := db.KeyFromURL(d.Storage, url)
+	if !ok {
+		log.Println("File is not in storage:", url)
+		return false
+	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Slide updated successfully", "status_code": 200, "result": result})
+	return d.deleteStorageKey(key)
 }
 
-// deleteAWSFile deletes a file from AWS S3 given its key
-func deleteAWSFile(key string) bool {
-	log.Println("Deleting file from S3:", key)
-	s3session := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(os.Getenv("AWS_REGION")),
-	}))
-	svc := s3.New(s3session)
-	_, err := svc.DeleteObject(&s3.DeleteObjectInput{
-		Bucket: aws.String(utils.AWS_BUCKET_NAME),
-		Key:    aws.String(key),
-	})
+// deleteStorageKey deletes a file from storage given its key
+func (d *Deps) deleteStorageKey(key string) bool {
+	log.Println("Deleting file from storage:", key)
+	err := d.Storage.Delete(context.Background(), key)
 	if err != nil {
-		log.Println("Error deleting file from S3:", err)
+		log.Println("Error deleting file from storage:", err)
 		return false
 	}
 
-	log.Println("File deletion initiated for key:", key)
+	log.Println("File deleted for key:", key)
 	return true
 }
 
-// DeleteSlide is a gin handler to delete a slide
-// Add more logs
-func DeleteSlide(c *gin.Context) {
+// DeleteSlide is a gin handler to move a slide to the trash, it is deleted for
+// good along with its slide images, quiz questions, flashcards and files once
+// TRASH_RETENTION has passed
+func (d *Deps) DeleteSlide(c *gin.Context) {
 	slideID := c.Param("id")
 	log.Println("*** /delete_slide ***")
 	log.Println("Slide ID:", slideID)
 
-	objID, err := primitive.ObjectIDFromHex(slideID)
-	if err != nil {
-		log.Println("Invalid slide ID", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid slide ID"})
-		return
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	// Find the slide
-	var slide bson.M
-	err = db.DB.Collection("slides").FindOne(context.Background(), bson.M{"_id": objID}).Decode(&slide)
+	found, err := moveToTrash(ctx, d.Slides, slideID)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			log.Println("Slide not found", err)
-			c.JSON(http.StatusNotFound, gin.H{"error": "Slide not found"})
-		} else {
-			log.Println("Error finding slide", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error finding slide"})
+		if err == errInvalidID {
+			respondSlideError(c, errInvalidSlideID)
+			return
 		}
-		return
-	}
-
-	log.Print("Found slide:", slide)
-
-	pdfURL, _ := slide["pdf_url"].(string)
-
-	// Delete the slide
-	result, err := db.DB.Collection(CollectionNameSlides).DeleteOne(context.Background(), bson.M{"_id": objID})
-	if err != nil {
 		log.Println("Error deleting slide", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting slide"})
 		return
 	}
+	if !found {
+		log.Println("Slide not found")
+		c.JSON(http.StatusNotFound, gin.H{"message": "Slide not found", "status_code": 404})
+		return
+	}
 
-	log.Println("Delete result:", result)
-
-	if result.DeletedCount == 1 {
-		if pdfURL != "" {
-			pdfKey := strings.Split(pdfURL, "amazonaws.com/")[1]
-			deleteAWSFile(pdfKey)
-		}
-
-		// Delete all images and audio files associated with the slide
-		cursor, err := db.DB.Collection(collectionNameSlideImages).Find(context.Background(), bson.M{"slide_id": slideID})
-		if err != nil {
-			log.Println("Error finding slide images", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error finding slide images"})
-			return
-		}
-		defer cursor.Close(context.Background())
-
-		for cursor.Next(context.Background()) {
-			log.Println("Deleting slide image and audio file")
-			var slideImage bson.M
-			if err := cursor.Decode(&slideImage); err != nil {
-				log.Println("Error decoding slide image", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error decoding slide image"})
-				return
-			}
-			log.Println("Slide image:", slideImage["_id"])
+	log.Println("Slide moved to trash")
 
-			audioURL, _ := slideImage["audio_url"].(string)
-			if audioURL != "" {
-				log.Println("Deleting audio file")
-				audioKey := strings.Split(audioURL, "amazonaws.com/")[1]
-				deleteAWSFile(audioKey)
-			}
+	c.JSON(http.StatusOK, gin.H{"message": "Slide deleted successfully", "status_code": 200})
+}
 
-			log.Println("Deleting slide image document")
-			imageURL := slideImage["image_url"].(string)
-			imageKey := strings.Split(imageURL, "amazonaws.com/")[1]
-			deleteAWSFile(imageKey)
-		}
+var errInvalidSlideID = errors.New("invalid slide ID")
+var errSlideNotFound = errors.New("slide not found")
 
-		log.Println("Deleting slide images documents")
+// findSlide retrieves a slide by ID
+func (d *Deps) findSlide(ctx context.Context, slideID string) (*models.Slide, error) {
+	objID, err := primitive.ObjectIDFromHex(slideID)
+	if err != nil {
+		return nil, errInvalidSlideID
+	}
 
-		_, err = db.DB.Collection(collectionNameSlideImages).DeleteMany(context.Background(), bson.M{"slide_id": slideID})
-		if err != nil {
-			log.Println("Error deleting slide images", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting slide images"})
-			return
+	slide, err := d.Slides.Get(ctx, objID)
+	if err != nil {
+		if err == repo.ErrNotFound {
+			return nil, errSlideNotFound
 		}
+		return nil, fmt.Errorf("error finding slide: %v", err)
+	}
+	return slide, nil
+}
 
-		log.Println("Slide deleted successfully")
-
-		c.JSON(http.StatusOK, gin.H{"message": "Slide deleted successfully", "status_code": 200})
-	} else {
-
-		log.Println("Slide not found")
-		c.JSON(http.StatusNotFound, gin.H{"message": "Slide not found", "status_code": 404})
+// respondSlideError responds with the status matching an error of findSlide
+func respondSlideError(c *gin.Context, err error) {
+	log.Println(err)
+	switch err {
+	case errInvalidSlideID:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid slide ID"})
+	case errSlideNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Slide not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error finding slide"})
 	}
 }
@@ -3,8 +3,9 @@ package handlers
 import (
 	"context"
 	"log"
-	"main/db"
+	"main/auth"
 	"main/models"
+	"main/repo"
 	"net/http"
 	"time"
 
@@ -15,7 +16,7 @@ import (
 
 const CollectionNameSpaces = "spaces"
 
-func CreateSpace(c *gin.Context) {
+func (d *Deps) CreateSpace(c *gin.Context) {
 	log.Println("CreateSpace")
 
 	var space models.Space
@@ -26,38 +27,38 @@ func CreateSpace(c *gin.Context) {
 	}
 
 	space.ID = primitive.NewObjectID()
+	space.UserID = auth.UserID(c)
 	space.CreatedAt = time.Now()
 	space.UpdatedAt = time.Now()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	result, err := db.DB.Collection(CollectionNameSpaces).InsertOne(ctx, space)
-	if err != nil {
+	if err := d.Spaces.Insert(ctx, &space); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	log.Println("Create created:", result.InsertedID)
+	log.Println("Create created:", space.ID)
 
-	c.JSON(http.StatusOK, result)
+	c.JSON(http.StatusOK, gin.H{"InsertedID": space.ID})
 }
 
 // Get all spaces
-func GetSpaces(c *gin.Context) {
+func (d *Deps) GetSpaces(c *gin.Context) {
 	log.Println("GetSpaces")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	cursor, err := db.DB.Collection(CollectionNameSpaces).Find(ctx, bson.M{})
+	filter, err := d.spaceFilter(c)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	var spaces []models.Space
-	if err = cursor.All(ctx, &spaces); err != nil {
+	spaces, err := d.Spaces.Find(ctx, filter, nil)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -66,7 +67,7 @@ func GetSpaces(c *gin.Context) {
 }
 
 // GetSpace
-func GetSpace(c *gin.Context) {
+func (d *Deps) GetSpace(c *gin.Context) {
 	log.Println("GetSpace")
 
 	spaceID := c.Param("id")
@@ -81,10 +82,13 @@ func GetSpace(c *gin.Context) {
 		return
 	}
 
-	var space models.Space
-	err = db.DB.Collection(CollectionNameSpaces).FindOne(ctx, bson.M{"_id": objID}).Decode(&space)
+	space, err := d.Spaces.Get(ctx, objID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if err == repo.ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Space not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
 		return
 	}
 
@@ -92,7 +96,7 @@ func GetSpace(c *gin.Context) {
 }
 
 // GetSpaceSlides
-func GetSpaceSlides(c *gin.Context) {
+func (d *Deps) GetSpaceSlides(c *gin.Context) {
 	log.Println("GetSpaceSlides")
 
 	spaceID := c.Param("space_id")
@@ -100,14 +104,13 @@ func GetSpaceSlides(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	cursor, err := db.DB.Collection(CollectionNameSlides).Find(ctx, bson.M{"space_id": spaceID})
+	slides, err := d.Slides.Find(ctx, notTrashed(bson.M{"space_id": spaceID}), nil)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	var slides []models.Slide
-	if err = cursor.All(ctx, &slides); err != nil {
+	if err = d.presignSlides(ctx, slides); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -115,8 +118,9 @@ func GetSpaceSlides(c *gin.Context) {
 	c.JSON(http.StatusOK, slides)
 }
 
-// DeleteSpace
-func DeleteSpace(c *gin.Context) {
+// DeleteSpace moves a space to the trash with its slides, it is deleted for
+// good along with them once TRASH_RETENTION has passed
+func (d *Deps) DeleteSpace(c *gin.Context) {
 	log.Println("DeleteSpace")
 
 	spaceID := c.Param("id")
@@ -124,20 +128,22 @@ func DeleteSpace(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	// Convert spaceID to ObjectID
-	objID, err := primitive.ObjectIDFromHex(spaceID)
+	found, err := moveToTrash(ctx, d.Spaces, spaceID)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		if err == errInvalidID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid space ID"})
+			return
+		}
+		log.Println("Error deleting space", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-
-	result, err := db.DB.Collection(CollectionNameSpaces).DeleteOne(ctx, bson.M{"_id": objID})
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Space not found"})
 		return
 	}
 
-	c.JSON(http.StatusOK, result)
+	c.JSON(http.StatusOK, gin.H{"message": "Space deleted successfully", "status_code": http.StatusOK})
 }
 
 // // addSlideToSpace adds a slide to a space.
@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"main/events"
+	"main/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// How often a stream checks the event log for events published by other server
+// instances, and sends a keep-alive comment
+const ssePollInterval = 2 * time.Second
+
+// wantsEventStream reports whether the client asked for a server-sent event stream
+func wantsEventStream(c *gin.Context) bool {
+	return strings.Contains(c.GetHeader("Accept"), "text/event-stream")
+}
+
+// lastEventID returns the ID of the last event the client received, from the
+// Last-Event-ID header set by EventSource on reconnect or the last_event_id query
+func lastEventID(c *gin.Context) (int64, bool) {
+	value := c.GetHeader("Last-Event-ID")
+	if value == "" {
+		value = c.Query("last_event_id")
+	}
+	if value == "" {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// streamEvents writes the events of a stream with an ID greater than lastID as
+// server-sent events, until an error or done event is sent or the client disconnects
+func (d *Deps) streamEvents(c *gin.Context, streamID string, lastID int64) {
+	ctx := c.Request.Context()
+
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Connection", "keep-alive")
+	c.Writer.Flush()
+
+	notify, unsubscribe := events.Subscribe(streamID)
+	defer unsubscribe()
+
+	ticker := time.NewTicker(ssePollInterval)
+	defer ticker.Stop()
+
+	for {
+		pending, err := d.Events.Since(ctx, streamID, lastID)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Println("Error reading events", err)
+			}
+			return
+		}
+
+		for _, event := range pending {
+			data, _ := json.Marshal(event.Data)
+			fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+			lastID = event.ID
+
+			if event.Type == events.TypeDone || event.Type == events.TypeError {
+				c.Writer.Flush()
+				return
+			}
+		}
+		c.Writer.Flush()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-notify:
+		case <-ticker.C:
+			fmt.Fprint(c.Writer, ": keep-alive\n\n")
+		}
+	}
+}
+
+// operationFunc is the work of an operation, it reports through emitter and returns
+// the data of the done event
+type operationFunc func(ctx context.Context, emitter events.Emitter) (bson.M, error)
+
+var (
+	operationsWG sync.WaitGroup
+	// operationsCtx is cancelled when a shutdown takes too long, to interrupt
+	// the running operations
+	operationsCtx, interruptOperations = context.WithCancel(context.Background())
+)
+
+// WaitForOperations waits for the operations running in the background to
+// finish, those still running when ctx expires are interrupted and refunded
+func WaitForOperations(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		operationsWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		interruptOperations()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// operationCost is what the caller is charged when an operation starts, the zero
+// value is free
+type operationCost struct {
+	operation string
+	units     int
+	reference string
+}
+
+// runOperation runs fn in the background and streams its events. The work keeps
+// going if the client disconnects; a client that reconnects while it runs, or
+// that sends Last-Event-ID afterwards, is attached to the same stream instead of
+// starting the work again. Runs are kept in the event log, so this holds across
+// server instances for as long as the log keeps the stream. The caller is
+// charged cost when the work starts and refunded if it fails
+func (d *Deps) runOperation(c *gin.Context, key string, timeout time.Duration, cost operationCost, fn operationFunc) {
+	ctx := c.Request.Context()
+	streamID := "operation:" + key
+	lastID, resuming := lastEventID(c)
+
+	// A client resuming a stream the log still holds replays the events it
+	// missed, even if the run finished, rather than starting another one
+	if resuming {
+		seen, err := d.Events.Since(ctx, streamID, lastID-1)
+		if err != nil {
+			log.Println("Error reading events", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading events"})
+			return
+		}
+		if len(seen) > 0 {
+			d.streamEvents(c, streamID, lastID)
+			return
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	run, err := d.Events.Start(ctx, streamID, deadline)
+	if err != nil {
+		log.Println("Error starting operation", key, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error starting operation"})
+		return
+	}
+	if !run.Started {
+		// Attach to the run in progress from its start
+		if !resuming {
+			lastID = run.After
+		}
+		d.streamEvents(c, streamID, lastID)
+		return
+	}
+
+	emitter := events.Emitter{Events: d.Events, StreamID: streamID}
+	var charge *models.CreditTransaction
+	if cost.units > 0 {
+		var ok bool
+		charge, ok = d.chargeCredits(c, cost.operation, cost.units, cost.reference)
+		if !ok {
+			// Ends the run, and the streams of requests that attached to it
+			emitter.Error("Operation could not be charged")
+			return
+		}
+	}
+
+	operationsWG.Add(1)
+	go func() {
+		defer operationsWG.Done()
+		ctx, cancel := context.WithDeadline(operationsCtx, deadline)
+		defer cancel()
+
+		data, err := fn(ctx, emitter)
+		if err != nil {
+			log.Println("Operation failed", key, err)
+			refundCredits(charge)
+			emitter.Error(err.Error())
+		} else {
+			emitter.Done(data)
+		}
+	}()
+
+	d.streamEvents(c, streamID, run.After)
+}
@@ -2,23 +2,24 @@ package handlers
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"main/db"
-	"main/utils"
+	"main/credits"
+	"main/events"
+	"main/jobs"
+	"main/llm"
+	"main/models"
+	"main/repo"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/sashabaranov/go-openai"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func GenerateText(c *gin.Context) {
+func (d *Deps) GenerateText(c *gin.Context) {
 	slideImageID := c.Param("slide_image_id")
 	fmt.Println("*** /generate-image-text ***")
 
@@ -29,140 +30,151 @@ func GenerateText(c *gin.Context) {
 		return
 	}
 
-	slideImage, err := findSlideImageByID(objID)
+	slideImage, err := d.findSlideImageByID(objID)
 	if err != nil {
 		log.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if errors.Is(err, repo.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
 		return
 	}
 
-	imageURL, ok := slideImage["image_url"].(string)
-	if !ok || imageURL == "" {
+	imageURL, err := d.fileURL(c.Request.Context(), slideImage.ImageKey, slideImage.ImageURL)
+	if err != nil {
+		log.Println("Error presigning image URL", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error presigning image URL"})
+		return
+	}
+	extractedText := slideImage.ExtractedText
+	if imageURL == "" && extractedText == "" {
 		log.Println("Image not found")
 		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
 		return
 	}
 
-	contextStr, err := generateContextForSlideImage(slideImage)
+	contextStr, err := d.generateContextForSlideImage(slideImage)
 	if err != nil {
 		log.Println("Error generating context", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.Writer.Header().Set("Content-Type", "text/event-stream")
-	c.Writer.Header().Set("Cache-Control", "no-cache")
-	c.Writer.Header().Set("Connection", "keep-alive")
-	c.Writer.Flush()
-
-	sendSSE := func(message string) {
-		fmt.Fprintf(c.Writer, "data: %s\n\n", message)
-		c.Writer.Flush()
-	}
-
-	sendSSE("Processing image to generate text")
+	cost := operationCost{operation: credits.OpGenerateImageText, units: 1, reference: slideImageID}
+	d.runOperation(c, "generate-image-text:"+slideImageID, 10*time.Minute, cost, func(ctx context.Context, emitter events.Emitter) (bson.M, error) {
+		emitter.Progress(0, 2, "Processing image to generate text")
 
-	response, err := processImage(imageURL, contextStr)
-	if err != nil {
-		log.Println("Error processing image", err)
-		sendSSE("Error processing image")
-		return
-	}
+		response, err := d.processImage(ctx, imageURL, contextStr, extractedText)
+		if err != nil {
+			log.Println("Error processing image", err)
+			return nil, fmt.Errorf("error processing image")
+		}
 
-	sendSSE("Updating generated text in the database")
+		emitter.Progress(1, 2, "Updating generated text in the database")
 
-	if !updateGeneratedText(slideImageID, response) {
-		log.Println("Error updating slide image")
-		sendSSE("Error updating slide image")
-		return
-	}
+		if !d.updateGeneratedText(slideImageID, response) {
+			log.Println("Error updating slide image")
+			return nil, fmt.Errorf("error updating slide image")
+		}
 
-	finalResponse, _ := json.Marshal(gin.H{"status": "success", "data": response})
-	fmt.Fprintf(c.Writer, "data: %s\n\n", finalResponse)
-	c.Writer.Flush()
+		emitter.Progress(2, 2, "Generated text")
+		return bson.M{"status": "success", "data": response}, nil
+	})
 }
 
-func GenerateAllImageText(c *gin.Context) {
+// GenerateAllImageText enqueues a job generating the text of every image of a slide
+func (d *Deps) GenerateAllImageText(c *gin.Context) {
 	slideID := c.Param("slide_id")
 	log.Println("*** /generate-all-image-text ***")
 
 	log.Println("Slide ID:", slideID)
 
-	slideImages, err := findSlideImagesBySlideID(slideID)
-	if err != nil {
-		log.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if _, err := primitive.ObjectIDFromHex(slideID); err != nil {
+		log.Println("Invalid slide ID", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid slide ID"})
 		return
 	}
 
-	c.Writer.Header().Set("Content-Type", "text/event-stream")
-	c.Writer.Header().Set("Cache-Control", "no-cache")
-	c.Writer.Header().Set("Connection", "keep-alive")
-	c.Writer.Flush()
+	d.enqueueJob(c, JobTypeGenerateAllImageText, map[string]string{"slide_id": slideID})
+}
+
+// generateAllImageTextJob generates the text of every image of a slide that does not have one yet
+func (d *Deps) generateAllImageTextJob(ctx context.Context, job *models.Job, report jobs.ReportFunc) (bson.M, error) {
+	slideID := job.Params["slide_id"]
 
-	sendSSE := func(message string) {
-		fmt.Fprintf(c.Writer, "data: %s\n\n", message)
-		c.Writer.Flush()
+	slideImages, err := d.findSlideImagesBySlideID(slideID)
+	if err != nil {
+		return nil, err
 	}
 
 	totalImages := len(slideImages)
-	sendSSE(fmt.Sprintf(`{"totalImages": %d}`, totalImages))
+	report(0, totalImages, "Generating text for slide images")
 
-	var slideImagesList []bson.M
-	for _, slideImage := range slideImages {
-		imageURL, ok := slideImage["image_url"].(string)
-		if !ok || imageURL == "" {
-			log.Println("Image URL not found")
-			sendSSE("Image URL not found")
-			continue
+	failed := 0
+	for i, slideImage := range slideImages {
+		if err := ctx.Err(); err != nil {
+			return nil, err
 		}
 
-		generatedText, _ := slideImage["generated_text"].(string)
-		if generatedText == "" {
-			contextStr, err := generateContextForSlideImage(slideImage)
+		order := slideImage.Order
+
+		if slideImage.GeneratedText == "" {
+			imageURL, err := d.fileURL(ctx, slideImage.ImageKey, slideImage.ImageURL)
+			extractedText := slideImage.ExtractedText
+			if err != nil || (imageURL == "" && extractedText == "") {
+				log.Println("Image URL not found")
+				report(i, totalImages, "Image URL not found")
+				failed++
+				continue
+			}
+
+			contextStr, err := d.generateContextForSlideImage(&slideImage)
 			if err != nil {
 				log.Println("Error generating context", err)
-				sendSSE("Error generating context")
+				report(i, totalImages, "Error generating context")
+				failed++
 				continue
 			}
 
-			sendSSE(fmt.Sprintf("Processing image for slide order %d", slideImage["order"].(int32)))
+			report(i, totalImages, fmt.Sprintf("Processing image for slide order %d", order))
 
-			response, err := processImage(imageURL, contextStr)
+			response, err := d.processImage(ctx, imageURL, contextStr, extractedText)
 			if err != nil {
 				log.Println("Error processing image", err)
-				sendSSE(fmt.Sprintf("Error processing image for slide order %d", slideImage["order"].(int32)))
+				report(i, totalImages, fmt.Sprintf("Error processing image for slide order %d", order))
+				failed++
 				continue
 			}
 
-			if !updateGeneratedText(slideImage["_id"].(primitive.ObjectID).Hex(), response) {
+			if !d.updateGeneratedText(slideImage.ID.Hex(), response) {
 				log.Println("Error updating slide image")
-				sendSSE(fmt.Sprintf("Error updating slide image for slide order %d", slideImage["order"].(int32)))
+				report(i, totalImages, fmt.Sprintf("Error updating slide image for slide order %d", order))
+				failed++
 				continue
 			}
-			slideImage["generated_text"] = response
+			d.completeUnit(job)
 		}
 
-		slideImagesList = append(slideImagesList, slideImage)
-		sendSSE(fmt.Sprintf(`{"processedImage": %d}`, slideImage["order"].(int32)))
+		report(i+1, totalImages, fmt.Sprintf("Processed image %d", order))
+	}
+
+	if failed > 0 {
+		return nil, fmt.Errorf("failed to generate text for %d of %d slide images", failed, totalImages)
 	}
 
-	finalResponse, _ := json.Marshal(gin.H{"status": "success", "data": slideImagesList})
-	fmt.Fprintf(c.Writer, "data: %s\n\n", finalResponse)
-	sendSSE("[DONE]")
-	c.Writer.Flush()
+	return bson.M{"total_images": totalImages}, nil
 }
 
 // findSlideImageByID retrieves a single slide image by ID from the database
-func findSlideImageByID(id primitive.ObjectID) (bson.M, error) {
+func (d *Deps) findSlideImageByID(id primitive.ObjectID) (*models.SlideImage, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
 	defer cancel()
 
-	var slideImage bson.M
-	slideImageResult := db.DB.Collection(collectionNameSlideImages).FindOne(ctx, bson.M{"_id": id})
-	if err := slideImageResult.Decode(&slideImage); err != nil {
-		if err == mongo.ErrNoDocuments {
-			return nil, fmt.Errorf("slide Image not found")
+	slideImage, err := d.SlideImages.Get(ctx, id)
+	if err != nil {
+		if err == repo.ErrNotFound {
+			return nil, fmt.Errorf("slide Image %w", err)
 		}
 		return nil, fmt.Errorf("error finding slide image: %v", err)
 	}
@@ -170,66 +182,63 @@ func findSlideImageByID(id primitive.ObjectID) (bson.M, error) {
 }
 
 // findSlideImagesBySlideID retrieves all slide images for a given slide ID from the database
-func findSlideImagesBySlideID(slideID string) ([]bson.M, error) {
+func (d *Deps) findSlideImagesBySlideID(slideID string) ([]models.SlideImage, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 360*time.Second)
 	defer cancel()
 
-	opts := options.Find()
-	opts.SetSort(bson.D{{Key: "order", Value: 1}}) // Sort by 'order' field in ascending order
-
-	cursor, err := db.DB.Collection(collectionNameSlideImages).Find(ctx, bson.M{"slide_id": slideID}, opts)
+	slideImages, err := d.SlideImages.Find(ctx, bson.M{"slide_id": slideID}, bson.D{{Key: "order", Value: 1}})
 	if err != nil {
 		log.Println("Error finding slide images", err)
 		return nil, fmt.Errorf("error finding slide images: %v", err)
 	}
-	defer cursor.Close(ctx)
-
-	var slideImages []bson.M
-	if err = cursor.All(ctx, &slideImages); err != nil {
-		log.Println("Error decoding slide images", err)
-		return nil, fmt.Errorf("error decoding slide images: %v", err)
-	}
 	return slideImages, nil
 }
 
 // generateContextForSlideImage generates the context string for a slide image based on preceding slides
-func generateContextForSlideImage(slideImage bson.M) (string, error) {
+func (d *Deps) generateContextForSlideImage(slideImage *models.SlideImage) (string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 1000*time.Second)
 	defer cancel()
 
-	slideID := slideImage["slide_id"].(string)
-	slideOrder := slideImage["order"].(int32)
-
 	// Find preceding 2 slides
-	precedingSlidesCursor, err := db.DB.Collection(collectionNameSlideImages).Find(ctx, bson.M{"slide_id": slideID, "order": bson.M{"$lt": slideOrder}})
+	precedingSlides, err := d.SlideImages.Find(ctx,
+		bson.M{"slide_id": slideImage.SlideID, "order": bson.M{"$lt": slideImage.Order}},
+		bson.D{{Key: "order", Value: 1}},
+	)
 	if err != nil {
 		return "", fmt.Errorf("error finding preceding slides: %v", err)
 	}
-	defer precedingSlidesCursor.Close(ctx)
-
-	var precedingSlides []bson.M
-	for precedingSlidesCursor.Next(ctx) {
-		var slide bson.M
-		if err := precedingSlidesCursor.Decode(&slide); err != nil {
-			return "", fmt.Errorf("error decoding preceding slide: %v", err)
-		}
-		precedingSlides = append(precedingSlides, slide)
+	if len(precedingSlides) > 2 {
+		precedingSlides = precedingSlides[len(precedingSlides)-2:]
 	}
 
 	var contextStr string
-	if len(precedingSlides) >= 2 {
-		contextStr += fmt.Sprintf("SLIDE %d: \n%s\n\n", precedingSlides[len(precedingSlides)-2]["order"].(int32)+1, precedingSlides[len(precedingSlides)-2]["generated_text"].(string))
-		contextStr += fmt.Sprintf("SLIDE %d: \n%s\n\n", precedingSlides[len(precedingSlides)-1]["order"].(int32)+1, precedingSlides[len(precedingSlides)-1]["generated_text"].(string))
-	} else if len(precedingSlides) == 1 {
-		contextStr += fmt.Sprintf("SLIDE %d: \n%s\n\n", precedingSlides[0]["order"].(int32)+1, precedingSlides[0]["generated_text"].(string))
+	for _, preceding := range precedingSlides {
+		contextStr += fmt.Sprintf("SLIDE %d: \n%s\n\n", preceding.Order+1, preceding.GeneratedText)
 	}
 
-	contextStr += fmt.Sprintf("SLIDE %d: \n", slideOrder+1)
+	contextStr += fmt.Sprintf("SLIDE %d: \n", slideImage.Order+1)
+
+	// Ground the explanation in the text layer of the page, when the PDF has one
+	if slideImage.ExtractedText != "" {
+		contextStr += fmt.Sprintf("Text on this slide:\n%s\n", slideImage.ExtractedText)
+		if len(slideImage.Links) > 0 {
+			contextStr += "Links on this slide:\n"
+			for _, link := range slideImage.Links {
+				contextStr += fmt.Sprintf("%v\n", link)
+			}
+		}
+		contextStr += "\n"
+	}
 	return contextStr, nil
 }
 
-// processImage calls the API to process the image and generate text
-func processImage(imageURL string, contextStr string) (string, error) {
+// Slides with at least this much extracted text can be explained without the image
+const minTextOnlyLength = 80
+
+// processImage calls the API to process the image and generate text. Without an
+// image, or if the vision model fails, slides with enough extracted text are
+// explained by a text-only model
+func (d *Deps) processImage(ctx context.Context, imageURL string, contextStr string, extractedText string) (string, error) {
 	PROMPT := `
 	
 	You are a professor, describe and explain this lecture slide, no fluff, buzzwords or jargon. Use the context(previous slides) provided to give a clear and concise explanation of this current slide.
@@ -238,55 +247,42 @@ func processImage(imageURL string, contextStr string) (string, error) {
 	`
 	PROMPT = contextStr + PROMPT
 	fmt.Println("PROMPT: ", PROMPT)
-	return callAPI(imageURL, PROMPT)
+
+	textOnly := len(extractedText) >= minTextOnlyLength
+	if imageURL == "" {
+		if !textOnly {
+			return "", fmt.Errorf("slide has no image and not enough text")
+		}
+		return d.callTextAPI(ctx, PROMPT)
+	}
+
+	content, err := d.callAPI(ctx, imageURL, PROMPT)
+	if err != nil && textOnly && ctx.Err() == nil {
+		log.Println("Vision model failed, explaining slide from its text:", err)
+		return d.callTextAPI(ctx, PROMPT)
+	}
+	return content, err
 }
 
 // callAPI makes the API call to generate text based on the image and prompt
-func callAPI(imageURL string, prompt string) (string, error) {
-	client := openai.NewClient(utils.OPENAI_API_KEY)
-
-	result, err := client.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{
-		Model: openai.GPT4o,
-		Messages: []openai.ChatCompletionMessage{
-			{
-				Role: openai.ChatMessageRoleUser,
-				MultiContent: []openai.ChatMessagePart{
-					{
-						Type: openai.ChatMessagePartTypeText,
-						Text: prompt,
-					},
-					{
-						Type: openai.ChatMessagePartTypeImageURL,
-						ImageURL: &openai.ChatMessageImageURL{
-							URL:    imageURL,
-							Detail: openai.ImageURLDetailHigh,
-						},
-					},
-				},
-			},
-		},
-		MaxTokens: 3000,
-	})
-
+func (d *Deps) callAPI(ctx context.Context, imageURL string, prompt string) (string, error) {
+	content, err := d.LLM.CompleteVision(ctx, llm.Prompt{User: prompt, MaxTokens: 3000}, imageURL)
 	if err != nil {
 		return "", err
 	}
 
-	for _, choice := range result.Choices {
-		log.Println("Choice:", choice.Message.Content)
+	log.Println("Choice:", content)
 
-		for _, part := range choice.Message.MultiContent {
-			if part.Type == openai.ChatMessagePartTypeText {
-				log.Println("Partial text:", part.Text)
-			}
-		}
-	}
+	return content, nil
+}
 
-	return result.Choices[0].Message.Content, nil
+// callTextAPI generates text from the prompt alone
+func (d *Deps) callTextAPI(ctx context.Context, prompt string) (string, error) {
+	return d.LLM.Complete(ctx, llm.Prompt{User: prompt, MaxTokens: 3000})
 }
 
 // updateGeneratedText updates the generated text in the database for a given slide image ID
-func updateGeneratedText(slideImageID string, generatedText string) bool {
+func (d *Deps) updateGeneratedText(slideImageID string, generatedText string) bool {
 	ctx, cancel := context.WithTimeout(context.Background(), 1000*time.Second)
 	defer cancel()
 	objID, err := primitive.ObjectIDFromHex(slideImageID)
@@ -294,7 +290,7 @@ func updateGeneratedText(slideImageID string, generatedText string) bool {
 		log.Println("Invalid slide image ID", err)
 		return false
 	}
-	_, err = db.DB.Collection(collectionNameSlideImages).UpdateOne(ctx, bson.M{"_id": objID}, bson.M{"$set": bson.M{"generated_text": generatedText}})
+	_, err = d.SlideImages.UpdateOne(ctx, repo.ByID(objID), bson.M{"$set": bson.M{"generated_text": generatedText}})
 	if err != nil {
 		log.Println("Error updating generated text", err)
 		return false
@@ -302,11 +298,13 @@ func updateGeneratedText(slideImageID string, generatedText string) bool {
 	return true
 }
 
-func GenerateNotes(c *gin.Context) {
+// GenerateNotes returns the generated text of every image of a slide, it is
+// free as the text was paid for when it was generated
+func (d *Deps) GenerateNotes(c *gin.Context) {
 	slideID := c.Param("slide_id")
 	log.Println("*** /generate-notes ***")
 
-	slideImages, err := findSlideImagesBySlideID(slideID)
+	slideImages, err := d.findSlideImagesBySlideID(slideID)
 	if err != nil {
 		log.Println(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -315,8 +313,8 @@ func GenerateNotes(c *gin.Context) {
 
 	var generatedNotes []string
 	for _, slideImage := range slideImages {
-		generatedText, ok := slideImage["generated_text"].(string)
-		if !ok || generatedText == "" {
+		generatedText := slideImage.GeneratedText
+		if generatedText == "" {
 			log.Println("Generated text not found")
 			c.JSON(http.StatusNotFound, gin.H{"error": "Generated text not found"})
 			return
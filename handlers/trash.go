@@ -0,0 +1,339 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"main/auth"
+	"main/repo"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// trashable is the part of a repository used to move documents in and out of
+// the trash
+type trashable interface {
+	UpdateOne(ctx context.Context, filter bson.M, update bson.M) (int64, error)
+}
+
+// notTrashed adds a condition to filter excluding documents in the trash
+func notTrashed(filter bson.M) bson.M {
+	filter["deleted_at"] = bson.M{"$exists": false}
+	return filter
+}
+
+// inTrash is a filter matching the document with the given ID if it is in the
+// trash
+func inTrash(id primitive.ObjectID) bson.M {
+	return bson.M{"_id": id, "deleted_at": bson.M{"$exists": true}}
+}
+
+// moveToTrash sets deleted_at on a document that is not in the trash yet, and
+// reports whether there was one
+func moveToTrash(ctx context.Context, r trashable, id string) (bool, error) {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return false, errInvalidID
+	}
+	matched, err := r.UpdateOne(ctx, notTrashed(repo.ByID(objID)), bson.M{
+		"$set": bson.M{"deleted_at": time.Now()},
+	})
+	if err != nil {
+		return false, err
+	}
+	return matched == 1, nil
+}
+
+// trashedSpaceIDs returns the IDs of the spaces in the trash, whose slides are
+// hidden with them
+func (d *Deps) trashedSpaceIDs(ctx context.Context) ([]string, error) {
+	ids, err := d.Spaces.IDs(ctx, bson.M{"deleted_at": bson.M{"$exists": true}})
+	if err != nil {
+		return nil, err
+	}
+	spaceIDs := []string{}
+	for _, id := range ids {
+		spaceIDs = append(spaceIDs, id.Hex())
+	}
+	return spaceIDs, nil
+}
+
+// spaceTrashed reports whether a space is in the trash
+func (d *Deps) spaceTrashed(ctx context.Context, spaceID string) (bool, error) {
+	objID, err := primitive.ObjectIDFromHex(spaceID)
+	if err != nil {
+		return false, nil
+	}
+	count, err := d.Spaces.Count(ctx, inTrash(objID))
+	return count > 0, err
+}
+
+// GetTrash lists the spaces, slides, quiz questions and flashcards in the
+// trash of the spaces the caller can access
+func (d *Deps) GetTrash(c *gin.Context) {
+	log.Println("GetTrash")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	trashed := bson.M{"$exists": true}
+	// The most recently trashed first
+	order := bson.D{{Key: "deleted_at", Value: -1}}
+
+	spaceQuery, err := d.spaceFilter(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	spaceQuery["deleted_at"] = trashed
+	spaces, err := d.Spaces.Find(ctx, spaceQuery, order)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	slideQuery := bson.M{"deleted_at": trashed}
+	spaceIDs, err := d.accessibleSpaceIDs(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if spaceIDs != nil {
+		slideQuery["space_id"] = bson.M{"$in": spaceIDs}
+	}
+	slides, err := d.Slides.Find(ctx, slideQuery, order)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := d.presignSlides(ctx, slides); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Quiz questions and flashcards of the slides the caller can access
+	childQuery := bson.M{"deleted_at": trashed}
+	if spaceIDs != nil {
+		slideIDs, err := d.Slides.IDs(ctx, bson.M{"space_id": bson.M{"$in": spaceIDs}})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		hexIDs := []string{}
+		for _, id := range slideIDs {
+			hexIDs = append(hexIDs, id.Hex())
+		}
+		childQuery["slide_id"] = bson.M{"$in": hexIDs}
+	}
+	questions, err := d.QuizQuestions.Find(ctx, childQuery, order)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	flashcards, err := d.Flashcards.Find(ctx, childQuery, order)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":         "success",
+		"retention_days": int(d.Config.TrashRetention.Hours() / 24),
+		"spaces":         spaces,
+		"slides":         slides,
+		"quiz_questions": questions,
+		"flashcards":     flashcards,
+	})
+}
+
+// trashedDoc is a document found in the trash by findInTrash
+type trashedDoc struct {
+	// collection is the name of the collection of the document
+	collection string
+	repo       trashable
+	// spaceID is set for spaces and slides, slideID for what belongs to a slide
+	spaceID string
+	slideID string
+}
+
+// findInTrash looks up a space, slide, quiz question or flashcard in the trash,
+// returning repo.ErrNotFound if there is none with this ID
+func (d *Deps) findInTrash(ctx context.Context, id primitive.ObjectID) (*trashedDoc, error) {
+	space, err := d.Spaces.FindOne(ctx, inTrash(id))
+	if err == nil {
+		return &trashedDoc{collection: CollectionNameSpaces, repo: d.Spaces, spaceID: space.ID.Hex()}, nil
+	} else if err != repo.ErrNotFound {
+		return nil, err
+	}
+
+	slide, err := d.Slides.FindOne(ctx, inTrash(id))
+	if err == nil {
+		return &trashedDoc{collection: CollectionNameSlides, repo: d.Slides, spaceID: slide.SpaceID}, nil
+	} else if err != repo.ErrNotFound {
+		return nil, err
+	}
+
+	question, err := d.QuizQuestions.FindOne(ctx, inTrash(id))
+	if err == nil {
+		return &trashedDoc{collection: collectionNameQuizQuestions, repo: d.QuizQuestions, slideID: question.SlideID}, nil
+	} else if err != repo.ErrNotFound {
+		return nil, err
+	}
+
+	flashcard, err := d.Flashcards.FindOne(ctx, inTrash(id))
+	if err == nil {
+		return &trashedDoc{collection: collectionNameFlashcards, repo: d.Flashcards, slideID: flashcard.SlideID}, nil
+	}
+	return nil, err
+}
+
+// RestoreFromTrash takes a space, slide, quiz question or flashcard out of the
+// trash
+func (d *Deps) RestoreFromTrash(c *gin.Context) {
+	log.Println("RestoreFromTrash")
+
+	objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	doc, err := d.findInTrash(ctx, objID)
+	if err == repo.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found in trash"})
+		return
+	}
+	if err != nil {
+		log.Println("Error finding trashed document", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !d.canRestore(c, ctx, doc) {
+		return
+	}
+
+	_, err = doc.repo.UpdateOne(ctx, repo.ByID(objID), bson.M{
+		"$unset": bson.M{"deleted_at": ""},
+		"$set":   bson.M{"updated_at": time.Now()},
+	})
+	if err != nil {
+		log.Println("Error restoring document", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Println("Restored", doc.collection, objID.Hex())
+	c.JSON(http.StatusOK, gin.H{"message": "Restored successfully", "status_code": http.StatusOK, "type": doc.collection, "id": objID.Hex()})
+}
+
+// canRestore responds with 403 and returns false when the caller does not own
+// the space of a trashed document. Ownership is checked on the raw documents
+// since the space may be in the trash too
+func (d *Deps) canRestore(c *gin.Context, ctx context.Context, doc *trashedDoc) bool {
+	if auth.IsAdmin(c) {
+		return true
+	}
+
+	spaceID := doc.spaceID
+	if doc.slideID != "" {
+		objID, err := primitive.ObjectIDFromHex(doc.slideID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Slide not found"})
+			return false
+		}
+		slide, err := d.Slides.Get(ctx, objID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Slide not found"})
+			return false
+		}
+		spaceID = slide.SpaceID
+	}
+
+	ok, err := d.userOwnsSpace(ctx, auth.UserID(c), spaceID)
+	if err != nil {
+		respondAuthzError(c, err)
+		return false
+	}
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+		return false
+	}
+	return true
+}
+
+// PurgeTrash permanently deletes what has been in the trash for longer than
+// retention, with the cascade of a hard delete
+func (d *Deps) PurgeTrash(ctx context.Context, retention time.Duration) error {
+	// Checked again when deleting, in case a document was restored meanwhile
+	expired := bson.M{"deleted_at": bson.M{"$lt": time.Now().Add(-retention)}}
+
+	spaceIDs, err := hexIDs(ctx, d.Spaces, expired)
+	if err != nil {
+		return err
+	}
+	spaces := 0
+	for spaceID := range spaceIDs {
+		err := d.deleteSpaceCascade(ctx, spaceID, expired)
+		if err == repo.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		spaces++
+	}
+
+	expiredSlides, err := d.Slides.Find(ctx, expired, nil)
+	if err != nil {
+		return err
+	}
+	slides := 0
+	for i := range expiredSlides {
+		err := d.deleteSlideCascade(ctx, &expiredSlides[i], expired)
+		if err == errSlideNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		slides++
+	}
+
+	questions, err := d.QuizQuestions.DeleteMany(ctx, expired)
+	if err != nil {
+		return err
+	}
+	flashcards, err := d.Flashcards.DeleteMany(ctx, expired)
+	if err != nil {
+		return err
+	}
+
+	purged := spaces + slides + int(questions+flashcards)
+	if purged > 0 {
+		log.Printf("Purged %d spaces, %d slides, %d quiz questions and %d flashcards from the trash", spaces, slides, questions, flashcards)
+	}
+	return nil
+}
+
+// RunTrashPurge purges the trash every interval until ctx is done
+func (d *Deps) RunTrashPurge(ctx context.Context, interval time.Duration, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.PurgeTrash(ctx, retention); err != nil {
+				log.Println("Error purging trash", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"main/auth"
+	"main/convert"
+	"main/db"
+	"main/models"
+	"main/repo"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gen2brain/go-fitz"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Room for the other fields of a multipart upload on top of PDF_MAX_BYTES
+const multipartOverhead = 1 << 20
+
+var errUploadNotPending = errors.New("slide has no pending upload")
+
+// UploadSlide creates a slide from a multipart upload of a document, or of
+// several images making one slide each, in the file fields. The slide is
+// converted right away with ?convert=true, taking the render options of
+// ConvertPDFToImages
+func (d *Deps) UploadSlide(c *gin.Context) {
+	log.Println("UploadSlide")
+
+	params, convertNow, err := d.uploadConvertQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, d.Config.PDFMaxBytes+multipartOverhead)
+	form, err := c.MultipartForm()
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": errFileTooLarge.Error()})
+		} else {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	defer form.RemoveAll()
+
+	slide := models.Slide{
+		ID:      primitive.NewObjectID(),
+		Name:    c.PostForm("name"),
+		SpaceID: c.PostForm("space_id"),
+	}
+	if slide.Name == "" || slide.SpaceID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name and space_id are required"})
+		return
+	}
+	if !d.requireSpaceAccess(c, slide.SpaceID) {
+		return
+	}
+
+	files := form.File["file"]
+	if len(files) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+		return
+	}
+	if len(files) > d.Config.PDFMaxPages {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%v: %d, the limit is %d", errPDFTooManyPages, len(files), d.Config.PDFMaxPages)})
+		return
+	}
+
+	tmpDir, err := os.MkdirTemp("", "upload")
+	if err != nil {
+		log.Println("Error creating temp directory", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating temp directory"})
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Validate every file before storing any
+	paths := make([]string, len(files))
+	types := make([]convert.Type, len(files))
+	for i, file := range files {
+		paths[i] = filepath.Join(tmpDir, fmt.Sprintf("source-%d", i))
+		if err := c.SaveUploadedFile(file, paths[i]); err != nil {
+			log.Println("Error saving upload", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving upload"})
+			return
+		}
+		types[i], err = d.validateUpload(paths[i])
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s: %v", file.Filename, err)})
+			return
+		}
+		if len(files) > 1 && types[i].Kind != convert.KindImage {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s: only images can be uploaded together", file.Filename)})
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Minute)
+	defer cancel()
+
+	var keys []string
+	for i, path := range paths {
+		key, err := d.uploadFileToStorage(ctx, slide.ID.Hex(), path, sourceFileName(types[i]), types[i].MIME)
+		if err != nil {
+			log.Println("Error uploading file to storage", err)
+			d.deleteStorageKeys(keys)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error uploading file to storage"})
+			return
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 1 && types[0].Kind != convert.KindImage {
+		slide.PDFKey = keys[0]
+	} else {
+		slide.ImageSourceKeys = keys
+	}
+
+	slide.CreatedAt = time.Now()
+	slide.UpdatedAt = slide.CreatedAt
+	if err := d.Slides.Insert(ctx, &slide); err != nil {
+		log.Println("Error creating slide", err)
+		d.deleteStorageKeys(keys)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	log.Println("Slide uploaded:", slide.ID.Hex())
+
+	d.respondUploadedSlide(c, ctx, slide, params, convertNow)
+}
+
+// CreateSlideUpload creates a slide whose document is uploaded by the client
+// straight to storage, for files too large to go through the server. The
+// client PUTs the file to upload_url, then calls CompleteSlideUpload
+func (d *Deps) CreateSlideUpload(c *gin.Context) {
+	log.Println("CreateSlideUpload")
+
+	var request struct {
+		Name        string `json:"name" binding:"required"`
+		SpaceID     string `json:"space_id" binding:"required"`
+		ContentType string `json:"content_type" binding:"required"`
+		Size        int64  `json:"size"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !d.requireSpaceAccess(c, request.SpaceID) {
+		return
+	}
+
+	if request.Size > d.Config.PDFMaxBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": errFileTooLarge.Error()})
+		return
+	}
+	fileType, err := convert.Lookup(request.ContentType)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	slide := models.Slide{
+		ID:              primitive.NewObjectID(),
+		Name:            request.Name,
+		SpaceID:         request.SpaceID,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+		UploadStartedAt: &now,
+	}
+	key := fmt.Sprintf("slides/%s/%s", slide.ID.Hex(), sourceFileName(fileType))
+	if fileType.Kind == convert.KindImage {
+		slide.ImageSourceKeys = []string{key}
+	} else {
+		slide.PDFKey = key
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	uploadURL, err := d.Storage.PresignPut(ctx, key, fileType.MIME, d.Config.PresignURLTTL)
+	if err != nil {
+		log.Println("Error presigning upload", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error presigning upload"})
+		return
+	}
+
+	if err := d.Slides.Insert(ctx, &slide); err != nil {
+		log.Println("Error creating slide", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	log.Println("Slide upload started:", slide.ID.Hex())
+
+	c.JSON(http.StatusOK, gin.H{
+		"slide_id":   slide.ID.Hex(),
+		"upload_url": uploadURL,
+		"method":     http.MethodPut,
+		"headers":    gin.H{"Content-Type": fileType.MIME},
+		"expires_at": now.Add(d.Config.PresignURLTTL),
+	})
+}
+
+// CompleteSlideUpload validates a document uploaded from CreateSlideUpload. A
+// document that is not valid is deleted along with its slide
+func (d *Deps) CompleteSlideUpload(c *gin.Context) {
+	log.Println("CompleteSlideUpload")
+
+	params, convertNow, err := d.uploadConvertQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Minute)
+	defer cancel()
+
+	slide, err := d.findSlide(ctx, c.Param("id"))
+	if err != nil {
+		respondSlideError(c, err)
+		return
+	}
+	if slide.UploadStartedAt == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": errUploadNotPending.Error()})
+		return
+	}
+
+	key := slide.PDFKey
+	if len(slide.ImageSourceKeys) == 1 {
+		key = slide.ImageSourceKeys[0]
+	}
+
+	tmpDir, err := os.MkdirTemp("", "upload")
+	if err != nil {
+		log.Println("Error creating temp directory", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating temp directory"})
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "source")
+	err = d.downloadFile(ctx, key, "", path, nil)
+	if errors.Is(err, db.ErrObjectNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The file has not been uploaded"})
+		return
+	}
+	if err == nil {
+		_, err = d.validateUpload(path)
+	}
+	if err != nil {
+		log.Println("Rejected upload", slide.ID.Hex(), err)
+		d.deleteStorageKey(key)
+		if _, err := d.Slides.DeleteOne(ctx, repo.ByID(slide.ID)); err != nil {
+			log.Println("Error deleting slide", err)
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	slide.UploadStartedAt = nil
+	slide.UpdatedAt = time.Now()
+	_, err = d.Slides.UpdateOne(ctx, repo.ByID(slide.ID), bson.M{
+		"$set":   bson.M{"updated_at": slide.UpdatedAt},
+		"$unset": bson.M{"upload_started_at": ""},
+	})
+	if err != nil {
+		log.Println("Error updating slide", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	log.Println("Slide upload completed:", slide.ID.Hex())
+
+	d.respondUploadedSlide(c, ctx, *slide, params, convertNow)
+}
+
+// uploadConvertQuery reads ?convert=true and the render options of the
+// conversion, as job params
+func (d *Deps) uploadConvertQuery(c *gin.Context) (map[string]string, bool, error) {
+	if c.Query("convert") != "true" {
+		return nil, false, nil
+	}
+	params := map[string]string{}
+	if err := d.renderQuery(c, params); err != nil {
+		return nil, false, err
+	}
+	return params, true, nil
+}
+
+// respondUploadedSlide responds with an uploaded slide, enqueueing its
+// conversion first if asked to
+func (d *Deps) respondUploadedSlide(c *gin.Context, ctx context.Context, slide models.Slide, params map[string]string, convertNow bool) {
+	response := gin.H{"message": "Slide uploaded successfully", "status_code": http.StatusOK}
+
+	if convertNow {
+		params["slide_id"] = slide.ID.Hex()
+		job, err := d.Jobs.Enqueue(ctx, JobTypeConvertPDF, params, auth.UserID(c), primitive.NilObjectID)
+		if err != nil {
+			// The slide is there, the client can still convert it
+			log.Println("Error enqueuing conversion", err)
+			response["error"] = "Error enqueuing conversion"
+		} else {
+			response["job_id"] = job.ID.Hex()
+		}
+	}
+
+	if err := d.presignSlide(ctx, &slide); err != nil {
+		log.Println("Error presigning slide", err)
+	}
+	response["slide"] = slide
+	c.JSON(http.StatusOK, response)
+}
+
+// validateUpload checks that an uploaded file is a document or an image slides
+// can be made from, and that a PDF is within PDF_MAX_PAGES
+func (d *Deps) validateUpload(path string) (convert.Type, error) {
+	fileType, err := convert.Detect(path)
+	if err != nil {
+		return fileType, err
+	}
+
+	switch fileType.Kind {
+	case convert.KindPDF:
+		doc, err := fitz.New(path)
+		if err != nil {
+			return fileType, errors.New("file is not a valid PDF")
+		}
+		numPages := doc.NumPage()
+		doc.Close()
+		if numPages == 0 {
+			return fileType, errors.New("PDF has no pages")
+		}
+		if numPages > d.Config.PDFMaxPages {
+			return fileType, fmt.Errorf("%w: %d, the limit is %d", errPDFTooManyPages, numPages, d.Config.PDFMaxPages)
+		}
+	case convert.KindPresentation:
+		// Pages are only known once converted, the conversion job checks them
+		if d.Converter == nil {
+			return fileType, convert.ErrNoConverter
+		}
+	}
+	return fileType, nil
+}
+
+// sourceFileName names an uploaded document of a slide in storage
+func sourceFileName(fileType convert.Type) string {
+	return "source-" + generateFileName() + fileType.Extension
+}
+
+// deleteStorageKeys deletes files from storage given their keys
+func (d *Deps) deleteStorageKeys(keys []string) {
+	for _, key := range keys {
+		d.deleteStorageKey(key)
+	}
+}
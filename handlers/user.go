@@ -2,9 +2,12 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"log"
-	"main/db"
+	"main/auth"
+	"main/credits"
 	"main/models"
+	"main/repo"
 	"net/http"
 	"time"
 
@@ -15,7 +18,10 @@ import (
 
 const CollectionNameUsers = "users"
 
-func CreateUser(c *gin.Context) {
+// Credits given to new users
+const signupCredits = 100
+
+func (d *Deps) CreateUser(c *gin.Context) {
 	log.Println("CreateUser")
 
 	var user models.User
@@ -25,55 +31,101 @@ func CreateUser(c *gin.Context) {
 		return
 	}
 
+	// Users can only create their own profile
+	if user.UserID == "" {
+		user.UserID = auth.UserID(c)
+	}
+	if user.UserID != auth.UserID(c) && !auth.IsAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+		return
+	}
+
 	user.ID = primitive.NewObjectID()
 	user.CreatedAt = time.Now()
 	user.UpdatedAt = time.Now()
 	user.SpaceIDs = []string{}
-	user.Credits = 100
+	// The signup credits are granted through the ledger once the user exists,
+	// and only the billing webhook sets the plan
+	user.Credits = 0
+	user.Plan = ""
+	user.StripeCustomerID = ""
+	user.StripeSubscriptionID = ""
+	user.PlanUpdatedAt = nil
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	result, err := db.DB.Collection(CollectionNameUsers).InsertOne(ctx, user)
-	if err != nil {
+	if err := d.Users.Insert(ctx, &user); err != nil {
+		if errors.Is(err, repo.ErrDuplicate) {
+			c.JSON(http.StatusConflict, gin.H{"error": "User already exists"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	log.Println("Create created:", result.InsertedID)
+	log.Println("Create created:", user.ID)
+
+	if _, err := credits.Grant(ctx, user.UserID, signupCredits, "signup"); err != nil {
+		log.Println("Error granting signup credits", err)
+	}
 
-	c.JSON(http.StatusOK, result)
+	c.JSON(http.StatusOK, gin.H{"InsertedID": user.ID})
 }
 
 // Get user
-func GetUser(c *gin.Context) {
+func (d *Deps) GetUser(c *gin.Context) {
 	log.Println("GetUser")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	var user models.User
 	userID := c.Param("user_id")
 
-	if err := db.DB.Collection(CollectionNameUsers).FindOne(ctx, bson.M{"user_id": userID}).Decode(&user); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	user, err := d.Users.FindOne(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		if err == repo.ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
 		return
 	}
 
 	c.JSON(http.StatusOK, user)
 }
 
+// DeleteUser deletes a user along with the spaces they own
+func (d *Deps) DeleteUser(c *gin.Context) {
+	log.Println("DeleteUser")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	if err := d.deleteUserCascade(ctx, c.Param("user_id")); err != nil {
+		if err == repo.ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		log.Println("Error deleting user", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User deleted successfully", "status_code": http.StatusOK})
+}
+
 // Get user spaces
-func GetUserSpaces(c *gin.Context) {
+func (d *Deps) GetUserSpaces(c *gin.Context) {
 	log.Println("GetUserSpaces")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	var user models.User
 	userID := c.Param("user_id")
 
-	if err := db.DB.Collection(CollectionNameUsers).FindOne(ctx, bson.M{"user_id": userID}).Decode(&user); err != nil {
+	user, err := d.Users.FindOne(ctx, bson.M{"user_id": userID})
+	if err != nil {
 		log.Println("Error finding user:", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -82,7 +134,6 @@ func GetUserSpaces(c *gin.Context) {
 	var userSpaces []models.Space
 	for _, spaceID := range user.SpaceIDs {
 		log.Println("Space ID:", spaceID)
-		var space models.Space
 
 		objID, err := primitive.ObjectIDFromHex(spaceID)
 		if err != nil {
@@ -90,12 +141,16 @@ func GetUserSpaces(c *gin.Context) {
 			return
 		}
 
-		if err := db.DB.Collection(CollectionNameSpaces).FindOne(ctx, bson.M{"_id": objID}).Decode(&space); err != nil {
+		space, err := d.Spaces.Get(ctx, objID)
+		if err != nil {
 			log.Println("Error finding space:", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		userSpaces = append(userSpaces, space)
+		if space.DeletedAt != nil {
+			continue
+		}
+		userSpaces = append(userSpaces, *space)
 	}
 
 	log.Println("User spaces:", userSpaces)
@@ -104,17 +159,28 @@ func GetUserSpaces(c *gin.Context) {
 }
 
 // Add space to user from user ID and space ID
-func AddSpaceToUser(c *gin.Context) {
+func (d *Deps) AddSpaceToUser(c *gin.Context) {
 	log.Println("AddSpaceToUser")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	var user models.User
 	userID := c.Param("user_id")
 	spaceID := c.Param("space_id")
 
-	if err := db.DB.Collection(CollectionNameUsers).FindOne(ctx, bson.M{"user_id": userID}).Decode(&user); err != nil {
+	// Only the creator of a space can add it, admins can add unowned spaces
+	space, err := findLive(ctx, d.Spaces, spaceID)
+	if err != nil {
+		respondAuthzError(c, err)
+		return
+	}
+	if space.UserID != userID && !(space.UserID == "" && auth.IsAdmin(c)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+		return
+	}
+
+	user, err := d.Users.FindOne(ctx, bson.M{"user_id": userID})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -138,7 +204,7 @@ func AddSpaceToUser(c *gin.Context) {
 			},
 		}
 
-		if _, err := db.DB.Collection(CollectionNameUsers).UpdateOne(ctx, bson.M{"user_id": userID}, update); err != nil {
+		if _, err := d.Users.UpdateOne(ctx, bson.M{"user_id": userID}, update); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
@@ -150,17 +216,17 @@ func AddSpaceToUser(c *gin.Context) {
 }
 
 // Remove space from user from user ID and space ID
-func RemoveSpaceFromUser(c *gin.Context) {
+func (d *Deps) RemoveSpaceFromUser(c *gin.Context) {
 	log.Println("RemoveSpaceFromUser")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	var user models.User
 	userID := c.Param("user_id")
 	spaceID := c.Param("space_id")
 
-	if err := db.DB.Collection(CollectionNameUsers).FindOne(ctx, bson.M{"user_id": userID}).Decode(&user); err != nil {
+	user, err := d.Users.FindOne(ctx, bson.M{"user_id": userID})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -178,7 +244,7 @@ func RemoveSpaceFromUser(c *gin.Context) {
 		},
 	}
 
-	if _, err := db.DB.Collection(CollectionNameUsers).UpdateOne(ctx, bson.M{"user_id": userID}, update); err != nil {
+	if _, err := d.Users.UpdateOne(ctx, bson.M{"user_id": userID}, update); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
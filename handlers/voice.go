@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"main/models"
+	"main/repo"
+	"main/tts"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// voiceOptions converts stored voice settings to synthesis options
+func voiceOptions(settings *models.VoiceSettings) tts.Options {
+	if settings == nil {
+		return tts.Options{}
+	}
+	return tts.Options{
+		Provider: settings.Provider,
+		Voice:    settings.Voice,
+		Speed:    settings.Speed,
+		Format:   settings.Format,
+	}
+}
+
+// voiceQuery reads the provider, voice, speed and format query parameters
+func (d *Deps) voiceQuery(c *gin.Context) (tts.Options, error) {
+	return d.voiceQueryWithFormat(c, c.Query("format"))
+}
+
+// voiceQueryWithFormat reads the voice options of the query with another
+// format, for routes whose format param is the one of their own output
+func (d *Deps) voiceQueryWithFormat(c *gin.Context, format string) (tts.Options, error) {
+	opts := tts.Options{
+		Provider: c.Query("provider"),
+		Voice:    c.Query("voice"),
+		Format:   format,
+	}
+	if speed := c.Query("speed"); speed != "" {
+		s, err := strconv.ParseFloat(speed, 64)
+		if err != nil {
+			return opts, tts.ErrInvalidSpeed
+		}
+		opts.Speed = s
+	}
+	return opts, d.TTS.Validate(opts)
+}
+
+// voiceParams adds the options set in opts to job params
+func voiceParams(params map[string]string, opts tts.Options) map[string]string {
+	for name, value := range map[string]string{"provider": opts.Provider, "voice": opts.Voice, "format": opts.Format} {
+		if value != "" {
+			params[name] = value
+		}
+	}
+	if opts.Speed != 0 {
+		params["speed"] = strconv.FormatFloat(opts.Speed, 'f', -1, 64)
+	}
+	return params
+}
+
+// voiceFromParams reads the options added by voiceParams
+func voiceFromParams(params map[string]string) tts.Options {
+	opts := tts.Options{Provider: params["provider"], Voice: params["voice"], Format: params["format"]}
+	opts.Speed, _ = strconv.ParseFloat(params["speed"], 64)
+	return opts
+}
+
+// resolveVoice layers the voice settings of the user and the slide over the
+// server defaults, then override on top
+func (d *Deps) resolveVoice(ctx context.Context, userID string, slideID string, override tts.Options) tts.Options {
+	opts := d.TTS.Defaults()
+
+	if userID != "" {
+		user, err := d.Users.FindOne(ctx, bson.M{"user_id": userID})
+		if err != nil && err != repo.ErrNotFound {
+			log.Println("Error finding user voice settings:", err)
+		}
+		if user != nil {
+			opts = opts.With(voiceOptions(user.Voice))
+		}
+	}
+
+	if objID, err := primitive.ObjectIDFromHex(slideID); err == nil {
+		slide, err := d.Slides.Get(ctx, objID)
+		if err != nil && err != repo.ErrNotFound {
+			log.Println("Error finding slide voice settings:", err)
+		}
+		if slide != nil {
+			opts = opts.With(voiceOptions(slide.Voice))
+		}
+	}
+
+	return opts.With(override)
+}
+
+// synthesizeSlideImageAudio narrates the generated text of a slide image,
+// uploads the audio and stores its key on the slide image. The audio it had
+// before is deleted once replaced
+func (d *Deps) synthesizeSlideImageAudio(ctx context.Context, slideImage *models.SlideImage, opts tts.Options) (string, error) {
+	generatedText := slideImage.GeneratedText
+	if generatedText == "" {
+		return "", errGeneratedTextNotFound
+	}
+
+	log.Printf("Generating audio file with %s voice %q", opts.Provider, opts.Voice)
+	narration, err := d.TTS.Narrate(ctx, generatedText, opts)
+	if err != nil {
+		return "", fmt.Errorf("error generating audio file: %w", err)
+	}
+	log.Printf("Narration of %s in %d parts", narration.Duration, len(narration.Chunks))
+
+	audioKey, err := d.uploadAudio(ctx, slideImage.SlideID, narration.Audio)
+	if err != nil {
+		log.Println("Error uploading audio to storage", err)
+		return "", fmt.Errorf("error uploading audio to storage")
+	}
+	log.Println("Audio uploaded to storage", audioKey)
+
+	if err := d.setSlideImageAudio(ctx, slideImage.ID, audioKey, narration); err != nil {
+		log.Println("Error updating slide image", err)
+		d.deleteStorageKey(audioKey)
+		return "", fmt.Errorf("error updating slide image")
+	}
+	d.deleteFile(slideImage.AudioKey, slideImage.AudioURL)
+	return audioKey, nil
+}
+
+// SetUserVoice sets the default voice settings of a user
+func (d *Deps) SetUserVoice(c *gin.Context) {
+	log.Println("SetUserVoice")
+
+	var settings models.VoiceSettings
+	if err := c.ShouldBindJSON(&settings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := d.TTS.Validate(voiceOptions(&settings)); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	userID := c.Param("user_id")
+	matched, err := d.Users.UpdateOne(ctx, bson.M{"user_id": userID}, bson.M{
+		"$set": bson.M{"voice": settings, "updated_at": time.Now()},
+	})
+	if err != nil {
+		log.Println("Error updating user voice:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if matched == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Voice settings updated successfully", "status_code": http.StatusOK, "voice": settings})
+}
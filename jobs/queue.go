@@ -0,0 +1,412 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"main/db"
+	"main/events"
+	"main/models"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const CollectionNameJobs = "jobs"
+
+// Job statuses
+const (
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+// How long a worker holds a job before another worker may pick it up again,
+// running jobs renew it every leaseDuration/3
+const leaseDuration = 60 * time.Second
+
+// ErrUnknownJobType is returned by Enqueue for job types that were never registered
+var ErrUnknownJobType = errors.New("unknown job type")
+
+// ErrJobNotFound is returned when a job ID does not exist
+var ErrJobNotFound = errors.New("job not found")
+
+// ReportFunc reports the progress of a running job
+type ReportFunc func(current int, total int, message string)
+
+// HandlerFunc runs a job and returns its result, ctx is cancelled when the job
+// times out or is cancelled through Cancel
+type HandlerFunc func(ctx context.Context, job *models.Job, report ReportFunc) (bson.M, error)
+
+// FailureFunc is called once for a job that failed for good or was cancelled
+type FailureFunc func(ctx context.Context, job *models.Job)
+
+type handler struct {
+	run         HandlerFunc
+	timeout     time.Duration
+	maxAttempts int
+}
+
+// Queue runs the jobs of the registered types with workers started by Start,
+// their events are published to an event log
+type Queue struct {
+	events events.EventLog
+
+	handlersMu   sync.RWMutex
+	handlers     map[string]handler
+	failureHooks []FailureFunc
+
+	wakeup chan struct{}
+
+	runningMu sync.Mutex
+	running   map[primitive.ObjectID]context.CancelFunc
+
+	workersWG sync.WaitGroup
+
+	// jobsCtx is cancelled when a shutdown takes too long, to interrupt the
+	// running jobs
+	jobsCtx       context.Context
+	interruptJobs context.CancelFunc
+}
+
+// New creates a Queue whose jobs publish their events to l
+func New(l events.EventLog) *Queue {
+	q := &Queue{
+		events:   l,
+		handlers: map[string]handler{},
+		wakeup:   make(chan struct{}, 1),
+		running:  map[primitive.ObjectID]context.CancelFunc{},
+	}
+	q.jobsCtx, q.interruptJobs = context.WithCancel(context.Background())
+	return q
+}
+
+// Register registers the handler for a job type, jobs that are not safe to run
+// twice should use a maxAttempts of 1
+func (q *Queue) Register(jobType string, timeout time.Duration, maxAttempts int, run HandlerFunc) {
+	q.handlersMu.Lock()
+	defer q.handlersMu.Unlock()
+	q.handlers[jobType] = handler{run: run, timeout: timeout, maxAttempts: maxAttempts}
+}
+
+// OnFailure registers a function called when a job fails for good or is cancelled
+func (q *Queue) OnFailure(fn FailureFunc) {
+	q.handlersMu.Lock()
+	defer q.handlersMu.Unlock()
+	q.failureHooks = append(q.failureHooks, fn)
+}
+
+// failed runs the failure hooks of a job
+func (q *Queue) failed(ctx context.Context, job *models.Job) {
+	q.handlersMu.RLock()
+	hooks := append([]FailureFunc{}, q.failureHooks...)
+	q.handlersMu.RUnlock()
+	for _, fn := range hooks {
+		fn(ctx, job)
+	}
+}
+
+// emitter returns the Emitter of the event stream of a job
+func (q *Queue) emitter(id primitive.ObjectID) events.Emitter {
+	return events.Emitter{Events: q.events, StreamID: StreamID(id)}
+}
+
+// StreamID returns the ID of the event stream of a job
+func StreamID(id primitive.ObjectID) string {
+	return "job:" + id.Hex()
+}
+
+func (q *Queue) lookup(jobType string) (handler, bool) {
+	q.handlersMu.RLock()
+	defer q.handlersMu.RUnlock()
+	h, ok := q.handlers[jobType]
+	return h, ok
+}
+
+// Enqueue stores a new job for userID to be picked up by a worker, chargeID is
+// the credit transaction that paid for it, if any
+func (q *Queue) Enqueue(ctx context.Context, jobType string, params map[string]string, userID string, chargeID primitive.ObjectID) (*models.Job, error) {
+	h, ok := q.lookup(jobType)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownJobType, jobType)
+	}
+	if params == nil {
+		params = map[string]string{}
+	}
+
+	now := time.Now()
+	job := &models.Job{
+		ID:          primitive.NewObjectID(),
+		Type:        jobType,
+		Params:      params,
+		UserID:      userID,
+		ChargeID:    chargeID,
+		Status:      StatusQueued,
+		MaxAttempts: h.maxAttempts,
+		RunAt:       now,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	_, err := db.DB.Collection(CollectionNameJobs).InsertOne(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Enqueued %s job %s", jobType, job.ID.Hex())
+	events.Publish(q.events, StreamID(job.ID), events.TypeLog, bson.M{"message": "Job queued", "job_id": job.ID.Hex()})
+	q.wake()
+	return job, nil
+}
+
+// Get returns a job by ID
+func (q *Queue) Get(ctx context.Context, id primitive.ObjectID) (*models.Job, error) {
+	var job models.Job
+	err := db.DB.Collection(CollectionNameJobs).FindOne(ctx, bson.M{"_id": id}).Decode(&job)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrJobNotFound
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+// FindLatest returns the most recent job of jobType with params enqueued by
+// userID, if active is set only queued or running jobs are considered
+func (q *Queue) FindLatest(ctx context.Context, jobType string, params map[string]string, userID string, active bool) (*models.Job, error) {
+	filter := bson.M{"type": jobType, "user_id": userID}
+	for k, v := range params {
+		filter["params."+k] = v
+	}
+	if active {
+		filter["status"] = bson.M{"$in": bson.A{StatusQueued, StatusRunning}}
+	}
+	opts := options.FindOne().SetSort(bson.D{{Key: "created_at", Value: -1}})
+
+	var job models.Job
+	err := db.DB.Collection(CollectionNameJobs).FindOne(ctx, filter, opts).Decode(&job)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrJobNotFound
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Cancel cancels a queued or running job, running jobs are interrupted the
+// next time their worker renews its lease
+func (q *Queue) Cancel(ctx context.Context, id primitive.ObjectID) (*models.Job, error) {
+	now := time.Now()
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var job models.Job
+	err := db.DB.Collection(CollectionNameJobs).FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "status": bson.M{"$in": bson.A{StatusQueued, StatusRunning}}},
+		bson.M{"$set": bson.M{"status": StatusCancelled, "updated_at": now, "finished_at": now}},
+		opts,
+	).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		// Already finished, return it as is
+		return q.Get(ctx, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	q.interrupt(id)
+	q.emitter(id).Error("Job cancelled")
+	q.failed(ctx, &job)
+	return &job, nil
+}
+
+// hasAttemptsLeft matches jobs that have not used up their attempts
+var hasAttemptsLeft = bson.M{"$expr": bson.M{"$lt": bson.A{"$attempts", "$max_attempts"}}}
+
+// claim picks the next job that is ready to run, including running jobs whose
+// worker stopped renewing the lease if they have attempts left
+func (q *Queue) claim(ctx context.Context) (*models.Job, error) {
+	if err := q.failAbandoned(ctx); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	filter := bson.M{
+		"$or": bson.A{
+			bson.M{"status": StatusQueued, "run_at": bson.M{"$lte": now}},
+			bson.M{"$and": bson.A{
+				bson.M{"status": StatusRunning, "locked_until": bson.M{"$lt": now}},
+				hasAttemptsLeft,
+			}},
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"status":       StatusRunning,
+			"locked_until": now.Add(leaseDuration),
+			"started_at":   now,
+			"updated_at":   now,
+		},
+		"$inc": bson.M{"attempts": 1},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "run_at", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	var job models.Job
+	err := db.DB.Collection(CollectionNameJobs).FindOneAndUpdate(ctx, filter, update, opts).Decode(&job)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+// failAbandoned fails the running jobs whose worker stopped renewing the lease
+// and that have no attempts left, e.g. jobs that are not safe to run twice
+// after a crash
+func (q *Queue) failAbandoned(ctx context.Context) error {
+	for {
+		now := time.Now()
+		filter := bson.M{"$and": bson.A{
+			bson.M{"status": StatusRunning, "locked_until": bson.M{"$lt": now}},
+			bson.M{"$nor": bson.A{hasAttemptsLeft}},
+		}}
+		update := bson.M{"$set": bson.M{
+			"status":      StatusFailed,
+			"error":       "worker stopped before the job finished",
+			"updated_at":  now,
+			"finished_at": now,
+		}}
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+		var job models.Job
+		err := db.DB.Collection(CollectionNameJobs).FindOneAndUpdate(ctx, filter, update, opts).Decode(&job)
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Job %s failed, its worker stopped", job.ID.Hex())
+		q.emitter(job.ID).Error(job.Error)
+		q.failed(ctx, &job)
+	}
+}
+
+// renew extends the lease of a running job, it reports false if the job is no
+// longer running, e.g. because it was cancelled
+func renew(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	result, err := db.DB.Collection(CollectionNameJobs).UpdateOne(ctx,
+		bson.M{"_id": id, "status": StatusRunning},
+		bson.M{"$set": bson.M{"locked_until": time.Now().Add(leaseDuration)}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+// release queues a job interrupted by a shutdown again without counting the
+// attempt, so that another server picks it up right away
+func (q *Queue) release(ctx context.Context, job *models.Job) error {
+	now := time.Now()
+	_, err := db.DB.Collection(CollectionNameJobs).UpdateOne(ctx,
+		bson.M{"_id": job.ID, "status": StatusRunning},
+		bson.M{
+			"$set": bson.M{"status": StatusQueued, "run_at": now, "updated_at": now},
+			"$inc": bson.M{"attempts": -1},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	q.emitter(job.ID).Log("Interrupted by a server shutdown, retrying")
+	return nil
+}
+
+// CompleteUnits records that n more units of the charge of a running job are
+// done, see models.Job.CompletedUnits
+func (q *Queue) CompleteUnits(ctx context.Context, job *models.Job, n int) error {
+	_, err := db.DB.Collection(CollectionNameJobs).UpdateOne(ctx,
+		bson.M{"_id": job.ID},
+		bson.M{"$inc": bson.M{"completed_units": n}, "$set": bson.M{"updated_at": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+	job.CompletedUnits += n
+	return nil
+}
+
+// updateProgress stores the progress of a running job
+func updateProgress(ctx context.Context, id primitive.ObjectID, progress models.JobProgress) error {
+	_, err := db.DB.Collection(CollectionNameJobs).UpdateOne(ctx,
+		bson.M{"_id": id, "status": StatusRunning},
+		bson.M{"$set": bson.M{"progress": progress, "updated_at": time.Now()}},
+	)
+	return err
+}
+
+// finish stores the outcome of a job, failed jobs are queued again with a
+// backoff until they run out of attempts
+func (q *Queue) finish(ctx context.Context, job *models.Job, result bson.M, runErr error) error {
+	now := time.Now()
+	set := bson.M{"updated_at": now}
+
+	switch {
+	case runErr == nil:
+		set["status"] = StatusSucceeded
+		set["result"] = result
+		set["finished_at"] = now
+	case job.Attempts < job.MaxAttempts:
+		set["status"] = StatusQueued
+		set["error"] = runErr.Error()
+		set["run_at"] = now.Add(backoff(job.Attempts))
+	default:
+		set["status"] = StatusFailed
+		set["error"] = runErr.Error()
+		set["finished_at"] = now
+	}
+
+	// Only running jobs are updated so a cancellation is never overwritten
+	updateResult, err := db.DB.Collection(CollectionNameJobs).UpdateOne(ctx,
+		bson.M{"_id": job.ID, "status": StatusRunning},
+		bson.M{"$set": set},
+	)
+	if err != nil {
+		return err
+	}
+	if updateResult.MatchedCount == 0 {
+		return nil
+	}
+
+	emitter := q.emitter(job.ID)
+	switch set["status"] {
+	case StatusSucceeded:
+		emitter.Done(bson.M{"status": StatusSucceeded, "job_id": job.ID.Hex(), "result": result})
+	case StatusQueued:
+		emitter.Log(fmt.Sprintf("Attempt %d failed, retrying: %v", job.Attempts, runErr))
+	default:
+		emitter.Error(runErr.Error())
+		q.failed(ctx, job)
+	}
+	return nil
+}
+
+// backoff returns how long to wait before retrying after attempt
+func backoff(attempt int) time.Duration {
+	return time.Duration(1<<uint(attempt)) * 15 * time.Second
+}
@@ -0,0 +1,179 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"main/models"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const pollInterval = 5 * time.Second
+
+// wake tells an idle worker to look for a job without waiting for the next poll
+func (q *Queue) wake() {
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// interrupt cancels a job if it is running in this process
+func (q *Queue) interrupt(id primitive.ObjectID) {
+	q.runningMu.Lock()
+	defer q.runningMu.Unlock()
+	if cancel, ok := q.running[id]; ok {
+		cancel()
+	}
+}
+
+// Start starts n workers that claim jobs until ctx is cancelled, the jobs they
+// are running then finish unless Shutdown interrupts them
+func (q *Queue) Start(ctx context.Context, n int) {
+	log.Printf("Starting %d job workers", n)
+	for i := 0; i < n; i++ {
+		q.workersWG.Add(1)
+		go func() {
+			defer q.workersWG.Done()
+			q.work(ctx)
+		}()
+	}
+}
+
+// Wait blocks until every worker started by Start has returned
+func (q *Queue) Wait() {
+	q.workersWG.Wait()
+}
+
+// Shutdown waits for the workers to return once the context given to Start is
+// cancelled. Jobs still running when ctx expires are interrupted and queued
+// again for another server
+func (q *Queue) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		q.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		q.interruptJobs()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (q *Queue) work(ctx context.Context) {
+	for {
+		job, err := q.claim(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Println("Error claiming job", err)
+		}
+
+		if job != nil {
+			q.run(q.jobsCtx, job)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wakeup:
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// run runs a claimed job and stores its outcome
+func (q *Queue) run(ctx context.Context, job *models.Job) {
+	log.Printf("Running %s job %s (attempt %d)", job.Type, job.ID.Hex(), job.Attempts)
+
+	h, ok := q.lookup(job.Type)
+	if !ok {
+		job.Attempts = job.MaxAttempts
+		q.finish(context.Background(), job, nil, fmt.Errorf("%w: %s", ErrUnknownJobType, job.Type))
+		return
+	}
+
+	jobCtx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	q.runningMu.Lock()
+	q.running[job.ID] = cancel
+	q.runningMu.Unlock()
+	defer func() {
+		q.runningMu.Lock()
+		delete(q.running, job.ID)
+		q.runningMu.Unlock()
+	}()
+
+	// Renew the lease while the job runs and stop it if it was cancelled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(leaseDuration / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				ok, err := renew(context.Background(), job.ID)
+				if err != nil {
+					log.Println("Error renewing job lease", err)
+				} else if !ok {
+					cancel()
+				}
+			}
+		}
+	}()
+
+	emitter := q.emitter(job.ID)
+	emitter.Log(fmt.Sprintf("Job started (attempt %d)", job.Attempts))
+
+	// Handlers may report from several goroutines
+	var progressMu sync.Mutex
+	report := func(current int, total int, message string) {
+		progressMu.Lock()
+		defer progressMu.Unlock()
+		job.Progress = models.JobProgress{Current: current, Total: total, Message: message}
+		if err := updateProgress(context.Background(), job.ID, job.Progress); err != nil {
+			log.Println("Error updating job progress", err)
+		}
+		emitter.Progress(current, total, message)
+	}
+
+	result, err := safeRun(jobCtx, h.run, job, report)
+	if err != nil && ctx.Err() != nil {
+		log.Printf("Job %s interrupted by shutdown", job.ID.Hex())
+		if err := q.release(context.Background(), job); err != nil {
+			log.Println("Error releasing job", err)
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("Job %s failed: %v", job.ID.Hex(), err)
+	} else {
+		log.Printf("Job %s succeeded", job.ID.Hex())
+	}
+
+	if err := q.finish(context.Background(), job, result, err); err != nil {
+		log.Println("Error finishing job", err)
+	}
+}
+
+// safeRun runs a handler and turns a panic into an error
+func safeRun(ctx context.Context, run HandlerFunc, job *models.Job, report ReportFunc) (result bson.M, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return run(ctx, job, report)
+}
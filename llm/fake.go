@@ -0,0 +1,75 @@
+package llm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+)
+
+// Kinds of completion recorded by Fake
+const (
+	KindText   = "text"
+	KindVision = "vision"
+	KindJSON   = "json"
+)
+
+// Call is a completion requested from Fake
+type Call struct {
+	Kind     string
+	Prompt   Prompt
+	ImageURL string
+}
+
+// Fake is a deterministic Completer for offline use. Without Respond it answers
+// text and vision prompts with a digest of the prompt and JSON prompts with {}
+type Fake struct {
+	// Respond overrides the completions, e.g. to return canned quiz questions
+	Respond func(call Call) (string, error)
+
+	mu    sync.Mutex
+	calls []Call
+}
+
+// NewFake creates a Fake with the default responses
+func NewFake() *Fake {
+	return &Fake{}
+}
+
+func (f *Fake) Complete(ctx context.Context, prompt Prompt) (string, error) {
+	return f.complete(ctx, Call{Kind: KindText, Prompt: prompt})
+}
+
+func (f *Fake) CompleteVision(ctx context.Context, prompt Prompt, imageURL string) (string, error) {
+	return f.complete(ctx, Call{Kind: KindVision, Prompt: prompt, ImageURL: imageURL})
+}
+
+func (f *Fake) CompleteJSON(ctx context.Context, prompt Prompt) (string, error) {
+	return f.complete(ctx, Call{Kind: KindJSON, Prompt: prompt})
+}
+
+// Calls returns the completions requested so far
+func (f *Fake) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Call{}, f.calls...)
+}
+
+func (f *Fake) complete(ctx context.Context, call Call) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	f.mu.Lock()
+	f.calls = append(f.calls, call)
+	f.mu.Unlock()
+
+	if f.Respond != nil {
+		return f.Respond(call)
+	}
+	if call.Kind == KindJSON {
+		return "{}", nil
+	}
+	sum := sha256.Sum256([]byte(call.Kind + "\x00" + call.Prompt.System + "\x00" + call.Prompt.User + "\x00" + call.ImageURL))
+	return "fake completion " + hex.EncodeToString(sum[:8]), nil
+}
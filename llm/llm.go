@@ -0,0 +1,88 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Prompt is a single-turn request to a model
+type Prompt struct {
+	// System is an optional system message
+	System string
+	User   string
+	// MaxTokens caps the completion, 0 uses the provider's default
+	MaxTokens int
+}
+
+// Completer generates completions, implementations are safe for concurrent use
+type Completer interface {
+	// Complete returns a text completion
+	Complete(ctx context.Context, prompt Prompt) (string, error)
+	// CompleteVision returns a text completion of a prompt about an image
+	CompleteVision(ctx context.Context, prompt Prompt, imageURL string) (string, error)
+	// CompleteJSON returns a completion that is a JSON object, the prompt must
+	// ask for JSON
+	CompleteJSON(ctx context.Context, prompt Prompt) (string, error)
+}
+
+// ErrEmptyCompletion is returned when the provider returns no choices
+var ErrEmptyCompletion = errors.New("empty completion")
+
+// Config configures the client
+type Config struct {
+	// Provider is "openai" or "fake"
+	Provider string
+	APIKey   string
+	// Model of each kind of completion
+	TextModel   string
+	VisionModel string
+	JSONModel   string
+	// Timeout of a single call, retries get a new one within the caller's deadline
+	Timeout time.Duration
+	// MaxRetries of calls failing with 429 or 5xx
+	MaxRetries int
+}
+
+// New returns the Completer of the provider of cfg
+func New(cfg Config) (Completer, error) {
+	switch cfg.Provider {
+	case "openai", "":
+		return NewOpenAI(cfg), nil
+	case "fake":
+		return NewFake(), nil
+	}
+	return nil, fmt.Errorf("unknown LLM provider: %s", cfg.Provider)
+}
+
+// retry calls fn until it succeeds, fails with an error that is not retryable,
+// runs out of retries or ctx is done. Attempts back off exponentially with jitter
+func retry(ctx context.Context, maxRetries int, timeout time.Duration, retryable func(error) bool, fn func(ctx context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		callCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := fn(callCtx)
+		cancel()
+
+		if err == nil || attempt >= maxRetries || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff(attempt)):
+		}
+	}
+}
+
+// backoff returns the wait before retrying after attempt, 1s, 2s, 4s... capped at
+// 30s, with up to 50% jitter
+func backoff(attempt int) time.Duration {
+	wait := time.Second << uint(attempt)
+	if wait > 30*time.Second {
+		wait = 30 * time.Second
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
@@ -0,0 +1,116 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// failing returns a call that fails with the given statuses in turn, then
+// succeeds, counting the calls made
+func failing(calls *int, statuses ...int) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		*calls++
+		if *calls > len(statuses) {
+			return nil
+		}
+		return &openai.APIError{HTTPStatusCode: statuses[*calls-1], Message: http.StatusText(statuses[*calls-1])}
+	}
+}
+
+func TestRetryRateLimit(t *testing.T) {
+	t.Parallel()
+
+	calls := 0
+	err := retry(context.Background(), 3, time.Second, retryable, failing(&calls, http.StatusTooManyRequests))
+	if err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("calls = %d, want 2", calls)
+	}
+}
+
+func TestRetryServerErrorRunsOutOfRetries(t *testing.T) {
+	t.Parallel()
+
+	calls := 0
+	err := retry(context.Background(), 1, time.Second, retryable, failing(&calls, http.StatusBadGateway, http.StatusServiceUnavailable))
+	var apiErr *openai.APIError
+	if !errors.As(err, &apiErr) || apiErr.HTTPStatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("err = %v, want the last 503", err)
+	}
+	if calls != 2 {
+		t.Errorf("calls = %d, want 2", calls)
+	}
+}
+
+func TestRetryClientErrorIsNotRetried(t *testing.T) {
+	t.Parallel()
+
+	for _, status := range []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusNotFound} {
+		calls := 0
+		err := retry(context.Background(), 3, time.Second, retryable, failing(&calls, status))
+		if err == nil {
+			t.Errorf("%d: err = nil, want the error", status)
+		}
+		if calls != 1 {
+			t.Errorf("%d: calls = %d, want 1", status, calls)
+		}
+	}
+}
+
+func TestRetryStopsWhenContextIsDone(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	calls := 0
+	start := time.Now()
+	err := retry(ctx, 5, time.Second, retryable, failing(&calls, 500, 500, 500, 500, 500))
+	if err == nil {
+		t.Fatal("err = nil, want the server error")
+	}
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("retry waited %s after the deadline", elapsed)
+	}
+}
+
+func TestRetryableTimeout(t *testing.T) {
+	if !retryable(context.DeadlineExceeded) {
+		t.Error("a call that timed out should be retried")
+	}
+	if retryable(context.Canceled) {
+		t.Error("a canceled call should not be retried")
+	}
+	if !retryable(&openai.RequestError{HTTPStatusCode: http.StatusInternalServerError}) {
+		t.Error("a request failing with 500 should be retried")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{0, 500 * time.Millisecond, time.Second},
+		{1, time.Second, 2 * time.Second},
+		{3, 4 * time.Second, 8 * time.Second},
+		{10, 15 * time.Second, 30 * time.Second},
+	}
+	for _, test := range tests {
+		for i := 0; i < 20; i++ {
+			if wait := backoff(test.attempt); wait < test.min || wait > test.max {
+				t.Errorf("backoff(%d) = %s, want between %s and %s", test.attempt, wait, test.min, test.max)
+			}
+		}
+	}
+}
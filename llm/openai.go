@@ -0,0 +1,121 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// OpenAI is a Completer backed by the OpenAI chat completions API
+type OpenAI struct {
+	client *openai.Client
+	cfg    Config
+}
+
+// NewOpenAI creates an OpenAI completer, unset models default to GPT-4o
+func NewOpenAI(cfg Config) *OpenAI {
+	if cfg.TextModel == "" {
+		cfg.TextModel = openai.GPT4o
+	}
+	if cfg.VisionModel == "" {
+		cfg.VisionModel = openai.GPT4o
+	}
+	if cfg.JSONModel == "" {
+		cfg.JSONModel = openai.GPT4o
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 2 * time.Minute
+	}
+	return &OpenAI{client: openai.NewClient(cfg.APIKey), cfg: cfg}
+}
+
+func (o *OpenAI) Complete(ctx context.Context, prompt Prompt) (string, error) {
+	return o.complete(ctx, openai.ChatCompletionRequest{
+		Model:     o.cfg.TextModel,
+		Messages:  messages(prompt, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: prompt.User}),
+		MaxTokens: prompt.MaxTokens,
+	})
+}
+
+func (o *OpenAI) CompleteVision(ctx context.Context, prompt Prompt, imageURL string) (string, error) {
+	user := openai.ChatCompletionMessage{
+		Role: openai.ChatMessageRoleUser,
+		MultiContent: []openai.ChatMessagePart{
+			{
+				Type: openai.ChatMessagePartTypeText,
+				Text: prompt.User,
+			},
+			{
+				Type: openai.ChatMessagePartTypeImageURL,
+				ImageURL: &openai.ChatMessageImageURL{
+					URL:    imageURL,
+					Detail: openai.ImageURLDetailHigh,
+				},
+			},
+		},
+	}
+	return o.complete(ctx, openai.ChatCompletionRequest{
+		Model:     o.cfg.VisionModel,
+		Messages:  messages(prompt, user),
+		MaxTokens: prompt.MaxTokens,
+	})
+}
+
+func (o *OpenAI) CompleteJSON(ctx context.Context, prompt Prompt) (string, error) {
+	return o.complete(ctx, openai.ChatCompletionRequest{
+		Model:     o.cfg.JSONModel,
+		Messages:  messages(prompt, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: prompt.User}),
+		MaxTokens: prompt.MaxTokens,
+		ResponseFormat: &openai.ChatCompletionResponseFormat{
+			Type: openai.ChatCompletionResponseFormatTypeJSONObject,
+		},
+	})
+}
+
+func (o *OpenAI) complete(ctx context.Context, request openai.ChatCompletionRequest) (string, error) {
+	var content string
+	err := retry(ctx, o.cfg.MaxRetries, o.cfg.Timeout, retryable, func(ctx context.Context) error {
+		result, err := o.client.CreateChatCompletion(ctx, request)
+		if err != nil {
+			return err
+		}
+		if len(result.Choices) == 0 {
+			return ErrEmptyCompletion
+		}
+		content = result.Choices[0].Message.Content
+		return nil
+	})
+	return content, err
+}
+
+// messages prepends the system message of a prompt, if any
+func messages(prompt Prompt, user openai.ChatCompletionMessage) []openai.ChatCompletionMessage {
+	if prompt.System == "" {
+		return []openai.ChatCompletionMessage{user}
+	}
+	return []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: prompt.System},
+		user,
+	}
+}
+
+// retryable reports whether a call failed with a rate limit, a server error or
+// a timeout of the single call
+func retryable(err error) bool {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return retryableStatus(apiErr.HTTPStatusCode)
+	}
+	var requestErr *openai.RequestError
+	if errors.As(err, &requestErr) {
+		return retryableStatus(requestErr.HTTPStatusCode)
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
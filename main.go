@@ -1,61 +1,325 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"log"
+	"main/auth"
+	"main/billing"
+	"main/config"
+	"main/convert"
+	"main/credits"
 	"main/db"
+	"main/events"
+	"main/fetch"
 	"main/handlers"
-	"main/utils"
+	"main/jobs"
+	"main/llm"
+	"main/migrations"
+	"main/repo"
+	"main/tts"
+	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	"github.com/joho/godotenv"
 )
 
 func main() {
 	log.Println("Starting server")
 
+	log.Println("Loading configuration")
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	if cfg.Env == "production" {
+		log.Println("Running in production")
+		gin.SetMode(gin.ReleaseMode)
+	} else if cfg.Local() {
+		log.Println("Running locally")
+	} else {
+		log.Println("Running in", cfg.Env)
+	}
+
 	r := gin.Default()
 	r.Use(cors.Default())
 
-	log.Println("Loading .env file")
-	env := os.Getenv("SERVER_ENV")
+	// Prints a token signed with the local test key, e.g. go run . token <user_id> admin
+	if len(os.Args) > 2 && os.Args[1] == "token" {
+		if !cfg.Local() {
+			log.Fatal("The token command only runs locally")
+		}
+		role := ""
+		if len(os.Args) > 3 {
+			role = os.Args[3]
+		}
+		token, err := auth.SignLocalToken(os.Args[2], role, 24*time.Hour)
+		if err != nil {
+			log.Fatalf("Error signing token: %v", err)
+		}
+		fmt.Println(token)
+		return
+	}
 
-	if env == "production" {
-		log.Println("Running in production")
-		gin.SetMode(gin.ReleaseMode)
+	authenticator, err := auth.New(auth.Config{
+		JWKS:      cfg.Auth.JWKS,
+		Issuer:    cfg.Auth.Issuer,
+		Audience:  cfg.Auth.Audience,
+		RoleClaim: cfg.Auth.RoleClaim,
+	})
+	if err != nil {
+		log.Fatalf("Error loading auth keys: %v", err)
+	}
 
-	} else if env == "development" {
-		log.Println("Running in development")
-	} else {
-		log.Println("No environment set, defaulting to local")
-		log.Println("Loading .env file")
-		err := godotenv.Load()
+	packs, err := billing.ParseProducts(billing.ModePayment, cfg.Billing.CreditPacks)
+	if err != nil {
+		log.Fatalf("Invalid BILLING_CREDIT_PACKS: %v", err)
+	}
+	plans, err := billing.ParseProducts(billing.ModeSubscription, cfg.Billing.Plans)
+	if err != nil {
+		log.Fatalf("Invalid BILLING_PLANS: %v", err)
+	}
+	billing.Configure(billing.Config{
+		SecretKey:     cfg.Billing.StripeSecret,
+		WebhookSecret: cfg.Billing.StripeWebhookSecret,
+		SuccessURL:    cfg.Billing.SuccessURL,
+		CancelURL:     cfg.Billing.CancelURL,
+		Products:      append(packs, plans...),
+	})
+
+	// Prints a Stripe-Signature header for a recorded webhook fixture, e.g.
+	// go run . sign-webhook billing/testdata/checkout_session_completed_payment.json
+	if len(os.Args) > 2 && os.Args[1] == "sign-webhook" {
+		payload, err := os.ReadFile(os.Args[2])
 		if err != nil {
-			log.Fatalf("Error loading .env file: %v", err)
+			log.Fatalf("Error reading fixture: %v", err)
 		}
+		fmt.Println(billing.SignPayload(payload, cfg.Billing.StripeWebhookSecret))
+		return
+	}
+
+	log.Println("Connecting to MongoDB")
+	db.ConnectMongo(cfg.Mongo.URI, cfg.Mongo.Database)
 
+	log.Println("Connecting to storage")
+	storage, err := db.NewStorage(cfg.Storage.Driver, cfg.Storage.AWSRegion, cfg.Storage.AWSBucket, cfg.Storage.LocalDir, cfg.Storage.LocalURL, cfg.Storage.LocalSecret)
+	if err != nil {
+		log.Fatalf("Error connecting to storage: %v", err)
 	}
 
-	utils.LoadEnvs()
+	deps := &handlers.Deps{
+		Storage: storage,
+		Auth:    authenticator,
+		Config: handlers.Config{
+			StorageDriver:  cfg.Storage.Driver,
+			PresignURLTTL:  cfg.Storage.PresignURLTTL,
+			PDFMaxPages:    cfg.Slides.PDFMaxPages,
+			PDFMaxBytes:    cfg.Slides.PDFMaxBytes,
+			PDFWorkers:     cfg.Slides.PDFWorkers,
+			RenderDPI:      cfg.Slides.RenderDPI,
+			RenderFormat:   cfg.Slides.RenderFormat,
+			RenderQuality:  cfg.Slides.RenderQuality,
+			ThumbnailWidth: cfg.Slides.ThumbnailWidth,
+			TrashRetention: cfg.Background.TrashRetention,
+			Audio:          cfg.TTS.Enabled(),
+		},
+	}
 
-	// stripeSecret := os.Getenv("STRIPE_SECRET")
+	deps.Repositories, err = repo.New(cfg.Mongo.Repository)
+	if err != nil {
+		log.Fatalf("Error connecting to repositories: %v", err)
+	}
 
-	// if stripeSecret == "" {
-	// 	log.Fatal("STRIPE_SECRET not found in .env file")
-	// }
-	// stripe.Key = stripeSecret
+	// Applies pending migrations and creates missing indexes, or only lists
+	// them with "dry-run", e.g. go run . migrate dry-run
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		dryRun := len(os.Args) > 2 && os.Args[2] == "dry-run"
+		report, err := migrations.Run(context.Background(), storage, dryRun)
+		if err != nil {
+			log.Fatalf("Error running migrations: %v", err)
+		}
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
 
-	log.Println("Connecting to MongoDB")
-	mongoURI := os.Getenv("MONGO_URI")
-	if mongoURI == "" {
-		log.Fatal("MONGO_URI not found in .env file")
+	if !cfg.Mongo.SkipMigrations {
+		log.Println("Running migrations")
+		_, err = migrations.Run(context.Background(), storage, false)
+		if err != nil {
+			log.Fatalf("Error running migrations: %v", err)
+		}
+	}
+
+	// Reports orphaned documents and files, or removes them with "delete", e.g.
+	// go run . gc delete
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		remove := len(os.Args) > 2 && os.Args[2] == "delete"
+		report, err := deps.CollectGarbage(context.Background(), remove)
+		if err != nil {
+			log.Fatalf("Error collecting garbage: %v", err)
+		}
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+
+	log.Println("Setting up credits ledger")
+	prices, err := credits.ParsePrices(cfg.Billing.CreditPrices)
+	if err != nil {
+		log.Fatalf("Invalid CREDIT_PRICES: %v", err)
+	}
+	credits.SetPrices(prices)
+
+	deps.LLM, err = llm.New(llm.Config{
+		Provider:    cfg.LLM.Provider,
+		APIKey:      cfg.LLM.OpenAIAPIKey,
+		TextModel:   cfg.LLM.TextModel,
+		VisionModel: cfg.LLM.VisionModel,
+		JSONModel:   cfg.LLM.JSONModel,
+		Timeout:     cfg.LLM.Timeout,
+		MaxRetries:  cfg.LLM.MaxRetries,
+	})
+	if err != nil {
+		log.Fatalf("Error configuring LLM client: %v", err)
+	}
+
+	deps.TTS = tts.NewSpeaker()
+	if cfg.TTS.Enabled() {
+		deps.TTS, err = tts.New(tts.Config{
+			OpenAIAPIKey:   cfg.TTS.OpenAIAPIKey,
+			OpenAIModel:    cfg.TTS.OpenAIModel,
+			DeepgramAPIKey: cfg.TTS.DeepgramAPIKey,
+			Defaults: tts.Options{
+				Provider: cfg.TTS.Provider,
+				Voice:    cfg.TTS.Voice,
+				Speed:    cfg.TTS.Speed,
+				Format:   cfg.TTS.Format,
+			},
+		})
+		if err != nil {
+			log.Fatalf("Error configuring text-to-speech: %v", err)
+		}
+		if err := deps.TTS.SetEncoder(cfg.TTS.FFmpegPath); err != nil {
+			log.Println("Lecture audio can only be exported as mp3:", err)
+		}
+	} else {
+		log.Println("Audio is disabled, no API key for text-to-speech provider", cfg.TTS.Provider)
+	}
+
+	deps.Converter, err = convert.New(cfg.Slides.PresentationConverter, cfg.Slides.LibreOfficePath)
+	if err != nil {
+		log.Fatalf("Error configuring presentation converter: %v", err)
+	}
+
+	deps.Fetcher = fetch.New(fetch.Config{
+		Schemes:      cfg.Fetch.Schemes,
+		Hosts:        cfg.Fetch.Hosts,
+		MaxBytes:     cfg.Slides.PDFMaxBytes,
+		Timeout:      cfg.Fetch.Timeout,
+		AllowPrivate: cfg.Fetch.AllowPrivate,
+	})
+
+	deps.Events, err = events.New(cfg.Mongo.EventLog)
+	if err != nil {
+		log.Fatalf("Error connecting to event log: %v", err)
+	}
+	deps.Jobs = jobs.New(deps.Events)
+
+	// Background work stops when the server shuts down
+	ctx, stop := context.WithCancel(context.Background())
+	var background sync.WaitGroup
+
+	log.Println("Starting job workers")
+	deps.RegisterJobs()
+	deps.Jobs.Start(ctx, cfg.Background.JobWorkers)
+
+	log.Println("Purging the trash every", cfg.Background.TrashPurgeInterval)
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		deps.RunTrashPurge(ctx, cfg.Background.TrashPurgeInterval, cfg.Background.TrashRetention)
+	}()
+
+	// Settles credit transactions left pending by a crash
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		credits.RunReconciler(ctx, 5*time.Minute, 10*time.Minute)
+	}()
+
+	if cfg.Background.GCInterval > 0 {
+		log.Println("Collecting garbage every", cfg.Background.GCInterval)
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			deps.RunGarbageCollector(ctx, cfg.Background.GCInterval)
+		}()
 	}
-	db.ConnectMongo(mongoURI)
 
 	log.Println("Setting up routes")
-	handlers.SetUpRoutes(r)
+	handlers.SetUpRoutes(r, deps)
+
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", cfg.Server.Port),
+		Handler:           r,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+	}
 
 	// Start the server
-	r.Run(":8080") // listen and serve on 0.0.0.0:8080
+	go func() {
+		log.Println("Listening on", server.Addr)
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Error starting server: %v", err)
+		}
+	}()
+	handlers.SetReady(true)
+
+	// Drain requests and background work on SIGTERM or Ctrl-C, a second signal
+	// exits right away
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	go func() {
+		<-signals
+		log.Fatal("Forced shutdown")
+	}()
+
+	log.Println("Shutting down, waiting up to", cfg.Server.ShutdownTimeout)
+	handlers.SetReady(false)
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Println("Error draining requests", err)
+		server.Close()
+	}
+	if err := handlers.WaitForOperations(shutdownCtx); err != nil {
+		log.Println("Interrupted running operations", err)
+	}
+	if err := deps.Jobs.Shutdown(shutdownCtx); err != nil {
+		log.Println("Interrupted running jobs", err)
+	}
+	background.Wait()
+
+	disconnectCtx, cancelDisconnect := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelDisconnect()
+	if err := db.DisconnectMongo(disconnectCtx); err != nil {
+		log.Println("Error disconnecting from MongoDB", err)
+	}
+
+	log.Println("Server stopped")
 }
@@ -0,0 +1,130 @@
+package migrations
+
+import (
+	"context"
+	"log"
+	"main/db"
+	"main/repo"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// fileFields lists the collections and fields that reference files in storage,
+// each field is stored as <field>_key, legacy documents have <field>_url
+var fileFields = map[string][]string{
+	repo.CollectionNameSlides:      {"pdf"},
+	repo.CollectionNameSlideImages: {"image", "audio"},
+}
+
+// migrateFileURLsToKeys converts documents that still store permanent storage
+// URLs to store object keys instead. URLs outside of storage are left untouched.
+func migrateFileURLsToKeys(ctx context.Context, store db.BlobStore) error {
+	for collection, fields := range fileFields {
+		for _, field := range fields {
+			urlField := field + "_url"
+			keyField := field + "_key"
+
+			cursor, err := db.DB.Collection(collection).Find(ctx, bson.M{
+				urlField: bson.M{"$nin": bson.A{nil, ""}},
+				keyField: bson.M{"$exists": false},
+			})
+			if err != nil {
+				return err
+			}
+
+			migrated := 0
+			for cursor.Next(ctx) {
+				var doc bson.M
+				if err := cursor.Decode(&doc); err != nil {
+					cursor.Close(ctx)
+					return err
+				}
+
+				url, _ := doc[urlField].(string)
+				key, ok := db.KeyFromURL(store, url)
+				if !ok {
+					continue
+				}
+
+				_, err := db.DB.Collection(collection).UpdateOne(ctx, bson.M{"_id": doc["_id"]}, bson.M{
+					"$set":   bson.M{keyField: key},
+					"$unset": bson.M{urlField: ""},
+				})
+				if err != nil {
+					cursor.Close(ctx)
+					return err
+				}
+				migrated++
+			}
+			err = cursor.Err()
+			cursor.Close(ctx)
+			if err != nil {
+				return err
+			}
+
+			if migrated > 0 {
+				log.Printf("Migrated %d %s.%s URLs to keys", migrated, collection, urlField)
+			}
+		}
+	}
+	return nil
+}
+
+// removeDuplicateSlideImageOrders prepares the order of slide images to be
+// unique per slide. Slides converted more than once before have duplicate
+// orders, of which the slide image with generated text, or else the oldest, is
+// kept and the others are deleted along with their quiz questions, flashcards
+// and files
+func removeDuplicateSlideImageOrders(ctx context.Context, store db.BlobStore) error {
+	collection := db.DB.Collection(repo.CollectionNameSlideImages)
+
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$sort", Value: bson.D{{Key: "generated_text", Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"slide_id": "$slide_id", "order": "$order"},
+			"docs":  bson.M{"$push": bson.M{"_id": "$_id", "image_key": "$image_key", "thumbnail_key": "$thumbnail_key", "audio_key": "$audio_key"}},
+			"count": bson.M{"$sum": 1},
+		}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+	})
+	if err != nil {
+		return err
+	}
+	var groups []struct {
+		Docs []bson.M `bson:"docs"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return err
+	}
+
+	removed := 0
+	for _, group := range groups {
+		for _, doc := range group.Docs[1:] {
+			// Deleted first so that a retry still finds the slide image
+			id, _ := doc["_id"].(primitive.ObjectID)
+			for _, name := range []string{repo.CollectionNameQuizQuestions, repo.CollectionNameFlashcards} {
+				if _, err := db.DB.Collection(name).DeleteMany(ctx, bson.M{"slide_image_id": id.Hex()}); err != nil {
+					return err
+				}
+			}
+			if _, err := collection.DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+				return err
+			}
+			for _, field := range []string{"image_key", "thumbnail_key", "audio_key"} {
+				if key, _ := doc[field].(string); key != "" {
+					if err := store.Delete(ctx, key); err != nil {
+						log.Println("Error deleting file of duplicate slide image:", err)
+					}
+				}
+			}
+			removed++
+		}
+	}
+	if removed > 0 {
+		log.Printf("Removed %d slide images with duplicate orders", removed)
+	}
+
+	return nil
+}
@@ -0,0 +1,223 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"main/credits"
+	"main/db"
+	"main/events"
+	"main/jobs"
+	"main/repo"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CollectionNameAccessCodes matches the collection of the access code handlers
+const CollectionNameAccessCodes = "access_codes"
+
+// Index is an index the queries of the server rely on
+type Index struct {
+	Collection string
+	Keys       bson.D
+	Unique     bool
+	// Only documents matching Partial are indexed, so that documents without
+	// the field don't conflict in a unique index
+	Partial bson.M
+	// Documents are removed this long after the time in the indexed field
+	ExpireAfter time.Duration
+}
+
+// nonEmpty matches documents where field is a non empty string
+func nonEmpty(field string) bson.M {
+	return bson.M{field: bson.M{"$gt": ""}}
+}
+
+// Indexes lists every index, they are created when missing and rebuilt when
+// their options changed, other indexes are never dropped
+var Indexes = []Index{
+	{
+		Collection: repo.CollectionNameSlides,
+		Keys:       bson.D{{Key: "space_id", Value: 1}},
+	},
+	{
+		Collection: repo.CollectionNameSlideImages,
+		Keys:       bson.D{{Key: "slide_id", Value: 1}, {Key: "order", Value: 1}},
+		Unique:     true,
+	},
+	{
+		Collection: repo.CollectionNameQuizQuestions,
+		Keys:       bson.D{{Key: "slide_id", Value: 1}, {Key: "slide_image_id", Value: 1}},
+	},
+	{
+		Collection: repo.CollectionNameFlashcards,
+		Keys:       bson.D{{Key: "slide_id", Value: 1}, {Key: "slide_image_id", Value: 1}},
+	},
+	{
+		Collection: repo.CollectionNameUsers,
+		Keys:       bson.D{{Key: "user_id", Value: 1}},
+		Unique:     true,
+		Partial:    nonEmpty("user_id"),
+	},
+	{
+		Collection: CollectionNameAccessCodes,
+		Keys:       bson.D{{Key: "code", Value: 1}},
+		Unique:     true,
+		Partial:    nonEmpty("code"),
+	},
+	// Idempotency keys are unique per user
+	{
+		Collection: credits.CollectionNameTransactions,
+		Keys:       bson.D{{Key: "user_id", Value: 1}, {Key: "idempotency_key", Value: 1}},
+		Unique:     true,
+		Partial:    bson.M{"idempotency_key": bson.M{"$type": "string"}},
+	},
+	{
+		Collection: credits.CollectionNameTransactions,
+		Keys:       bson.D{{Key: "user_id", Value: 1}, {Key: "_id", Value: -1}},
+	},
+	{
+		Collection: jobs.CollectionNameJobs,
+		Keys:       bson.D{{Key: "status", Value: 1}, {Key: "run_at", Value: 1}},
+	},
+	// Every event stream polls the events after the last one it sent
+	{
+		Collection: events.CollectionNameEvents,
+		Keys:       bson.D{{Key: "stream_id", Value: 1}, {Key: "seq", Value: 1}},
+		Unique:     true,
+	},
+	{
+		Collection:  events.CollectionNameEvents,
+		Keys:        bson.D{{Key: "created_at", Value: 1}},
+		ExpireAfter: events.Retention,
+	},
+	{
+		Collection:  events.CollectionNameEventStreams,
+		Keys:        bson.D{{Key: "updated_at", Value: 1}},
+		ExpireAfter: events.Retention,
+	},
+	// Finds the latest job of a slide, see jobs.FindLatest
+	{
+		Collection: jobs.CollectionNameJobs,
+		Keys:       bson.D{{Key: "type", Value: 1}, {Key: "params.slide_id", Value: 1}, {Key: "created_at", Value: -1}},
+	},
+}
+
+// name is the name MongoDB gives the index by default, e.g. slide_id_1_order_1,
+// so that indexes created before they were declared here are recognized
+func (index Index) name() string {
+	parts := make([]string, 0, len(index.Keys))
+	for _, key := range index.Keys {
+		parts = append(parts, fmt.Sprintf("%s_%v", key.Key, key.Value))
+	}
+	return strings.Join(parts, "_")
+}
+
+func (index Index) create(ctx context.Context) error {
+	opts := options.Index().SetName(index.name())
+	if index.Unique {
+		opts.SetUnique(true)
+	}
+	if index.Partial != nil {
+		opts.SetPartialFilterExpression(index.Partial)
+	}
+	if index.ExpireAfter > 0 {
+		opts.SetExpireAfterSeconds(int32(index.ExpireAfter.Seconds()))
+	}
+	_, err := db.DB.Collection(index.Collection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    index.Keys,
+		Options: opts,
+	})
+	return err
+}
+
+// existingIndex is the part of an index specification compared with Index
+type existingIndex struct {
+	Name        string `bson:"name"`
+	Unique      bool   `bson:"unique"`
+	Partial     bson.M `bson:"partialFilterExpression"`
+	ExpireAfter int64  `bson:"expireAfterSeconds"`
+}
+
+// matches reports whether an existing index with the same keys has the options
+// of index
+func (index Index) matches(existing existingIndex) (bool, error) {
+	var partial bson.M
+	if index.Partial != nil {
+		// Decoded the same way as the existing index for the comparison
+		data, err := bson.Marshal(index.Partial)
+		if err != nil {
+			return false, err
+		}
+		if err := bson.Unmarshal(data, &partial); err != nil {
+			return false, err
+		}
+	}
+	return index.Unique == existing.Unique &&
+		int64(index.ExpireAfter.Seconds()) == existing.ExpireAfter &&
+		reflect.DeepEqual(partial, existing.Partial), nil
+}
+
+// changedIndexes returns the indexes that don't exist yet, and those that exist
+// with other options and must be rebuilt
+func changedIndexes(ctx context.Context) (missing []Index, changed []Index, err error) {
+	existing := map[string]map[string]existingIndex{}
+	for _, index := range Indexes {
+		specs, ok := existing[index.Collection]
+		if !ok {
+			specs, err = listIndexes(ctx, index.Collection)
+			if err != nil {
+				return nil, nil, err
+			}
+			existing[index.Collection] = specs
+		}
+
+		spec, ok := specs[index.name()]
+		if !ok {
+			missing = append(missing, index)
+			continue
+		}
+		same, err := index.matches(spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !same {
+			changed = append(changed, index)
+		}
+	}
+	return missing, changed, nil
+}
+
+// rebuild drops the index with the name of index and creates it again
+func (index Index) rebuild(ctx context.Context) error {
+	if _, err := db.DB.Collection(index.Collection).Indexes().DropOne(ctx, index.name()); err != nil {
+		return err
+	}
+	return index.create(ctx)
+}
+
+func listIndexes(ctx context.Context, collection string) (map[string]existingIndex, error) {
+	indexes := map[string]existingIndex{}
+	cursor, err := db.DB.Collection(collection).Indexes().List(ctx)
+	if err != nil {
+		// The collection doesn't exist yet
+		var commandErr mongo.CommandError
+		if errors.As(err, &commandErr) && commandErr.Code == 26 {
+			return indexes, nil
+		}
+		return nil, err
+	}
+	var specs []existingIndex
+	if err := cursor.All(ctx, &specs); err != nil {
+		return nil, err
+	}
+	for _, spec := range specs {
+		indexes[spec.Name] = spec
+	}
+	return indexes, nil
+}
@@ -0,0 +1,133 @@
+package migrations
+
+import (
+	"context"
+	"log"
+	"main/db"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CollectionNameMigrations records the versions of the migrations applied
+const CollectionNameMigrations = "migrations"
+
+// Migration changes existing documents and the files of store. Migrations run
+// once each in order of version and must be safe to run again, a migration
+// that fails half way is retried from the start on the next run
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, store db.BlobStore) error
+}
+
+// migrations lists every migration, new ones are appended with the next version
+var migrations = []Migration{
+	{Version: 1, Name: "file_urls_to_keys", Up: migrateFileURLsToKeys},
+	{Version: 2, Name: "unique_slide_image_orders", Up: removeDuplicateSlideImageOrders},
+	{Version: 3, Name: "unique_user_ids", Up: mergeDuplicateUsers},
+	{Version: 4, Name: "unique_access_codes", Up: removeDuplicateAccessCodes},
+}
+
+// Report lists the migrations and indexes that were applied, or with DryRun
+// that would be
+type Report struct {
+	DryRun     bool     `json:"dry_run"`
+	Migrations []string `json:"migrations"`
+	Indexes    []string `json:"indexes"`
+}
+
+type record struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"applied_at"`
+}
+
+// Run applies the pending migrations and then creates the missing indexes and
+// rebuilds the changed ones, so that migrations can remove documents that would
+// break a unique index. Migrations read and delete files in store
+func Run(ctx context.Context, store db.BlobStore, dryRun bool) (*Report, error) {
+	report := &Report{DryRun: dryRun, Migrations: []string{}, Indexes: []string{}}
+
+	pending, err := Pending(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, migration := range pending {
+		report.Migrations = append(report.Migrations, migration.Name)
+		if dryRun {
+			continue
+		}
+
+		log.Printf("Applying migration %d %s", migration.Version, migration.Name)
+		if err := migration.Up(ctx, store); err != nil {
+			return nil, err
+		}
+		_, err := db.DB.Collection(CollectionNameMigrations).InsertOne(ctx, record{
+			Version:   migration.Version,
+			Name:      migration.Name,
+			AppliedAt: time.Now(),
+		})
+		// Another server may have applied it at the same time
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+	}
+
+	missing, changed, err := changedIndexes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range missing {
+		report.Indexes = append(report.Indexes, index.Collection+"."+index.name())
+		if dryRun {
+			continue
+		}
+
+		log.Printf("Creating index %s on %s", index.name(), index.Collection)
+		if err := index.create(ctx); err != nil {
+			return nil, err
+		}
+	}
+	for _, index := range changed {
+		report.Indexes = append(report.Indexes, index.Collection+"."+index.name()+" (rebuilt)")
+		if dryRun {
+			continue
+		}
+
+		log.Printf("Rebuilding index %s on %s, its options changed", index.name(), index.Collection)
+		if err := index.rebuild(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+// Pending returns the migrations that have not been applied yet
+func Pending(ctx context.Context) ([]Migration, error) {
+	opts := options.Find().SetProjection(bson.M{"_id": 1})
+	cursor, err := db.DB.Collection(CollectionNameMigrations).Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var records []record
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+
+	applied := map[int]bool{}
+	for _, r := range records {
+		applied[r.Version] = true
+	}
+
+	var pending []Migration
+	for _, migration := range migrations {
+		if !applied[migration.Version] {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
@@ -0,0 +1,137 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"main/credits"
+	"main/db"
+	"main/repo"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// duplicates groups the documents of collection that share a non empty field,
+// oldest first, keeping the fields in push
+func duplicates[T any](ctx context.Context, collection string, field string, push bson.M) ([]T, error) {
+	cursor, err := db.DB.Collection(collection).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: nonEmpty(field)}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   "$" + field,
+			"docs":  bson.M{"$push": push},
+			"count": bson.M{"$sum": 1},
+		}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var groups []T
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// mergeDuplicateUsers prepares user IDs to be unique. Users created twice
+// before are merged into the oldest, which gets the spaces of the others and
+// their credits as a grant in the ledger
+func mergeDuplicateUsers(ctx context.Context, store db.BlobStore) error {
+	type user struct {
+		ID       primitive.ObjectID `bson:"_id"`
+		SpaceIDs []string           `bson:"space_ids"`
+		Credits  int                `bson:"credits"`
+	}
+	groups, err := duplicates[struct {
+		UserID string `bson:"_id"`
+		Docs   []user `bson:"docs"`
+	}](ctx, repo.CollectionNameUsers, "user_id", bson.M{"_id": "$_id", "space_ids": "$space_ids", "credits": "$credits"})
+	if err != nil {
+		return err
+	}
+
+	collection := db.DB.Collection(repo.CollectionNameUsers)
+	merged := 0
+	for _, group := range groups {
+		spaceIDs := []string{}
+		var others []primitive.ObjectID
+		for _, other := range group.Docs[1:] {
+			spaceIDs = append(spaceIDs, other.SpaceIDs...)
+			others = append(others, other.ID)
+		}
+
+		_, err := collection.UpdateOne(ctx, bson.M{"_id": group.Docs[0].ID}, bson.M{
+			"$addToSet": bson.M{"space_ids": bson.M{"$each": spaceIDs}},
+		})
+		if err != nil {
+			return err
+		}
+		result, err := collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": others}})
+		if err != nil {
+			return err
+		}
+		merged += int(result.DeletedCount)
+
+		// Granted once the others are gone, so that the grant cannot land on
+		// one of them
+		for _, other := range group.Docs[1:] {
+			if other.Credits <= 0 {
+				continue
+			}
+			if _, err := credits.Grant(ctx, group.UserID, other.Credits, "merge_user:"+other.ID.Hex()); err != nil {
+				return fmt.Errorf("granting the credits of duplicate user %s: %w", other.ID.Hex(), err)
+			}
+		}
+	}
+	if merged > 0 {
+		log.Printf("Merged %d duplicate users", merged)
+	}
+	return nil
+}
+
+// removeDuplicateAccessCodes prepares access codes to be unique. The oldest of
+// each code is kept, and counts as used if any of the others was
+func removeDuplicateAccessCodes(ctx context.Context, store db.BlobStore) error {
+	type accessCode struct {
+		ID   primitive.ObjectID `bson:"_id"`
+		Used bool               `bson:"used"`
+	}
+	groups, err := duplicates[struct {
+		Docs []accessCode `bson:"docs"`
+	}](ctx, CollectionNameAccessCodes, "code", bson.M{"_id": "$_id", "used": "$used"})
+	if err != nil {
+		return err
+	}
+
+	collection := db.DB.Collection(CollectionNameAccessCodes)
+	removed := 0
+	for _, group := range groups {
+		used := false
+		var others []primitive.ObjectID
+		for _, other := range group.Docs {
+			used = used || other.Used
+			if other.ID != group.Docs[0].ID {
+				others = append(others, other.ID)
+			}
+		}
+
+		if used {
+			_, err := collection.UpdateOne(ctx, bson.M{"_id": group.Docs[0].ID}, bson.M{"$set": bson.M{"used": true}})
+			if err != nil {
+				return err
+			}
+		}
+		result, err := collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": others}})
+		if err != nil {
+			return err
+		}
+		removed += int(result.DeletedCount)
+	}
+	if removed > 0 {
+		log.Printf("Removed %d duplicate access codes", removed)
+	}
+	return nil
+}
@@ -7,31 +7,90 @@ import (
 )
 
 type Slide struct {
-	ID             primitive.ObjectID `bson:"_id" json:"id"`
-	Name           string             `bson:"name" json:"name"`
-	PDFURL         string             `bson:"pdf_url" json:"pdf_url"`
-	SpaceID        string             `bson:"space_id" json:"space_id"`
-	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
-	UpdatedAt      time.Time          `bson:"updated_at" json:"updated_at"`
-	GeneratedNotes []string           `bson:"generated_notes" json:"generated_notes"`
+	ID     primitive.ObjectID `bson:"_id" json:"id"`
+	Name   string             `bson:"name" json:"name"`
+	PDFURL string             `bson:"pdf_url,omitempty" json:"pdf_url"`
+	PDFKey string             `bson:"pdf_key,omitempty" json:"-"`
+	// Slides made from images instead of a document, in order
+	ImageSourceURLs []string       `bson:"-" json:"image_urls,omitempty"`
+	ImageSourceKeys []string       `bson:"image_source_keys,omitempty" json:"-"`
+	SpaceID         string         `bson:"space_id" json:"space_id"`
+	CreatedAt       time.Time      `bson:"created_at" json:"created_at"`
+	UpdatedAt       time.Time      `bson:"updated_at" json:"updated_at"`
+	GeneratedNotes  []string       `bson:"generated_notes" json:"generated_notes"`
+	Voice           *VoiceSettings `bson:"voice,omitempty" json:"voice,omitempty"`
+	// UploadStartedAt is set by a presigned upload until it is completed
+	UploadStartedAt *time.Time `bson:"upload_started_at,omitempty" json:"upload_started_at,omitempty"`
+	// DeletedAt is set while the slide is in the trash
+	DeletedAt *time.Time `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+	// AudioExport is the whole lecture narration as one chaptered MP3 or M4A
+	AudioExportKey        string     `bson:"audio_export_key,omitempty" json:"-"`
+	AudioExportURL        string     `bson:"-" json:"audio_export_url,omitempty"`
+	AudioExportDurationMS int64      `bson:"audio_export_duration_ms,omitempty" json:"audio_export_duration_ms,omitempty"`
+	AudioExportedAt       *time.Time `bson:"audio_exported_at,omitempty" json:"audio_exported_at,omitempty"`
+}
+
+// VoiceSettings choose how narration is spoken, empty fields are inherited from
+// the user or the server defaults
+type VoiceSettings struct {
+	Provider string  `bson:"provider,omitempty" json:"provider,omitempty"`
+	Voice    string  `bson:"voice,omitempty" json:"voice,omitempty"`
+	Speed    float64 `bson:"speed,omitempty" json:"speed,omitempty"`
+	Format   string  `bson:"format,omitempty" json:"format,omitempty"`
 }
 
 type SlideImage struct {
 	ID            primitive.ObjectID `bson:"_id" json:"id"`
 	SlideID       string             `bson:"slide_id" json:"slide_id"`
-	ImageURL      string             `bson:"image_url" json:"image_url"`
+	ImageURL      string             `bson:"image_url,omitempty" json:"image_url"`
+	ImageKey      string             `bson:"image_key,omitempty" json:"-"`
+	ThumbnailURL  string             `bson:"thumbnail_url,omitempty" json:"thumbnail_url,omitempty"`
+	ThumbnailKey  string             `bson:"thumbnail_key,omitempty" json:"-"`
 	Order         int                `bson:"order" json:"order"`
 	GeneratedText string             `bson:"generated_text" json:"generated_text"`
-	AudioURL      string             `bson:"audio_url" json:"audio_url"`
-	CreatedAt     time.Time          `bson:"created_at" json:"created_at"`
-	UpdatedAt     time.Time          `bson:"updated_at" json:"updated_at"`
+	// ExtractedText and Links are read from the text layer of the page, if any
+	ExtractedText string   `bson:"extracted_text,omitempty" json:"extracted_text,omitempty"`
+	Links         []string `bson:"links,omitempty" json:"links,omitempty"`
+	AudioURL      string   `bson:"audio_url,omitempty" json:"audio_url"`
+	AudioKey      string   `bson:"audio_key,omitempty" json:"-"`
+	// AudioChunks are the parts the narration was synthesized in, in order
+	AudioChunks     []AudioChunk `bson:"audio_chunks,omitempty" json:"audio_chunks,omitempty"`
+	AudioDurationMS int64        `bson:"audio_duration_ms,omitempty" json:"audio_duration_ms,omitempty"`
+	// Captions are the estimated timings of each sentence of the narration
+	Captions  []Caption `bson:"captions,omitempty" json:"-"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// AudioChunk is the text and position of a part of a slide image narration
+type AudioChunk struct {
+	Text       string `bson:"text" json:"text"`
+	StartMS    int64  `bson:"start_ms" json:"start_ms"`
+	DurationMS int64  `bson:"duration_ms" json:"duration_ms"`
+}
+
+// Caption is a sentence of a narration and when it is spoken
+type Caption struct {
+	Text    string       `bson:"text" json:"text"`
+	StartMS int64        `bson:"start_ms" json:"start_ms"`
+	EndMS   int64        `bson:"end_ms" json:"end_ms"`
+	Words   []WordTiming `bson:"words,omitempty" json:"words,omitempty"`
+}
+
+// WordTiming is a word of a caption and when it is spoken
+type WordTiming struct {
+	Text    string `bson:"text" json:"text"`
+	StartMS int64  `bson:"start_ms" json:"start_ms"`
+	EndMS   int64  `bson:"end_ms" json:"end_ms"`
 }
 
 type Space struct {
 	ID        primitive.ObjectID `bson:"_id" json:"id"`
 	Name      string             `bson:"name" json:"name"`
+	UserID    string             `bson:"user_id,omitempty" json:"user_id"`
 	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
 	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
+	DeletedAt *time.Time         `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
 }
 
 type SlideSpaceRequest struct {
@@ -61,6 +120,7 @@ type QuizQA struct {
 	Rationale     string             `bson:"rationale" json:"rationale"`
 	SlideID       string             `bson:"slide_id" json:"slide_id"`
 	SlideImageID  string             `bson:"slide_image_id" json:"slide_image_id"`
+	DeletedAt     *time.Time         `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
 }
 
 type Flashcard struct {
@@ -69,6 +129,7 @@ type Flashcard struct {
 	Answer       string             `bson:"answer" json:"answer"`
 	SlideID      string             `bson:"slide_id" json:"slide_id"`
 	SlideImageID string             `bson:"slide_image_id" json:"slide_image_id"`
+	DeletedAt    *time.Time         `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
 }
 
 type User struct {
@@ -84,6 +145,11 @@ type User struct {
 	AccessCode string             `bson:"access_code" json:"access_code"`
 	Credits    int                `bson:"credits" json:"credits"`
 	Plan       string             `bson:"plan" json:"plan"`
+	// Stripe billing, PlanUpdatedAt is the time of the last event that changed Plan
+	StripeCustomerID     string         `bson:"stripe_customer_id,omitempty" json:"-"`
+	StripeSubscriptionID string         `bson:"stripe_subscription_id,omitempty" json:"-"`
+	PlanUpdatedAt        *time.Time     `bson:"plan_updated_at,omitempty" json:"-"`
+	Voice                *VoiceSettings `bson:"voice,omitempty" json:"voice,omitempty"`
 }
 
 type AccessCode struct {
@@ -91,3 +157,67 @@ type AccessCode struct {
 	Code string             `bson:"code" json:"code"`
 	Used bool               `bson:"used" json:"used"`
 }
+
+type Job struct {
+	ID          primitive.ObjectID `bson:"_id" json:"id"`
+	Type        string             `bson:"type" json:"type"`
+	Params      map[string]string  `bson:"params" json:"params"`
+	UserID      string             `bson:"user_id,omitempty" json:"user_id,omitempty"`
+	Status      string             `bson:"status" json:"status"`
+	Progress    JobProgress        `bson:"progress" json:"progress"`
+	Attempts    int                `bson:"attempts" json:"attempts"`
+	MaxAttempts int                `bson:"max_attempts" json:"max_attempts"`
+	Error       string             `bson:"error,omitempty" json:"error,omitempty"`
+	Result      primitive.M        `bson:"result,omitempty" json:"result,omitempty"`
+	RunAt       time.Time          `bson:"run_at" json:"run_at"`
+	LockedUntil time.Time          `bson:"locked_until,omitempty" json:"-"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt   time.Time          `bson:"updated_at" json:"updated_at"`
+	StartedAt   *time.Time         `bson:"started_at,omitempty" json:"started_at,omitempty"`
+	FinishedAt  *time.Time         `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+	ChargeID    primitive.ObjectID `bson:"charge_id,omitempty" json:"charge_id,omitempty"`
+	// CompletedUnits are the units of the charge that were done, they are not
+	// refunded when the job fails or is cancelled
+	CompletedUnits int `bson:"completed_units" json:"completed_units"`
+}
+
+type JobProgress struct {
+	Current int    `bson:"current" json:"current"`
+	Total   int    `bson:"total" json:"total"`
+	Message string `bson:"message" json:"message"`
+}
+
+type JobRequest struct {
+	Type   string            `json:"type" binding:"required"`
+	Params map[string]string `json:"params"`
+}
+
+type Event struct {
+	ID        int64       `bson:"seq" json:"id"`
+	StreamID  string      `bson:"stream_id" json:"stream_id"`
+	Type      string      `bson:"type" json:"type"`
+	Data      primitive.M `bson:"data" json:"data"`
+	CreatedAt time.Time   `bson:"created_at" json:"created_at"`
+}
+
+type CreditTransaction struct {
+	ID           primitive.ObjectID `bson:"_id" json:"id"`
+	UserID       string             `bson:"user_id" json:"user_id"`
+	Type         string             `bson:"type" json:"type"`
+	Amount       int                `bson:"amount" json:"amount"`
+	BalanceAfter int                `bson:"balance_after" json:"balance_after"`
+	Status       string             `bson:"status" json:"status"`
+	Operation    string             `bson:"operation,omitempty" json:"operation,omitempty"`
+	// Units of the operation a charge paid for, or a refund gave back
+	Units          int                `bson:"units,omitempty" json:"units,omitempty"`
+	Reference      string             `bson:"reference,omitempty" json:"reference,omitempty"`
+	RefundOf       primitive.ObjectID `bson:"refund_of,omitempty" json:"refund_of,omitempty"`
+	IdempotencyKey string             `bson:"idempotency_key,omitempty" json:"idempotency_key,omitempty"`
+	Error          string             `bson:"error,omitempty" json:"error,omitempty"`
+	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt      time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+type CheckoutRequest struct {
+	ProductID string `json:"product_id" binding:"required"`
+}
@@ -0,0 +1,556 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Memory is a Repository kept in memory, for tests and local development.
+// It understands the query operators $exists, $in, $nin, $ne, $lt, $lte, $gt
+// and $gte, and the update operators $set, $unset, $inc, $push, $addToSet and
+// $pull, which is what the handlers use
+type Memory[T any] struct {
+	mu   sync.Mutex
+	docs []bson.M
+}
+
+// NewMemory creates an empty in-memory repository
+func NewMemory[T any]() *Memory[T] {
+	return &Memory[T]{}
+}
+
+func (r *Memory[T]) Get(ctx context.Context, id primitive.ObjectID) (*T, error) {
+	return r.FindOne(ctx, ByID(id))
+}
+
+func (r *Memory[T]) FindOne(ctx context.Context, filter bson.M) (*T, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, doc := range r.docs {
+		ok, err := matches(doc, filter)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return decode[T](doc)
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *Memory[T]) Find(ctx context.Context, filter bson.M, order bson.D) ([]T, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	found, err := r.filter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if order != nil {
+		sort.SliceStable(found, func(i, j int) bool {
+			for _, e := range order {
+				c, _ := compare(lookup(found[i], e.Key), lookup(found[j], e.Key))
+				if c == 0 {
+					continue
+				}
+				if direction, _ := toFloat(e.Value); direction < 0 {
+					return c > 0
+				}
+				return c < 0
+			}
+			return false
+		})
+	}
+
+	docs := make([]T, 0, len(found))
+	for _, doc := range found {
+		decoded, err := decode[T](doc)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, *decoded)
+	}
+	return docs, nil
+}
+
+func (r *Memory[T]) IDs(ctx context.Context, filter bson.M) ([]primitive.ObjectID, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	found, err := r.filter(filter)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, 0, len(found))
+	for _, doc := range found {
+		if id, ok := doc["_id"].(primitive.ObjectID); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (r *Memory[T]) Distinct(ctx context.Context, field string, filter bson.M) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	found, err := r.filter(filter)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	strs := []string{}
+	for _, doc := range found {
+		values, ok := lookup(doc, field).(bson.A)
+		if !ok {
+			values = bson.A{lookup(doc, field)}
+		}
+		for _, value := range values {
+			if str, ok := value.(string); ok && !seen[str] {
+				seen[str] = true
+				strs = append(strs, str)
+			}
+		}
+	}
+	return strs, nil
+}
+
+func (r *Memory[T]) Count(ctx context.Context, filter bson.M) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	found, err := r.filter(filter)
+	return int64(len(found)), err
+}
+
+func (r *Memory[T]) Insert(ctx context.Context, doc *T) error {
+	return r.InsertMany(ctx, []T{*doc})
+}
+
+func (r *Memory[T]) InsertMany(ctx context.Context, docs []T) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	encoded := make([]bson.M, 0, len(docs))
+	for i := range docs {
+		doc, err := encode(docs[i])
+		if err != nil {
+			return err
+		}
+		for _, other := range append(r.docs, encoded...) {
+			if doc["_id"] == other["_id"] {
+				return ErrDuplicate
+			}
+		}
+		encoded = append(encoded, doc)
+	}
+	r.docs = append(r.docs, encoded...)
+	return nil
+}
+
+func (r *Memory[T]) UpdateOne(ctx context.Context, filter bson.M, update bson.M) (int64, error) {
+	return r.update(filter, update, false)
+}
+
+func (r *Memory[T]) UpdateMany(ctx context.Context, filter bson.M, update bson.M) (int64, error) {
+	return r.update(filter, update, true)
+}
+
+func (r *Memory[T]) DeleteOne(ctx context.Context, filter bson.M) (int64, error) {
+	return r.delete(filter, false)
+}
+
+func (r *Memory[T]) DeleteMany(ctx context.Context, filter bson.M) (int64, error) {
+	return r.delete(filter, true)
+}
+
+// filter returns the documents matching filter, r.mu must be held
+func (r *Memory[T]) filter(filter bson.M) ([]bson.M, error) {
+	var found []bson.M
+	for _, doc := range r.docs {
+		ok, err := matches(doc, filter)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			found = append(found, doc)
+		}
+	}
+	return found, nil
+}
+
+func (r *Memory[T]) update(filter bson.M, update bson.M, many bool) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var matched int64
+	for i, doc := range r.docs {
+		ok, err := matches(doc, filter)
+		if err != nil {
+			return matched, err
+		}
+		if !ok {
+			continue
+		}
+
+		updated, err := apply(doc, update)
+		if err != nil {
+			return matched, err
+		}
+		// Round trip through T so the document keeps the shape of the type
+		decoded, err := decode[T](updated)
+		if err != nil {
+			return matched, err
+		}
+		if r.docs[i], err = encode(*decoded); err != nil {
+			return matched, err
+		}
+
+		matched++
+		if !many {
+			break
+		}
+	}
+	return matched, nil
+}
+
+func (r *Memory[T]) delete(filter bson.M, many bool) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var deleted int64
+	kept := r.docs[:0]
+	for _, doc := range r.docs {
+		if many || deleted == 0 {
+			ok, err := matches(doc, filter)
+			if err != nil {
+				return 0, err
+			}
+			if ok {
+				deleted++
+				continue
+			}
+		}
+		kept = append(kept, doc)
+	}
+	r.docs = kept
+	return deleted, nil
+}
+
+// encode converts a document to the bson.M stored by MongoDB
+func encode(doc interface{}) (bson.M, error) {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var m bson.M
+	if err := bson.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func decode[T any](doc bson.M) (*T, error) {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var decoded T
+	if err := bson.Unmarshal(data, &decoded); err != nil {
+		return nil, err
+	}
+	return &decoded, nil
+}
+
+// normalize converts a value of a filter or update to the type it has once
+// stored, e.g. int to int32 and time.Time to primitive.DateTime
+func normalize(value interface{}) (interface{}, error) {
+	m, err := encode(bson.M{"v": value})
+	if err != nil {
+		return nil, err
+	}
+	return m["v"], nil
+}
+
+// lookup returns the value at a dotted path of doc, nil if it is missing
+func lookup(doc bson.M, path string) interface{} {
+	var value interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case bson.M:
+			value = v[key]
+		case bson.D:
+			value = v.Map()[key]
+		case bson.A:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil
+			}
+			value = v[i]
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+func matches(doc bson.M, filter bson.M) (bool, error) {
+	for path, condition := range filter {
+		value := lookup(doc, path)
+		_, exists := doc[path]
+		if strings.Contains(path, ".") {
+			exists = value != nil
+		}
+
+		operators, ok := condition.(bson.M)
+		if !ok || !isOperators(operators) {
+			expected, err := normalize(condition)
+			if err != nil {
+				return false, err
+			}
+			if !equals(value, expected) {
+				return false, nil
+			}
+			continue
+		}
+
+		for operator, operand := range operators {
+			ok, err := matchOperator(value, exists, operator, operand)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
+
+func isOperators(m bson.M) bool {
+	for key := range m {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return len(m) > 0
+}
+
+func matchOperator(value interface{}, exists bool, operator string, operand interface{}) (bool, error) {
+	if operator == "$exists" {
+		want, _ := operand.(bool)
+		return exists == want, nil
+	}
+
+	normalized, err := normalize(operand)
+	if err != nil {
+		return false, err
+	}
+	switch operator {
+	case "$in", "$nin":
+		candidates, ok := normalized.(bson.A)
+		if !ok {
+			return false, fmt.Errorf("%s needs an array", operator)
+		}
+		found := false
+		for _, candidate := range candidates {
+			if equals(value, candidate) {
+				found = true
+				break
+			}
+		}
+		return found == (operator == "$in"), nil
+	case "$ne":
+		return !equals(value, normalized), nil
+	case "$lt", "$lte", "$gt", "$gte":
+		return anyValue(value, func(v interface{}) bool {
+			c, ok := compare(v, normalized)
+			if !ok || v == nil {
+				return false
+			}
+			switch operator {
+			case "$lt":
+				return c < 0
+			case "$lte":
+				return c <= 0
+			case "$gt":
+				return c > 0
+			default:
+				return c >= 0
+			}
+		}), nil
+	}
+	return false, fmt.Errorf("unsupported query operator %s", operator)
+}
+
+// equals reports whether a stored value matches expected, arrays match if
+// one of their elements does, and null matches missing values
+func equals(value interface{}, expected interface{}) bool {
+	if value == nil || expected == nil {
+		return value == nil && expected == nil
+	}
+	if reflect.DeepEqual(value, expected) {
+		return true
+	}
+	return anyValue(value, func(v interface{}) bool {
+		c, ok := compare(v, expected)
+		return ok && c == 0
+	})
+}
+
+// anyValue reports whether f is true for value, or an element of it if it is
+// an array
+func anyValue(value interface{}, f func(interface{}) bool) bool {
+	if values, ok := value.(bson.A); ok {
+		for _, v := range values {
+			if f(v) {
+				return true
+			}
+		}
+		return false
+	}
+	return f(value)
+}
+
+// compare orders two stored values of the same kind, ok is false if they
+// cannot be compared. Missing values come first
+func compare(a interface{}, b interface{}) (int, bool) {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0, true
+		case a == nil:
+			return -1, true
+		default:
+			return 1, true
+		}
+	}
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+		return sign(x - y), true
+	}
+	switch x := a.(type) {
+	case string:
+		y, ok := b.(string)
+		return strings.Compare(x, y), ok
+	case bool:
+		y, ok := b.(bool)
+		if !ok || x == y {
+			return 0, ok
+		}
+		if x {
+			return 1, true
+		}
+		return -1, true
+	case primitive.DateTime:
+		y, ok := b.(primitive.DateTime)
+		return sign(float64(x - y)), ok
+	case primitive.ObjectID:
+		y, ok := b.(primitive.ObjectID)
+		return strings.Compare(x.Hex(), y.Hex()), ok
+	}
+	return 0, false
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func sign(x float64) int {
+	switch {
+	case x < 0:
+		return -1
+	case x > 0:
+		return 1
+	}
+	return 0
+}
+
+// apply returns a copy of doc with the update operators applied
+func apply(doc bson.M, update bson.M) (bson.M, error) {
+	updated := bson.M{}
+	for key, value := range doc {
+		updated[key] = value
+	}
+
+	for operator, fields := range update {
+		fields, ok := fields.(bson.M)
+		if !ok {
+			return nil, fmt.Errorf("%s needs a document", operator)
+		}
+		for field, operand := range fields {
+			if field == "_id" {
+				return nil, fmt.Errorf("cannot update _id")
+			}
+			normalized, err := normalize(operand)
+			if err != nil {
+				return nil, err
+			}
+			values, _ := updated[field].(bson.A)
+
+			switch operator {
+			case "$set":
+				updated[field] = normalized
+			case "$unset":
+				delete(updated, field)
+			case "$inc":
+				current, _ := toFloat(updated[field])
+				increment, ok := toFloat(normalized)
+				if !ok {
+					return nil, fmt.Errorf("$inc needs a number")
+				}
+				updated[field] = int64(current + increment)
+				if _, isFloat := normalized.(float64); isFloat {
+					updated[field] = current + increment
+				}
+			case "$push":
+				updated[field] = append(append(bson.A{}, values...), normalized)
+			case "$addToSet":
+				if !equals(values, normalized) {
+					updated[field] = append(append(bson.A{}, values...), normalized)
+				}
+			case "$pull":
+				if values == nil {
+					continue
+				}
+				condition := bson.M{"v": operand}
+				if m, ok := operand.(bson.M); ok && isOperators(m) {
+					condition = bson.M{"v": m}
+				}
+				kept := bson.A{}
+				for _, v := range values {
+					ok, err := matches(bson.M{"v": v}, condition)
+					if err != nil {
+						return nil, err
+					}
+					if !ok {
+						kept = append(kept, v)
+					}
+				}
+				updated[field] = kept
+			default:
+				return nil, fmt.Errorf("unsupported update operator %s", operator)
+			}
+		}
+	}
+	return updated, nil
+}
@@ -0,0 +1,279 @@
+package repo
+
+import (
+	"context"
+	"main/models"
+	"sort"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// names returns the sorted names of slides
+func names(slides []models.Slide) []string {
+	list := []string{}
+	for _, slide := range slides {
+		list = append(list, slide.Name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func insertSlides(t *testing.T, slides ...models.Slide) *Memory[models.Slide] {
+	t.Helper()
+	r := NewMemory[models.Slide]()
+	for i := range slides {
+		slides[i].ID = primitive.NewObjectID()
+		if err := r.Insert(context.Background(), &slides[i]); err != nil {
+			t.Fatalf("Insert: %v", err)
+		}
+	}
+	return r
+}
+
+func TestMemoryFilters(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+	r := insertSlides(t,
+		models.Slide{Name: "live", SpaceID: "a"},
+		models.Slide{Name: "other space", SpaceID: "b"},
+		models.Slide{Name: "trashed space", SpaceID: "c"},
+		models.Slide{Name: "trashed", SpaceID: "a", DeletedAt: &now},
+		models.Slide{Name: "expired", SpaceID: "a", DeletedAt: &old},
+	)
+
+	tests := []struct {
+		name   string
+		filter bson.M
+		want   []string
+	}{
+		// slideFilter of a user owning spaces a and c, c being in the trash
+		{
+			name: "accessible slides",
+			filter: bson.M{
+				"space_id":   bson.M{"$nin": []string{"c"}, "$in": []string{"a", "c"}},
+				"deleted_at": bson.M{"$exists": false},
+			},
+			want: []string{"live"},
+		},
+		// slideFilter of an admin when nothing is in the trash
+		{
+			name:   "no trashed spaces",
+			filter: bson.M{"space_id": bson.M{"$nin": []string{}}, "deleted_at": bson.M{"$exists": false}},
+			want:   []string{"live", "other space", "trashed space"},
+		},
+		{
+			name:   "in trash",
+			filter: bson.M{"deleted_at": bson.M{"$exists": true}},
+			want:   []string{"expired", "trashed"},
+		},
+		// PurgeTrash, time.Time is compared with the stored date
+		{
+			name:   "expired",
+			filter: bson.M{"deleted_at": bson.M{"$lt": now.Add(-24 * time.Hour)}},
+			want:   []string{"expired"},
+		},
+		{
+			name:   "not equal",
+			filter: bson.M{"space_id": bson.M{"$ne": "a"}},
+			want:   []string{"other space", "trashed space"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			slides, err := r.Find(context.Background(), test.filter, nil)
+			if err != nil {
+				t.Fatalf("Find: %v", err)
+			}
+			if got := names(slides); !equalStrings(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMemoryInObjectIDs(t *testing.T) {
+	r := insertSlides(t, models.Slide{Name: "first"}, models.Slide{Name: "second"}, models.Slide{Name: "third"})
+	ids, err := r.IDs(context.Background(), bson.M{})
+	if err != nil {
+		t.Fatalf("IDs: %v", err)
+	}
+
+	// deleteSlideImageDocs and spaceFilter pass IDs as bson.A and slices
+	for _, filter := range []bson.M{
+		{"_id": bson.M{"$in": bson.A{ids[0], ids[2]}}},
+		{"_id": bson.M{"$in": []primitive.ObjectID{ids[0], ids[2]}}},
+	} {
+		slides, err := r.Find(context.Background(), filter, nil)
+		if err != nil {
+			t.Fatalf("Find: %v", err)
+		}
+		if got := names(slides); !equalStrings(got, []string{"first", "third"}) {
+			t.Errorf("got %v, want [first third]", got)
+		}
+	}
+}
+
+func TestMemoryMissingOrEmpty(t *testing.T) {
+	r := NewMemory[models.SlideImage]()
+	ctx := context.Background()
+	for _, slideImage := range []models.SlideImage{
+		{Order: 0, GeneratedText: "narrated", AudioKey: "slides/s/audio/a.mp3"},
+		{Order: 1, GeneratedText: "legacy", AudioURL: "https://example.com/a.mp3"},
+		{Order: 2, GeneratedText: "silent"},
+		{Order: 3},
+	} {
+		slideImage.ID = primitive.NewObjectID()
+		slideImage.SlideID = "s"
+		if err := r.Insert(ctx, &slideImage); err != nil {
+			t.Fatalf("Insert: %v", err)
+		}
+	}
+
+	// countSlideImagesWithoutText, generated_text is stored even when empty
+	withoutText, err := r.Count(ctx, bson.M{"slide_id": "s", "generated_text": bson.M{"$in": bson.A{nil, ""}}})
+	if err != nil {
+		t.Fatalf("Count: %v", err)
+	}
+	if withoutText != 1 {
+		t.Errorf("without text = %d, want 1", withoutText)
+	}
+
+	// countSlideImagesWithoutAudio, the audio fields are left out when empty
+	withoutAudio, err := r.Count(ctx, bson.M{
+		"slide_id":  "s",
+		"audio_key": bson.M{"$in": bson.A{nil, ""}},
+		"audio_url": bson.M{"$in": bson.A{nil, ""}},
+	})
+	if err != nil {
+		t.Fatalf("Count: %v", err)
+	}
+	if withoutAudio != 2 {
+		t.Errorf("without audio = %d, want 2", withoutAudio)
+	}
+
+	// The slide images before one, as in the text handlers
+	before, err := r.Find(ctx, bson.M{"slide_id": "s", "order": bson.M{"$lt": 2}}, bson.D{{Key: "order", Value: -1}})
+	if err != nil {
+		t.Fatalf("Find: %v", err)
+	}
+	if len(before) != 2 || before[0].Order != 1 || before[1].Order != 0 {
+		t.Errorf("before = %+v, want orders 1 and 0", before)
+	}
+}
+
+func TestMemoryArrays(t *testing.T) {
+	r := NewMemory[models.User]()
+	ctx := context.Background()
+	for _, user := range []models.User{
+		{UserID: "alice", SpaceIDs: []string{"a", "b"}},
+		{UserID: "bob", SpaceIDs: []string{"b", "c"}},
+		{UserID: "carol"},
+	} {
+		user.ID = primitive.NewObjectID()
+		if err := r.Insert(ctx, &user); err != nil {
+			t.Fatalf("Insert: %v", err)
+		}
+	}
+
+	// deleteUserCascade, an array matches if one of its elements does
+	shared, err := r.Count(ctx, bson.M{"space_ids": "b", "user_id": bson.M{"$ne": "alice"}})
+	if err != nil {
+		t.Fatalf("Count: %v", err)
+	}
+	if shared != 1 {
+		t.Errorf("shared = %d, want 1", shared)
+	}
+
+	// The garbage collector only looks at users with spaces
+	withSpaces, err := r.Count(ctx, bson.M{"space_ids.0": bson.M{"$exists": true}})
+	if err != nil {
+		t.Fatalf("Count: %v", err)
+	}
+	if withSpaces != 2 {
+		t.Errorf("with spaces = %d, want 2", withSpaces)
+	}
+
+	// deleteSpaceCascade pulls a value, the garbage collector pulls with $in
+	if _, err := r.UpdateMany(ctx, bson.M{"space_ids": "b"}, bson.M{"$pull": bson.M{"space_ids": "b"}}); err != nil {
+		t.Fatalf("UpdateMany: %v", err)
+	}
+	if _, err := r.UpdateMany(ctx, bson.M{}, bson.M{"$pull": bson.M{"space_ids": bson.M{"$in": []string{"c"}}}}); err != nil {
+		t.Fatalf("UpdateMany: %v", err)
+	}
+	alice, err := r.FindOne(ctx, bson.M{"user_id": "alice"})
+	if err != nil {
+		t.Fatalf("FindOne: %v", err)
+	}
+	bob, err := r.FindOne(ctx, bson.M{"user_id": "bob"})
+	if err != nil {
+		t.Fatalf("FindOne: %v", err)
+	}
+	if !equalStrings(alice.SpaceIDs, []string{"a"}) || len(bob.SpaceIDs) != 0 {
+		t.Errorf("space IDs = %v and %v, want [a] and []", alice.SpaceIDs, bob.SpaceIDs)
+	}
+}
+
+func TestMemoryUpdateAndDelete(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	r := insertSlides(t, models.Slide{Name: "slide", PDFURL: "https://example.com/a.pdf", DeletedAt: &now})
+	slide, err := r.FindOne(ctx, bson.M{})
+	if err != nil {
+		t.Fatalf("FindOne: %v", err)
+	}
+
+	// UpdateSlide stores a PDF in our storage by key
+	matched, err := r.UpdateOne(ctx, ByID(slide.ID), bson.M{
+		"$set":   bson.M{"pdf_key": "slides/a/source.pdf"},
+		"$unset": bson.M{"pdf_url": ""},
+	})
+	if err != nil || matched != 1 {
+		t.Fatalf("UpdateOne = %d, %v", matched, err)
+	}
+	slide, err = r.Get(ctx, slide.ID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if slide.PDFKey != "slides/a/source.pdf" || slide.PDFURL != "" {
+		t.Errorf("pdf = %q %q, want only the key", slide.PDFKey, slide.PDFURL)
+	}
+
+	// The purge only deletes what is still expired
+	expired := bson.M{"_id": slide.ID, "deleted_at": bson.M{"$lt": now.Add(-time.Hour)}}
+	if deleted, err := r.DeleteOne(ctx, expired); err != nil || deleted != 0 {
+		t.Fatalf("DeleteOne of a recent slide = %d, %v", deleted, err)
+	}
+	expired["deleted_at"] = bson.M{"$lt": now.Add(time.Hour)}
+	if deleted, err := r.DeleteOne(ctx, expired); err != nil || deleted != 1 {
+		t.Fatalf("DeleteOne of an expired slide = %d, %v", deleted, err)
+	}
+	if _, err := r.Get(ctx, slide.ID); err != ErrNotFound {
+		t.Errorf("Get after delete = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryDuplicateID(t *testing.T) {
+	r := insertSlides(t, models.Slide{Name: "slide"})
+	slide, err := r.FindOne(context.Background(), bson.M{"name": "slide"})
+	if err != nil {
+		t.Fatalf("FindOne: %v", err)
+	}
+	if err := r.Insert(context.Background(), slide); err != ErrDuplicate {
+		t.Errorf("Insert of the same ID = %v, want ErrDuplicate", err)
+	}
+}
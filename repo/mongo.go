@@ -0,0 +1,147 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"main/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Mongo is a Repository stored in a collection of db.DB
+type Mongo[T any] struct {
+	collection string
+}
+
+// NewMongo creates a repository stored in the named collection of db.DB
+func NewMongo[T any](collection string) *Mongo[T] {
+	return &Mongo[T]{collection: collection}
+}
+
+func (r *Mongo[T]) coll() *mongo.Collection {
+	return db.DB.Collection(r.collection)
+}
+
+func (r *Mongo[T]) Get(ctx context.Context, id primitive.ObjectID) (*T, error) {
+	return r.FindOne(ctx, ByID(id))
+}
+
+func (r *Mongo[T]) FindOne(ctx context.Context, filter bson.M) (*T, error) {
+	var doc T
+	err := r.coll().FindOne(ctx, filter).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+func (r *Mongo[T]) Find(ctx context.Context, filter bson.M, sort bson.D) ([]T, error) {
+	opts := options.Find()
+	if sort != nil {
+		opts.SetSort(sort)
+	}
+	cursor, err := r.coll().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	docs := []T{}
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+func (r *Mongo[T]) IDs(ctx context.Context, filter bson.M) ([]primitive.ObjectID, error) {
+	values, err := r.coll().Distinct(ctx, "_id", filter)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, 0, len(values))
+	for _, value := range values {
+		if id, ok := value.(primitive.ObjectID); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (r *Mongo[T]) Distinct(ctx context.Context, field string, filter bson.M) ([]string, error) {
+	values, err := r.coll().Distinct(ctx, field, filter)
+	if err != nil {
+		return nil, err
+	}
+	strs := make([]string, 0, len(values))
+	for _, value := range values {
+		if str, ok := value.(string); ok {
+			strs = append(strs, str)
+		}
+	}
+	return strs, nil
+}
+
+func (r *Mongo[T]) Count(ctx context.Context, filter bson.M) (int64, error) {
+	return r.coll().CountDocuments(ctx, filter)
+}
+
+func (r *Mongo[T]) Insert(ctx context.Context, doc *T) error {
+	_, err := r.coll().InsertOne(ctx, doc)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (r *Mongo[T]) InsertMany(ctx context.Context, docs []T) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	values := make([]interface{}, len(docs))
+	for i := range docs {
+		values[i] = docs[i]
+	}
+	_, err := r.coll().InsertMany(ctx, values)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (r *Mongo[T]) UpdateOne(ctx context.Context, filter bson.M, update bson.M) (int64, error) {
+	result, err := r.coll().UpdateOne(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.MatchedCount, nil
+}
+
+func (r *Mongo[T]) UpdateMany(ctx context.Context, filter bson.M, update bson.M) (int64, error) {
+	result, err := r.coll().UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.MatchedCount, nil
+}
+
+func (r *Mongo[T]) DeleteOne(ctx context.Context, filter bson.M) (int64, error) {
+	result, err := r.coll().DeleteOne(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+func (r *Mongo[T]) DeleteMany(ctx context.Context, filter bson.M) (int64, error) {
+	result, err := r.coll().DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
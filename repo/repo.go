@@ -0,0 +1,102 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"main/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Names of the collections of the repositories
+const (
+	CollectionNameSlides        = "slides"
+	CollectionNameSlideImages   = "slide_images"
+	CollectionNameSpaces        = "spaces"
+	CollectionNameUsers         = "users"
+	CollectionNameQuizQuestions = "quiz_questions"
+	CollectionNameFlashcards    = "flashcards"
+)
+
+// ErrNotFound is returned when no document matches
+var ErrNotFound = errors.New("not found")
+
+// ErrDuplicate is returned when inserting a document whose ID or unique index
+// value is taken
+var ErrDuplicate = errors.New("duplicate key")
+
+// Repository stores documents of type T. Filters and updates use the MongoDB
+// query and update operators on the bson field names of T
+type Repository[T any] interface {
+	// Get returns the document with the given ID, or ErrNotFound
+	Get(ctx context.Context, id primitive.ObjectID) (*T, error)
+	// FindOne returns the first document matching filter, or ErrNotFound
+	FindOne(ctx context.Context, filter bson.M) (*T, error)
+	// Find returns the documents matching filter ordered by sort, which may be nil
+	Find(ctx context.Context, filter bson.M, sort bson.D) ([]T, error)
+	// IDs returns the IDs of the documents matching filter
+	IDs(ctx context.Context, filter bson.M) ([]primitive.ObjectID, error)
+	// Distinct returns the distinct values of a string field among the
+	// documents matching filter, elements of arrays are returned separately
+	Distinct(ctx context.Context, field string, filter bson.M) ([]string, error)
+	// Count returns the number of documents matching filter
+	Count(ctx context.Context, filter bson.M) (int64, error)
+	// Insert stores a new document, its ID must be set
+	Insert(ctx context.Context, doc *T) error
+	// InsertMany stores new documents, all or none of them
+	InsertMany(ctx context.Context, docs []T) error
+	// UpdateOne applies update to the first document matching filter and
+	// returns the number of documents matched
+	UpdateOne(ctx context.Context, filter bson.M, update bson.M) (int64, error)
+	// UpdateMany applies update to every document matching filter and returns
+	// the number of documents matched
+	UpdateMany(ctx context.Context, filter bson.M, update bson.M) (int64, error)
+	// DeleteOne deletes the first document matching filter and returns the
+	// number of documents deleted
+	DeleteOne(ctx context.Context, filter bson.M) (int64, error)
+	// DeleteMany deletes every document matching filter and returns the number
+	// of documents deleted
+	DeleteMany(ctx context.Context, filter bson.M) (int64, error)
+}
+
+// Repositories are the repositories of every collection used by the handlers
+type Repositories struct {
+	Slides        Repository[models.Slide]
+	SlideImages   Repository[models.SlideImage]
+	Spaces        Repository[models.Space]
+	Users         Repository[models.User]
+	QuizQuestions Repository[models.QuizQA]
+	Flashcards    Repository[models.Flashcard]
+}
+
+// New returns the repositories of the implementation selected by driver
+// ("mongo" or "memory")
+func New(driver string) (*Repositories, error) {
+	switch driver {
+	case "", "mongo":
+		return &Repositories{
+			Slides:        NewMongo[models.Slide](CollectionNameSlides),
+			SlideImages:   NewMongo[models.SlideImage](CollectionNameSlideImages),
+			Spaces:        NewMongo[models.Space](CollectionNameSpaces),
+			Users:         NewMongo[models.User](CollectionNameUsers),
+			QuizQuestions: NewMongo[models.QuizQA](CollectionNameQuizQuestions),
+			Flashcards:    NewMongo[models.Flashcard](CollectionNameFlashcards),
+		}, nil
+	case "memory":
+		return &Repositories{
+			Slides:        NewMemory[models.Slide](),
+			SlideImages:   NewMemory[models.SlideImage](),
+			Spaces:        NewMemory[models.Space](),
+			Users:         NewMemory[models.User](),
+			QuizQuestions: NewMemory[models.QuizQA](),
+			Flashcards:    NewMemory[models.Flashcard](),
+		}, nil
+	}
+	return nil, errors.New("unknown repository driver: " + driver)
+}
+
+// ByID is a filter matching the document with the given ID
+func ByID(id primitive.ObjectID) bson.M {
+	return bson.M{"_id": id}
+}
@@ -0,0 +1,69 @@
+package tts
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Sentence is the timing of a sentence in a narration
+type Sentence struct {
+	Text  string
+	Start time.Duration
+	End   time.Duration
+	Words []Word
+}
+
+// Word is the timing of a word in a narration
+type Word struct {
+	Text  string
+	Start time.Duration
+	End   time.Duration
+}
+
+// Pause after a sentence, in characters of speaking time
+const sentencePause = 4
+
+// Align estimates sentence and word timings within each chunk of a narration.
+// The providers return no timestamps, so the duration of a chunk is shared
+// between its words by length, with a short pause after each sentence
+func Align(chunks []Chunk) []Sentence {
+	var sentences []Sentence
+	for _, chunk := range chunks {
+		chunkSentences := Sentences(chunk.Text)
+
+		total := 0
+		for _, sentence := range chunkSentences {
+			total += sentenceWeight(sentence)
+		}
+		if total == 0 {
+			continue
+		}
+		per := float64(chunk.Duration) / float64(total)
+		at := func(weight int) time.Duration {
+			return chunk.Start + time.Duration(float64(weight)*per)
+		}
+
+		weight := 0
+		for _, text := range chunkSentences {
+			sentence := Sentence{Text: text, Start: at(weight)}
+			for _, word := range strings.Fields(text) {
+				start := at(weight)
+				weight += utf8.RuneCountInString(word) + 1
+				sentence.Words = append(sentence.Words, Word{Text: word, Start: start, End: at(weight - 1)})
+			}
+			sentence.End = at(weight)
+			weight += sentencePause
+			sentences = append(sentences, sentence)
+		}
+	}
+	return sentences
+}
+
+func sentenceWeight(sentence string) int {
+	weight := sentencePause
+	for _, word := range strings.Fields(sentence) {
+		weight += utf8.RuneCountInString(word) + 1
+	}
+	return weight
+}
@@ -0,0 +1,86 @@
+package tts
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Sentences splits text after sentence-ending punctuation followed by a space,
+// and at blank lines
+func Sentences(text string) []string {
+	var sentences []string
+	var current strings.Builder
+
+	flush := func() {
+		if sentence := strings.TrimSpace(current.String()); sentence != "" {
+			sentences = append(sentences, sentence)
+		}
+		current.Reset()
+	}
+
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		current.WriteRune(r)
+
+		if r == '\n' && i+1 < len(runes) && runes[i+1] == '\n' {
+			flush()
+			continue
+		}
+		if r != '.' && r != '!' && r != '?' {
+			continue
+		}
+
+		// Keep closing quotes and brackets with the sentence
+		for i+1 < len(runes) && strings.ContainsRune(`"')]”’`, runes[i+1]) {
+			i++
+			current.WriteRune(runes[i])
+		}
+		if i+1 == len(runes) || unicode.IsSpace(runes[i+1]) {
+			flush()
+		}
+	}
+	flush()
+	return sentences
+}
+
+// Split packs the sentences of text into chunks of at most maxLength bytes,
+// splitting sentences that are too long at spaces
+func Split(text string, maxLength int) []string {
+	var chunks []string
+	var current string
+
+	add := func(piece string) {
+		if current == "" {
+			current = piece
+		} else if len(current)+1+len(piece) <= maxLength {
+			current += " " + piece
+		} else {
+			chunks = append(chunks, current)
+			current = piece
+		}
+	}
+
+	for _, sentence := range Sentences(text) {
+		if len(sentence) <= maxLength {
+			add(sentence)
+			continue
+		}
+		for _, word := range strings.Fields(sentence) {
+			for len(word) > maxLength {
+				cut := maxLength
+				for cut > 0 && !utf8.RuneStart(word[cut]) {
+					cut--
+				}
+				add(word[:cut])
+				word = word[cut:]
+			}
+			add(word)
+		}
+	}
+	if current != "" {
+		chunks = append(chunks, current)
+	}
+	return chunks
+}
@@ -0,0 +1,75 @@
+package tts
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSentences(t *testing.T) {
+	text := "First sentence. Is it \"quoted?\" Yes (it is.)\n\nA heading\nwith a line break 3.5 times! End"
+	want := []string{
+		"First sentence.",
+		"Is it \"quoted?\"",
+		"Yes (it is.)",
+		"A heading\nwith a line break 3.5 times!",
+		"End",
+	}
+
+	got := Sentences(text)
+	if len(got) != len(want) {
+		t.Fatalf("Sentences = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("sentence %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestSplitPacksSentences(t *testing.T) {
+	text := "One two. Three four. Five six seven eight nine."
+	got := Split(text, 20)
+	// The last sentence is too long for a chunk and is split at spaces
+	want := []string{"One two. Three four.", "Five six seven eight", "nine."}
+	if len(got) != len(want) {
+		t.Fatalf("Split = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("chunk %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+
+	for _, chunk := range got {
+		if len(chunk) > 20 {
+			t.Errorf("chunk %q is longer than 20 bytes", chunk)
+		}
+	}
+	if joined := strings.Join(got, " "); strings.Join(strings.Fields(joined), " ") != strings.Join(strings.Fields(text), " ") {
+		t.Errorf("chunks %q lose words of %q", got, text)
+	}
+}
+
+func TestSplitLongWords(t *testing.T) {
+	// A word longer than a chunk is cut between runes
+	word := strings.Repeat("é", 10)
+	got := Split(word, 5)
+	for _, chunk := range got {
+		if len(chunk) > 5 {
+			t.Errorf("chunk %q is longer than 5 bytes", chunk)
+		}
+		if !utf8.ValidString(chunk) {
+			t.Errorf("chunk %q cuts a rune", chunk)
+		}
+	}
+	if joined := strings.Join(got, ""); joined != word {
+		t.Errorf("chunks %q join to %q, want %q", got, joined, word)
+	}
+}
+
+func TestSplitEmpty(t *testing.T) {
+	if got := Split("  \n\n ", 100); len(got) != 0 {
+		t.Errorf("Split of blank text = %q, want no chunks", got)
+	}
+}
@@ -0,0 +1,78 @@
+package tts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+const deepgramSpeakURL = "https://api.deepgram.com/v1/speak"
+
+// Deepgram synthesizes speech with the Deepgram Aura API. Voices are Aura
+// models, speed is not supported and is ignored
+type Deepgram struct {
+	apiKey string
+	client *http.Client
+}
+
+// NewDeepgram creates a Deepgram synthesizer
+func NewDeepgram(apiKey string) *Deepgram {
+	return &Deepgram{apiKey: apiKey, client: &http.Client{}}
+}
+
+// Deepgram encodings of the formats it supports
+var deepgramEncodings = map[string]string{
+	FormatMP3:  "mp3",
+	FormatOpus: "opus",
+	FormatAAC:  "aac",
+	FormatFLAC: "flac",
+	FormatWAV:  "linear16",
+}
+
+func (d *Deepgram) Synthesize(ctx context.Context, text string, opts Options) (*Audio, error) {
+	voice := opts.Voice
+	if voice == "" {
+		voice = "aura-athena-en"
+	}
+	encoding, ok := deepgramEncodings[opts.Format]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedFormat, opts.Format)
+	}
+
+	query := url.Values{"model": {voice}, "encoding": {encoding}}
+	if opts.Format == FormatWAV {
+		query.Set("container", "wav")
+	}
+
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, deepgramSpeakURL+"?"+query.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Token "+d.apiKey)
+
+	response, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(response.Body)
+		return nil, fmt.Errorf("deepgram returned %d: %s", response.StatusCode, message)
+	}
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &Audio{Data: data, Format: opts.Format}, nil
+}
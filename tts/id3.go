@@ -0,0 +1,78 @@
+package tts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+	"unicode/utf16"
+)
+
+// Chapter is a named part of an MP3 file
+type Chapter struct {
+	Title string
+	Start time.Duration
+	End   time.Duration
+}
+
+// The table of contents lists at most this many chapters, the others are left
+// out so that every chapter frame is in it
+const maxTOCEntries = 255
+
+// TagMP3 prepends an ID3v2.3 tag with a title and chapter frames (CHAP and
+// CTOC) to an MP3 file that has no tag, chapters that do not fit in the table
+// of contents are left out
+func TagMP3(audio []byte, title string, chapters []Chapter) []byte {
+	if len(chapters) > maxTOCEntries {
+		chapters = chapters[:maxTOCEntries]
+	}
+
+	var frames bytes.Buffer
+	writeID3Frame(&frames, "TIT2", id3Text(title))
+
+	toc := new(bytes.Buffer)
+	toc.WriteString("toc\x00")
+	toc.WriteByte(0x03) // top level, ordered
+	toc.WriteByte(byte(len(chapters)))
+	for i := range chapters {
+		fmt.Fprintf(toc, "chp%d\x00", i)
+	}
+	writeID3Frame(&frames, "CTOC", toc.Bytes())
+
+	for i, chapter := range chapters {
+		chap := new(bytes.Buffer)
+		fmt.Fprintf(chap, "chp%d\x00", i)
+		binary.Write(chap, binary.BigEndian, uint32(chapter.Start.Milliseconds()))
+		binary.Write(chap, binary.BigEndian, uint32(chapter.End.Milliseconds()))
+		// Byte offsets are unused
+		binary.Write(chap, binary.BigEndian, uint32(0xFFFFFFFF))
+		binary.Write(chap, binary.BigEndian, uint32(0xFFFFFFFF))
+		writeID3Frame(chap, "TIT2", id3Text(chapter.Title))
+		writeID3Frame(&frames, "CHAP", chap.Bytes())
+	}
+
+	var tag bytes.Buffer
+	tag.WriteString("ID3")
+	tag.Write([]byte{3, 0, 0}) // version 2.3.0, no flags
+	size := frames.Len()
+	tag.Write([]byte{byte(size >> 21 & 0x7F), byte(size >> 14 & 0x7F), byte(size >> 7 & 0x7F), byte(size & 0x7F)})
+	tag.Write(frames.Bytes())
+	tag.Write(audio)
+	return tag.Bytes()
+}
+
+func writeID3Frame(b *bytes.Buffer, id string, body []byte) {
+	b.WriteString(id)
+	binary.Write(b, binary.BigEndian, uint32(len(body)))
+	b.Write([]byte{0, 0}) // flags
+	b.Write(body)
+}
+
+// id3Text encodes a text frame as UTF-16 with a byte order mark
+func id3Text(text string) []byte {
+	b := []byte{1, 0xFF, 0xFE}
+	for _, unit := range utf16.Encode([]rune(text)) {
+		b = append(b, byte(unit), byte(unit>>8))
+	}
+	return b
+}
@@ -0,0 +1,28 @@
+package tts
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestTagMP3CapsChapters(t *testing.T) {
+	chapters := make([]Chapter, 300)
+	for i := range chapters {
+		chapters[i] = Chapter{Title: "Slide", Start: time.Duration(i) * time.Second, End: time.Duration(i+1) * time.Second}
+	}
+	tagged := TagMP3(silence(1), "Lecture", chapters)
+
+	toc := bytes.Index(tagged, []byte("CTOC"))
+	if toc < 0 {
+		t.Fatal("no CTOC frame")
+	}
+	// Frame header, element ID "toc\x00" and flags come before the entry count
+	entries := int(tagged[toc+10+5])
+	if frames := bytes.Count(tagged, []byte("CHAP")); frames != entries {
+		t.Errorf("%d CHAP frames for %d entries in the table of contents", frames, entries)
+	}
+	if entries != maxTOCEntries {
+		t.Errorf("%d entries, want %d", entries, maxTOCEntries)
+	}
+}
@@ -0,0 +1,109 @@
+package tts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// FormatM4A is AAC audio in an MP4 container. Lecture exports are encoded to it
+// from MP3 with ffmpeg, narration is never synthesized as M4A
+const FormatM4A = "m4a"
+
+// ErrNoEncoder is returned when encoding M4A without ffmpeg
+var ErrNoEncoder = errors.New("ffmpeg is not available to encode m4a")
+
+// SetEncoder looks up the ffmpeg binary used to encode M4A, binary defaults to
+// ffmpeg in the PATH. M4A is disabled when it is not found
+func (s *Speaker) SetEncoder(binary string) error {
+	if binary == "" {
+		binary = "ffmpeg"
+	}
+	path, err := exec.LookPath(binary)
+
+	s.encoderMu.Lock()
+	defer s.encoderMu.Unlock()
+	if err != nil {
+		s.ffmpeg = ""
+		return fmt.Errorf("%w: %v", ErrNoEncoder, err)
+	}
+	s.ffmpeg = path
+	return nil
+}
+
+// CanEncodeM4A reports whether ffmpeg was found by SetEncoder
+func (s *Speaker) CanEncodeM4A() bool {
+	s.encoderMu.RLock()
+	defer s.encoderMu.RUnlock()
+	return s.ffmpeg != ""
+}
+
+// EncodeM4A encodes MP3 audio to M4A with a title and chapters
+func (s *Speaker) EncodeM4A(ctx context.Context, mp3 []byte, title string, chapters []Chapter) ([]byte, error) {
+	s.encoderMu.RLock()
+	binary := s.ffmpeg
+	s.encoderMu.RUnlock()
+	if binary == "" {
+		return nil, ErrNoEncoder
+	}
+
+	dir, err := os.MkdirTemp("", "m4a")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "input.mp3")
+	metadata := filepath.Join(dir, "metadata.txt")
+	output := filepath.Join(dir, "output.m4a")
+	if err := os.WriteFile(input, mp3, 0o600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(metadata, []byte(ffmetadata(title, chapters)), 0o600); err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, binary,
+		"-nostdin", "-loglevel", "error",
+		"-i", input, "-i", metadata,
+		"-map", "0:a", "-map_metadata", "1", "-map_chapters", "1",
+		"-c:a", "aac", "-b:a", "128k",
+		"-movflags", "+faststart",
+		output,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return os.ReadFile(output)
+}
+
+// ffmetadata writes the title and chapters in ffmpeg's metadata format
+func ffmetadata(title string, chapters []Chapter) string {
+	var b strings.Builder
+	b.WriteString(";FFMETADATA1\n")
+	fmt.Fprintf(&b, "title=%s\n", escapeFFMetadata(title))
+	for _, chapter := range chapters {
+		b.WriteString("\n[CHAPTER]\nTIMEBASE=1/1000\n")
+		fmt.Fprintf(&b, "START=%d\nEND=%d\n", chapter.Start.Milliseconds(), chapter.End.Milliseconds())
+		fmt.Fprintf(&b, "title=%s\n", escapeFFMetadata(chapter.Title))
+	}
+	return b.String()
+}
+
+// escapeFFMetadata escapes the characters with a meaning in ffmpeg's metadata
+// format with a backslash
+func escapeFFMetadata(value string) string {
+	var b strings.Builder
+	for _, r := range value {
+		switch r {
+		case '=', ';', '#', '\\', '\n':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,54 @@
+package tts
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestFFMetadata(t *testing.T) {
+	got := ffmetadata("Week 1; intro = #1", []Chapter{
+		{Title: "Slide 1", Start: 0, End: 1500 * time.Millisecond},
+		{Title: "a\\b\nc", Start: 1500 * time.Millisecond, End: 3 * time.Second},
+	})
+	want := ";FFMETADATA1\n" +
+		`title=Week 1\; intro \= \#1` + "\n" +
+		"\n[CHAPTER]\nTIMEBASE=1/1000\nSTART=0\nEND=1500\ntitle=Slide 1\n" +
+		"\n[CHAPTER]\nTIMEBASE=1/1000\nSTART=1500\nEND=3000\n" + `title=a\\b\` + "\nc\n"
+	if got != want {
+		t.Errorf("ffmetadata =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestEncodeM4A(t *testing.T) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+	s := NewSpeaker()
+	if err := s.SetEncoder(""); err != nil {
+		t.Fatal(err)
+	}
+
+	audio, err := s.EncodeM4A(context.Background(), silence(40), "Lecture", []Chapter{{Title: "Slide 1", End: time.Second}})
+	if err != nil {
+		t.Fatalf("EncodeM4A: %v", err)
+	}
+	// MP4 files start with an ftyp box
+	if len(audio) < 8 || string(audio[4:8]) != "ftyp" {
+		t.Errorf("output is not an MP4 file")
+	}
+}
+
+func TestEncodeM4AWithoutFFmpeg(t *testing.T) {
+	s := NewSpeaker()
+	if err := s.SetEncoder("/nonexistent/ffmpeg"); err == nil {
+		t.Fatal("SetEncoder found a missing binary")
+	}
+	if s.CanEncodeM4A() {
+		t.Error("CanEncodeM4A with a missing binary")
+	}
+	if _, err := s.EncodeM4A(context.Background(), silence(1), "Lecture", nil); err != ErrNoEncoder {
+		t.Errorf("EncodeM4A = %v, want ErrNoEncoder", err)
+	}
+}
@@ -0,0 +1,148 @@
+package tts
+
+import (
+	"bytes"
+	"errors"
+	"time"
+)
+
+// ErrNoMP3Frames is returned for MP3 data without a single audio frame
+var ErrNoMP3Frames = errors.New("no MP3 frames found")
+
+// Layer III bitrates in kbit/s by bitrate index
+var (
+	mp3BitratesV1  = [16]int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0}
+	mp3BitratesV2  = [16]int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0}
+	mp3SampleRates = [3]int{44100, 48000, 32000}
+)
+
+// mp3Frame is the position and duration of a Layer III frame
+type mp3Frame struct {
+	offset   int
+	length   int
+	duration time.Duration
+}
+
+// parseMP3Header returns the frame starting at data[offset], ok is false if it
+// is not a valid Layer III frame header
+func parseMP3Header(data []byte, offset int) (mp3Frame, bool) {
+	if offset+4 > len(data) {
+		return mp3Frame{}, false
+	}
+	h := data[offset : offset+4]
+	if h[0] != 0xFF || h[1]&0xE0 != 0xE0 {
+		return mp3Frame{}, false
+	}
+
+	version := (h[1] >> 3) & 0x03 // 3 MPEG-1, 2 MPEG-2, 0 MPEG-2.5
+	layer := (h[1] >> 1) & 0x03   // 1 Layer III
+	bitrateIndex := h[2] >> 4
+	sampleRateIndex := (h[2] >> 2) & 0x03
+	padding := int((h[2] >> 1) & 0x01)
+	if version == 1 || layer != 1 || bitrateIndex == 0 || bitrateIndex == 15 || sampleRateIndex == 3 {
+		return mp3Frame{}, false
+	}
+
+	sampleRate := mp3SampleRates[sampleRateIndex]
+	bitrate := mp3BitratesV1[bitrateIndex] * 1000
+	samples, coefficient := 1152, 144
+	if version != 3 {
+		bitrate = mp3BitratesV2[bitrateIndex] * 1000
+		samples, coefficient = 576, 72
+		sampleRate /= 2
+		if version == 0 {
+			sampleRate /= 2
+		}
+	}
+
+	return mp3Frame{
+		offset:   offset,
+		length:   coefficient*bitrate/sampleRate + padding,
+		duration: time.Duration(samples) * time.Second / time.Duration(sampleRate),
+	}, true
+}
+
+// isVBRHeader reports whether a frame is a Xing, Info or VBRI header frame,
+// which describes the whole file and is wrong once files are joined
+func isVBRHeader(data []byte, frame mp3Frame) bool {
+	body := data[frame.offset : frame.offset+frame.length]
+	mono := body[3]>>6 == 3
+	sideInfo := 32
+	switch {
+	case body[1]&0x18 == 0x18 && mono:
+		sideInfo = 17
+	case body[1]&0x18 != 0x18 && mono:
+		sideInfo = 9
+	case body[1]&0x18 != 0x18:
+		sideInfo = 17
+	}
+	for _, at := range []int{4 + sideInfo, 36} {
+		if at+4 <= len(body) {
+			tag := body[at : at+4]
+			if bytes.Equal(tag, []byte("Xing")) || bytes.Equal(tag, []byte("Info")) || bytes.Equal(tag, []byte("VBRI")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mp3Frames returns the audio frames of an MP3 file, skipping ID3 tags, VBR
+// header frames and any garbage between frames
+func mp3Frames(data []byte) []mp3Frame {
+	offset := 0
+	// ID3v2 tag
+	if len(data) >= 10 && bytes.HasPrefix(data, []byte("ID3")) {
+		size := int(data[6]&0x7F)<<21 | int(data[7]&0x7F)<<14 | int(data[8]&0x7F)<<7 | int(data[9]&0x7F)
+		offset = 10 + size
+		if data[5]&0x10 != 0 {
+			offset += 10
+		}
+	}
+	// ID3v1 tag
+	end := len(data)
+	if end-offset >= 128 && bytes.Equal(data[end-128:end-125], []byte("TAG")) {
+		end -= 128
+	}
+
+	var frames []mp3Frame
+	for offset < end {
+		frame, ok := parseMP3Header(data[:end], offset)
+		if !ok || frame.offset+frame.length > end {
+			offset++
+			continue
+		}
+		if !isVBRHeader(data, frame) {
+			frames = append(frames, frame)
+		}
+		offset += frame.length
+	}
+	return frames
+}
+
+// MP3Duration returns the playing time of an MP3 file
+func MP3Duration(data []byte) time.Duration {
+	var duration time.Duration
+	for _, frame := range mp3Frames(data) {
+		duration += frame.duration
+	}
+	return duration
+}
+
+// JoinMP3 concatenates the audio frames of MP3 files into one file and returns
+// the duration of each part
+func JoinMP3(parts ...[]byte) ([]byte, []time.Duration, error) {
+	var joined bytes.Buffer
+	durations := make([]time.Duration, len(parts))
+	for i, part := range parts {
+		frames := mp3Frames(part)
+		if len(frames) == 0 {
+			return nil, nil, ErrNoMP3Frames
+		}
+		for _, frame := range frames {
+			joined.Write(part[frame.offset : frame.offset+frame.length])
+			durations[i] += frame.duration
+		}
+	}
+	return joined.Bytes(), durations, nil
+}
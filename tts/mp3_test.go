@@ -0,0 +1,88 @@
+package tts
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// silence returns n silent frames
+func silence(n int) []byte {
+	return bytes.Repeat(silentMP3Frame, n)
+}
+
+// xingFrame is a silent frame carrying a Xing header, as encoders write first
+func xingFrame() []byte {
+	frame := append([]byte{}, silentMP3Frame...)
+	// After the side information of a mono MPEG-1 frame
+	copy(frame[4+17:], "Xing")
+	return frame
+}
+
+func TestJoinMP3(t *testing.T) {
+	joined, durations, err := JoinMP3(silence(3), silence(2))
+	if err != nil {
+		t.Fatalf("JoinMP3: %v", err)
+	}
+	if !bytes.Equal(joined, silence(5)) {
+		t.Errorf("joined %d bytes, want the %d bytes of 5 frames", len(joined), len(silence(5)))
+	}
+	if durations[0] != 3*silentMP3Duration || durations[1] != 2*silentMP3Duration {
+		t.Errorf("durations = %v, want 3 and 2 frames", durations)
+	}
+	if got := MP3Duration(joined); got != 5*silentMP3Duration {
+		t.Errorf("MP3Duration = %s, want %s", got, 5*silentMP3Duration)
+	}
+}
+
+func TestJoinMP3DropsTagsAndHeaders(t *testing.T) {
+	tagged := TagMP3(silence(2), "Lecture", []Chapter{{Title: "Intro", End: time.Second}})
+	withXing := append(xingFrame(), silence(1)...)
+	withID3v1 := append(silence(1), append([]byte("TAG"), make([]byte, 125)...)...)
+	withGarbage := append(append(silence(1), "garbage"...), silence(1)...)
+
+	joined, durations, err := JoinMP3(tagged, withXing, withID3v1, withGarbage)
+	if err != nil {
+		t.Fatalf("JoinMP3: %v", err)
+	}
+	if !bytes.Equal(joined, silence(6)) {
+		t.Errorf("joined %d bytes, want only the %d bytes of the 6 audio frames", len(joined), len(silence(6)))
+	}
+	want := []time.Duration{2 * silentMP3Duration, silentMP3Duration, silentMP3Duration, 2 * silentMP3Duration}
+	for i := range want {
+		if durations[i] != want[i] {
+			t.Errorf("duration of part %d = %s, want %s", i, durations[i], want[i])
+		}
+	}
+}
+
+func TestJoinMP3WithoutFrames(t *testing.T) {
+	for _, part := range [][]byte{nil, []byte("not audio"), xingFrame()} {
+		if _, _, err := JoinMP3(silence(1), part); !errors.Is(err, ErrNoMP3Frames) {
+			t.Errorf("JoinMP3 of %d bytes = %v, want ErrNoMP3Frames", len(part), err)
+		}
+	}
+}
+
+func TestParseMP3Header(t *testing.T) {
+	frame, ok := parseMP3Header(silentMP3Frame, 0)
+	if !ok {
+		t.Fatal("the silent frame is not a valid header")
+	}
+	if frame.length != len(silentMP3Frame) {
+		t.Errorf("length = %d, want %d", frame.length, len(silentMP3Frame))
+	}
+
+	// Layer II, free bitrate and a reserved sample rate are not supported
+	for _, header := range [][]byte{
+		{0xFF, 0xFD, 0x90, 0xC4},
+		{0xFF, 0xFB, 0x00, 0xC4},
+		{0xFF, 0xFB, 0x9C, 0xC4},
+		{0xFF, 0xFB, 0x90},
+	} {
+		if _, ok := parseMP3Header(header, 0); ok {
+			t.Errorf("parseMP3Header(% X) accepted an invalid header", header)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package tts
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Input limits of the providers in bytes, chunks are kept below them
+const (
+	openAIMaxInput   = 4096
+	deepgramMaxInput = 2000
+	defaultMaxInput  = 1000
+)
+
+// maxParallelChunks bounds the chunks of one narration synthesized at once
+const maxParallelChunks = 4
+
+// inputLimiter is implemented by synthesizers that cap the length of the text
+type inputLimiter interface {
+	MaxInput() int
+}
+
+func (o *OpenAI) MaxInput() int   { return openAIMaxInput }
+func (d *Deepgram) MaxInput() int { return deepgramMaxInput }
+
+// Chunk is a part of a narration synthesized on its own
+type Chunk struct {
+	Text     string
+	Start    time.Duration
+	Duration time.Duration
+}
+
+// Narration is the speech of a text that may be longer than the provider accepts
+type Narration struct {
+	*Audio
+	Duration  time.Duration
+	Chunks    []Chunk
+	Sentences []Sentence
+}
+
+// Narrate splits text on sentence boundaries into chunks the provider accepts,
+// synthesizes them in parallel and joins them. Text that needs more than one
+// chunk can only be narrated as MP3
+func (s *Speaker) Narrate(ctx context.Context, text string, opts Options) (*Narration, error) {
+	opts = s.Defaults().With(opts)
+	if err := s.Validate(opts); err != nil {
+		return nil, err
+	}
+
+	synthesizer, ok := s.synthesizer(opts.Provider)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownProvider, opts.Provider)
+	}
+
+	maxInput := defaultMaxInput
+	if limiter, ok := synthesizer.(inputLimiter); ok {
+		maxInput = limiter.MaxInput()
+	}
+	texts := Split(text, maxInput)
+	if len(texts) == 0 {
+		return nil, fmt.Errorf("nothing to narrate")
+	}
+	if len(texts) > 1 && opts.Format != FormatMP3 {
+		return nil, fmt.Errorf("%w: narration in %d parts must be %s, not %s", ErrUnsupportedFormat, len(texts), FormatMP3, opts.Format)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	parts := make([][]byte, len(texts))
+	errs := make([]error, len(texts))
+	sem := make(chan struct{}, maxParallelChunks)
+	var wg sync.WaitGroup
+	for i, chunk := range texts {
+		wg.Add(1)
+		go func(i int, chunk string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			audio, err := synthesizer.Synthesize(ctx, chunk, opts)
+			if err != nil {
+				errs[i] = fmt.Errorf("part %d of %d: %w", i+1, len(texts), err)
+				cancel()
+				return
+			}
+			parts[i] = audio.Data
+		}(i, chunk)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	narration := &Narration{Audio: &Audio{Data: parts[0], Format: opts.Format}}
+	durations := make([]time.Duration, len(parts))
+	if opts.Format == FormatMP3 {
+		data, d, err := JoinMP3(parts...)
+		if err != nil {
+			return nil, err
+		}
+		narration.Data = data
+		durations = d
+	}
+
+	for i, chunk := range texts {
+		narration.Chunks = append(narration.Chunks, Chunk{Text: chunk, Start: narration.Duration, Duration: durations[i]})
+		narration.Duration += durations[i]
+	}
+	narration.Sentences = Align(narration.Chunks)
+	return narration, nil
+}
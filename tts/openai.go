@@ -0,0 +1,47 @@
+package tts
+
+import (
+	"context"
+	"io"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// OpenAI synthesizes speech with the OpenAI speech API
+type OpenAI struct {
+	client *openai.Client
+	model  string
+}
+
+// NewOpenAI creates an OpenAI synthesizer, model defaults to tts-1
+func NewOpenAI(apiKey string, model string) *OpenAI {
+	if model == "" {
+		model = string(openai.TTSModel1)
+	}
+	return &OpenAI{client: openai.NewClient(apiKey), model: model}
+}
+
+func (o *OpenAI) Synthesize(ctx context.Context, text string, opts Options) (*Audio, error) {
+	voice := opts.Voice
+	if voice == "" {
+		voice = string(openai.VoiceAlloy)
+	}
+
+	response, err := o.client.CreateSpeech(ctx, openai.CreateSpeechRequest{
+		Model:          openai.SpeechModel(o.model),
+		Input:          text,
+		Voice:          openai.SpeechVoice(voice),
+		ResponseFormat: openai.SpeechResponseFormat(opts.Format),
+		Speed:          opts.Speed,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer response.Close()
+
+	data, err := io.ReadAll(response)
+	if err != nil {
+		return nil, err
+	}
+	return &Audio{Data: data, Format: opts.Format}, nil
+}
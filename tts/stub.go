@@ -0,0 +1,75 @@
+package tts
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Stub is a deterministic Synthesizer for offline use. It returns silence
+// lasting as long as the text would take to read at about 150 words a minute
+type Stub struct{}
+
+// NewStub creates a Stub
+func NewStub() *Stub {
+	return &Stub{}
+}
+
+// A silent MPEG-1 Layer III frame, 128 kbit/s 44.1 kHz mono, lasts 1152 samples
+var (
+	silentMP3Frame    = append([]byte{0xFF, 0xFB, 0x90, 0xC4}, make([]byte, 413)...)
+	silentMP3Duration = time.Second * 1152 / 44100
+)
+
+const stubWAVSampleRate = 16000
+
+func (s *Stub) Synthesize(ctx context.Context, text string, opts Options) (*Audio, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	speed := opts.Speed
+	if speed == 0 {
+		speed = 1
+	}
+	words := len(strings.Fields(text))
+	duration := time.Duration(float64(words) / 2.5 / speed * float64(time.Second))
+
+	switch opts.Format {
+	case FormatMP3:
+		frames := int(duration/silentMP3Duration) + 1
+		return &Audio{Data: bytes.Repeat(silentMP3Frame, frames), Format: FormatMP3}, nil
+	case FormatWAV:
+		return &Audio{Data: silentWAV(duration), Format: FormatWAV}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedFormat, opts.Format)
+}
+
+// silentWAV returns 16-bit mono PCM silence in a WAV container
+func silentWAV(duration time.Duration) []byte {
+	samples := int(duration.Seconds() * stubWAVSampleRate)
+	dataSize := uint32(samples * 2)
+
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, 36+dataSize)
+	b.WriteString("WAVEfmt ")
+	for _, v := range []interface{}{
+		uint32(16),                    // fmt chunk size
+		uint16(1),                     // PCM
+		uint16(1),                     // channels
+		uint32(stubWAVSampleRate),     // sample rate
+		uint32(stubWAVSampleRate * 2), // byte rate
+		uint16(2),                     // block align
+		uint16(16),                    // bits per sample
+	} {
+		binary.Write(&b, binary.LittleEndian, v)
+	}
+	b.WriteString("data")
+	binary.Write(&b, binary.LittleEndian, dataSize)
+	b.Write(make([]byte, dataSize))
+	return b.Bytes()
+}
@@ -0,0 +1,204 @@
+package tts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Audio formats
+const (
+	FormatMP3  = "mp3"
+	FormatOpus = "opus"
+	FormatAAC  = "aac"
+	FormatFLAC = "flac"
+	FormatWAV  = "wav"
+)
+
+var (
+	ErrUnknownProvider   = errors.New("unknown text-to-speech provider")
+	ErrUnsupportedFormat = errors.New("unsupported audio format")
+	ErrInvalidSpeed      = errors.New("speed must be between 0.25 and 4")
+)
+
+// Options selects how text is spoken, empty fields fall back to the defaults
+type Options struct {
+	Provider string
+	Voice    string
+	Speed    float64
+	Format   string
+}
+
+// With returns o with the fields set in override replaced
+func (o Options) With(override Options) Options {
+	if override.Provider != "" {
+		// A voice only makes sense for the provider it was chosen for
+		if override.Provider != o.Provider {
+			o.Voice = ""
+		}
+		o.Provider = override.Provider
+	}
+	if override.Voice != "" {
+		o.Voice = override.Voice
+	}
+	if override.Speed != 0 {
+		o.Speed = override.Speed
+	}
+	if override.Format != "" {
+		o.Format = override.Format
+	}
+	return o
+}
+
+// Audio is synthesized speech
+type Audio struct {
+	Data   []byte
+	Format string
+}
+
+// ContentType returns the MIME type of the audio
+func (a *Audio) ContentType() string {
+	return ContentType(a.Format)
+}
+
+// Synthesizer turns text into speech
+type Synthesizer interface {
+	Synthesize(ctx context.Context, text string, opts Options) (*Audio, error)
+}
+
+// Speaker speaks text with the registered synthesizers
+type Speaker struct {
+	mu           sync.RWMutex
+	synthesizers map[string]Synthesizer
+	defaults     Options
+
+	// ffmpeg is the binary used to encode M4A, see SetEncoder
+	encoderMu sync.RWMutex
+	ffmpeg    string
+}
+
+// NewSpeaker creates a Speaker without synthesizers
+func NewSpeaker() *Speaker {
+	return &Speaker{
+		synthesizers: map[string]Synthesizer{},
+		defaults:     Options{Speed: 1, Format: FormatMP3},
+	}
+}
+
+// Register makes a synthesizer available under a provider name
+func (s *Speaker) Register(provider string, synthesizer Synthesizer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.synthesizers[provider] = synthesizer
+}
+
+// SetDefaults sets the options used when neither the request, the slide nor
+// the user chose one
+func (s *Speaker) SetDefaults(opts Options) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.defaults = Options{Speed: 1, Format: FormatMP3}.With(opts)
+}
+
+// Defaults returns the default options
+func (s *Speaker) Defaults() Options {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.defaults
+}
+
+// synthesizer returns the synthesizer of a provider
+func (s *Speaker) synthesizer(provider string) (Synthesizer, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	synthesizer, ok := s.synthesizers[provider]
+	return synthesizer, ok
+}
+
+// Synthesize speaks text with the provider of opts, on top of the defaults
+func (s *Speaker) Synthesize(ctx context.Context, text string, opts Options) (*Audio, error) {
+	opts = s.Defaults().With(opts)
+	if err := s.Validate(opts); err != nil {
+		return nil, err
+	}
+
+	synthesizer, ok := s.synthesizer(opts.Provider)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownProvider, opts.Provider)
+	}
+	return synthesizer.Synthesize(ctx, text, opts)
+}
+
+// Validate checks the options that are set
+func (s *Speaker) Validate(opts Options) error {
+	if opts.Provider != "" {
+		if _, ok := s.synthesizer(opts.Provider); !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownProvider, opts.Provider)
+		}
+	}
+	if opts.Speed != 0 && (opts.Speed < 0.25 || opts.Speed > 4) {
+		return ErrInvalidSpeed
+	}
+	if opts.Format != "" && (ContentType(opts.Format) == "" || opts.Format == FormatM4A) {
+		return fmt.Errorf("%w: %s", ErrUnsupportedFormat, opts.Format)
+	}
+	return nil
+}
+
+// ContentType returns the MIME type of a format, or "" if it is unknown
+func ContentType(format string) string {
+	switch format {
+	case FormatMP3:
+		return "audio/mpeg"
+	case FormatOpus:
+		return "audio/ogg"
+	case FormatAAC:
+		return "audio/aac"
+	case FormatFLAC:
+		return "audio/flac"
+	case FormatWAV:
+		return "audio/wav"
+	case FormatM4A:
+		return "audio/mp4"
+	}
+	return ""
+}
+
+// Providers
+const (
+	ProviderOpenAI   = "openai"
+	ProviderDeepgram = "deepgram"
+	ProviderStub     = "stub"
+)
+
+// Config configures the providers
+type Config struct {
+	OpenAIAPIKey   string
+	OpenAIModel    string
+	DeepgramAPIKey string
+	// Defaults are used when neither the request, the slide nor the user chose
+	// an option
+	Defaults Options
+}
+
+// New creates a Speaker with the providers that have an API key and the defaults
+func New(cfg Config) (*Speaker, error) {
+	s := NewSpeaker()
+	if cfg.OpenAIAPIKey != "" {
+		s.Register(ProviderOpenAI, NewOpenAI(cfg.OpenAIAPIKey, cfg.OpenAIModel))
+	}
+	if cfg.DeepgramAPIKey != "" {
+		s.Register(ProviderDeepgram, NewDeepgram(cfg.DeepgramAPIKey))
+	}
+	s.Register(ProviderStub, NewStub())
+
+	if cfg.Defaults.Provider == "" {
+		cfg.Defaults.Provider = ProviderOpenAI
+	}
+	if err := s.Validate(cfg.Defaults); err != nil {
+		return nil, err
+	}
+	s.SetDefaults(cfg.Defaults)
+	return s, nil
+}